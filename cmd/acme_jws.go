@@ -0,0 +1,188 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+// jsonWebKey is the public key in JWK form defined in RFC 7517
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// ECDSA
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwsHeader is the protected header of JWS signed by ACME clients
+type jwsHeader struct {
+	Alg   string          `json:"alg"`
+	JWK   json.RawMessage `json:"jwk,omitempty"`
+	KID   string          `json:"kid,omitempty"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+}
+
+// jwsMessage is JWS in flattened JSON serialization defined in RFC 7515
+type jwsMessage struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// parseJWS decodes the protected header and payload of JWS without verifying it
+func parseJWS(data []byte) (*jwsMessage, *jwsHeader, []byte, error) {
+	msg := &jwsMessage{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, nil, nil, err
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(msg.Protected)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid protected header: %v", err)
+	}
+	header := &jwsHeader{}
+	if err = json.Unmarshal(headerBytes, header); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid protected header: %v", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(msg.Payload)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid payload: %v", err)
+	}
+	return msg, header, payload, nil
+}
+
+// verify checks the signature of JWS using pub
+func (msg *jwsMessage) verify(alg string, pub crypto.PublicKey) error {
+	sig, err := base64.RawURLEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	signed := []byte(msg.Protected + "." + msg.Payload)
+
+	var h hash.Hash
+	var hashFunc crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h, hashFunc = sha256.New(), crypto.SHA256
+	case "ES384":
+		h, hashFunc = sha512.New384(), crypto.SHA384
+	case "ES512":
+		h, hashFunc = sha512.New(), crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("algorithm %s does not match RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(pub, hashFunc, digest, sig)
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if alg != ecdsaAlgorithm(pub.Curve) || len(sig) != 2*size {
+			return fmt.Errorf("algorithm %s does not match ECDSA key", alg)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key type")
+}
+
+func ecdsaAlgorithm(curve elliptic.Curve) string {
+	switch curve {
+	case elliptic.P256():
+		return "ES256"
+	case elliptic.P384():
+		return "ES384"
+	case elliptic.P521():
+		return "ES512"
+	}
+	return ""
+}
+
+// parseJWK parses public key in JWK form, and returns its thumbprint
+// defined in RFC 7638 as well
+func parseJWK(data []byte) (crypto.PublicKey, string, error) {
+	jwk := &jsonWebKey{}
+	if err := json.Unmarshal(data, jwk); err != nil {
+		return nil, "", err
+	}
+
+	var pub crypto.PublicKey
+	var canonical string
+	switch jwk.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return nil, "", errors.New("invalid RSA key")
+		}
+		pub = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, "", fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err1 != nil || err2 != nil {
+			return nil, "", errors.New("invalid ECDSA key")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, "", errors.New("invalid ECDSA key")
+		}
+		pub = key
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Crv, jwk.X, jwk.Y)
+	default:
+		return nil, "", fmt.Errorf("unsupported key type %s", jwk.Kty)
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+	return pub, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,492 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/gopkg.in/yaml.v2"
+	"github.com/coreos/etcd-ca/depot"
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+// clusterManifest describes CA and members of a cluster
+type clusterManifest struct {
+	CA manifestCA `yaml:"ca"`
+	// RenewBefore renews certificates expiring within it, e.g. 30d
+	RenewBefore string `yaml:"renew_before"`
+	// Profiles are user-defined profiles used by members in addition to built-in ones
+	Profiles map[string]*pkix.Profile `yaml:"profiles"`
+	Members  []manifestMember         `yaml:"members"`
+}
+
+// manifestKey describes the keypair to generate
+type manifestKey struct {
+	KeyType string `yaml:"key_type"`
+	KeyBits int    `yaml:"key_bits"`
+	Curve   string `yaml:"curve"`
+}
+
+type manifestCA struct {
+	manifestKey    `yaml:",inline"`
+	Organization   string `yaml:"organization"`
+	Country        string `yaml:"country"`
+	Years          int    `yaml:"years"`
+	SerialStrategy string `yaml:"serial_strategy"`
+}
+
+type manifestMember struct {
+	manifestKey `yaml:",inline"`
+	Name        string   `yaml:"name"`
+	IPs         []string `yaml:"ips"`
+	Domains     []string `yaml:"domains"`
+	// Profile is the name of built-in or user-defined profile
+	Profile string `yaml:"profile"`
+	// Validity is how long until the certificate expires, e.g. 365d
+	Validity string `yaml:"validity"`
+	// CA is the name of intermediate CA to sign with instead of CA
+	CA           string `yaml:"ca"`
+	Organization string `yaml:"organization"`
+	Country      string `yaml:"country"`
+}
+
+func NewApplyCommand() cli.Command {
+	return cli.Command{
+		Name:        "apply",
+		Usage:       "Create or renew certificates of cluster described in manifest",
+		Description: "Create CA, keys, certificate requests and certificates of members listed in manifest if they are missing, and renew certificates near expiry. Differences between manifest and depot are reported but not changed. It is safe to run repeatedly.",
+		Flags: []cli.Flag{
+			cli.StringFlag{"file, f", "", "YAML or JSON manifest of cluster", ""},
+			cli.StringFlag{"passphrase", "", "Passphrase to encrypt or decrypt private-key PEM block of CA and intermediate CAs", ""},
+			cli.StringFlag{"key-passphrase", "", "Passphrase to encrypt private-key PEM block of new member keys", ""},
+			cli.StringFlag{"key-encryption", string(pkix.DefaultKeyEncryption), "Scheme to encrypt private-key PEM block of new keys (3des, pbkdf2-aes256-cbc, pbkdf2-aes256-gcm, scrypt-aes256-cbc or scrypt-aes256-gcm)", ""},
+		},
+		Action: newApplyAction,
+	}
+}
+
+// applier brings depot in line with manifest
+type applier struct {
+	c           *cli.Context
+	m           *clusterManifest
+	enc         pkix.KeyEncryption
+	renewBefore time.Duration
+	// keyPassphrase is asked at the first time a member key is created
+	keyPassphrase []byte
+	authorities   authorityCache
+	drifts        int
+}
+
+func newApplyAction(c *cli.Context) {
+	if c.String("file") == "" {
+		fmt.Fprintln(os.Stderr, "Manifest file must be provided by --file.")
+		os.Exit(1)
+	}
+	data, err := ioutil.ReadFile(c.String("file"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Read manifest error:", err)
+		os.Exit(1)
+	}
+	m, err := parseClusterManifest(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Parse manifest error:", err)
+		os.Exit(1)
+	}
+	enc, err := pkix.ParseKeyEncryption(c.String("key-encryption"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	renewBefore, _ := parseDuration(m.RenewBefore)
+
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer unlock()
+
+	a := &applier{
+		c:           c,
+		m:           m,
+		enc:         enc,
+		renewBefore: renewBefore,
+		authorities: make(authorityCache),
+	}
+	if c.IsSet("key-passphrase") {
+		a.keyPassphrase = []byte(c.String("key-passphrase"))
+	}
+
+	if err = a.applyAuthority(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	failed := false
+	members := make(map[string]bool)
+	for _, member := range m.Members {
+		members[member.Name] = true
+		if err = a.applyMember(&member); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", member.Name, err)
+			failed = true
+		}
+	}
+	tags, err := depot.ListTags(d, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "List depot error:", err)
+		failed = true
+	}
+	for _, tag := range tags {
+		if name := depot.GetNameFromHostCrtTag(tag); name != "" && !members[name] {
+			a.drift("%s/crt is not in manifest", name)
+		}
+	}
+
+	if a.drifts > 0 {
+		fmt.Printf("Found %d difference(s) between manifest and depot\n", a.drifts)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// parseClusterManifest parses manifest and fills in default values
+func parseClusterManifest(data []byte) (*clusterManifest, error) {
+	m := &clusterManifest{}
+	if err := yaml.UnmarshalStrict(data, m); err != nil {
+		return nil, err
+	}
+
+	m.CA.manifestKey.setDefaults()
+	if m.CA.Organization == "" {
+		m.CA.Organization = "etcd-ca"
+	}
+	if m.CA.Country == "" {
+		m.CA.Country = "USA"
+	}
+	if m.CA.Years == 0 {
+		m.CA.Years = 10
+	}
+	if m.CA.SerialStrategy == "" {
+		m.CA.SerialStrategy = string(pkix.SerialSequential)
+	}
+	if _, err := pkix.ParseSerialStrategy(m.CA.SerialStrategy); err != nil {
+		return nil, err
+	}
+	if m.RenewBefore == "" {
+		m.RenewBefore = "30d"
+	}
+	if _, err := parseDuration(m.RenewBefore); err != nil {
+		return nil, fmt.Errorf("renew_before: %v", err)
+	}
+	for name, p := range m.Profiles {
+		if p == nil {
+			return nil, fmt.Errorf("profile %s is empty", name)
+		}
+		p.Name = name
+		if err := p.Validate(); err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i := range m.Members {
+		member := &m.Members[i]
+		if member.Name == "" {
+			return nil, errors.New("member name must be provided")
+		}
+		if names[member.Name] {
+			return nil, fmt.Errorf("member %s is listed more than once", member.Name)
+		}
+		names[member.Name] = true
+
+		member.manifestKey.setDefaults()
+		// The same as new-cert, which always puts an IP address into certificate request
+		if len(member.IPs) == 0 {
+			member.IPs = []string{"127.0.0.1"}
+		}
+		for _, ip := range member.IPs {
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("member %s: invalid IP address %s", member.Name, ip)
+			}
+		}
+		if member.Organization == "" {
+			member.Organization = m.CA.Organization
+		}
+		if member.Country == "" {
+			member.Country = m.CA.Country
+		}
+		if member.Validity != "" {
+			if _, err := parseDuration(member.Validity); err != nil {
+				return nil, fmt.Errorf("member %s: validity: %v", member.Name, err)
+			}
+		}
+		if member.Profile != "" {
+			if _, err := pkix.GetProfile(member.Profile, m.Profiles); err != nil {
+				return nil, fmt.Errorf("member %s: %v", member.Name, err)
+			}
+		}
+	}
+	return m, nil
+}
+
+// setDefaults fills in the same defaults as key flags
+func (k *manifestKey) setDefaults() {
+	if k.KeyType == "" {
+		k.KeyType = "rsa"
+	}
+	if k.KeyBits == 0 {
+		k.KeyBits = 4096
+	}
+	if k.Curve == "" {
+		k.Curve = "P256"
+	}
+}
+
+func (a *applier) drift(format string, args ...interface{}) {
+	a.drifts++
+	fmt.Printf("Drift: "+format+"\n", args...)
+}
+
+// applyAuthority creates CA if it does not exist, or reports its drift
+func (a *applier) applyAuthority() error {
+	ca := a.m.CA
+	if !depot.CheckCertificateAuthority(d) {
+		return a.createAuthority()
+	}
+
+	crt, err := depot.GetCertificateAuthority(d)
+	if err != nil {
+		return fmt.Errorf("Get CA certificate error: %w", err)
+	}
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return fmt.Errorf("Parse CA certificate error: %w", err)
+	}
+	if org := strings.Join(rawCrt.Subject.Organization, ","); org != ca.Organization {
+		a.drift("ca/crt has organization %q, manifest has %q", org, ca.Organization)
+	}
+	if country := strings.Join(rawCrt.Subject.Country, ","); country != ca.Country {
+		a.drift("ca/crt has country %q, manifest has %q", country, ca.Country)
+	}
+	return nil
+}
+
+// createAuthority creates CA in the same way as init
+func (a *applier) createAuthority() error {
+	if depot.CheckCertificateAuthorityInfo(d) || depot.CheckPrivateKeyAuthority(d) {
+		return errors.New("CA certificate is missing, but its info or key exists")
+	}
+	ca := a.m.CA
+
+	passphrase := []byte(a.c.String("passphrase"))
+	if !a.c.IsSet("passphrase") {
+		var err error
+		if passphrase, err = createPassPhrase(); err != nil {
+			return err
+		}
+	}
+	key, err := createKeyOfType(ca.KeyType, ca.KeyBits, ca.Curve)
+	if err != nil {
+		return fmt.Errorf("Create key error: %w", err)
+	}
+	fmt.Println("Created ca/key")
+	crt, info, err := pkix.CreateCertificateAuthority(key, ca.Years, ca.Organization, ca.Country)
+	if err != nil {
+		return fmt.Errorf("Create certificate error: %w", err)
+	}
+	fmt.Println("Created ca/crt")
+	info.SerialStrategy, _ = pkix.ParseSerialStrategy(ca.SerialStrategy)
+
+	if err = depot.PutCertificateAuthority(d, crt); err != nil {
+		return fmt.Errorf("Save certificate error: %w", err)
+	}
+	if err = depot.PutCertificateAuthorityInfo(d, info); err != nil {
+		return fmt.Errorf("Save certificate info error: %w", err)
+	}
+	if err = depot.PutEncryptedPrivateKeyAuthorityWithEncryption(d, key, passphrase, a.enc); err != nil {
+		return fmt.Errorf("Save key error: %w", err)
+	}
+	a.authorities[""] = &authority{crt, key}
+	return nil
+}
+
+// applyMember creates key, certificate request and certificate of member if
+// they are missing, renews certificate near expiry and reports drift.
+// Revoked certificates are reported as drift and left alone, like watch does.
+func (a *applier) applyMember(member *manifestMember) error {
+	name := member.Name
+	hasCsr := depot.CheckCertificateSigningRequest(d, name)
+	if !hasCsr && depot.CheckPrivateKeyHost(d, name) {
+		return errors.New("certificate request is missing, but key exists")
+	}
+	if !hasCsr {
+		if err := a.createCertificateSigningRequest(member); err != nil {
+			return err
+		}
+	}
+	csr, err := depot.GetCertificateSigningRequest(d, name)
+	if err != nil {
+		return fmt.Errorf("Get certificate request error: %w", err)
+	}
+	if hasCsr {
+		if err = a.checkCertificateSigningRequest(member, csr); err != nil {
+			return err
+		}
+	}
+
+	if !depot.CheckCertificateHost(d, name) {
+		return a.createCertificateHost(member, csr)
+	}
+
+	crt, err := depot.GetCertificateHost(d, name)
+	if err != nil {
+		return fmt.Errorf("Get certificate error: %w", err)
+	}
+	caName, err := getIssuerName(crt)
+	if err != nil {
+		return err
+	}
+	if caName != member.CA {
+		a.drift("%s/crt is signed by %s/key, manifest has %s/key", name, authorityName(caName), authorityName(member.CA))
+	}
+	if profile := getIndexProfile(caName, crt); profile != member.Profile {
+		a.drift("%s/crt has profile %q, manifest has %q", name, profile, member.Profile)
+	}
+
+	// Revoked certificate is not re-issued with the same key, which may be compromised
+	if getRevokedCertificate(crt) != nil {
+		a.drift("%s/crt is revoked", name)
+		return nil
+	}
+	if crt.GetExpirationDuration() > a.renewBefore {
+		return nil
+	}
+	auth, err := a.authorities.get(a.c, caName)
+	if err != nil {
+		return err
+	}
+	info, err := getAuthorityInfo(caName)
+	if err != nil {
+		return fmt.Errorf("Get CA certificate info error: %w", err)
+	}
+	validity, _ := parseDuration(member.Validity)
+	crtHost, err := renewCertificateHost(auth.crt, info, auth.key, crt, csr, validity, nil)
+	if err != nil {
+		return err
+	}
+	is := &hostIssuance{name: name, caName: caName, profile: getIndexProfile(caName, crt), info: info, crt: crtHost, crtOld: crt}
+	if err = is.save(); err != nil {
+		return err
+	}
+	fmt.Printf("Renewed %s/crt signed by %s/key\n", name, authorityName(caName))
+	return nil
+}
+
+// createCertificateSigningRequest creates key and certificate request of member
+// in the same way as new-cert
+func (a *applier) createCertificateSigningRequest(member *manifestMember) error {
+	if a.keyPassphrase == nil {
+		passphrase, err := createPassPhrase()
+		if err != nil {
+			return err
+		}
+		a.keyPassphrase = passphrase
+	}
+	key, err := createKeyOfType(member.KeyType, member.KeyBits, member.Curve)
+	if err != nil {
+		return fmt.Errorf("Create key error: %w", err)
+	}
+	csr, err := pkix.CreateCertificateSigningRequest(key, member.Name, strings.Join(member.IPs, ","), strings.Join(member.Domains, ","), member.Organization, member.Country)
+	if err != nil {
+		return fmt.Errorf("Create certificate request error: %w", err)
+	}
+
+	// Both are saved in one transaction if depot supports. Otherwise key
+	// goes first, as certificate request is useless without it.
+	txn := depot.Begin(d)
+	if err = depot.PutEncryptedPrivateKeyHostWithEncryption(txn, member.Name, key, a.keyPassphrase, a.enc); err != nil {
+		return fmt.Errorf("Save key error: %w", err)
+	}
+	if err = depot.PutCertificateSigningRequest(txn, member.Name, csr); err != nil {
+		return fmt.Errorf("Save certificate request error: %w", err)
+	}
+	if err = txn.Commit(); err != nil {
+		return fmt.Errorf("Save depot error: %w", err)
+	}
+	fmt.Printf("Created %s/key\n", member.Name)
+	fmt.Printf("Created %s/csr\n", member.Name)
+	return nil
+}
+
+// checkCertificateSigningRequest reports SANs of csr that differ from manifest
+func (a *applier) checkCertificateSigningRequest(member *manifestMember, csr *pkix.CertificateSigningRequest) error {
+	rawCsr, err := csr.GetRawCertificateSigningRequest()
+	if err != nil {
+		return fmt.Errorf("Parse certificate request error: %w", err)
+	}
+	ips := make([]string, 0, len(rawCsr.IPAddresses))
+	for _, ip := range rawCsr.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	wantIPs := make([]string, 0, len(member.IPs))
+	for _, ip := range member.IPs {
+		wantIPs = append(wantIPs, net.ParseIP(ip).String())
+	}
+	if !equalStringSets(ips, wantIPs) {
+		a.drift("%s/csr has IPs %v, manifest has %v", member.Name, ips, wantIPs)
+	}
+	if !equalStringSets(rawCsr.DNSNames, member.Domains) {
+		a.drift("%s/csr has domains %v, manifest has %v", member.Name, rawCsr.DNSNames, member.Domains)
+	}
+	return nil
+}
+
+// createCertificateHost signs certificate request of member in the same way as sign
+func (a *applier) createCertificateHost(member *manifestMember, csr *pkix.CertificateSigningRequest) error {
+	auth, err := a.authorities.get(a.c, member.CA)
+	if err != nil {
+		return err
+	}
+	info, err := getAuthorityInfo(member.CA)
+	if err != nil {
+		return fmt.Errorf("Get CA certificate info error: %w", err)
+	}
+
+	opts := &pkix.CertificateHostOptions{}
+	if member.Profile != "" {
+		if opts.Profile, err = pkix.GetProfile(member.Profile, a.m.Profiles); err != nil {
+			return err
+		}
+	}
+	opts.Validity, _ = parseDuration(member.Validity)
+	crtHost, err := pkix.CreateCertificateHostWithOptions(auth.crt, info, auth.key, csr, 10, opts)
+	if err != nil {
+		return fmt.Errorf("Create certificate error: %w", err)
+	}
+
+	is := &hostIssuance{name: member.Name, caName: member.CA, profile: member.Profile, info: info, crt: crtHost}
+	if err = is.save(); err != nil {
+		return err
+	}
+	fmt.Printf("Created %s/crt from %s/csr signed by %s/key\n", member.Name, member.Name, authorityName(member.CA))
+	return nil
+}
@@ -26,7 +26,7 @@ func NewChainCommand() cli.Command {
 	return cli.Command{
 		Name:        "chain",
 		Usage:       "Export certificate chain",
-		Description: "Export the certificate chain for host. With no args it exports this CA's certificate.",
+		Description: "Export the certificate chain for host, from CA down through any intermediate CAs to host. With no args it exports this CA's certificate.",
 		Action:      newChainAction,
 	}
 }
@@ -55,13 +55,21 @@ func newChainAction(c *cli.Context) {
 		fmt.Fprintln(os.Stderr, "Get certificate error:", err)
 		os.Exit(1)
 	}
-	crtHostBytes, _ := crtHost.Export()
-
-	if err = crt.VerifyHost(crtHost, name); err != nil {
+	intermediates, err := getIntermediates()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Get intermediate CA certificates error:", err)
+		os.Exit(1)
+	}
+	chain, err := crt.VerifyHostChain(crtHost, name, intermediates)
+	if err != nil {
 		fmt.Fprintln(os.Stderr, "Verify certificate chain error:", err)
 		os.Exit(1)
 	}
 
 	fmt.Fprintln(os.Stderr, "Outputting CA and Host certificate body:")
-	fmt.Printf("%s%s", crtBytes, crtHostBytes)
+	// chain starts from host, so print it reversely
+	for i := len(chain) - 1; i >= 0; i-- {
+		b, _ := chain[i].Export()
+		fmt.Printf("%s", b)
+	}
 }
@@ -0,0 +1,87 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+func NewCRLCommand() cli.Command {
+	return cli.Command{
+		Name:        "crl",
+		Usage:       "Export certificate revocation list",
+		Description: "Generate the certificate revocation list signed by CA, which includes all revoked certificates issued by it.",
+		Flags: []cli.Flag{
+			cli.StringFlag{"passphrase", "", "Passphrase to decrypt private-key PEM block of CA", ""},
+			cli.StringFlag{"ca", "", "Name of intermediate CA to generate CRL for instead of CA", ""},
+			cli.IntFlag{"days", 7, "How long until the next CRL is expected", ""},
+			cli.StringFlag{"format", "pem", "Format of CRL to output (pem or der)", ""},
+		},
+		Action: newCRLAction,
+	}
+}
+
+func newCRLAction(c *cli.Context) {
+	format := c.String("format")
+	if format != "pem" && format != "der" {
+		fmt.Fprintln(os.Stderr, "Format must be pem or der.")
+		os.Exit(1)
+	}
+
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer unlock()
+
+	caName := c.String("ca")
+	records, err := getRevocationRecords(caName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	crt, info, key, err := getAuthority(c, "passphrase", caName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if isFileNotExist(err) && caName == "" {
+			fmt.Fprintln(os.Stderr, "Please run 'etcd-ca init' to initial the depot.")
+		}
+		os.Exit(1)
+	}
+
+	crl, err := pkix.CreateCertificateRevocationList(crt, info, key, records, time.Duration(c.Int("days"))*24*time.Hour)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Create CRL error:", err)
+		os.Exit(1)
+	}
+	if err = updateAuthorityInfo(d, caName, info); err != nil {
+		fmt.Fprintln(os.Stderr, "Update CA info error:", err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Outputting CRL of %s with %d revoked certificates:\n", authorityName(caName), len(records.Revoked))
+	if format == "der" {
+		os.Stdout.Write(crl.ExportDER())
+		return
+	}
+	b, _ := crl.Export()
+	fmt.Printf("%s", b)
+}
@@ -0,0 +1,303 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/golang.org/x/crypto/ssh/terminal"
+	"github.com/coreos/etcd-ca/depot"
+)
+
+// depotSessionEnv holds the session token of encrypted depot printed by
+// 'depot unlock'. The token unwraps the data key only until it expires or
+// the session is locked.
+const depotSessionEnv = "ETCD_CA_DEPOT_SESSION"
+
+func NewDepotCommand() cli.Command {
+	return cli.Command{
+		Name:  "depot",
+		Usage: "Manage encryption and etcd roles of depot",
+		Subcommands: []cli.Command{
+			{
+				Name:        "encrypt",
+				Usage:       "Encrypt all data in depot",
+				Description: "Encrypt all data in depot under a data key, which is wrapped by the key derived from --depot-passphrase, or the content of --depot-key-file.",
+				Action:      newDepotEncryptAction,
+			},
+			{
+				Name:        "unlock",
+				Usage:       "Print shell commands that unlock depot for the session",
+				Description: "Start a session of encrypted depot and print its token in " + depotSessionEnv + ", so that following commands skip the passphrase until the session expires. Run it as 'eval $(etcd-ca depot unlock)'.",
+				Flags: []cli.Flag{
+					cli.StringFlag{"ttl", "8h", "How long until the session expires, e.g. 8h or 1d", ""},
+				},
+				Action: newDepotUnlockAction,
+			},
+			{
+				Name:   "lock",
+				Usage:  "End the session of depot and print shell commands that forget it",
+				Action: newDepotLockAction,
+			},
+			{
+				Name:        "change-passphrase",
+				Usage:       "Wrap the data key of encrypted depot with a new passphrase or key file",
+				Description: "Wrap the data key with the new passphrase or key file, and end all sessions. The current passphrase or key file is always asked, even in an unlocked session.",
+				Flags: []cli.Flag{
+					cli.StringFlag{"new-depot-passphrase", "", "New passphrase to unlock depot", ""},
+					cli.StringFlag{"new-depot-key-file", "", "New key file to unlock depot instead of passphrase", ""},
+				},
+				Action: newDepotChangePassphraseAction,
+			},
+			{
+				Name:        "grant-roles",
+				Usage:       "Create etcd roles that read depot by permission of files",
+				Description: "Create etcd role ROLE that reads and writes the depot, ROLE-group that reads files readable by group, such as certificates of intermediate CAs, and ROLE-other that reads files readable by everyone, such as ca.crt. Users given by --owner, --group and --other are granted the roles, and must exist in etcd.",
+				Flags: []cli.Flag{
+					cli.StringSliceFlag{"owner", &cli.StringSlice{}, "etcd user granted ROLE", ""},
+					cli.StringSliceFlag{"group", &cli.StringSlice{}, "etcd user granted ROLE-group", ""},
+					cli.StringSliceFlag{"other", &cli.StringSlice{}, "etcd user granted ROLE-other", ""},
+				},
+				Action: newDepotGrantRolesAction,
+			},
+		},
+	}
+}
+
+func newDepotEncryptAction(c *cli.Context) {
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer unlock()
+
+	// Depot opened by UnlockDepot may be left partly encrypted by an
+	// interrupted run
+	if e, ok := d.(*depot.EncryptedDepot); ok {
+		if err = e.EncryptAll(); err != nil {
+			fmt.Fprintln(os.Stderr, "Encrypt depot error:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Depot is encrypted")
+		return
+	}
+
+	kek, err := getDepotKEK(c, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err = depot.InitEncryptedDepot(d, kek); err != nil {
+		fmt.Fprintln(os.Stderr, "Encrypt depot error:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Encrypted depot")
+}
+
+func newDepotUnlockAction(c *cli.Context) {
+	e, ok := d.(*depot.EncryptedDepot)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Depot is not encrypted. Run 'etcd-ca depot encrypt' first.")
+		os.Exit(1)
+	}
+	ttl, err := parseDuration(c.String("ttl"))
+	if err != nil || ttl <= 0 {
+		fmt.Fprintln(os.Stderr, "Invalid ttl:", c.String("ttl"))
+		os.Exit(1)
+	}
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer unlock()
+	token, err := e.NewSession(ttl)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unlock depot error:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("export %s=%s\n", depotSessionEnv, token)
+}
+
+// newDepotLockAction ends the session in depot, so that its token is useless
+// even if it has been copied out of the shell
+func newDepotLockAction(c *cli.Context) {
+	if token := os.Getenv(depotSessionEnv); token != "" && depot.IsEncryptedDepot(d) {
+		unlock, err := lockDepot()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer unlock()
+		if err = depot.EndSession(d, token); err != nil {
+			fmt.Fprintln(os.Stderr, "Lock depot error:", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("unset %s\n", depotSessionEnv)
+}
+
+func newDepotChangePassphraseAction(c *cli.Context) {
+	e, ok := d.(*depot.EncryptedDepot)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Depot is not encrypted. Run 'etcd-ca depot encrypt' first.")
+		os.Exit(1)
+	}
+	kek, err := getNewDepotKEK(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer unlock()
+	if err = e.ChangeKEK(kek); err != nil {
+		fmt.Fprintln(os.Stderr, "Change depot passphrase error:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Changed depot passphrase")
+}
+
+func newDepotGrantRolesAction(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Fprintln(os.Stderr, "One role name must be provided.")
+		os.Exit(1)
+	}
+	role := c.Args()[0]
+	e, ok := d.(*depot.EtcdDepot)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Depot is not in etcd. Open it with --depot-url etcd://host:port/prefix.")
+		os.Exit(1)
+	}
+	if err := e.GrantRoles(role); err != nil {
+		fmt.Fprintln(os.Stderr, "Grant etcd roles error:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Granted etcd roles %s\n", strings.Join(depot.EtcdRoles(role, 0444), ", "))
+
+	for _, flag := range []struct{ name, role string }{{"owner", role}, {"group", role + "-group"}, {"other", role + "-other"}} {
+		for _, user := range c.StringSlice(flag.name) {
+			if err := e.GrantUser(user, flag.role); err != nil {
+				fmt.Fprintf(os.Stderr, "Grant etcd role %s to user %s error: %v\n", flag.role, user, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Granted %s to user %s\n", flag.role, user)
+		}
+	}
+}
+
+// UnlockDepot opens encrypted depot with the session token in
+// ETCD_CA_DEPOT_SESSION, or the key from depot-key-file or depot-passphrase
+// flag. Depot that is not encrypted is left as it is.
+func UnlockDepot(c *cli.Context) error {
+	// Help and 'depot lock' need no data of depot
+	args := c.Args()
+	switch {
+	case !args.Present(), args.First() == "help", args.First() == "h":
+		return nil
+	case args.First() == "depot" && args.Get(1) != "encrypt" && args.Get(1) != "unlock" && args.Get(1) != "change-passphrase":
+		return nil
+	}
+	if !depot.IsEncryptedDepot(d) {
+		return nil
+	}
+	// Changing passphrase proves the current one instead of the session
+	changing := args.First() == "depot" && args.Get(1) == "change-passphrase"
+
+	var e *depot.EncryptedDepot
+	if token := os.Getenv(depotSessionEnv); token != "" && !changing {
+		var err error
+		if e, err = depot.OpenEncryptedDepotWithSession(d, token); err != nil {
+			if errors.Is(err, depot.ErrSessionExpired) {
+				return fmt.Errorf("%w. Run 'eval $(etcd-ca depot unlock)' again.", err)
+			}
+			return err
+		}
+	} else {
+		kek, err := getDepotKEK(c, false)
+		if err != nil {
+			return err
+		}
+		if e, err = depot.OpenEncryptedDepot(d, kek); err != nil {
+			return err
+		}
+	}
+	d = e
+	return nil
+}
+
+// getDepotKEK gets the key encryption key of depot from global flags,
+// or asks passphrase on terminal, twice if create is set
+func getDepotKEK(c *cli.Context, create bool) (*depot.KeyEncryptionKey, error) {
+	if path := c.GlobalString("depot-key-file"); path != "" {
+		return readDepotKeyFile(path)
+	}
+	if c.GlobalIsSet("depot-passphrase") {
+		return depot.NewPassphraseKEK([]byte(c.GlobalString("depot-passphrase")))
+	}
+	return askDepotPassphrase("Enter passphrase for depot: ", create)
+}
+
+// getNewDepotKEK gets the key encryption key for 'depot change-passphrase'
+func getNewDepotKEK(c *cli.Context) (*depot.KeyEncryptionKey, error) {
+	if path := c.String("new-depot-key-file"); path != "" {
+		return readDepotKeyFile(path)
+	}
+	if c.IsSet("new-depot-passphrase") {
+		return depot.NewPassphraseKEK([]byte(c.String("new-depot-passphrase")))
+	}
+	return askDepotPassphrase("Enter new passphrase for depot: ", true)
+}
+
+func readDepotKeyFile(path string) (*depot.KeyEncryptionKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Read depot key file error: %w", err)
+	}
+	return depot.NewKeyFileKEK(data)
+}
+
+// askDepotPassphrase reads passphrase on terminal, twice if create is set
+func askDepotPassphrase(prompt string, create bool) (*depot.KeyEncryptionKey, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	pass, err := terminal.ReadPassword(syscall.Stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if create {
+		fmt.Fprint(os.Stderr, "Enter same passphrase again: ")
+		pass2, err := terminal.ReadPassword(syscall.Stdin)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(pass, pass2) {
+			return nil, errors.New("Passphrases do not match.")
+		}
+	}
+	return depot.NewPassphraseKEK(pass)
+}
@@ -39,6 +39,12 @@ func NewExportCommand() cli.Command {
 		Flags: []cli.Flag{
 			cli.BoolFlag{"insecure", "Export private key without encryption", ""},
 			cli.StringFlag{"passphrase", "", "Passphrase to decrypt private-key PEM block", ""},
+			cli.StringFlag{"format", "tar", "Format of output (tar of PEM files, pkcs12 with key, certificate and CA chain, or k8s-secret)", ""},
+			cli.StringFlag{"pkcs12-password", "", "Password to protect PKCS#12 bundle", ""},
+			cli.StringFlag{"pkcs12-encryption", string(pkix.DefaultPKCS12Encryption), "Scheme to encrypt PKCS#12 bundle (modern, legacy-des or legacy-rc2)", ""},
+			cli.StringFlag{"namespace", "default", "Namespace of Kubernetes Secret and ConfigMap", ""},
+			cli.StringFlag{"secret-name", "", "Name of Kubernetes Secret, the same as host if unset", ""},
+			cli.StringFlag{"configmap", "", "Name of Kubernetes ConfigMap of CA bundle to export along with Secret", ""},
 		},
 		Action: newExportAction,
 	}
@@ -60,6 +66,19 @@ func newExportAction(c *cli.Context) {
 		os.Exit(1)
 	}
 
+	switch c.String("format") {
+	case "tar":
+	case "pkcs12":
+		exportPKCS12(c)
+		return
+	case "k8s-secret":
+		exportK8sSecret(c)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unsupported format %s.\n", c.String("format"))
+		os.Exit(1)
+	}
+
 	var files []*TarFile
 	var err error
 	if len(c.Args()) == 0 {
@@ -80,11 +99,67 @@ func newExportAction(c *cli.Context) {
 	}
 }
 
+// exportPKCS12 writes PKCS#12 bundle of key, certificate and CA chain of
+// the host in args, or CA if no host is given
+func exportPKCS12(c *cli.Context) {
+	enc, err := pkix.ParsePKCS12Encryption(c.String("pkcs12-encryption"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var crt *pkix.Certificate
+	var key *pkix.Key
+	chain := make([]*pkix.Certificate, 0)
+	if len(c.Args()) == 0 {
+		if crt, err = depot.GetCertificateAuthority(d); err != nil {
+			fmt.Fprintln(os.Stderr, "Get CA certificate error:", err)
+			os.Exit(1)
+		}
+		if key, err = depot.GetEncryptedPrivateKeyAuthority(d, getPassPhrase(c, "ca key")); err != nil {
+			fmt.Fprintln(os.Stderr, "Get CA key error:", err)
+			os.Exit(1)
+		}
+	} else {
+		name := c.Args()[0]
+		if crt, err = depot.GetCertificateHost(d, name); err != nil {
+			fmt.Fprintln(os.Stderr, "Get host certificate error:", err)
+			os.Exit(1)
+		}
+		caName, err := getIssuerName(crt)
+		if err == nil {
+			chain, err = getAuthorityChain(caName)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Get CA chain error:", err)
+			os.Exit(1)
+		}
+		if key, err = depot.GetEncryptedPrivateKeyHost(d, name, getPassPhrase(c, name+" key")); err != nil {
+			fmt.Fprintln(os.Stderr, "Get host key error:", err)
+			os.Exit(1)
+		}
+	}
+
+	var password []byte
+	if c.IsSet("pkcs12-password") {
+		password = []byte(c.String("pkcs12-password"))
+	} else if password, err = createPassPhrase(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	pfxData, err := pkix.ExportPKCS12(key, crt, chain, password, enc)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Export PKCS#12 error:", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(pfxData)
+}
+
 func getAuthFiles(c *cli.Context) ([]*TarFile, error) {
 	name := "ca"
 	tarFiles := make([]*TarFile, 0)
 
-	crtFile, err := d.GetFile(depot.AuthCrtTag())
+	crtFile, err := depot.GetFile(d, depot.AuthCrtTag())
 	if err != nil {
 		return nil, errors.New("Get CA certificate error: " + err.Error())
 	}
@@ -94,7 +169,7 @@ func getAuthFiles(c *cli.Context) ([]*TarFile, error) {
 	}
 	tarFiles = append(tarFiles, crtTarFile)
 
-	keyFile, err := d.GetFile(depot.AuthPrivKeyTag())
+	keyFile, err := depot.GetFile(d, depot.AuthPrivKeyTag())
 	if err != nil {
 		return nil, errors.New("Get CA key error: " + err.Error())
 	}
@@ -115,7 +190,7 @@ func getAuthFiles(c *cli.Context) ([]*TarFile, error) {
 func getHostFiles(c *cli.Context, name string) ([]*TarFile, error) {
 	tarFiles := make([]*TarFile, 0)
 
-	crtFile, err := d.GetFile(depot.HostCrtTag(name))
+	crtFile, err := depot.GetFile(d, depot.HostCrtTag(name))
 	if err != nil {
 		return nil, errors.New("Get host certificate error: " + err.Error())
 	}
@@ -125,7 +200,7 @@ func getHostFiles(c *cli.Context, name string) ([]*TarFile, error) {
 	}
 	tarFiles = append(tarFiles, crtTarFile)
 
-	keyFile, err := d.GetFile(depot.HostPrivKeyTag(name))
+	keyFile, err := depot.GetFile(d, depot.HostPrivKeyTag(name))
 	if err != nil {
 		return nil, errors.New("Get host key error: " + err.Error())
 	}
@@ -0,0 +1,160 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/gopkg.in/yaml.v2"
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+// k8sObject is the Kubernetes Secret or ConfigMap in YAML
+type k8sObject struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sMetadata       `yaml:"metadata"`
+	Type       string            `yaml:"type,omitempty"`
+	Data       map[string]string `yaml:"data"`
+}
+
+type k8sMetadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
+// exportK8sSecret writes kubernetes.io/tls Secret of the host in args, or CA
+// if no host is given, followed by ConfigMap of CA bundle if configmap flag is set
+func exportK8sSecret(c *cli.Context) {
+	name := "ca"
+	if len(c.Args()) > 0 {
+		name = c.Args()[0]
+	}
+	secretName := c.String("secret-name")
+	if secretName == "" {
+		secretName = name
+	}
+	for _, objName := range []string{secretName, c.String("namespace"), c.String("configmap")} {
+		if objName != "" && !isValidK8sName(objName) {
+			fmt.Fprintf(os.Stderr, "Invalid Kubernetes name %q.\n", objName)
+			os.Exit(1)
+		}
+	}
+
+	var files []*TarFile
+	var err error
+	if len(c.Args()) == 0 {
+		files, err = getAuthFiles(c)
+	} else {
+		files, err = getHostFiles(c, name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// Kubernetes takes unencrypted key only
+	crtFile, keyFile := files[0], files[1]
+	if !strings.HasSuffix(keyFile.Header.Name, insecureSuffix) {
+		if keyFile, err = decryptEncryptedKeyTarFile(keyFile, getPassPhrase(c, name+" key")); err != nil {
+			fmt.Fprintln(os.Stderr, "Get decrypted key error:", err)
+			os.Exit(1)
+		}
+	}
+
+	caBundle, err := getK8sCABundle(crtFile.Data, len(c.Args()) == 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Get CA chain error:", err)
+		os.Exit(1)
+	}
+
+	objects := []*k8sObject{{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   k8sMetadata{secretName, c.String("namespace")},
+		Type:       "kubernetes.io/tls",
+		Data: map[string]string{
+			"tls.crt": base64.StdEncoding.EncodeToString(crtFile.Data),
+			"tls.key": base64.StdEncoding.EncodeToString(keyFile.Data),
+			"ca.crt":  base64.StdEncoding.EncodeToString(caBundle),
+		},
+	}}
+	if configMapName := c.String("configmap"); configMapName != "" {
+		objects = append(objects, &k8sObject{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+			Metadata:   k8sMetadata{configMapName, c.String("namespace")},
+			Data:       map[string]string{"ca.crt": string(caBundle)},
+		})
+	}
+
+	for i, obj := range objects {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Marshal YAML error:", err)
+			os.Exit(1)
+		}
+		if i > 0 {
+			fmt.Println("---")
+		}
+		os.Stdout.Write(data)
+	}
+}
+
+// getK8sCABundle returns PEM certificates from the CA issuing crtPEM up to the root CA,
+// or crtPEM itself if it is the root CA
+func getK8sCABundle(crtPEM []byte, isAuthority bool) ([]byte, error) {
+	if isAuthority {
+		return crtPEM, nil
+	}
+	crt, err := pkix.NewCertificateFromPEM(crtPEM)
+	if err != nil {
+		return nil, err
+	}
+	caName, err := getIssuerName(crt)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := getAuthorityChain(caName)
+	if err != nil {
+		return nil, err
+	}
+	var bundle []byte
+	for _, crtAuth := range chain {
+		data, err := crtAuth.Export()
+		if err != nil {
+			return nil, err
+		}
+		bundle = append(bundle, data...)
+	}
+	return bundle, nil
+}
+
+// isValidK8sName checks that name is a DNS subdomain name required by Kubernetes objects
+func isValidK8sName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for i, r := range name {
+		alphanumeric := r >= 'a' && r <= 'z' || r >= '0' && r <= '9'
+		if !alphanumeric && (i == 0 || i == len(name)-1 || r != '-' && r != '.') {
+			return false
+		}
+	}
+	return true
+}
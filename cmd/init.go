@@ -30,23 +30,55 @@ func NewInitCommand() cli.Command {
 		Description: "Create Certificate Authority, including certificate, key and extra information file.",
 		Flags: []cli.Flag{
 			cli.StringFlag{"passphrase", "", "Passphrase to encrypt private-key PEM block", ""},
+			cli.StringFlag{"key-encryption", string(pkix.DefaultKeyEncryption), "Scheme to encrypt private-key PEM block (3des, pbkdf2-aes256-cbc, pbkdf2-aes256-gcm, scrypt-aes256-cbc or scrypt-aes256-gcm)", ""},
+			cli.StringFlag{"key-type", "rsa", "Type of keypair to generate (rsa, ecdsa or ed25519)", ""},
 			cli.IntFlag{"key-bits", 4096, "Bit size of RSA keypair to generate", ""},
+			cli.StringFlag{"curve", "P256", "Elliptic curve of ECDSA keypair to generate (P256, P384 or P521)", ""},
 			cli.IntFlag{"years", 10, "How long until the CA certificate expires", ""},
+			cli.StringFlag{"serial-strategy", string(pkix.SerialSequential), "How to pick serial numbers of issued certificates (sequential or random)", ""},
 			cli.StringFlag{"organization", "etcd-ca", "CA Certificate organization", ""},
 			cli.StringFlag{"country", "USA", "CA Certificate country", ""},
+			cli.StringSliceFlag{"permitted-dns", &cli.StringSlice{}, "Domain whose names and subdomains are permitted in issued certificates, or subdomains only with leading dot", ""},
+			cli.StringSliceFlag{"excluded-dns", &cli.StringSlice{}, "Domain whose names and subdomains are excluded from issued certificates, or subdomains only with leading dot", ""},
+			cli.StringSliceFlag{"permitted-ip", &cli.StringSlice{}, "CIDR whose addresses are permitted in issued certificates", ""},
+			cli.StringSliceFlag{"excluded-ip", &cli.StringSlice{}, "CIDR whose addresses are excluded from issued certificates", ""},
+			cli.StringSliceFlag{"permitted-email", &cli.StringSlice{}, "Mailbox, or domain of mailboxes, permitted in issued certificates", ""},
+			cli.StringSliceFlag{"excluded-email", &cli.StringSlice{}, "Mailbox, or domain of mailboxes, excluded from issued certificates", ""},
 		},
 		Action: initAction,
 	}
 }
 
 func initAction(c *cli.Context) {
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer unlock()
+
 	if depot.CheckCertificateAuthority(d) || depot.CheckCertificateAuthorityInfo(d) || depot.CheckPrivateKeyAuthority(d) {
 		fmt.Fprintln(os.Stderr, "CA has existed!")
 		os.Exit(1)
 	}
 
+	enc, err := pkix.ParseKeyEncryption(c.String("key-encryption"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	strategy, err := pkix.ParseSerialStrategy(c.String("serial-strategy"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	nc, err := getNameConstraints(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	var passphrase []byte
-	var err error
 	if c.IsSet("passphrase") {
 		passphrase = []byte(c.String("passphrase"))
 	} else {
@@ -57,21 +89,22 @@ func initAction(c *cli.Context) {
 		}
 	}
 
-	key, err := pkix.CreateRSAKey(c.Int("key-bits"))
+	key, err := createKey(c)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Create RSA Key error:", err)
+		fmt.Fprintln(os.Stderr, "Create key error:", err)
 		os.Exit(1)
 	} else {
 		fmt.Println("Created ca/key")
 	}
 
-	crt, info, err := pkix.CreateCertificateAuthority(key, c.Int("years"), c.String("organization"), c.String("country"))
+	crt, info, err := pkix.CreateCertificateAuthorityWithConstraints(key, c.Int("years"), c.String("organization"), c.String("country"), nc)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Create certificate error:", err)
 		os.Exit(1)
 	} else {
 		fmt.Println("Created ca/crt")
 	}
+	info.SerialStrategy = strategy
 
 	if err = depot.PutCertificateAuthority(d, crt); err != nil {
 		fmt.Fprintln(os.Stderr, "Save certificate error:", err)
@@ -79,7 +112,7 @@ func initAction(c *cli.Context) {
 	if err = depot.PutCertificateAuthorityInfo(d, info); err != nil {
 		fmt.Fprintln(os.Stderr, "Save certificate info error:", err)
 	}
-	if err = depot.PutEncryptedPrivateKeyAuthority(d, key, passphrase); err != nil {
+	if err = depot.PutEncryptedPrivateKeyAuthorityWithEncryption(d, key, passphrase, enc); err != nil {
 		fmt.Fprintln(os.Stderr, "Save key error:", err)
 	}
 }
@@ -0,0 +1,88 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+func NewListCommand() cli.Command {
+	return cli.Command{
+		Name:        "list",
+		Usage:       "List issued certificates",
+		Description: "List certificates recorded in the index of depot. Only valid certificates are listed unless --all is set.",
+		Flags: []cli.Flag{
+			cli.BoolFlag{"all", "List revoked and expired certificates too", ""},
+			cli.StringFlag{"ca", "", "Only list certificates issued by the named CA ('ca' for CA)", ""},
+			cli.StringFlag{"format", "table", "Format of output (table or json)", ""},
+		},
+		Action: newListAction,
+	}
+}
+
+func newListAction(c *cli.Context) {
+	format := c.String("format")
+	if format != "table" && format != "json" {
+		fmt.Fprintln(os.Stderr, "Format must be table or json.")
+		os.Exit(1)
+	}
+
+	index, err := getCertificateIndex(d)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	now := time.Now()
+	selected := pkix.NewCertificateIndex()
+	for _, entry := range index.Entries {
+		if c.IsSet("ca") && authorityName(entry.Issuer) != c.String("ca") {
+			continue
+		}
+		if !c.Bool("all") && entry.StatusAt(now) != pkix.IndexStatusValid {
+			continue
+		}
+		selected.Entries = append(selected.Entries, entry)
+	}
+
+	if format == "json" {
+		b, err := selected.Export()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Export certificate index error:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s", b)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tISSUER\tSERIAL\tSTATUS\tNOT AFTER\tSANS")
+	for _, entry := range selected.Entries {
+		status := entry.StatusAt(now)
+		if status == pkix.IndexStatusRevoked {
+			status += " (" + pkix.RevocationReasonName(entry.Reason) + ")"
+		}
+		sans := append(append([]string{}, entry.DNSNames...), entry.IPAddresses...)
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\t%s\n", entry.Name, authorityName(entry.Issuer), entry.SerialNumber, status, entry.NotAfter.Format("2006-01-02"), strings.Join(sans, ","))
+	}
+	w.Flush()
+}
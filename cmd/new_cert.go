@@ -30,8 +30,11 @@ func NewNewCertCommand() cli.Command {
 		Description: "Create certificate for host, including certificate signing request and key. Certificate could be generated by signing the request.",
 		Flags: []cli.Flag{
 			cli.StringFlag{"passphrase", "", "Passphrase to encrypt private-key PEM block", ""},
+			cli.StringFlag{"key-encryption", string(pkix.DefaultKeyEncryption), "Scheme to encrypt private-key PEM block (3des, pbkdf2-aes256-cbc, pbkdf2-aes256-gcm, scrypt-aes256-cbc or scrypt-aes256-gcm)", ""},
 			cli.StringFlag{"ip", "127.0.0.1", "IP address of the host", ""},
+			cli.StringFlag{"key-type", "rsa", "Type of keypair to generate (rsa, ecdsa or ed25519)", ""},
 			cli.IntFlag{"key-bits", 4096, "Bit size of RSA keypair to generate", ""},
+			cli.StringFlag{"curve", "P256", "Elliptic curve of ECDSA keypair to generate (P256, P384 or P521)", ""},
 			cli.StringFlag{"domain", "", "Use domain instead of IP address for SAN", ""},
 			cli.StringFlag{"organization", "etcd-ca", "Certificate organization", ""},
 			cli.StringFlag{"country", "USA", "Certificate country", ""},
@@ -47,13 +50,25 @@ func newCertAction(c *cli.Context) {
 	}
 	name := c.Args()[0]
 
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer unlock()
+
 	if depot.CheckCertificateSigningRequest(d, name) || depot.CheckPrivateKeyHost(d, name) {
 		fmt.Fprintln(os.Stderr, "Certificate request has existed!")
 		os.Exit(1)
 	}
 
+	enc, err := pkix.ParseKeyEncryption(c.String("key-encryption"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	var passphrase []byte
-	var err error
 	if c.IsSet("passphrase") {
 		passphrase = []byte(c.String("passphrase"))
 	} else {
@@ -64,9 +79,9 @@ func newCertAction(c *cli.Context) {
 		}
 	}
 
-	key, err := pkix.CreateRSAKey(c.Int("key-bits"))
+	key, err := createKey(c)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Create RSA Key error:", err)
+		fmt.Fprintln(os.Stderr, "Create key error:", err)
 		os.Exit(1)
 	} else {
 		fmt.Printf("Created %s/key\n", name)
@@ -83,7 +98,7 @@ func newCertAction(c *cli.Context) {
 	if err = depot.PutCertificateSigningRequest(d, name, csr); err != nil {
 		fmt.Fprintln(os.Stderr, "Save certificate request error:", err)
 	}
-	if err = depot.PutEncryptedPrivateKeyHost(d, name, key, passphrase); err != nil {
+	if err = depot.PutEncryptedPrivateKeyHostWithEncryption(d, name, key, passphrase, enc); err != nil {
 		fmt.Fprintln(os.Stderr, "Save key error:", err)
 	}
 }
@@ -0,0 +1,161 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/depot"
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+func NewNewIntermediateCommand() cli.Command {
+	return cli.Command{
+		Name:        "new-intermediate",
+		Usage:       "Create intermediate Certificate Authority",
+		Description: "Create intermediate Certificate Authority signed by CA, including certificate, key and extra information file. It could sign certificate requests the same as CA.",
+		Flags: []cli.Flag{
+			cli.StringFlag{"passphrase", "", "Passphrase to encrypt private-key PEM block", ""},
+			cli.StringFlag{"key-encryption", string(pkix.DefaultKeyEncryption), "Scheme to encrypt private-key PEM block (3des, pbkdf2-aes256-cbc, pbkdf2-aes256-gcm, scrypt-aes256-cbc or scrypt-aes256-gcm)", ""},
+			cli.StringFlag{"ca", "", "Name of intermediate CA to sign with instead of CA", ""},
+			cli.StringFlag{"ca-passphrase", "", "Passphrase to decrypt private-key PEM block of signing CA", ""},
+			cli.StringFlag{"key-type", "rsa", "Type of keypair to generate (rsa, ecdsa or ed25519)", ""},
+			cli.IntFlag{"key-bits", 4096, "Bit size of RSA keypair to generate", ""},
+			cli.StringFlag{"curve", "P256", "Elliptic curve of ECDSA keypair to generate (P256, P384 or P521)", ""},
+			cli.IntFlag{"years", 5, "How long until the intermediate CA certificate expires", ""},
+			cli.IntFlag{"max-path-len", 0, "Number of intermediate CAs allowed under it, or -1 for unlimited", ""},
+			cli.StringFlag{"serial-strategy", "", "How to pick serial numbers of issued certificates (sequential or random), the same as signing CA if unset", ""},
+			cli.StringFlag{"organization", "etcd-ca", "Intermediate CA certificate organization", ""},
+			cli.StringFlag{"country", "USA", "Intermediate CA certificate country", ""},
+			cli.StringSliceFlag{"permitted-dns", &cli.StringSlice{}, "Domain whose names and subdomains are permitted in issued certificates, or subdomains only with leading dot", ""},
+			cli.StringSliceFlag{"excluded-dns", &cli.StringSlice{}, "Domain whose names and subdomains are excluded from issued certificates, or subdomains only with leading dot", ""},
+			cli.StringSliceFlag{"permitted-ip", &cli.StringSlice{}, "CIDR whose addresses are permitted in issued certificates, the same as signing CA if none is set", ""},
+			cli.StringSliceFlag{"excluded-ip", &cli.StringSlice{}, "CIDR whose addresses are excluded from issued certificates, the same as signing CA if none is set", ""},
+			cli.StringSliceFlag{"permitted-email", &cli.StringSlice{}, "Mailbox, or domain of mailboxes, permitted in issued certificates, the same as signing CA if none is set", ""},
+			cli.StringSliceFlag{"excluded-email", &cli.StringSlice{}, "Mailbox, or domain of mailboxes, excluded from issued certificates, the same as signing CA if none is set", ""},
+		},
+		Action: newIntermediateAction,
+	}
+}
+
+func newIntermediateAction(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Fprintln(os.Stderr, "One intermediate CA name must be provided.")
+		os.Exit(1)
+	}
+	name := c.Args()[0]
+	if name == "ca" {
+		fmt.Fprintln(os.Stderr, "Name 'ca' is reserved for CA.")
+		os.Exit(1)
+	}
+
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer unlock()
+
+	if depot.CheckCertificateIntermediate(d, name) || depot.CheckCertificateIntermediateInfo(d, name) || depot.CheckEncryptedPrivateKeyIntermediate(d, name) {
+		fmt.Fprintln(os.Stderr, "Intermediate CA has existed!")
+		os.Exit(1)
+	}
+
+	enc, err := pkix.ParseKeyEncryption(c.String("key-encryption"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	nc, err := getNameConstraints(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	caName := c.String("ca")
+	crtAuth, infoAuth, keyAuth, err := getAuthority(c, "ca-passphrase", caName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if isFileNotExist(err) && caName == "" {
+			fmt.Fprintln(os.Stderr, "Please run 'etcd-ca init' to initial the depot.")
+		}
+		os.Exit(1)
+	}
+	strategy := infoAuth.SerialStrategy
+	if c.IsSet("serial-strategy") {
+		if strategy, err = pkix.ParseSerialStrategy(c.String("serial-strategy")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	var passphrase []byte
+	if c.IsSet("passphrase") {
+		passphrase = []byte(c.String("passphrase"))
+	} else {
+		passphrase, err = createPassPhrase()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	key, err := createKey(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Create key error:", err)
+		os.Exit(1)
+	} else {
+		fmt.Printf("Created %s/key\n", name)
+	}
+
+	crt, info, err := pkix.CreateIntermediateCertificateAuthorityWithConstraints(crtAuth, infoAuth, keyAuth, key, name, c.Int("years"), c.Int("max-path-len"), c.String("organization"), c.String("country"), nc)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Create certificate error:", err)
+		os.Exit(1)
+	} else {
+		fmt.Printf("Created %s/crt signed by %s/key\n", name, authorityName(caName))
+	}
+	info.SerialStrategy = strategy
+
+	// All changes are saved in one transaction, with CA info of issuer
+	// first as hostIssuance does
+	txn := depot.Begin(d)
+	if err = updateAuthorityInfo(txn, caName, infoAuth); err != nil {
+		fmt.Fprintln(os.Stderr, "Update CA info error:", err)
+		os.Exit(1)
+	}
+	if err = addCertificateIndex(txn, name, caName, "", "", crt); err != nil {
+		fmt.Fprintln(os.Stderr, "Update certificate index error:", err)
+		os.Exit(1)
+	}
+	if err = depot.PutEncryptedPrivateKeyIntermediate(txn, name, key, passphrase, enc); err != nil {
+		fmt.Fprintln(os.Stderr, "Save key error:", err)
+		os.Exit(1)
+	}
+	if err = depot.PutCertificateIntermediateInfo(txn, name, info); err != nil {
+		fmt.Fprintln(os.Stderr, "Save certificate info error:", err)
+		os.Exit(1)
+	}
+	if err = depot.PutCertificateIntermediate(txn, name, crt); err != nil {
+		fmt.Fprintln(os.Stderr, "Save certificate error:", err)
+		os.Exit(1)
+	}
+	if err = txn.Commit(); err != nil {
+		fmt.Fprintln(os.Stderr, "Save depot error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/depot"
+)
+
+func NewRecoverCommand() cli.Command {
+	return cli.Command{
+		Name:        "recover",
+		Usage:       "Recover operation interrupted in depot",
+		Description: "Finish saving the changes of sign or renew interrupted by a crash, which are recorded in the journal of depot.",
+		Flags: []cli.Flag{
+			cli.BoolFlag{"rollback", "Undo the interrupted changes instead", ""},
+		},
+		Action: newRecoverAction,
+	}
+}
+
+func newRecoverAction(c *cli.Context) {
+	j, ok := d.(depot.Journaler)
+	if !ok {
+		fmt.Println("Depot keeps no journal.")
+		return
+	}
+	if l, ok := d.(depot.Locker); ok {
+		unlock, err := l.Lock()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Lock depot error:", err)
+			os.Exit(1)
+		}
+		defer unlock()
+	}
+	if !j.Pending() {
+		fmt.Println("No interrupted operation found.")
+		return
+	}
+
+	if err := j.Recover(c.Bool("rollback")); err != nil {
+		fmt.Fprintln(os.Stderr, "Recover depot error:", err)
+		os.Exit(1)
+	}
+	if c.Bool("rollback") {
+		fmt.Println("Rolled back interrupted operation")
+	} else {
+		fmt.Println("Rolled forward interrupted operation")
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/depot"
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+func NewRekeyPassphraseCommand() cli.Command {
+	return cli.Command{
+		Name:        "rekey-passphrase",
+		Usage:       "Re-encrypt private key with new passphrase",
+		Description: "Decrypt the private key of host and encrypt it again in place, using new passphrase and encryption scheme. With no args it re-encrypts CA key, or the key of intermediate CA given by --ca.",
+		Flags: []cli.Flag{
+			cli.StringFlag{"passphrase", "", "Passphrase to decrypt private-key PEM block", ""},
+			cli.StringFlag{"new-passphrase", "", "Passphrase to encrypt private-key PEM block", ""},
+			cli.StringFlag{"ca", "", "Name of intermediate CA to re-encrypt key of", ""},
+			cli.StringFlag{"key-encryption", string(pkix.DefaultKeyEncryption), "Scheme to encrypt private-key PEM block (3des, pbkdf2-aes256-cbc, pbkdf2-aes256-gcm, scrypt-aes256-cbc or scrypt-aes256-gcm)", ""},
+		},
+		Action: newRekeyPassphraseAction,
+	}
+}
+
+func newRekeyPassphraseAction(c *cli.Context) {
+	if len(c.Args()) > 1 {
+		fmt.Fprintln(os.Stderr, "At most one host name could be provided.")
+		os.Exit(1)
+	}
+
+	enc, err := pkix.ParseKeyEncryption(c.String("key-encryption"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	caName := c.String("ca")
+	if caName != "" && len(c.Args()) != 0 {
+		fmt.Fprintln(os.Stderr, "Host name could not be provided with --ca.")
+		os.Exit(1)
+	}
+
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer unlock()
+
+	name := authorityName(caName)
+	var tag *depot.Tag
+	var prompt string
+	if caName != "" {
+		tag, prompt = depot.IntermediatePrivKeyTag(caName), caName+" CA key"
+	} else if len(c.Args()) == 0 {
+		tag, prompt = depot.AuthPrivKeyTag(), "CA key"
+	} else {
+		name = c.Args()[0]
+		tag, prompt = depot.HostPrivKeyTag(name), name+" key"
+	}
+	// PEM block read here is compared when the key is replaced
+	var key *pkix.Key
+	keyFile, err := depot.GetFile(d, tag)
+	if err == nil {
+		key, err = pkix.NewKeyFromEncryptedPrivateKeyPEM(keyFile.Data, getPassPhrase(c, prompt))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Get key error:", err)
+		if isFileNotExist(err) && caName == "" && len(c.Args()) == 0 {
+			fmt.Fprintln(os.Stderr, "Please run 'etcd-ca init' to initial the depot.")
+		}
+		os.Exit(1)
+	}
+
+	var passphrase []byte
+	if c.IsSet("new-passphrase") {
+		passphrase = []byte(c.String("new-passphrase"))
+	} else {
+		passphrase, err = createPassPhrase()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if caName != "" {
+		err = depot.UpdateEncryptedPrivateKeyIntermediate(d, caName, keyFile.Data, key, passphrase, enc)
+	} else if len(c.Args()) == 0 {
+		err = depot.UpdateEncryptedPrivateKeyAuthority(d, keyFile.Data, key, passphrase, enc)
+	} else {
+		err = depot.UpdateEncryptedPrivateKeyHost(d, name, keyFile.Data, key, passphrase, enc)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Save key error:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Re-encrypted %s/key\n", name)
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/depot"
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+func NewRenewCommand() cli.Command {
+	return cli.Command{
+		Name:        "renew",
+		Usage:       "Renew host certificate",
+		Description: "Re-issue the certificate of host from its certificate request by the same CA, with the same SANs and extensions. The old certificate is archived.",
+		Flags: []cli.Flag{
+			cli.StringFlag{"passphrase", "", "Passphrase to decrypt private-key PEM block of CA", ""},
+			cli.IntFlag{"days", 0, "How long until the certificate expires, the same as the old one if unset", ""},
+			cli.BoolFlag{"rekey", "Generate new key and certificate request of the same type and subject", ""},
+			cli.StringFlag{"key-passphrase", "", "Passphrase to encrypt private-key PEM block of the new host key", ""},
+			cli.StringFlag{"key-encryption", string(pkix.DefaultKeyEncryption), "Scheme to encrypt private-key PEM block of the new host key (3des, pbkdf2-aes256-cbc, pbkdf2-aes256-gcm, scrypt-aes256-cbc or scrypt-aes256-gcm)", ""},
+		},
+		Action: newRenewAction,
+	}
+}
+
+func newRenewAction(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Fprintln(os.Stderr, "One host name must be provided.")
+		os.Exit(1)
+	}
+	name := c.Args()[0]
+
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer unlock()
+
+	enc, err := pkix.ParseKeyEncryption(c.String("key-encryption"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	crtOld, err := depot.GetCertificateHost(d, name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Get certificate error:", err)
+		if isFileNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Please run 'etcd-ca sign %s' to sign the certificate first.\n", name)
+		}
+		os.Exit(1)
+	}
+	rawCrtOld, err := crtOld.GetRawCertificate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Parse certificate error:", err)
+		os.Exit(1)
+	}
+	csr, err := depot.GetCertificateSigningRequest(d, name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Get certificate request error:", err)
+		os.Exit(1)
+	}
+
+	caName, err := getIssuerName(crtOld)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	crt, info, key, err := getAuthority(c, "passphrase", caName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var keyHost *pkix.Key
+	var keyOld, passphrase []byte
+	csrOld := csr
+	if c.Bool("rekey") {
+		if c.IsSet("key-passphrase") {
+			passphrase = []byte(c.String("key-passphrase"))
+		} else if passphrase, err = createPassPhrase(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		// The key read here is the one replaced, if host has any
+		if depot.CheckPrivateKeyHost(d, name) {
+			keyFile, err := depot.GetFile(d, depot.HostPrivKeyTag(name))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Get key error:", err)
+				os.Exit(1)
+			}
+			keyOld = keyFile.Data
+		}
+		if keyHost, err = pkix.CreateKeyLike(rawCrtOld.PublicKey); err != nil {
+			fmt.Fprintln(os.Stderr, "Create key error:", err)
+			os.Exit(1)
+		}
+		if csr, err = pkix.CreateCertificateSigningRequestLike(keyHost, csr); err != nil {
+			fmt.Fprintln(os.Stderr, "Create certificate request error:", err)
+			os.Exit(1)
+		}
+	}
+
+	crtHost, err := renewCertificateHost(crt, info, key, crtOld, csr, time.Duration(c.Int("days"))*24*time.Hour, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	is := &hostIssuance{name: name, caName: caName, profile: getIndexProfile(caName, crtOld), info: info, crt: crtHost, crtOld: crtOld}
+	if keyHost != nil {
+		is.csr, is.csrOld = csr, csrOld
+		is.key, is.keyOld, is.keyPassphrase, is.keyEncryption = keyHost, keyOld, passphrase, enc
+	}
+	// Archived and renewed certificates, CA info and index are saved together in one transaction
+	if err = is.save(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Archived %s/crt (serial %v)\n", name, rawCrtOld.SerialNumber)
+	if keyHost != nil {
+		fmt.Printf("Created %s/key\nCreated %s/csr\n", name, name)
+	}
+	fmt.Printf("Renewed %s/crt signed by %s/key\n", name, authorityName(caName))
+}
+
+// renewCertificateHost re-issues the certificate of host from csr by CA,
+// with the same SANs and extensions as crtOld. SANs dropped from csr when
+// crtOld was signed are not brought back. The validity is the same as crtOld if it is zero.
+// It is refused if policy is set and broken.
+// The caller saves it with hostIssuance, which archives crtOld.
+func renewCertificateHost(crtAuth *pkix.Certificate, info *pkix.CertificateAuthorityInfo, keyAuth *pkix.Key, crtOld *pkix.Certificate, csr *pkix.CertificateSigningRequest, validity time.Duration, policy *pkix.Policy) (*pkix.Certificate, error) {
+	rawCrtOld, err := crtOld.GetRawCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("Parse certificate error: %w", err)
+	}
+
+	// Profile of old certificate carries its usages and extra extensions
+	profile, err := pkix.NewProfileFromCertificate(crtOld)
+	if err != nil {
+		return nil, fmt.Errorf("Parse certificate error: %w", err)
+	}
+	opts := &pkix.CertificateHostOptions{
+		OCSPServer: rawCrtOld.OCSPServer,
+		Profile:    profile,
+		Policy:     policy,
+		SANsOf:     crtOld,
+		// NotBefore is a little earlier than issuing time
+		Validity: rawCrtOld.NotAfter.Sub(rawCrtOld.NotBefore).Round(time.Hour),
+	}
+	if validity > 0 {
+		opts.Validity = validity
+	}
+	crtHost, err := pkix.CreateCertificateHostWithOptions(crtAuth, info, keyAuth, csr, 0, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Create certificate error: %w", err)
+	}
+	return crtHost, nil
+}
+
+// getIndexProfile returns the name of profile used to issue certificate
+// according to index, or empty string if it is unknown
+func getIndexProfile(caName string, crt *pkix.Certificate) string {
+	if entry := getIndexEntry(caName, crt); entry != nil {
+		return entry.Profile
+	}
+	return ""
+}
+
+// getIndexEntry returns the index entry of crt issued by CA named by caName,
+// or nil if it is not in index
+func getIndexEntry(caName string, crt *pkix.Certificate) *pkix.IndexEntry {
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return nil
+	}
+	index, err := getCertificateIndex(d)
+	if err != nil {
+		return nil
+	}
+	return index.Get(caName, rawCrt.SerialNumber)
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/depot"
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+func NewRevokeCommand() cli.Command {
+	return cli.Command{
+		Name:        "revoke",
+		Usage:       "Revoke host certificate",
+		Description: "Record the certificate of host as revoked by the CA that issues it. Run 'etcd-ca crl' to publish the revocation.",
+		Flags: []cli.Flag{
+			cli.StringFlag{"reason", "unspecified", "Revocation reason defined in RFC 5280, e.g. keyCompromise, superseded or cessationOfOperation", ""},
+			cli.StringFlag{"serial", "", "Serial number of the certificate to revoke, which could be archived by renewal, instead of the current one", ""},
+		},
+		Action: newRevokeAction,
+	}
+}
+
+func newRevokeAction(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Fprintln(os.Stderr, "One host name must be provided.")
+		os.Exit(1)
+	}
+	name := c.Args()[0]
+
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer unlock()
+
+	reason, err := pkix.ParseRevocationReason(c.String("reason"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	crt, err := getCertificateHostToRevoke(name, c.String("serial"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Get certificate error:", err)
+		os.Exit(1)
+	}
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Parse certificate error:", err)
+		os.Exit(1)
+	}
+
+	caName, err := getIssuerName(crt)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	records, err := getRevocationRecords(caName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	index, err := getCertificateIndex(d)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	now := time.Now()
+	if err = records.Revoke(name, rawCrt.SerialNumber, reason, now); err != nil {
+		fmt.Fprintln(os.Stderr, "Revoke certificate error:", err)
+		os.Exit(1)
+	}
+	// Certificate missing from index, e.g. signed before it was kept, is only in records
+	if !index.Revoke(caName, rawCrt.SerialNumber, reason, now) {
+		index = nil
+	}
+	if err = saveRevocation(caName, records, index); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Revoked %s/crt (serial %v) issued by %s/key: %s\n", name, rawCrt.SerialNumber, authorityName(caName), pkix.RevocationReasonName(reason))
+}
+
+// getCertificateHostToRevoke returns the certificate of host to revoke, which
+// is the archived one with serial number if it is set, or the current one
+func getCertificateHostToRevoke(name string, serial string) (*pkix.Certificate, error) {
+	crt, err := depot.GetCertificateHost(d, name)
+	if serial == "" {
+		return crt, err
+	}
+	serialNumber, ok := new(big.Int).SetString(serial, 0)
+	if !ok {
+		return nil, fmt.Errorf("invalid serial number %s", serial)
+	}
+	if err == nil {
+		if rawCrt, err := crt.GetRawCertificate(); err == nil && rawCrt.SerialNumber.Cmp(serialNumber) == 0 {
+			return crt, nil
+		}
+	}
+	return depot.GetArchivedCertificateHost(d, name, serialNumber)
+}
@@ -0,0 +1,378 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/depot"
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+// Requests larger than this are not certificate requests for sure
+const maxCSRSize = 64 * 1024
+
+func NewServeCommand() cli.Command {
+	return cli.Command{
+		Name:        "serve",
+		Usage:       "Serve signing API over HTTPS",
+		Description: "Serve REST API to submit certificate requests, fetch certificates, the CA chain and status. Clients authenticate with certificates issued by CA, and may sign only with the profile bound to them by --role.",
+		Flags: []cli.Flag{
+			cli.StringFlag{"listen", ":8443", "Address to listen on", ""},
+			cli.StringFlag{"passphrase", "", "Passphrase to decrypt private-key PEM block of CA", ""},
+			cli.StringFlag{"ca", "", "Name of intermediate CA to sign with instead of CA", ""},
+			cli.StringFlag{"cert", "", "Name of host whose certificate and key are used by the server", ""},
+			cli.StringFlag{"cert-passphrase", "", "Passphrase to decrypt private-key PEM block of the server host", ""},
+			cli.StringSliceFlag{"role", &cli.StringSlice{}, "Profile that client could sign with in the form of name=profile, or *=profile for all clients", ""},
+			cli.StringFlag{"profile-file", "", "YAML or JSON file of user-defined profiles", ""},
+			cli.StringFlag{"policy-file", "", "YAML or JSON file of issuance policy that certificates must comply with", ""},
+			cli.IntFlag{"years", 10, "How long until the certificate expires if profile does not set days", ""},
+		},
+		Action: newServeAction,
+	}
+}
+
+func newServeAction(c *cli.Context) {
+	if len(c.Args()) != 0 {
+		fmt.Fprintln(os.Stderr, "No argument is expected.")
+		os.Exit(1)
+	}
+	if c.String("cert") == "" {
+		fmt.Fprintln(os.Stderr, "Name of server host must be provided by --cert.")
+		os.Exit(1)
+	}
+
+	var profiles map[string]*pkix.Profile
+	if path := c.String("profile-file"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Read profile file error:", err)
+			os.Exit(1)
+		}
+		if profiles, err = pkix.NewProfilesFromYAML(data); err != nil {
+			fmt.Fprintln(os.Stderr, "Parse profile file error:", err)
+			os.Exit(1)
+		}
+	}
+	roles := make(map[string]*pkix.Profile)
+	for _, role := range c.StringSlice("role") {
+		i := strings.Index(role, "=")
+		if i <= 0 {
+			fmt.Fprintf(os.Stderr, "Role %q is not in the form of name=profile.\n", role)
+			os.Exit(1)
+		}
+		profile, err := pkix.GetProfile(role[i+1:], profiles)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		roles[role[:i]] = profile
+	}
+
+	policy, err := getPolicy(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	caName := c.String("ca")
+	crt, _, key, err := getAuthority(c, "passphrase", caName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	tlsConfig, err := newServerTLSConfig(c, c.String("cert"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Create TLS config error:", err)
+		os.Exit(1)
+	}
+
+	h := &signingHandler{
+		depot:  d,
+		caName: caName,
+		auth:   &authority{crt, key},
+		roles:  roles,
+		policy: policy,
+		years:  c.Int("years"),
+	}
+	server := &http.Server{
+		Addr:      c.String("listen"),
+		Handler:   h,
+		TLSConfig: tlsConfig,
+	}
+	fmt.Fprintf(os.Stderr, "Serving signing API for %s on %s\n", authorityName(caName), c.String("listen"))
+	if err = server.ListenAndServeTLS("", ""); err != nil {
+		fmt.Fprintln(os.Stderr, "Serve error:", err)
+		os.Exit(1)
+	}
+}
+
+// newServerTLSConfig builds TLS config using certificate and key of host name,
+// which requires clients to present certificates issued by CA or intermediate CAs
+func newServerTLSConfig(c *cli.Context, name string) (*tls.Config, error) {
+	crtAuth, err := depot.GetCertificateAuthority(d)
+	if err != nil {
+		return nil, err
+	}
+	crt, err := depot.GetCertificateHost(d, name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := depot.GetEncryptedPrivateKeyHost(d, name, getPassPhraseFromFlag(c, "cert-passphrase", name+" key"))
+	if err != nil {
+		return nil, err
+	}
+	intermediates, err := getIntermediates()
+	if err != nil {
+		return nil, err
+	}
+	chain, err := crtAuth.VerifyHostChain(crt, name, intermediates)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCrt := tls.Certificate{PrivateKey: key.Private}
+	// Send intermediate CAs along with host certificate
+	for _, crt := range chain[:len(chain)-1] {
+		rawCrt, _ := crt.GetRawCertificate()
+		tlsCrt.Certificate = append(tlsCrt.Certificate, rawCrt.Raw)
+	}
+	clientCAs := x509.NewCertPool()
+	for _, crt := range append(intermediates, crtAuth) {
+		if rawCrt, err := crt.GetRawCertificate(); err == nil {
+			clientCAs.AddCert(rawCrt)
+		}
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{tlsCrt},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// signingHandler serves the signing API:
+//
+//	GET  /v1/ca            PEM certificates from the signing CA up to the root CA
+//	POST /v1/csr/<name>    sign PEM certificate request of host, and return PEM certificate
+//	GET  /v1/certs/<name>  PEM certificate of host
+//	GET  /v1/status        index entries in JSON lines, filtered by optional name query
+type signingHandler struct {
+	depot  depot.Depot
+	caName string
+	auth   *authority
+	// roles maps client name to profile, and "*" stands for all clients
+	roles  map[string]*pkix.Profile
+	policy *pkix.Policy
+	years  int
+	// mu serializes signing, which updates CA info and index
+	mu sync.Mutex
+}
+
+func (h *signingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client, err := h.authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	switch {
+	case r.Method == "GET" && path == "ca":
+		h.serveAuthorityChain(w)
+	case r.Method == "POST" && strings.HasPrefix(path, "csr/"):
+		h.serveSign(w, r, client, strings.TrimPrefix(path, "csr/"))
+	case r.Method == "GET" && strings.HasPrefix(path, "certs/"):
+		h.serveCertificate(w, strings.TrimPrefix(path, "certs/"))
+	case r.Method == "GET" && path == "status":
+		h.serveStatus(w, r.URL.Query().Get("name"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authenticate returns the name of client in depot, and rejects revoked clients.
+// Subject of client certificate is not trusted, as it is copied from the
+// certificate request.
+func (h *signingHandler) authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", errors.New("Client certificate is required")
+	}
+	crt := pkix.NewCertificateFromDER(r.TLS.PeerCertificates[0].Raw)
+	if getRevokedCertificate(crt) != nil {
+		return "", errors.New("Client certificate is revoked")
+	}
+	name, err := getCertificateHostName(crt)
+	if err != nil {
+		return "", fmt.Errorf("Client certificate is unknown: %v", err)
+	}
+	return name, nil
+}
+
+func (h *signingHandler) serveAuthorityChain(w http.ResponseWriter) {
+	chain, err := getAuthorityChain(h.caName)
+	if err != nil {
+		http.Error(w, "Get CA certificate error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	for _, crt := range chain {
+		b, _ := crt.Export()
+		w.Write(b)
+	}
+}
+
+func (h *signingHandler) serveSign(w http.ResponseWriter, r *http.Request, client string, name string) {
+	profile, ok := h.roles[client]
+	if !ok {
+		profile, ok = h.roles["*"]
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("Client %s is not allowed to sign", client), http.StatusForbidden)
+		return
+	}
+	if !isValidHostName(name) {
+		http.Error(w, "Invalid host name", http.StatusBadRequest)
+		return
+	}
+	csrBytes, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCSRSize))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	csr, err := pkix.NewCertificateSigningRequestFromPEM(csrBytes)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		http.Error(w, "Invalid certificate request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The certificate names the host in organizational unit as new-cert does,
+	// which must not claim another identity
+	rawCsr, _ := csr.GetRawCertificateSigningRequest()
+	if units := rawCsr.Subject.OrganizationalUnit; len(units) != 1 || units[0] != name {
+		http.Error(w, fmt.Sprintf("Organizational unit of subject must be %s", name), http.StatusBadRequest)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		http.Error(w, "Lock depot error", http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+	if depot.CheckCertificateSigningRequest(h.depot, name) || depot.CheckCertificateHost(h.depot, name) {
+		http.Error(w, fmt.Sprintf("Certificate of %s has existed", name), http.StatusConflict)
+		return
+	}
+	info, err := getAuthorityInfo(h.caName)
+	if err != nil {
+		http.Error(w, "Get CA certificate info error", http.StatusInternalServerError)
+		return
+	}
+	crt, err := pkix.CreateCertificateHostWithOptions(h.auth.crt, info, h.auth.key, csr, h.years, &pkix.CertificateHostOptions{Profile: profile, Policy: h.policy})
+	if err != nil {
+		http.Error(w, "Create certificate error: "+err.Error(), createCertificateErrorStatus(err))
+		return
+	}
+	is := &hostIssuance{name: name, caName: h.caName, profile: profile.Name, info: info, crt: crt, csr: csr}
+	if err = is.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		http.Error(w, "Save certificate error", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s Created %s/crt from %s/csr signed by %s/key for %s\n", time.Now().Format(time.RFC3339), name, name, authorityName(h.caName), client)
+
+	crtBytes, _ := crt.Export()
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(crtBytes)
+}
+
+func (h *signingHandler) serveCertificate(w http.ResponseWriter, name string) {
+	if !isValidHostName(name) || !depot.CheckCertificateHost(h.depot, name) {
+		http.Error(w, "Certificate not found", http.StatusNotFound)
+		return
+	}
+	crt, err := depot.GetCertificateHost(h.depot, name)
+	if err != nil {
+		http.Error(w, "Get certificate error", http.StatusInternalServerError)
+		return
+	}
+	crtBytes, _ := crt.Export()
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(crtBytes)
+}
+
+func (h *signingHandler) serveStatus(w http.ResponseWriter, name string) {
+	index, err := getCertificateIndex(h.depot)
+	if err != nil {
+		http.Error(w, "Get certificate index error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	selected := pkix.NewCertificateIndex()
+	for _, entry := range index.Entries {
+		if name != "" && entry.Name != name {
+			continue
+		}
+		entry.Status = entry.StatusAt(now)
+		selected.Entries = append(selected.Entries, entry)
+	}
+	b, err := selected.Export()
+	if err != nil {
+		http.Error(w, "Export certificate index error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Write(b)
+}
+
+// createCertificateErrorStatus returns HTTP status for error of creating certificate,
+// which is forbidden for policy violations
+func createCertificateErrorStatus(err error) int {
+	var policyErr *pkix.PolicyError
+	if errors.As(err, &policyErr) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// isValidHostName checks that name could be used in depot tags safely
+func isValidHostName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
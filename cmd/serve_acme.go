@@ -0,0 +1,1079 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/depot"
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+const (
+	// Requests larger than this are not ACME requests for sure
+	maxACMERequestSize = 64 * 1024
+	// How long until pending orders and authorizations expire
+	acmeOrderLifetime = 7 * 24 * time.Hour
+	// acmeOrigin marks certificates issued by ACME in index
+	acmeOrigin = "acme"
+)
+
+// errHostManaged refuses ACME orders for hosts that are not issued by ACME
+var errHostManaged = errors.New("host is managed in depot outside ACME")
+
+// Status of ACME objects defined in RFC 8555 section 7.1.6
+const (
+	acmeStatusPending     = "pending"
+	acmeStatusProcessing  = "processing"
+	acmeStatusReady       = "ready"
+	acmeStatusValid       = "valid"
+	acmeStatusInvalid     = "invalid"
+	acmeStatusDeactivated = "deactivated"
+	acmeStatusExpired     = "expired"
+)
+
+func NewServeACMECommand() cli.Command {
+	return cli.Command{
+		Name:        "serve-acme",
+		Usage:       "Serve ACME server",
+		Description: "Issue certificates signed by CA to ACME (RFC 8555) clients. Identifiers are validated by http-01 or dns-01 challenges, or accepted as they are with --trust-all. Accounts and orders are kept in memory, while issued certificates are saved in depot under the first identifier.",
+		Flags: []cli.Flag{
+			cli.StringFlag{"listen", ":14000", "Address to listen on", ""},
+			cli.StringFlag{"passphrase", "", "Passphrase to decrypt private-key PEM block of CA", ""},
+			cli.StringFlag{"ca", "", "Name of intermediate CA to sign with instead of CA", ""},
+			cli.StringFlag{"cert", "", "Name of host whose certificate and key are used to serve HTTPS, plain HTTP if unset", ""},
+			cli.StringFlag{"cert-passphrase", "", "Passphrase to decrypt private-key PEM block of the server host", ""},
+			cli.StringFlag{"profile", "server", "Profile of issued certificates (server, client, peer, ca or one in profile file)", ""},
+			cli.StringFlag{"profile-file", "", "YAML or JSON file of user-defined profiles", ""},
+			cli.StringFlag{"policy-file", "", "YAML or JSON file of issuance policy that certificates must comply with", ""},
+			cli.IntFlag{"days", 90, "How long until issued certificates expire", ""},
+			cli.IntFlag{"http-port", 80, "Port to connect to for http-01 validation", ""},
+			cli.StringFlag{"dns-resolver", "", "Address of DNS server for dns-01 validation, e.g. 10.0.0.2:53, the system resolver if unset", ""},
+			cli.BoolFlag{"trust-all", "Accept all challenges without validation, for test networks only", ""},
+		},
+		Action: newServeACMEAction,
+	}
+}
+
+func newServeACMEAction(c *cli.Context) {
+	if len(c.Args()) != 0 {
+		fmt.Fprintln(os.Stderr, "No argument is expected.")
+		os.Exit(1)
+	}
+
+	profile, err := getProfile(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	policy, err := getPolicy(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	caName := c.String("ca")
+	crt, _, key, err := getAuthority(c, "passphrase", caName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	s := newACMEServer(caName, &authority{crt, key}, profile)
+	s.policy = policy
+	s.validity = time.Duration(c.Int("days")) * 24 * time.Hour
+	s.httpPort = c.Int("http-port")
+	s.trustAll = c.Bool("trust-all")
+	if addr := c.String("dns-resolver"); addr != "" {
+		s.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}
+	}
+
+	server := &http.Server{Addr: c.String("listen"), Handler: s}
+	if name := c.String("cert"); name != "" {
+		if server.TLSConfig, err = newServerTLSConfig(c, name); err != nil {
+			fmt.Fprintln(os.Stderr, "Create TLS config error:", err)
+			os.Exit(1)
+		}
+		// ACME clients authenticate by signing requests instead
+		server.TLSConfig.ClientAuth = tls.NoClientCert
+	}
+	if s.trustAll {
+		fmt.Fprintln(os.Stderr, "All challenges are accepted without validation!")
+	}
+	fmt.Fprintf(os.Stderr, "Serving ACME for %s on %s\n", authorityName(caName), c.String("listen"))
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Serve ACME error:", err)
+		os.Exit(1)
+	}
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// acmeProblem is the error document defined in RFC 7807
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status,omitempty"`
+}
+
+func newACMEProblem(status int, typ string, format string, args ...interface{}) *acmeProblem {
+	return &acmeProblem{
+		Type:   "urn:ietf:params:acme:error:" + typ,
+		Detail: fmt.Sprintf(format, args...),
+		Status: status,
+	}
+}
+
+type acmeAccount struct {
+	id         string
+	key        crypto.PublicKey
+	thumbprint string
+	status     string
+	contact    []string
+	orderIDs   []string
+}
+
+type acmeOrder struct {
+	id          string
+	accountID   string
+	status      string
+	expires     time.Time
+	identifiers []acmeIdentifier
+	authzIDs    []string
+	// name is the host in depot, and chain is the certificate chain in PEM,
+	// which are set once the certificate is issued
+	name  string
+	chain []byte
+	err   *acmeProblem
+}
+
+type acmeAuthz struct {
+	id           string
+	accountID    string
+	identifier   acmeIdentifier
+	status       string
+	expires      time.Time
+	wildcard     bool
+	challengeIDs []string
+}
+
+type acmeChallenge struct {
+	id        string
+	authzID   string
+	typ       string
+	token     string
+	status    string
+	validated time.Time
+	err       *acmeProblem
+}
+
+// acmeServer serves ACME requests. Objects are kept in memory, and their URLs
+// are built from the host of each request.
+type acmeServer struct {
+	caName   string
+	auth     *authority
+	profile  *pkix.Profile
+	policy   *pkix.Policy
+	validity time.Duration
+	httpPort int
+	resolver *net.Resolver
+	trustAll bool
+
+	mu          sync.Mutex
+	nonces      map[string]bool
+	accounts    map[string]*acmeAccount
+	accountKeys map[string]*acmeAccount
+	orders      map[string]*acmeOrder
+	authzs      map[string]*acmeAuthz
+	challenges  map[string]*acmeChallenge
+}
+
+func newACMEServer(caName string, auth *authority, profile *pkix.Profile) *acmeServer {
+	return &acmeServer{
+		caName:      caName,
+		auth:        auth,
+		profile:     profile,
+		httpPort:    80,
+		resolver:    net.DefaultResolver,
+		nonces:      make(map[string]bool),
+		accounts:    make(map[string]*acmeAccount),
+		accountKeys: make(map[string]*acmeAccount),
+		orders:      make(map[string]*acmeOrder),
+		authzs:      make(map[string]*acmeAuthz),
+		challenges:  make(map[string]*acmeChallenge),
+	}
+}
+
+// acmeRequest is the verified POST request
+type acmeRequest struct {
+	base    string
+	path    string
+	payload []byte
+	// account is nil if the request is signed by jwk
+	account    *acmeAccount
+	key        crypto.PublicKey
+	thumbprint string
+}
+
+// isPostAsGet checks whether the request fetches resource without changing it
+func (req *acmeRequest) isPostAsGet() bool {
+	return len(req.payload) == 0
+}
+
+func (s *acmeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	base := "http://" + r.Host
+	if r.TLS != nil {
+		base = "https://" + r.Host
+	}
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Link", fmt.Sprintf("<%s/directory>;rel=\"index\"", base))
+
+	switch {
+	case r.URL.Path == "/directory" && r.Method == "GET":
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"newNonce":   base + "/new-nonce",
+			"newAccount": base + "/new-account",
+			"newOrder":   base + "/new-order",
+			"revokeCert": base + "/revoke-cert",
+			"keyChange":  base + "/key-change",
+			"meta":       map[string]interface{}{},
+		})
+	case r.URL.Path == "/new-nonce" && (r.Method == "GET" || r.Method == "HEAD"):
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == "GET" {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case r.Method == "POST":
+		req, prob := s.verifyRequest(r, base)
+		if prob != nil {
+			s.writeProblem(w, prob)
+			return
+		}
+		s.servePost(w, req)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *acmeServer) servePost(w http.ResponseWriter, req *acmeRequest) {
+	id := req.path[strings.LastIndex(req.path, "/")+1:]
+	switch {
+	case req.path == "/new-account":
+		s.serveNewAccount(w, req)
+	case req.path == "/new-order":
+		s.serveNewOrder(w, req)
+	case req.path == "/revoke-cert":
+		s.serveRevokeCertificate(w, req)
+	case strings.HasPrefix(req.path, "/account/"):
+		s.serveAccount(w, req, id)
+	case strings.HasPrefix(req.path, "/orders/"):
+		s.serveOrderList(w, req, id)
+	case strings.HasPrefix(req.path, "/order/"):
+		s.serveOrder(w, req, id)
+	case strings.HasPrefix(req.path, "/authz/"):
+		s.serveAuthz(w, req, id)
+	case strings.HasPrefix(req.path, "/challenge/"):
+		s.serveChallenge(w, req, id)
+	case strings.HasPrefix(req.path, "/finalize/"):
+		s.serveFinalize(w, req, id)
+	case strings.HasPrefix(req.path, "/cert/"):
+		s.serveCertificate(w, req, id)
+	default:
+		s.writeProblem(w, newACMEProblem(http.StatusNotFound, "malformed", "%s not found", req.path))
+	}
+}
+
+// verifyRequest checks JWS, URL and nonce of POST request, and finds the account signing it
+func (s *acmeServer) verifyRequest(r *http.Request, base string) (*acmeRequest, *acmeProblem) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxACMERequestSize))
+	if err != nil {
+		return nil, newACMEProblem(http.StatusBadRequest, "malformed", "read request error: %v", err)
+	}
+	msg, header, payload, err := parseJWS(body)
+	if err != nil {
+		return nil, newACMEProblem(http.StatusBadRequest, "malformed", "%v", err)
+	}
+	if header.URL != base+r.URL.Path {
+		return nil, newACMEProblem(http.StatusUnauthorized, "unauthorized", "url %s in header does not match request", header.URL)
+	}
+	if !s.useNonce(header.Nonce) {
+		return nil, newACMEProblem(http.StatusBadRequest, "badNonce", "invalid nonce")
+	}
+
+	req := &acmeRequest{base: base, path: r.URL.Path, payload: payload}
+	switch {
+	case len(header.JWK) != 0 && header.KID == "":
+		if req.path != "/new-account" && req.path != "/revoke-cert" {
+			return nil, newACMEProblem(http.StatusBadRequest, "malformed", "kid is required")
+		}
+		if req.key, req.thumbprint, err = parseJWK(header.JWK); err != nil {
+			return nil, newACMEProblem(http.StatusBadRequest, "badPublicKey", "%v", err)
+		}
+	case len(header.JWK) == 0 && strings.HasPrefix(header.KID, base+"/account/"):
+		if req.path == "/new-account" {
+			return nil, newACMEProblem(http.StatusBadRequest, "malformed", "jwk is required")
+		}
+		s.mu.Lock()
+		req.account = s.accounts[strings.TrimPrefix(header.KID, base+"/account/")]
+		var status string
+		if req.account != nil {
+			status = req.account.status
+		}
+		s.mu.Unlock()
+		if req.account == nil {
+			return nil, newACMEProblem(http.StatusBadRequest, "accountDoesNotExist", "account %s does not exist", header.KID)
+		}
+		if status != acmeStatusValid {
+			return nil, newACMEProblem(http.StatusUnauthorized, "unauthorized", "account is %s", status)
+		}
+		req.key, req.thumbprint = req.account.key, req.account.thumbprint
+	default:
+		return nil, newACMEProblem(http.StatusBadRequest, "malformed", "either jwk or kid is required")
+	}
+	if err = msg.verify(header.Alg, req.key); err != nil {
+		if strings.HasPrefix(err.Error(), "unsupported") {
+			return nil, newACMEProblem(http.StatusBadRequest, "badSignatureAlgorithm", "%v", err)
+		}
+		return nil, newACMEProblem(http.StatusUnauthorized, "unauthorized", "verify signature error: %v", err)
+	}
+	return req, nil
+}
+
+func (s *acmeServer) serveNewAccount(w http.ResponseWriter, req *acmeRequest) {
+	var payload struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", "invalid payload: %v", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := http.StatusOK
+	account := s.accountKeys[req.thumbprint]
+	if account == nil {
+		if payload.OnlyReturnExisting {
+			s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "accountDoesNotExist", "account does not exist"))
+			return
+		}
+		account = &acmeAccount{
+			id:         newACMEID(),
+			key:        req.key,
+			thumbprint: req.thumbprint,
+			status:     acmeStatusValid,
+			contact:    payload.Contact,
+		}
+		s.accounts[account.id] = account
+		s.accountKeys[account.thumbprint] = account
+		status = http.StatusCreated
+	}
+	w.Header().Set("Location", req.base+"/account/"+account.id)
+	s.writeJSON(w, status, s.accountObject(req.base, account))
+}
+
+func (s *acmeServer) serveAccount(w http.ResponseWriter, req *acmeRequest, id string) {
+	if req.account == nil || req.account.id != id {
+		s.writeProblem(w, newACMEProblem(http.StatusUnauthorized, "unauthorized", "account does not match kid"))
+		return
+	}
+	var payload struct {
+		Contact []string `json:"contact"`
+		Status  string   `json:"status"`
+	}
+	if !req.isPostAsGet() {
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", "invalid payload: %v", err))
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if payload.Contact != nil {
+		req.account.contact = payload.Contact
+	}
+	if payload.Status == acmeStatusDeactivated {
+		req.account.status = acmeStatusDeactivated
+	}
+	s.writeJSON(w, http.StatusOK, s.accountObject(req.base, req.account))
+}
+
+func (s *acmeServer) serveOrderList(w http.ResponseWriter, req *acmeRequest, id string) {
+	if req.account == nil || req.account.id != id {
+		s.writeProblem(w, newACMEProblem(http.StatusUnauthorized, "unauthorized", "account does not match kid"))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	urls := make([]string, 0, len(req.account.orderIDs))
+	for _, orderID := range req.account.orderIDs {
+		urls = append(urls, req.base+"/order/"+orderID)
+	}
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{"orders": urls})
+}
+
+func (s *acmeServer) serveNewOrder(w http.ResponseWriter, req *acmeRequest) {
+	if req.account == nil {
+		s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", "kid is required"))
+		return
+	}
+	var payload struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", "invalid payload: %v", err))
+		return
+	}
+	if len(payload.Identifiers) == 0 {
+		s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", "no identifier"))
+		return
+	}
+	for _, ident := range payload.Identifiers {
+		if prob := checkACMEIdentifier(ident); prob != nil {
+			s.writeProblem(w, prob)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := &acmeOrder{
+		id:          newACMEID(),
+		accountID:   req.account.id,
+		status:      acmeStatusPending,
+		expires:     time.Now().Add(acmeOrderLifetime).UTC(),
+		identifiers: payload.Identifiers,
+	}
+	for _, ident := range payload.Identifiers {
+		authz := s.newAuthz(req.account, ident, order.expires)
+		order.authzIDs = append(order.authzIDs, authz.id)
+	}
+	s.orders[order.id] = order
+	req.account.orderIDs = append(req.account.orderIDs, order.id)
+
+	w.Header().Set("Location", req.base+"/order/"+order.id)
+	s.writeJSON(w, http.StatusCreated, s.orderObject(req.base, order))
+}
+
+// checkACMEIdentifier checks that identifier could be put into certificate
+func checkACMEIdentifier(ident acmeIdentifier) *acmeProblem {
+	switch ident.Type {
+	case "dns":
+		name := strings.TrimPrefix(ident.Value, "*.")
+		if name == "" || strings.Contains(name, "*") || net.ParseIP(name) != nil || !isValidHostName(name) {
+			return newACMEProblem(http.StatusBadRequest, "rejectedIdentifier", "invalid domain name %s", ident.Value)
+		}
+	case "ip":
+		if net.ParseIP(ident.Value) == nil {
+			return newACMEProblem(http.StatusBadRequest, "rejectedIdentifier", "invalid IP address %s", ident.Value)
+		}
+	default:
+		return newACMEProblem(http.StatusBadRequest, "unsupportedIdentifier", "unsupported identifier type %s", ident.Type)
+	}
+	return nil
+}
+
+// newAuthz creates authorization of identifier with challenges that could validate it.
+// It should be called with mu held.
+func (s *acmeServer) newAuthz(account *acmeAccount, ident acmeIdentifier, expires time.Time) *acmeAuthz {
+	authz := &acmeAuthz{
+		id:         newACMEID(),
+		accountID:  account.id,
+		identifier: ident,
+		status:     acmeStatusPending,
+		expires:    expires,
+	}
+	// Wildcard could only be validated by dns-01, and IP address by http-01
+	types := []string{"http-01", "dns-01"}
+	if strings.HasPrefix(ident.Value, "*.") {
+		authz.identifier.Value = strings.TrimPrefix(ident.Value, "*.")
+		authz.wildcard = true
+		types = []string{"dns-01"}
+	} else if ident.Type == "ip" {
+		types = []string{"http-01"}
+	}
+	for _, typ := range types {
+		chal := &acmeChallenge{
+			id:      newACMEID(),
+			authzID: authz.id,
+			typ:     typ,
+			token:   newACMEID(),
+			status:  acmeStatusPending,
+		}
+		s.challenges[chal.id] = chal
+		authz.challengeIDs = append(authz.challengeIDs, chal.id)
+	}
+	s.authzs[authz.id] = authz
+	return authz
+}
+
+func (s *acmeServer) serveOrder(w http.ResponseWriter, req *acmeRequest, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := s.orders[id]
+	if order == nil || req.account == nil || order.accountID != req.account.id {
+		s.writeProblem(w, newACMEProblem(http.StatusNotFound, "malformed", "order %s not found", id))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, s.orderObject(req.base, order))
+}
+
+func (s *acmeServer) serveAuthz(w http.ResponseWriter, req *acmeRequest, id string) {
+	var payload struct {
+		Status string `json:"status"`
+	}
+	if !req.isPostAsGet() {
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", "invalid payload: %v", err))
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	authz := s.authzs[id]
+	if authz == nil || req.account == nil || authz.accountID != req.account.id {
+		s.writeProblem(w, newACMEProblem(http.StatusNotFound, "malformed", "authorization %s not found", id))
+		return
+	}
+	if payload.Status == acmeStatusDeactivated {
+		authz.status = acmeStatusDeactivated
+	}
+	s.writeJSON(w, http.StatusOK, s.authzObject(req.base, authz))
+}
+
+func (s *acmeServer) serveChallenge(w http.ResponseWriter, req *acmeRequest, id string) {
+	s.mu.Lock()
+	chal := s.challenges[id]
+	var authz *acmeAuthz
+	if chal != nil {
+		authz = s.authzs[chal.authzID]
+	}
+	if authz == nil || req.account == nil || authz.accountID != req.account.id {
+		s.mu.Unlock()
+		s.writeProblem(w, newACMEProblem(http.StatusNotFound, "malformed", "challenge %s not found", id))
+		return
+	}
+	// Client responds to challenge by posting an empty object
+	respond := !req.isPostAsGet() && chal.status == acmeStatusPending && s.authzStatus(authz) == acmeStatusPending
+	if respond {
+		chal.status = acmeStatusProcessing
+	}
+	s.mu.Unlock()
+
+	if respond {
+		// Validation may take a while, so other requests are not blocked by it
+		prob := s.validate(chal, authz.identifier, req.thumbprint)
+
+		s.mu.Lock()
+		if prob == nil {
+			chal.status = acmeStatusValid
+			chal.validated = time.Now().UTC()
+			authz.status = acmeStatusValid
+		} else {
+			chal.status = acmeStatusInvalid
+			chal.err = prob
+			authz.status = acmeStatusInvalid
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Link", fmt.Sprintf("<%s/authz/%s>;rel=\"up\"", req.base, authz.id))
+	s.writeJSON(w, http.StatusOK, s.challengeObject(req.base, chal))
+}
+
+// validate checks that key authorization of account with thumbprint is provisioned
+// for identifier as challenge requires
+func (s *acmeServer) validate(chal *acmeChallenge, ident acmeIdentifier, thumbprint string) *acmeProblem {
+	if s.trustAll {
+		return nil
+	}
+	keyAuth := chal.token + "." + thumbprint
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	switch chal.typ {
+	case "http-01":
+		url := fmt.Sprintf("http://%s/.well-known/acme-challenge/%s", net.JoinHostPort(ident.Value, strconv.Itoa(s.httpPort)), chal.token)
+		httpReq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return newACMEProblem(http.StatusBadRequest, "malformed", "%v", err)
+		}
+		resp, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			return newACMEProblem(http.StatusBadRequest, "connection", "fetch %s error: %v", url, err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return newACMEProblem(http.StatusBadRequest, "incorrectResponse", "fetch %s error: status %d", url, resp.StatusCode)
+		}
+		if strings.TrimSpace(string(body)) != keyAuth {
+			return newACMEProblem(http.StatusBadRequest, "incorrectResponse", "unexpected key authorization from %s", url)
+		}
+	case "dns-01":
+		name := "_acme-challenge." + ident.Value
+		records, err := s.resolver.LookupTXT(ctx, name)
+		if err != nil {
+			return newACMEProblem(http.StatusBadRequest, "dns", "lookup TXT records of %s error: %v", name, err)
+		}
+		sum := sha256.Sum256([]byte(keyAuth))
+		digest := base64.RawURLEncoding.EncodeToString(sum[:])
+		for _, record := range records {
+			if record == digest {
+				return nil
+			}
+		}
+		return newACMEProblem(http.StatusBadRequest, "incorrectResponse", "no TXT record of %s matches key authorization", name)
+	default:
+		return newACMEProblem(http.StatusBadRequest, "malformed", "unsupported challenge %s", chal.typ)
+	}
+	return nil
+}
+
+func (s *acmeServer) serveFinalize(w http.ResponseWriter, req *acmeRequest, id string) {
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", "invalid payload: %v", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := s.orders[id]
+	if order == nil || req.account == nil || order.accountID != req.account.id {
+		s.writeProblem(w, newACMEProblem(http.StatusNotFound, "malformed", "order %s not found", id))
+		return
+	}
+	if status := s.orderStatus(order); status != acmeStatusReady {
+		s.writeProblem(w, newACMEProblem(http.StatusForbidden, "orderNotReady", "order is %s", status))
+		return
+	}
+
+	csrBytes, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "badCSR", "invalid CSR encoding: %v", err))
+		return
+	}
+	csr := pkix.NewCertificateSigningRequestFromDER(csrBytes)
+	if err = csr.CheckSignature(); err != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "badCSR", "invalid CSR: %v", err))
+		return
+	}
+	rawCsr, _ := csr.GetRawCertificateSigningRequest()
+	if !equalStringSets(csrIdentifiers(rawCsr), orderIdentifiers(order)) {
+		s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "badCSR", "identifiers in CSR do not match order"))
+		return
+	}
+
+	name := acmeHostName(order.identifiers[0].Value)
+	crt, err := s.issue(name, csr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		order.status = acmeStatusInvalid
+		var policyErr *pkix.PolicyError
+		if errors.As(err, &policyErr) {
+			order.err = newACMEProblem(http.StatusForbidden, "rejectedIdentifier", "%v", policyErr)
+		} else if errors.Is(err, errHostManaged) {
+			order.err = newACMEProblem(http.StatusForbidden, "rejectedIdentifier", "%v", err)
+		} else {
+			order.err = newACMEProblem(http.StatusInternalServerError, "serverInternal", "%v", err)
+		}
+		s.writeProblem(w, order.err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s Created %s/crt signed by %s/key for ACME order %s\n", time.Now().Format(time.RFC3339), name, authorityName(s.caName), order.id)
+
+	var chain bytes.Buffer
+	b, _ := crt.Export()
+	chain.Write(b)
+	if crtAuths, err := getAuthorityChain(s.caName); err == nil {
+		// Root CA is not sent, as clients should trust it already
+		for _, crtAuth := range crtAuths[:len(crtAuths)-1] {
+			b, _ = crtAuth.Export()
+			chain.Write(b)
+		}
+	}
+	order.name = name
+	order.chain = chain.Bytes()
+	order.status = acmeStatusValid
+
+	w.Header().Set("Location", req.base+"/order/"+order.id)
+	s.writeJSON(w, http.StatusOK, s.orderObject(req.base, order))
+}
+
+// issue signs csr and saves it with the certificate as host name.
+// Certificate issued to ACME clients before is archived.
+func (s *acmeServer) issue(name string, csr *pkix.CertificateSigningRequest) (*pkix.Certificate, error) {
+	unlock, err := lockDepot()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	crtOld, err := getACMECertificateHost(name)
+	if err != nil {
+		return nil, err
+	}
+	csrOld, err := getOldCertificateSigningRequest(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := getAuthorityInfo(s.caName)
+	if err != nil {
+		return nil, fmt.Errorf("Get CA certificate info error: %w", err)
+	}
+	opts := &pkix.CertificateHostOptions{Validity: s.validity, Profile: s.profile, Policy: s.policy}
+	crt, err := pkix.CreateCertificateHostWithOptions(s.auth.crt, info, s.auth.key, csr, 0, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Create certificate error: %w", err)
+	}
+
+	is := &hostIssuance{name: name, caName: s.caName, origin: acmeOrigin, info: info, crt: crt, crtOld: crtOld, csr: csr, csrOld: csrOld}
+	if s.profile != nil {
+		is.profile = s.profile.Name
+	}
+	if err = is.save(); err != nil {
+		return nil, err
+	}
+	return crt, nil
+}
+
+// getACMECertificateHost returns the certificate of host issued by ACME
+// before, or nil if host is new. Hosts created or signed by other means
+// are refused, so that ACME clients cannot replace them.
+func getACMECertificateHost(name string) (*pkix.Certificate, error) {
+	if depot.CheckPrivateKeyHost(d, name) {
+		return nil, fmt.Errorf("host %s: %w", name, errHostManaged)
+	}
+	if !depot.CheckCertificateHost(d, name) {
+		return nil, nil
+	}
+	crt, err := depot.GetCertificateHost(d, name)
+	if err != nil {
+		return nil, fmt.Errorf("Get certificate error: %w", err)
+	}
+	caName, err := getIssuerName(crt)
+	if err != nil {
+		return nil, fmt.Errorf("host %s: %w", name, errHostManaged)
+	}
+	if entry := getIndexEntry(caName, crt); entry == nil || entry.Origin != acmeOrigin {
+		return nil, fmt.Errorf("host %s: %w", name, errHostManaged)
+	}
+	return crt, nil
+}
+
+func (s *acmeServer) serveCertificate(w http.ResponseWriter, req *acmeRequest, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := s.orders[id]
+	if order == nil || req.account == nil || order.accountID != req.account.id || order.chain == nil {
+		s.writeProblem(w, newACMEProblem(http.StatusNotFound, "malformed", "certificate %s not found", id))
+		return
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(order.chain)
+}
+
+// serveRevokeCertificate revokes certificate signed by account that ordered it,
+// or by the key of certificate itself
+func (s *acmeServer) serveRevokeCertificate(w http.ResponseWriter, req *acmeRequest) {
+	var payload struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", "invalid payload: %v", err))
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.Certificate)
+	if err != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", "invalid certificate encoding: %v", err))
+		return
+	}
+	crt := pkix.NewCertificateFromDER(der)
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", "invalid certificate: %v", err))
+		return
+	}
+	if _, err = pkix.ParseRevocationReason(pkix.RevocationReasonName(payload.Reason)); err != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "badRevocationReason", "invalid revocation reason %d", payload.Reason))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := lockDepot()
+	if err != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusInternalServerError, "serverInternal", "%v", err))
+		return
+	}
+	defer unlock()
+	caName, err := getIssuerName(crt)
+	var entry *pkix.IndexEntry
+	index, indexErr := getCertificateIndex(d)
+	if err == nil && indexErr == nil {
+		entry = index.Get(caName, rawCrt.SerialNumber)
+	}
+	if entry == nil {
+		s.writeProblem(w, newACMEProblem(http.StatusNotFound, "malformed", "certificate is not issued by CA"))
+		return
+	}
+	if !s.canRevoke(req, entry.Name, rawCrt) {
+		s.writeProblem(w, newACMEProblem(http.StatusForbidden, "unauthorized", "not allowed to revoke certificate"))
+		return
+	}
+
+	records, err := getRevocationRecords(caName)
+	if err != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusInternalServerError, "serverInternal", "%v", err))
+		return
+	}
+	if records.Get(rawCrt.SerialNumber) != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusBadRequest, "alreadyRevoked", "certificate has been revoked"))
+		return
+	}
+	now := time.Now()
+	if err = records.Revoke(entry.Name, rawCrt.SerialNumber, payload.Reason, now); err != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusInternalServerError, "serverInternal", "revoke certificate error: %v", err))
+		return
+	}
+	// Entry was found in index, so it is marked revoked there as well
+	index.Revoke(caName, rawCrt.SerialNumber, payload.Reason, now)
+	if err = saveRevocation(caName, records, index); err != nil {
+		s.writeProblem(w, newACMEProblem(http.StatusInternalServerError, "serverInternal", "%v", err))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s Revoked %s/crt (serial %v) issued by %s/key: %s\n", now.Format(time.RFC3339), entry.Name, rawCrt.SerialNumber, authorityName(caName), pkix.RevocationReasonName(payload.Reason))
+	w.WriteHeader(http.StatusOK)
+}
+
+// canRevoke checks whether request is signed by the key of rawCrt,
+// or by the account whose order issued it. It should be called with mu held.
+func (s *acmeServer) canRevoke(req *acmeRequest, name string, rawCrt *x509.Certificate) bool {
+	if req.account == nil {
+		keyBytes, err1 := x509.MarshalPKIXPublicKey(req.key)
+		crtKeyBytes, err2 := x509.MarshalPKIXPublicKey(rawCrt.PublicKey)
+		return err1 == nil && err2 == nil && bytes.Equal(keyBytes, crtKeyBytes)
+	}
+	for _, orderID := range req.account.orderIDs {
+		if order := s.orders[orderID]; order != nil && order.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// authzStatus returns the current status of authorization. It should be called with mu held.
+func (s *acmeServer) authzStatus(authz *acmeAuthz) string {
+	if authz.status == acmeStatusPending && time.Now().After(authz.expires) {
+		return acmeStatusExpired
+	}
+	return authz.status
+}
+
+// orderStatus returns the current status of order according to its authorizations.
+// It should be called with mu held.
+func (s *acmeServer) orderStatus(order *acmeOrder) string {
+	if order.status != acmeStatusPending {
+		return order.status
+	}
+	if time.Now().After(order.expires) {
+		return acmeStatusInvalid
+	}
+	status := acmeStatusReady
+	for _, id := range order.authzIDs {
+		switch s.authzStatus(s.authzs[id]) {
+		case acmeStatusValid:
+		case acmeStatusPending:
+			status = acmeStatusPending
+		default:
+			return acmeStatusInvalid
+		}
+	}
+	return status
+}
+
+func (s *acmeServer) accountObject(base string, account *acmeAccount) interface{} {
+	return map[string]interface{}{
+		"status":  account.status,
+		"contact": account.contact,
+		"orders":  base + "/orders/" + account.id,
+	}
+}
+
+func (s *acmeServer) orderObject(base string, order *acmeOrder) interface{} {
+	authzURLs := make([]string, 0, len(order.authzIDs))
+	for _, id := range order.authzIDs {
+		authzURLs = append(authzURLs, base+"/authz/"+id)
+	}
+	obj := map[string]interface{}{
+		"status":         s.orderStatus(order),
+		"expires":        order.expires.Format(time.RFC3339),
+		"identifiers":    order.identifiers,
+		"authorizations": authzURLs,
+		"finalize":       base + "/finalize/" + order.id,
+	}
+	if order.chain != nil {
+		obj["certificate"] = base + "/cert/" + order.id
+	}
+	if order.err != nil {
+		obj["error"] = order.err
+	}
+	return obj
+}
+
+func (s *acmeServer) authzObject(base string, authz *acmeAuthz) interface{} {
+	challenges := make([]interface{}, 0, len(authz.challengeIDs))
+	for _, id := range authz.challengeIDs {
+		challenges = append(challenges, s.challengeObject(base, s.challenges[id]))
+	}
+	obj := map[string]interface{}{
+		"status":     s.authzStatus(authz),
+		"expires":    authz.expires.Format(time.RFC3339),
+		"identifier": authz.identifier,
+		"challenges": challenges,
+	}
+	if authz.wildcard {
+		obj["wildcard"] = true
+	}
+	return obj
+}
+
+func (s *acmeServer) challengeObject(base string, chal *acmeChallenge) interface{} {
+	obj := map[string]interface{}{
+		"type":   chal.typ,
+		"url":    base + "/challenge/" + chal.id,
+		"token":  chal.token,
+		"status": chal.status,
+	}
+	if !chal.validated.IsZero() {
+		obj["validated"] = chal.validated.Format(time.RFC3339)
+	}
+	if chal.err != nil {
+		obj["error"] = chal.err
+	}
+	return obj
+}
+
+func (s *acmeServer) writeJSON(w http.ResponseWriter, status int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func (s *acmeServer) writeProblem(w http.ResponseWriter, prob *acmeProblem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(prob.Status)
+	json.NewEncoder(w).Encode(prob)
+}
+
+// newNonce issues nonce for the next request. Old nonces are dropped
+// when there are too many, so clients would retry with new ones.
+func (s *acmeServer) newNonce() string {
+	nonce := newACMEID()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.nonces) >= 10000 {
+		s.nonces = make(map[string]bool)
+	}
+	s.nonces[nonce] = true
+	return nonce
+}
+
+func (s *acmeServer) useNonce(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.nonces[nonce] {
+		return false
+	}
+	delete(s.nonces, nonce)
+	return true
+}
+
+// newACMEID returns random string used as ID, token or nonce
+func newACMEID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// csrIdentifiers returns domains and IP addresses in csr
+func csrIdentifiers(csr *x509.CertificateRequest) []string {
+	idents := append([]string{}, csr.DNSNames...)
+	for _, ip := range csr.IPAddresses {
+		idents = append(idents, ip.String())
+	}
+	return idents
+}
+
+// orderIdentifiers returns identifier values of order in the form used by csrIdentifiers
+func orderIdentifiers(order *acmeOrder) []string {
+	idents := make([]string, 0, len(order.identifiers))
+	for _, ident := range order.identifiers {
+		if ident.Type == "ip" {
+			idents = append(idents, net.ParseIP(ident.Value).String())
+		} else {
+			idents = append(idents, ident.Value)
+		}
+	}
+	return idents
+}
+
+// acmeHostName returns the name in depot of certificate for identifier value
+func acmeHostName(value string) string {
+	return strings.NewReplacer("*", "_", ":", "_").Replace(value)
+}
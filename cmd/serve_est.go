@@ -0,0 +1,364 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/depot"
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+const estPathPrefix = "/.well-known/est/"
+
+func NewServeESTCommand() cli.Command {
+	return cli.Command{
+		Name:        "serve-est",
+		Usage:       "Serve EST enrollment over HTTPS",
+		Description: "Serve cacerts, simpleenroll and simplereenroll of EST (RFC 7030). Enrollment is authenticated by HTTP basic auth of --user or certificate issued by CA, and re-enrollment by the current certificate of client.",
+		Flags: []cli.Flag{
+			cli.StringFlag{"listen", ":8444", "Address to listen on", ""},
+			cli.StringFlag{"passphrase", "", "Passphrase to decrypt private-key PEM block of CA", ""},
+			cli.StringFlag{"ca", "", "Name of intermediate CA to sign with instead of CA", ""},
+			cli.StringFlag{"cert", "", "Name of host whose certificate and key are used by the server", ""},
+			cli.StringFlag{"cert-passphrase", "", "Passphrase to decrypt private-key PEM block of the server host", ""},
+			cli.StringSliceFlag{"user", &cli.StringSlice{}, "User allowed to enroll by HTTP basic auth in the form of name:password", ""},
+			cli.StringFlag{"profile", "", "Profile of enrolled certificates (server, client, peer, ca or one in profile file), both server and client if unset", ""},
+			cli.StringFlag{"profile-file", "", "YAML or JSON file of user-defined profiles", ""},
+			cli.StringFlag{"policy-file", "", "YAML or JSON file of issuance policy that certificates must comply with", ""},
+			cli.IntFlag{"years", 10, "How long until enrolled certificates expire if profile does not set days", ""},
+		},
+		Action: newServeESTAction,
+	}
+}
+
+func newServeESTAction(c *cli.Context) {
+	if len(c.Args()) != 0 {
+		fmt.Fprintln(os.Stderr, "No argument is expected.")
+		os.Exit(1)
+	}
+	if c.String("cert") == "" {
+		fmt.Fprintln(os.Stderr, "Name of server host must be provided by --cert.")
+		os.Exit(1)
+	}
+
+	users := make(map[string]string)
+	for _, user := range c.StringSlice("user") {
+		i := strings.Index(user, ":")
+		if i <= 0 {
+			fmt.Fprintf(os.Stderr, "User %q is not in the form of name:password.\n", user)
+			os.Exit(1)
+		}
+		users[user[:i]] = user[i+1:]
+	}
+	profile, err := getProfile(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	policy, err := getPolicy(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	caName := c.String("ca")
+	crt, _, key, err := getAuthority(c, "passphrase", caName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	tlsConfig, err := newServerTLSConfig(c, c.String("cert"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Create TLS config error:", err)
+		os.Exit(1)
+	}
+	// Devices without certificate could enroll by HTTP basic auth
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+
+	h := &estHandler{
+		caName:  caName,
+		auth:    &authority{crt, key},
+		users:   users,
+		profile: profile,
+		policy:  policy,
+		years:   c.Int("years"),
+	}
+	server := &http.Server{
+		Addr:      c.String("listen"),
+		Handler:   h,
+		TLSConfig: tlsConfig,
+	}
+	fmt.Fprintf(os.Stderr, "Serving EST for %s on %s\n", authorityName(caName), c.String("listen"))
+	if err = server.ListenAndServeTLS("", ""); err != nil {
+		fmt.Fprintln(os.Stderr, "Serve EST error:", err)
+		os.Exit(1)
+	}
+}
+
+// estHandler serves EST requests. Certificates are named by the organizational
+// unit of subject in depot as new-cert does, or common name if it is missing.
+type estHandler struct {
+	caName  string
+	auth    *authority
+	users   map[string]string
+	profile *pkix.Profile
+	policy  *pkix.Policy
+	years   int
+	// mu serializes enrollment, which updates CA info and index
+	mu sync.Mutex
+}
+
+func (h *estHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == estPathPrefix+"cacerts" && r.Method == "GET":
+		h.serveCACerts(w)
+	case r.URL.Path == estPathPrefix+"simpleenroll" && r.Method == "POST":
+		h.serveEnroll(w, r)
+	case r.URL.Path == estPathPrefix+"simplereenroll" && r.Method == "POST":
+		h.serveReenroll(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *estHandler) serveCACerts(w http.ResponseWriter) {
+	chain, err := getAuthorityChain(h.caName)
+	if err != nil {
+		http.Error(w, "Get CA certificate error", http.StatusInternalServerError)
+		return
+	}
+	h.writeCertificates(w, chain)
+}
+
+func (h *estHandler) serveEnroll(w http.ResponseWriter, r *http.Request) {
+	client, ok := h.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="etcd-ca"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	csr, rawCsr, err := readESTCertificateSigningRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := estHostName(rawCsr.Subject.OrganizationalUnit, rawCsr.Subject.CommonName)
+	if !isValidHostName(name) {
+		http.Error(w, "Invalid host name in subject", http.StatusBadRequest)
+		return
+	}
+	// Organizational unit of the certificate must not claim another identity
+	if len(rawCsr.Subject.OrganizationalUnit) > 1 {
+		http.Error(w, "Subject must have at most one organizational unit", http.StatusBadRequest)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		http.Error(w, "Lock depot error", http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+	// Keys of hosts created by new-cert never leave depot, so they could not enroll
+	if depot.CheckPrivateKeyHost(d, name) || depot.CheckCertificateHost(d, name) {
+		http.Error(w, fmt.Sprintf("Certificate of %s has existed, and simplereenroll should be used", name), http.StatusConflict)
+		return
+	}
+	// Certificate request left without certificate is replaced
+	csrOld, err := getOldCertificateSigningRequest(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info, err := getAuthorityInfo(h.caName)
+	if err != nil {
+		http.Error(w, "Get CA certificate info error", http.StatusInternalServerError)
+		return
+	}
+	crt, err := pkix.CreateCertificateHostWithOptions(h.auth.crt, info, h.auth.key, csr, h.years, &pkix.CertificateHostOptions{Profile: h.profile, Policy: h.policy})
+	if err != nil {
+		http.Error(w, "Create certificate error: "+err.Error(), createCertificateErrorStatus(err))
+		return
+	}
+	profileName := ""
+	if h.profile != nil {
+		profileName = h.profile.Name
+	}
+	is := &hostIssuance{name: name, caName: h.caName, profile: profileName, info: info, crt: crt, csr: csr, csrOld: csrOld}
+	if err = is.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		http.Error(w, "Save certificate error", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s Created %s/crt from %s/csr signed by %s/key for %s\n", time.Now().Format(time.RFC3339), name, name, authorityName(h.caName), client)
+	h.writeCertificates(w, []*pkix.Certificate{crt})
+}
+
+// serveReenroll renews the certificate presented by client in the same way as renew.
+// The subject and SANs of certificate request must be the same as the current certificate.
+func (h *estHandler) serveReenroll(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "Client certificate is required", http.StatusUnauthorized)
+		return
+	}
+	crtOld := pkix.NewCertificateFromDER(r.TLS.PeerCertificates[0].Raw)
+	rawCrtOld, _ := crtOld.GetRawCertificate()
+	csr, rawCsr, err := readESTCertificateSigningRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !bytes.Equal(rawCsr.RawSubject, rawCrtOld.RawSubject) ||
+		!equalStringSets(rawCsr.DNSNames, rawCrtOld.DNSNames) ||
+		!equalStringSets(csrIdentifiers(rawCsr), csrIdentifiers(&x509.CertificateRequest{DNSNames: rawCrtOld.DNSNames, IPAddresses: rawCrtOld.IPAddresses})) {
+		http.Error(w, "Subject and SANs must be the same as the current certificate", http.StatusBadRequest)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		http.Error(w, "Lock depot error", http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+	caName, err := getIssuerName(crtOld)
+	if err != nil || getRevokedCertificate(crtOld) != nil {
+		http.Error(w, "Client certificate is revoked or not issued by CA", http.StatusForbidden)
+		return
+	}
+	name, err := getCertificateHostName(crtOld)
+	if err != nil {
+		http.Error(w, "Client certificate is unknown: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if !isCurrentCertificateHost(name, rawCrtOld) {
+		http.Error(w, "Client certificate is not the current certificate of "+name, http.StatusForbidden)
+		return
+	}
+	if caName != h.caName {
+		http.Error(w, "Client certificate is issued by "+authorityName(caName), http.StatusForbidden)
+		return
+	}
+	// Key kept in depot would not match the certificate of a new key
+	if depot.CheckPrivateKeyHost(d, name) && !bytes.Equal(rawCsr.RawSubjectPublicKeyInfo, rawCrtOld.RawSubjectPublicKeyInfo) {
+		http.Error(w, fmt.Sprintf("Key of %s is kept in depot, and could not be changed by re-enrollment", name), http.StatusConflict)
+		return
+	}
+	csrOld, err := getOldCertificateSigningRequest(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info, err := getAuthorityInfo(h.caName)
+	if err != nil {
+		http.Error(w, "Get CA certificate info error", http.StatusInternalServerError)
+		return
+	}
+
+	crt, err := renewCertificateHost(h.auth.crt, info, h.auth.key, crtOld, csr, 0, h.policy)
+	if err != nil {
+		http.Error(w, "Renew certificate error: "+err.Error(), createCertificateErrorStatus(err))
+		return
+	}
+	is := &hostIssuance{name: name, caName: caName, profile: getIndexProfile(caName, crtOld), info: info, crt: crt, crtOld: crtOld, csr: csr, csrOld: csrOld}
+	if err = is.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		http.Error(w, "Save certificate error", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s Renewed %s/crt signed by %s/key\n", time.Now().Format(time.RFC3339), name, authorityName(caName))
+	h.writeCertificates(w, []*pkix.Certificate{crt})
+}
+
+// authenticate returns the user of HTTP basic auth, or the name of client certificate
+func (h *estHandler) authenticate(r *http.Request) (string, bool) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		crt := pkix.NewCertificateFromDER(r.TLS.PeerCertificates[0].Raw)
+		if getRevokedCertificate(crt) != nil {
+			return "", false
+		}
+		name, err := getCertificateHostName(crt)
+		return name, err == nil
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	expected, ok := h.users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return "", false
+	}
+	return user, true
+}
+
+// writeCertificates writes crts in base64-encoded PKCS#7 as RFC 7030 section 4.1.3
+func (h *estHandler) writeCertificates(w http.ResponseWriter, crts []*pkix.Certificate) {
+	derBytes, err := pkix.ExportPKCS7Certificates(crts)
+	if err != nil {
+		http.Error(w, "Export PKCS#7 error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.Write([]byte(base64.StdEncoding.EncodeToString(derBytes)))
+}
+
+// readESTCertificateSigningRequest reads base64-encoded PKCS#10 from request body
+func readESTCertificateSigningRequest(r *http.Request) (*pkix.CertificateSigningRequest, *x509.CertificateRequest, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxCSRSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	// Line breaks are allowed in base64 body
+	derBytes, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid base64 encoding: %v", err)
+	}
+	csr := pkix.NewCertificateSigningRequestFromDER(derBytes)
+	if err = csr.CheckSignature(); err != nil {
+		return nil, nil, fmt.Errorf("Invalid certificate request: %v", err)
+	}
+	rawCsr, _ := csr.GetRawCertificateSigningRequest()
+	return csr, rawCsr, nil
+}
+
+// estHostName returns the first organizational unit, or common name if there is none
+func estHostName(units []string, commonName string) string {
+	if len(units) > 0 {
+		return units[0]
+	}
+	return commonName
+}
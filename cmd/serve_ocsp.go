@@ -0,0 +1,171 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/depot"
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+// Requests larger than this are not OCSP requests for sure
+const maxOCSPRequestSize = 10000
+
+func NewServeOCSPCommand() cli.Command {
+	return cli.Command{
+		Name:        "serve-ocsp",
+		Usage:       "Serve OCSP responder",
+		Description: "Answer OCSP requests for certificates issued by CA over HTTP, which are signed by CA or the delegated OCSP signing certificate.",
+		Flags: []cli.Flag{
+			cli.StringFlag{"listen", ":8889", "Address to listen on", ""},
+			cli.StringFlag{"passphrase", "", "Passphrase to decrypt private-key PEM block of CA or responder", ""},
+			cli.StringFlag{"ca", "", "Name of intermediate CA to respond for instead of CA", ""},
+			cli.StringFlag{"responder", "", "Name of host with OCSP signing certificate to sign responses instead of CA", ""},
+			cli.IntFlag{"hours", 24, "How long until the response is expected to be updated", ""},
+		},
+		Action: newServeOCSPAction,
+	}
+}
+
+func newServeOCSPAction(c *cli.Context) {
+	if len(c.Args()) != 0 {
+		fmt.Fprintln(os.Stderr, "No argument is expected.")
+		os.Exit(1)
+	}
+
+	caName := c.String("ca")
+	var responder *pkix.OCSPResponder
+	var err error
+	if name := c.String("responder"); name != "" {
+		responder, err = newDelegatedOCSPResponder(c, caName, name)
+	} else {
+		var crt *pkix.Certificate
+		var key *pkix.Key
+		if crt, _, key, err = getAuthority(c, "passphrase", caName); err == nil {
+			responder, err = pkix.NewOCSPResponder(crt, crt, key)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Create OCSP responder error:", err)
+		os.Exit(1)
+	}
+
+	handler := &ocspHandler{
+		caName:     caName,
+		responder:  responder,
+		nextUpdate: time.Duration(c.Int("hours")) * time.Hour,
+	}
+	fmt.Fprintf(os.Stderr, "Serving OCSP responses for %s on %s\n", authorityName(caName), c.String("listen"))
+	if err = http.ListenAndServe(c.String("listen"), handler); err != nil {
+		fmt.Fprintln(os.Stderr, "Serve OCSP error:", err)
+		os.Exit(1)
+	}
+}
+
+// newDelegatedOCSPResponder inits OCSP responder which signs with
+// the certificate and key of host name
+func newDelegatedOCSPResponder(c *cli.Context, caName string, name string) (*pkix.OCSPResponder, error) {
+	var crtAuth *pkix.Certificate
+	var err error
+	if caName == "" {
+		crtAuth, err = depot.GetCertificateAuthority(d)
+	} else {
+		crtAuth, err = depot.GetCertificateIntermediate(d, caName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	crt, err := depot.GetCertificateHost(d, name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := depot.GetEncryptedPrivateKeyHost(d, name, getPassPhrase(c, name+" key"))
+	if err != nil {
+		return nil, err
+	}
+	return pkix.NewOCSPResponder(crtAuth, crt, key)
+}
+
+// ocspHandler serves OCSP requests over HTTP as RFC 6960 Appendix A
+type ocspHandler struct {
+	caName     string
+	responder  *pkix.OCSPResponder
+	nextUpdate time.Duration
+}
+
+func (h *ocspHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var reqBytes []byte
+	var err error
+	switch r.Method {
+	case "GET":
+		var path string
+		if path, err = url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/")); err == nil {
+			reqBytes, err = base64.StdEncoding.DecodeString(path)
+		}
+	case "POST":
+		reqBytes, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxOCSPRequestSize))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	// Records are read for each request to reflect the latest revocations
+	records, err := getRevocationRecords(h.caName)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	info, err := getAuthorityInfo(h.caName)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	hasIndex := depot.CheckCertificateIndex(d)
+	index, err := getCertificateIndex(d)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	status := func(serialNumber *big.Int) (int, *pkix.RevokedCertificate) {
+		if revoked := records.Get(serialNumber); revoked != nil {
+			return pkix.OCSPRevoked, revoked
+		}
+		if index.Get(h.caName, serialNumber) != nil {
+			return pkix.OCSPGood, nil
+		}
+		// Depots created before index only know the range of issued serial numbers
+		if !hasIndex && info.IsIssuedSerialNumber(serialNumber) {
+			return pkix.OCSPGood, nil
+		}
+		return pkix.OCSPUnknown, nil
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(h.responder.Respond(reqBytes, status, h.nextUpdate))
+}
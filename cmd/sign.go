@@ -15,7 +15,9 @@
 package cmd
 
 import (
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
@@ -27,63 +29,162 @@ func NewSignCommand() cli.Command {
 	return cli.Command{
 		Name:        "sign",
 		Usage:       "Sign certificate request",
-		Description: "Sign certificate request with CA, and generate certificate for the host.",
+		Description: "Sign certificate request with CA, and generate certificate for the host. The request is the one in depot created by new-cert, or imported from --csr-file.",
 		Flags: []cli.Flag{
 			cli.StringFlag{"passphrase", "", "Passphrase to decrypt private-key PEM block of CA", ""},
 			cli.IntFlag{"years", 10, "How long until the certificate expires", ""},
+			cli.StringFlag{"ca", "", "Name of intermediate CA to sign with instead of CA", ""},
+			cli.StringSliceFlag{"ocsp-url", &cli.StringSlice{}, "URL of OCSP responder to put in authority information access extension", ""},
+			cli.BoolFlag{"ocsp-signing", "Issue the certificate for signing OCSP responses on behalf of CA", ""},
+			cli.StringFlag{"profile", "", "Profile of key usages and extensions (server, client, peer, ca or one in profile file), both server and client if unset", ""},
+			cli.StringFlag{"profile-file", "", "YAML or JSON file of user-defined profiles", ""},
+			cli.StringFlag{"policy-file", "", "YAML or JSON file of issuance policy that certificates must comply with", ""},
+			cli.StringFlag{"csr-file", "", "PEM file of certificate request generated elsewhere to import, or - for stdin", ""},
+			cli.StringFlag{"name", "", "Host name in depot for the imported certificate request", ""},
+			cli.StringSliceFlag{"allow-domain", &cli.StringSlice{}, "Domain whose names and subdomains requested in SANs are honored, all DNS names if no --allow-domain is given", ""},
+			cli.StringSliceFlag{"allow-ip", &cli.StringSlice{}, "CIDR whose addresses requested in SANs are honored, all IP addresses if no --allow-ip is given", ""},
 		},
 		Action: newSignAction,
 	}
 }
 
 func newSignAction(c *cli.Context) {
-	if len(c.Args()) != 1 {
+	var name string
+	switch {
+	case c.String("name") != "" && len(c.Args()) == 0:
+		name = c.String("name")
+	case c.String("name") == "" && len(c.Args()) == 1:
+		name = c.Args()[0]
+	default:
 		fmt.Fprintln(os.Stderr, "One host name must be provided.")
 		os.Exit(1)
 	}
-	name := c.Args()[0]
+
+	unlock, err := lockDepot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer unlock()
 
 	if depot.CheckCertificateHost(d, name) {
 		fmt.Fprintln(os.Stderr, "Certificate has existed!")
 		os.Exit(1)
 	}
 
-	csr, err := depot.GetCertificateSigningRequest(d, name)
+	profile, err := getProfile(c)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Get certificate request error:", err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	crt, err := depot.GetCertificateAuthority(d)
+
+	policy, err := getPolicy(c)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Get CA certificate error:", err)
-		if isFileNotExist(err) {
-			fmt.Fprintln(os.Stderr, "Please run 'etcd-ca init' to initial the depot.")
-		}
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	info, err := depot.GetCertificateAuthorityInfo(d)
+
+	ipRanges, err := parseIPRanges(c.StringSlice("allow-ip"))
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Get CA certificate info error:", err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	key, err := depot.GetEncryptedPrivateKeyAuthority(d, getPassPhrase(c, "CA key"))
+
+	var csr *pkix.CertificateSigningRequest
+	csrFile := c.String("csr-file")
+	if csrFile != "" {
+		if depot.CheckCertificateSigningRequest(d, name) || depot.CheckPrivateKeyHost(d, name) {
+			fmt.Fprintf(os.Stderr, "Host %s has existed in depot!\n", name)
+			os.Exit(1)
+		}
+		if csr, err = readCertificateSigningRequest(csrFile); err != nil {
+			fmt.Fprintln(os.Stderr, "Import certificate request error:", err)
+			os.Exit(1)
+		}
+	} else {
+		if csr, err = depot.GetCertificateSigningRequest(d, name); err != nil {
+			fmt.Fprintln(os.Stderr, "Get certificate request error:", err)
+			os.Exit(1)
+		}
+	}
+	caName := c.String("ca")
+	crt, info, key, err := getAuthority(c, "passphrase", caName)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Get CA key error:", err)
+		fmt.Fprintln(os.Stderr, err)
+		if isFileNotExist(err) && caName == "" {
+			fmt.Fprintln(os.Stderr, "Please run 'etcd-ca init' to initial the depot.")
+		}
 		os.Exit(1)
 	}
 
-	crtHost, err := pkix.CreateCertificateHost(crt, info, key, csr, c.Int("years"))
+	opts := &pkix.CertificateHostOptions{
+		OCSPServer:  c.StringSlice("ocsp-url"),
+		OCSPSigning: c.Bool("ocsp-signing"),
+		Profile:     profile,
+
+		AllowedDNSDomains: c.StringSlice("allow-domain"),
+		AllowedIPRanges:   ipRanges,
+		Policy:            policy,
+	}
+	crtHost, err := pkix.CreateCertificateHostWithOptions(crt, info, key, csr, c.Int("years"), opts)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Create certificate error:", err)
 		os.Exit(1)
+	}
+
+	// Certificate, CA info and index are saved together in one transaction
+	is := &hostIssuance{name: name, caName: caName, profile: c.String("profile"), info: info, crt: crtHost}
+	if csrFile != "" {
+		is.csr = csr
+	}
+	if err = is.save(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Created %s/crt from %s/csr signed by %s/key\n", name, name, authorityName(caName))
+	printDroppedSANs(csr, crtHost)
+}
+
+// readCertificateSigningRequest reads PEM certificate request from path,
+// or stdin if path is -, and checks its signature
+func readCertificateSigningRequest(path string) (*pkix.CertificateSigningRequest, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
 	} else {
-		fmt.Printf("Created %s/crt from %s/csr signed by ca/key\n", name, name)
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
 	}
+	csr, err := pkix.NewCertificateSigningRequestFromPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	return csr, nil
+}
 
-	if err = depot.PutCertificateHost(d, name, crtHost); err != nil {
-		fmt.Fprintln(os.Stderr, "Save certificate error:", err)
+// printDroppedSANs prints SANs requested in csr but not honored in crt
+func printDroppedSANs(csr *pkix.CertificateSigningRequest, crt *pkix.Certificate) {
+	rawCsr, err := csr.GetRawCertificateSigningRequest()
+	if err != nil {
+		return
 	}
-	if err = depot.UpdateCertificateAuthorityInfo(d, info); err != nil {
-		fmt.Fprintln(os.Stderr, "Update CA info error:", err)
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return
+	}
+	honored := make(map[string]bool)
+	for _, ident := range csrIdentifiers(&x509.CertificateRequest{DNSNames: rawCrt.DNSNames, IPAddresses: rawCrt.IPAddresses}) {
+		honored[ident] = true
+	}
+	for _, ident := range csrIdentifiers(rawCsr) {
+		if !honored[ident] {
+			fmt.Printf("Dropped SAN %s not allowed\n", ident)
+		}
 	}
 }
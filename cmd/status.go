@@ -43,6 +43,24 @@ func printSignedStatusLine(crt *pkix.Certificate, name string) {
 	}
 }
 
+// getRevokedCertificate returns the revocation record of certificate,
+// or nil if it is not revoked
+func getRevokedCertificate(crt *pkix.Certificate) *pkix.RevokedCertificate {
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return nil
+	}
+	caName, err := getIssuerName(crt)
+	if err != nil {
+		return nil
+	}
+	records, err := getRevocationRecords(caName)
+	if err != nil {
+		return nil
+	}
+	return records.Get(rawCrt.SerialNumber)
+}
+
 func newStatusAction(c *cli.Context) {
 	crtAuth, err := depot.GetCertificateAuthority(d)
 	if err != nil {
@@ -51,7 +69,24 @@ func newStatusAction(c *cli.Context) {
 		printSignedStatusLine(crtAuth, "CA")
 	}
 
-	tags := d.List()
+	tags, err := depot.ListTags(d, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "List depot error:", err)
+		os.Exit(1)
+	}
+	for _, tag := range tags {
+		name := depot.GetNameFromIntermediateCrtTag(tag)
+		if name == "" {
+			continue
+		}
+		crt, err := depot.GetCertificateIntermediate(d, name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: Get intermediate CA certificate error: %v\n", name, err)
+			continue
+		}
+		printSignedStatusLine(crt, name+" (intermediate CA)")
+	}
+
 	for _, tag := range tags {
 		name := depot.GetNameFromHostCrtTag(tag)
 		if name == "" {
@@ -66,6 +101,10 @@ func newStatusAction(c *cli.Context) {
 			fmt.Printf("%s: Unsigned\n", name)
 			continue
 		}
+		if revoked := getRevokedCertificate(crt); revoked != nil {
+			fmt.Printf("%s: REVOKED (%s)\n", name, pkix.RevocationReasonName(revoked.Reason))
+			continue
+		}
 		printSignedStatusLine(crt, name)
 	}
 }
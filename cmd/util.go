@@ -16,30 +16,79 @@ package cmd
 
 import (
 	"bytes"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/coreos/etcd-ca/Godeps/_workspace/src/golang.org/x/crypto/ssh/terminal"
 	"github.com/coreos/etcd-ca/depot"
+	"github.com/coreos/etcd-ca/pkix"
 )
 
 var (
-	d *depot.FileDepot
+	d depot.Depot
 )
 
-func InitDepot(path string) error {
-	if d == nil {
-		var err error
-		if d, err = depot.NewFileDepot(path); err != nil {
-			return err
+// InitDepot opens the depot backend of depot-url flag if it is given, or
+// FileDepot at depot-path. Depot in etcd connects with the TLS files given
+// by etcd-cacert, etcd-cert and etcd-key flags.
+func InitDepot(c *cli.Context) error {
+	if d != nil {
+		return nil
+	}
+	var dp depot.Depot
+	var err error
+	if url := c.GlobalString("depot-url"); url != "" {
+		dp, err = depot.Open(url)
+	} else {
+		dp, err = depot.NewFileDepot(c.GlobalString("depot-path"))
+	}
+	if err != nil {
+		return err
+	}
+	caFile, certFile, keyFile := c.GlobalString("etcd-cacert"), c.GlobalString("etcd-cert"), c.GlobalString("etcd-key")
+	if caFile != "" || certFile != "" || keyFile != "" {
+		e, ok := dp.(*depot.EtcdDepot)
+		if !ok {
+			return errors.New("--etcd-cacert, --etcd-cert and --etcd-key only apply to depot in etcd")
 		}
+		config, err := depot.NewEtcdTLSConfig(caFile, certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("Load etcd TLS files error: %w", err)
+		}
+		e.SetTLSConfig(config)
 	}
+	d = dp
 	return nil
 }
 
+// lockDepot locks the depot against other etcd-ca processes if it supports,
+// and fails if a journal is left by an interrupted operation
+func lockDepot() (func(), error) {
+	unlock := func() {}
+	if l, ok := d.(depot.Locker); ok {
+		var err error
+		if unlock, err = l.Lock(); err != nil {
+			return nil, fmt.Errorf("Lock depot error: %w", err)
+		}
+	}
+	if j, ok := d.(depot.Journaler); ok && j.Pending() {
+		unlock()
+		return nil, errors.New("Depot has an interrupted operation. Run 'etcd-ca recover' to finish it, or 'etcd-ca recover --rollback' to undo it.")
+	}
+	return unlock, nil
+}
+
 func createPassPhrase() ([]byte, error) {
 	fmt.Fprint(os.Stderr, "Enter passphrase (empty for no passphrase): ")
 	pass1, err := terminal.ReadPassword(syscall.Stdin)
@@ -67,14 +116,533 @@ func askPassPhrase(name string) []byte {
 }
 
 func getPassPhrase(c *cli.Context, name string) []byte {
-	if c.IsSet("passphrase") {
-		return []byte(c.String("passphrase"))
+	return getPassPhraseFromFlag(c, "passphrase", name)
+}
+
+func getPassPhraseFromFlag(c *cli.Context, flag string, name string) []byte {
+	if c.IsSet(flag) {
+		return []byte(c.String(flag))
 	} else {
 		return askPassPhrase(name)
 	}
 }
 
+// createKey creates a keypair of the type specified by key-type flag
+func createKey(c *cli.Context) (*pkix.Key, error) {
+	return createKeyOfType(c.String("key-type"), c.Int("key-bits"), c.String("curve"))
+}
+
+// createKeyOfType creates a keypair of keyType, using bits for RSA and curve for ECDSA
+func createKeyOfType(keyType string, bits int, curveName string) (*pkix.Key, error) {
+	switch keyType {
+	case "rsa":
+		return pkix.CreateRSAKey(bits)
+	case "ecdsa":
+		curve, err := pkix.GetCurve(curveName)
+		if err != nil {
+			return nil, err
+		}
+		return pkix.CreateECDSAKey(curve)
+	case "ed25519":
+		return pkix.CreateEd25519Key()
+	}
+	return nil, fmt.Errorf("unsupported key type %s", keyType)
+}
+
+// getAuthority gets certificate, info and key of the CA to sign with.
+// Empty name stands for the root CA, and others for intermediate CAs.
+// The key is decrypted using passphrase from flag, or asked on terminal.
+func getAuthority(c *cli.Context, flag string, name string) (*pkix.Certificate, *pkix.CertificateAuthorityInfo, *pkix.Key, error) {
+	if name == "" {
+		crt, err := depot.GetCertificateAuthority(d)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Get CA certificate error: %w", err)
+		}
+		info, err := getAuthorityInfo(name)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Get CA certificate info error: %w", err)
+		}
+		key, err := depot.GetEncryptedPrivateKeyAuthority(d, getPassPhraseFromFlag(c, flag, "CA key"))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Get CA key error: %w", err)
+		}
+		return crt, info, key, nil
+	}
+
+	crt, err := depot.GetCertificateIntermediate(d, name)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Get intermediate CA certificate error: %w", err)
+	}
+	info, err := getAuthorityInfo(name)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Get intermediate CA certificate info error: %w", err)
+	}
+	key, err := depot.GetEncryptedPrivateKeyIntermediate(d, name, getPassPhraseFromFlag(c, flag, name+" CA key"))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Get intermediate CA key error: %w", err)
+	}
+	return crt, info, key, nil
+}
+
+// authority includes certificate and decrypted key of CA
+type authority struct {
+	crt *pkix.Certificate
+	key *pkix.Key
+}
+
+// authorityCache caches decrypted CAs by name so passphrases are asked once.
+// CA info is not cached because other commands may update it.
+type authorityCache map[string]*authority
+
+// get returns the CA named by name, and decrypts its key with passphrase
+// flag at the first time
+func (ac authorityCache) get(c *cli.Context, name string) (*authority, error) {
+	if auth, ok := ac[name]; ok {
+		return auth, nil
+	}
+	crt, _, key, err := getAuthority(c, "passphrase", name)
+	if err != nil {
+		return nil, err
+	}
+	auth := &authority{crt, key}
+	ac[name] = auth
+	return auth, nil
+}
+
+// getAuthorityInfo gets the info of CA named by name, along with the CAs
+// above it whose name constraints apply to the certificates it issues
+func getAuthorityInfo(name string) (*pkix.CertificateAuthorityInfo, error) {
+	if name == "" {
+		info, err := depot.GetCertificateAuthorityInfo(d)
+		if err != nil {
+			return nil, err
+		}
+		info.SerialNumberUsed = serialNumberUsed(name)
+		return info, nil
+	}
+
+	info, err := depot.GetCertificateIntermediateInfo(d, name)
+	if err != nil {
+		return nil, err
+	}
+	info.SerialNumberUsed = serialNumberUsed(name)
+	chain, err := getAuthorityChain(name)
+	if err != nil {
+		return nil, fmt.Errorf("Get CA chain error: %w", err)
+	}
+	info.Issuers = chain[1:]
+	return info, nil
+}
+
+// updateAuthorityInfo saves the info of CA named by name into dp
+func updateAuthorityInfo(dp depot.Depot, name string, info *pkix.CertificateAuthorityInfo) error {
+	if name == "" {
+		return depot.UpdateCertificateAuthorityInfo(dp, info)
+	}
+	return depot.UpdateCertificateIntermediateInfo(dp, name, info)
+}
+
+// authorityName returns the name used in outputs for CA named by name
+func authorityName(name string) string {
+	if name == "" {
+		return "ca"
+	}
+	return name
+}
+
+// getRevocationRecords gets the revocation records of CA named by name.
+// Empty records are returned if no certificate has been revoked.
+func getRevocationRecords(name string) (*pkix.RevocationRecords, error) {
+	var records *pkix.RevocationRecords
+	var err error
+	if name == "" {
+		if !depot.CheckRevocationRecordsAuthority(d) {
+			return pkix.NewRevocationRecords(), nil
+		}
+		records, err = depot.GetRevocationRecordsAuthority(d)
+	} else {
+		if !depot.CheckRevocationRecordsIntermediate(d, name) {
+			return pkix.NewRevocationRecords(), nil
+		}
+		records, err = depot.GetRevocationRecordsIntermediate(d, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Get revocation records error: %w", err)
+	}
+	return records, nil
+}
+
+// updateRevocationRecords saves the revocation records of CA named by name into dp
+func updateRevocationRecords(dp depot.Depot, name string, records *pkix.RevocationRecords) error {
+	if name == "" {
+		return depot.UpdateRevocationRecordsAuthority(dp, records)
+	}
+	return depot.UpdateRevocationRecordsIntermediate(dp, name, records)
+}
+
+// saveRevocation saves the revocation records of CA named by caName together
+// with index in one transaction, so that list and status agree with CRL and OCSP.
+// Index is not saved if it is nil.
+func saveRevocation(caName string, records *pkix.RevocationRecords, index *pkix.CertificateIndex) error {
+	txn := depot.Begin(d)
+	if err := updateRevocationRecords(txn, caName, records); err != nil {
+		return fmt.Errorf("Save revocation records error: %w", err)
+	}
+	if index != nil {
+		if err := depot.UpdateCertificateIndex(txn, index); err != nil {
+			return fmt.Errorf("Update certificate index error: %w", err)
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("Save depot error: %w", err)
+	}
+	return nil
+}
+
+// getCertificateIndex gets the index of certificates issued in dp.
+// Empty index is returned if no certificate has been recorded.
+func getCertificateIndex(dp depot.Depot) (*pkix.CertificateIndex, error) {
+	if !depot.CheckCertificateIndex(dp) {
+		return pkix.NewCertificateIndex(), nil
+	}
+	index, err := depot.GetCertificateIndex(dp)
+	if err != nil {
+		return nil, fmt.Errorf("Get certificate index error: %w", err)
+	}
+	return index, nil
+}
+
+// addCertificateIndex records certificate of name issued by CA named by caName
+// with profile in index of dp
+func addCertificateIndex(dp depot.Depot, name string, caName string, profile string, origin string, crt *pkix.Certificate) error {
+	index, err := getCertificateIndex(dp)
+	if err != nil {
+		return err
+	}
+	entry, err := pkix.NewIndexEntry(name, caName, crt)
+	if err != nil {
+		return err
+	}
+	entry.Profile, entry.Origin = profile, origin
+	if err = index.Add(entry); err != nil {
+		return err
+	}
+	return depot.UpdateCertificateIndex(dp, index)
+}
+
+// hostIssuance is a certificate issued to host, with the changes saved along with it
+type hostIssuance struct {
+	name   string
+	caName string
+	// profile is the name of profile recorded in index
+	profile string
+	// origin is recorded in index, or inherited from crtOld if it is empty
+	origin string
+	info   *pkix.CertificateAuthorityInfo
+	crt    *pkix.Certificate
+	// crtOld is archived and replaced by crt if it is set
+	crtOld *pkix.Certificate
+	// csr replaces csrOld, the certificate request of host read by the
+	// caller, if it is set. It is created if csrOld is nil.
+	csr    *pkix.CertificateSigningRequest
+	csrOld *pkix.CertificateSigningRequest
+	// key replaces the private key of host if it is set, encrypted with
+	// keyPassphrase in keyEncryption. keyOld is the PEM block of the key
+	// read by the caller, or nil if host has no key.
+	key           *pkix.Key
+	keyOld        []byte
+	keyPassphrase []byte
+	keyEncryption pkix.KeyEncryption
+}
+
+// save saves the changes together in one transaction of depot if it
+// supports. Otherwise CA info that has handed out the serial number of
+// certificate is saved first. It is compared and swapped in depots such as
+// EtcdDepot, so a concurrent issuer that got the same serial number fails
+// before saving its certificate. The index entry goes next, so that no
+// certificate is saved without being known to OCSP and revocation. The key
+// and certificate request are saved before the certificate, which is
+// useless without them. They fail with depot.ErrConflict if they are no
+// longer the ones read by the caller.
+func (is *hostIssuance) save() error {
+	origin := is.origin
+	if origin == "" && is.crtOld != nil {
+		if caName, err := getIssuerName(is.crtOld); err == nil {
+			if entry := getIndexEntry(caName, is.crtOld); entry != nil {
+				origin = entry.Origin
+			}
+		}
+	}
+
+	txn := depot.Begin(d)
+	if err := updateAuthorityInfo(txn, is.caName, is.info); err != nil {
+		return fmt.Errorf("Update CA info error: %w", err)
+	}
+	if err := addCertificateIndex(txn, is.name, is.caName, is.profile, origin, is.crt); err != nil {
+		return fmt.Errorf("Update certificate index error: %w", err)
+	}
+	if is.key != nil {
+		if err := depot.UpdateEncryptedPrivateKeyHost(txn, is.name, is.keyOld, is.key, is.keyPassphrase, is.keyEncryption); err != nil {
+			return fmt.Errorf("Save key error: %w", err)
+		}
+	}
+	if is.csr != nil {
+		if err := depot.UpdateCertificateSigningRequest(txn, is.name, is.csrOld, is.csr); err != nil {
+			return fmt.Errorf("Save certificate request error: %w", err)
+		}
+	}
+	if is.crtOld == nil {
+		if err := depot.PutCertificateHost(txn, is.name, is.crt); err != nil {
+			return fmt.Errorf("Save certificate error: %w", err)
+		}
+	} else {
+		if err := depot.PutArchivedCertificateHost(txn, is.name, is.crtOld); err != nil {
+			return fmt.Errorf("Archive certificate error: %w", err)
+		}
+		if err := depot.UpdateCertificateHost(txn, is.name, is.crt); err != nil {
+			return fmt.Errorf("Save certificate error: %w", err)
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("Save depot error: %w", err)
+	}
+	return nil
+}
+
+// getOldCertificateSigningRequest returns the certificate request of host
+// to be replaced, or nil if host has none
+func getOldCertificateSigningRequest(name string) (*pkix.CertificateSigningRequest, error) {
+	if !depot.CheckCertificateSigningRequest(d, name) {
+		return nil, nil
+	}
+	csr, err := depot.GetCertificateSigningRequest(d, name)
+	if err != nil {
+		return nil, fmt.Errorf("Get certificate request error: %w", err)
+	}
+	return csr, nil
+}
+
+// getProfile returns the profile named by profile flag, which could be defined
+// in the file of profile-file flag, or nil if profile flag is not set
+func getProfile(c *cli.Context) (*pkix.Profile, error) {
+	name := c.String("profile")
+	if name == "" {
+		return nil, nil
+	}
+	var profiles map[string]*pkix.Profile
+	if path := c.String("profile-file"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Read profile file error: %w", err)
+		}
+		if profiles, err = pkix.NewProfilesFromYAML(data); err != nil {
+			return nil, fmt.Errorf("Parse profile file error: %w", err)
+		}
+	}
+	return pkix.GetProfile(name, profiles)
+}
+
+// getPolicy returns the issuance policy in the file of policy-file flag,
+// or nil if the flag is not set
+func getPolicy(c *cli.Context) (*pkix.Policy, error) {
+	path := c.String("policy-file")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Read policy file error: %w", err)
+	}
+	policy, err := pkix.NewPolicyFromYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("Parse policy file error: %w", err)
+	}
+	return policy, nil
+}
+
+// getNameConstraints returns name constraints from flags of init and new-intermediate
+func getNameConstraints(c *cli.Context) (*pkix.NameConstraints, error) {
+	permittedIPRanges, err := parseIPRanges(c.StringSlice("permitted-ip"))
+	if err != nil {
+		return nil, err
+	}
+	excludedIPRanges, err := parseIPRanges(c.StringSlice("excluded-ip"))
+	if err != nil {
+		return nil, err
+	}
+	return &pkix.NameConstraints{
+		PermittedDNSDomains:     c.StringSlice("permitted-dns"),
+		ExcludedDNSDomains:      c.StringSlice("excluded-dns"),
+		PermittedIPRanges:       permittedIPRanges,
+		ExcludedIPRanges:        excludedIPRanges,
+		PermittedEmailAddresses: c.StringSlice("permitted-email"),
+		ExcludedEmailAddresses:  c.StringSlice("excluded-email"),
+	}, nil
+}
+
+// parseIPRanges parses CIDRs like 10.0.0.0/8
+func parseIPRanges(cidrs []string) ([]*net.IPNet, error) {
+	ipRanges := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipRange, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid IP range %s: %w", cidr, err)
+		}
+		ipRanges = append(ipRanges, ipRange)
+	}
+	return ipRanges, nil
+}
+
+// serialNumberUsed returns the function checking whether CA named by name
+// has issued certificate with the serial number according to index
+func serialNumberUsed(name string) func(*big.Int) bool {
+	return func(serialNumber *big.Int) bool {
+		index, err := getCertificateIndex(d)
+		if err != nil {
+			// Uniqueness cannot be guaranteed without index
+			return true
+		}
+		return index.Get(name, serialNumber) != nil
+	}
+}
+
+// getIssuerName finds the CA in depot that issues the certificate.
+// Empty name stands for the root CA, and others for intermediate CAs.
+func getIssuerName(crt *pkix.Certificate) (string, error) {
+	if crtAuth, err := depot.GetCertificateAuthority(d); err == nil && crtAuth.IsIssuerOf(crt) {
+		return "", nil
+	}
+	tags, err := depot.ListTags(d, "")
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range tags {
+		name := depot.GetNameFromIntermediateCrtTag(tag)
+		if name == "" {
+			continue
+		}
+		crtAuth, err := depot.GetCertificateIntermediate(d, name)
+		if err == nil && crtAuth.IsIssuerOf(crt) {
+			return name, nil
+		}
+	}
+	return "", errors.New("cannot find the CA that issues the certificate")
+}
+
+// getCertificateHostName returns the name of host that crt is issued to,
+// according to index kept by CA rather than subject chosen by the certificate
+// request. Certificates issued before index exists are named by their
+// organizational unit only if they are the current certificate of that host.
+func getCertificateHostName(crt *pkix.Certificate) (string, error) {
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return "", err
+	}
+	caName, err := getIssuerName(crt)
+	if err != nil {
+		return "", err
+	}
+	index, err := getCertificateIndex(d)
+	if err != nil {
+		return "", err
+	}
+	if entry := index.Get(caName, rawCrt.SerialNumber); entry != nil {
+		// Compare fingerprint in case serial number is reused by a forged entry
+		presented, err := pkix.NewIndexEntry(entry.Name, caName, crt)
+		if err != nil || entry.IsCA || entry.Fingerprint != presented.Fingerprint {
+			return "", errors.New("certificate does not match index")
+		}
+		return entry.Name, nil
+	}
+	if units := rawCrt.Subject.OrganizationalUnit; len(units) == 1 && isCurrentCertificateHost(units[0], rawCrt) {
+		return units[0], nil
+	}
+	return "", errors.New("certificate is not issued to any host in depot")
+}
+
+// isCurrentCertificateHost checks that rawCrt is the certificate of host in depot
+func isCurrentCertificateHost(name string, rawCrt *x509.Certificate) bool {
+	crt, err := depot.GetCertificateHost(d, name)
+	if err != nil {
+		return false
+	}
+	rawCrtCurrent, err := crt.GetRawCertificate()
+	return err == nil && bytes.Equal(rawCrtCurrent.Raw, rawCrt.Raw)
+}
+
+// getIntermediates gets the certificates of all intermediate CAs in depot
+func getIntermediates() ([]*pkix.Certificate, error) {
+	tags, err := depot.ListTags(d, "")
+	if err != nil {
+		return nil, err
+	}
+	crts := make([]*pkix.Certificate, 0)
+	for _, tag := range tags {
+		name := depot.GetNameFromIntermediateCrtTag(tag)
+		if name == "" {
+			continue
+		}
+		crt, err := depot.GetCertificateIntermediate(d, name)
+		if err != nil {
+			continue
+		}
+		crts = append(crts, crt)
+	}
+	return crts, nil
+}
+
+// getAuthorityChain gets the certificates from CA named by name up to the root CA
+func getAuthorityChain(name string) ([]*pkix.Certificate, error) {
+	chain := make([]*pkix.Certificate, 0)
+	for {
+		if name == "" {
+			crt, err := depot.GetCertificateAuthority(d)
+			if err != nil {
+				return nil, err
+			}
+			return append(chain, crt), nil
+		}
+		crt, err := depot.GetCertificateIntermediate(d, name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, crt)
+		if name, err = getIssuerName(crt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseDuration parses duration like time.ParseDuration, and also accepts days like 30d
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
 func isFileNotExist(err error) bool {
-	perr, ok := err.(*os.PathError)
-	return ok && perr.Err.Error() == "no such file or directory"
+	var perr *os.PathError
+	return errors.As(err, &perr) && perr.Err.Error() == "no such file or directory"
+}
+
+// equalStringSets reports whether a and b have the same strings regardless of order
+func equalStringSets(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,299 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/coreos/etcd-ca/depot"
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+func NewWatchCommand() cli.Command {
+	return cli.Command{
+		Name:        "watch",
+		Usage:       "Renew host certificates periodically",
+		Description: "Scan the depot periodically and renew host certificates which expire soon. Renewed certificates are written to output directories, and hook commands are run for them.",
+		Flags: []cli.Flag{
+			cli.StringFlag{"passphrase", "", "Passphrase to decrypt private-key PEM block of CA and intermediate CAs", ""},
+			cli.StringFlag{"renew-before", "30d", "Renew certificates expiring within this duration, e.g. 30d or 12h", ""},
+			cli.StringFlag{"interval", "1h", "How long to wait between scans, e.g. 1h or 10m", ""},
+			cli.IntFlag{"days", 0, "How long until renewed certificates expire, the same as the old ones if unset", ""},
+			cli.StringSliceFlag{"output-dir", &cli.StringSlice{}, "Directory to write <name>.crt with intermediate CAs and ca.crt into after renewal", ""},
+			cli.StringSliceFlag{"hook", &cli.StringSlice{}, "Command to run by sh after renewal in the form of name=command, or *=command for all hosts", ""},
+			cli.BoolFlag{"once", "Scan once and exit", ""},
+		},
+		Action: newWatchAction,
+	}
+}
+
+// watcher renews certificates in depot
+type watcher struct {
+	c           *cli.Context
+	renewBefore time.Duration
+	validity    time.Duration
+	outputDirs  []string
+	// hooks maps host name to commands, and "*" stands for all hosts
+	hooks       map[string][]string
+	authorities authorityCache
+	// pending holds hosts renewed in depot whose outputs are not written yet
+	pending map[string]bool
+}
+
+func newWatchAction(c *cli.Context) {
+	renewBefore, err := parseDuration(c.String("renew-before"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Parse renew-before error:", err)
+		os.Exit(1)
+	}
+	interval, err := parseDuration(c.String("interval"))
+	if err != nil || interval <= 0 {
+		fmt.Fprintln(os.Stderr, "Interval must be a positive duration.")
+		os.Exit(1)
+	}
+
+	w := &watcher{
+		c:           c,
+		renewBefore: renewBefore,
+		validity:    time.Duration(c.Int("days")) * 24 * time.Hour,
+		outputDirs:  c.StringSlice("output-dir"),
+		hooks:       make(map[string][]string),
+		authorities: make(authorityCache),
+		pending:     make(map[string]bool),
+	}
+	for _, hook := range c.StringSlice("hook") {
+		i := strings.Index(hook, "=")
+		if i <= 0 {
+			fmt.Fprintf(os.Stderr, "Hook %q is not in the form of name=command.\n", hook)
+			os.Exit(1)
+		}
+		w.hooks[hook[:i]] = append(w.hooks[hook[:i]], hook[i+1:])
+	}
+
+	// Decrypt CA key at start instead of waiting for the first renewal
+	if _, err = w.authorities.get(w.c, ""); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	for {
+		w.scan()
+		if c.Bool("once") {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// scan renews all host certificates that expire within renewBefore, and
+// writes outputs that failed or were left behind by earlier renewals
+func (w *watcher) scan() {
+	tags, err := depot.ListTags(d, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "List depot error:", err)
+		return
+	}
+	for _, tag := range tags {
+		name := depot.GetNameFromHostCrtTag(tag)
+		if name == "" {
+			continue
+		}
+		crt, err := depot.GetCertificateHost(d, name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: Get certificate error: %v\n", name, err)
+			continue
+		}
+		if getRevokedCertificate(crt) != nil {
+			continue
+		}
+		if crt.GetExpirationDuration() > w.renewBefore {
+			if w.isPending(name, crt) {
+				err = w.deliver(name, crt)
+			}
+		} else {
+			err = w.renew(name, crt)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		}
+	}
+}
+
+// renew renews certificate of host, writes it into output directories and runs hooks
+func (w *watcher) renew(name string, crtOld *pkix.Certificate) error {
+	unlock, err := lockDepot()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	caName, err := getIssuerName(crtOld)
+	if err != nil {
+		return err
+	}
+	auth, err := w.authorities.get(w.c, caName)
+	if err != nil {
+		return err
+	}
+	info, err := getAuthorityInfo(caName)
+	if err != nil {
+		return fmt.Errorf("Get CA certificate info error: %w", err)
+	}
+	csr, err := depot.GetCertificateSigningRequest(d, name)
+	if err != nil {
+		return fmt.Errorf("Get certificate request error: %w", err)
+	}
+
+	crt, err := renewCertificateHost(auth.crt, info, auth.key, crtOld, csr, w.validity, nil)
+	if err != nil {
+		return err
+	}
+	is := &hostIssuance{name: name, caName: caName, profile: getIndexProfile(caName, crtOld), info: info, crt: crt, crtOld: crtOld}
+	if err = is.save(); err != nil {
+		return err
+	}
+	fmt.Printf("%s Renewed %s/crt signed by %s/key\n", time.Now().Format(time.RFC3339), name, authorityName(caName))
+
+	w.pending[name] = true
+	return w.deliver(name, crt)
+}
+
+// isPending checks whether outputs of host should be written again, because
+// writing them failed or an output directory still holds an older certificate
+func (w *watcher) isPending(name string, crt *pkix.Certificate) bool {
+	if w.pending[name] {
+		return true
+	}
+	crtBytes, err := crt.Export()
+	if err != nil {
+		return false
+	}
+	for _, dir := range w.outputDirs {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name+".crt"))
+		if err == nil && !bytes.HasPrefix(data, crtBytes) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver writes certificate of host into output directories and runs hooks.
+// Host is kept pending on failure, so that the next scan tries again.
+func (w *watcher) deliver(name string, crt *pkix.Certificate) error {
+	files, err := w.writeOutputs(name, crt)
+	if err != nil {
+		return fmt.Errorf("Write outputs error, retry at next scan: %w", err)
+	}
+	delete(w.pending, name)
+	w.runHooks(name, files)
+	return nil
+}
+
+// writeOutputs writes certificate of host followed by intermediate CAs, and CA certificate
+// into output directories, and returns the paths of host certificate files
+func (w *watcher) writeOutputs(name string, crt *pkix.Certificate) ([]string, error) {
+	if len(w.outputDirs) == 0 {
+		return nil, nil
+	}
+
+	crtAuth, err := depot.GetCertificateAuthority(d)
+	if err != nil {
+		return nil, fmt.Errorf("Get CA certificate error: %w", err)
+	}
+	intermediates, err := getIntermediates()
+	if err != nil {
+		return nil, fmt.Errorf("Get intermediate CA certificates error: %w", err)
+	}
+	chain, err := crtAuth.VerifyHostChain(crt, name, intermediates)
+	if err != nil {
+		return nil, fmt.Errorf("Verify certificate chain error: %w", err)
+	}
+	var crtBytes bytes.Buffer
+	for _, c := range chain[:len(chain)-1] {
+		b, _ := c.Export()
+		crtBytes.Write(b)
+	}
+	crtAuthBytes, _ := crtAuth.Export()
+
+	files := make([]string, 0, len(w.outputDirs))
+	for _, dir := range w.outputDirs {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		// Host certificate goes last, so it stays old until all are written
+		if err = writeFileAtomic(filepath.Join(dir, "ca.crt"), crtAuthBytes, 0644); err != nil {
+			return nil, err
+		}
+		file := filepath.Join(dir, name+".crt")
+		if err = writeFileAtomic(file, crtBytes.Bytes(), 0644); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// runHooks runs hook commands of host, with the name and the first written
+// certificate file in environment variables ETCD_CA_NAME and ETCD_CA_CRT_FILE.
+// The depot session is left out, as hooks should not read the depot.
+func (w *watcher) runHooks(name string, files []string) {
+	env := []string{"ETCD_CA_NAME=" + name}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, depotSessionEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	if len(files) > 0 {
+		env = append(env, "ETCD_CA_CRT_FILE="+files[0])
+	}
+	hooks := append(append([]string{}, w.hooks["*"]...), w.hooks[name]...)
+	for _, hook := range hooks {
+		cmd := exec.Command("sh", "-c", hook)
+		cmd.Env = env
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: Run hook %q error: %v\n", name, hook, err)
+		}
+	}
+}
+
+// writeFileAtomic writes data into a temporary file and renames it to name,
+// so readers never see a partial certificate
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -15,14 +15,26 @@
 package depot
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const (
 	DefaultFileDepotDir = ".etcd-ca"
+
+	// metadataDir holds metadata of files in FileDepot, which is not listed
+	metadataDir = ".metadata"
+	// tmpDir holds files being written before they are renamed into place
+	tmpDir = ".tmp"
+	// lockName is the file locked by FileDepot.Lock, which is not listed
+	lockName = ".lock"
 )
 
 // Tag includes name and permission requirement
@@ -45,6 +57,164 @@ type Depot interface {
 	Check(tag *Tag) bool
 	Get(tag *Tag) ([]byte, error)
 	Delete(tag *Tag) error
+	// List returns tags of all data whose name starts with prefix
+	List(prefix string) []*Tag
+	// Stat returns size, mode, modification time and metadata of data
+	Stat(tag *Tag) (*FileInfo, error)
+	// SetMetadata replaces metadata of data, which is removed with data
+	SetMetadata(tag *Tag, metadata map[string]string) error
+}
+
+// Lister is implemented by Depot whose listing could fail, such as EtcdDepot.
+// Its List returns no tags on failure, which ListTags reports instead.
+type Lister interface {
+	ListTags(prefix string) ([]*Tag, error)
+}
+
+// ListTags returns tags of data in d whose name starts with prefix, and the
+// error of listing if d is a Lister
+func ListTags(d Depot, prefix string) ([]*Tag, error) {
+	if l, ok := d.(Lister); ok {
+		return l.ListTags(prefix)
+	}
+	return d.List(prefix), nil
+}
+
+// Locker is implemented by Depot that could be locked against other processes
+type Locker interface {
+	Lock() (unlock func(), err error)
+}
+
+// Transaction buffers changes to Depot until Commit applies them together
+type Transaction interface {
+	Depot
+	Updater
+	Swapper
+	Commit() error
+}
+
+// Journaler is implemented by Depot that commits Transaction through a journal,
+// so that changes interrupted by a crash could be rolled forward or back
+type Journaler interface {
+	Begin() Transaction
+	// Pending checks whether a journal is left by an interrupted Commit
+	Pending() bool
+	// Recover applies the pending journal, or undoes it if rollback is set
+	Recover(rollback bool) error
+}
+
+// Begin starts Transaction of d if it is a Journaler. Otherwise changes are
+// written to d directly, and Commit does nothing.
+func Begin(d Depot) Transaction {
+	if j, ok := d.(Journaler); ok {
+		return j.Begin()
+	}
+	return &directTransaction{d}
+}
+
+type directTransaction struct {
+	Depot
+}
+
+func (t *directTransaction) Update(tag *Tag, data []byte) error {
+	return update(t.Depot, tag, data)
+}
+
+func (t *directTransaction) Swap(tag *Tag, old, data []byte) error {
+	return swap(t.Depot, tag, old, data)
+}
+
+func (t *directTransaction) Commit() error {
+	return nil
+}
+
+// backends opens Depot of url scheme
+var backends = map[string]func(rawurl string) (Depot, error){
+	"file": openFileDepot,
+}
+
+// RegisterBackend makes Depot of url scheme available to Open
+func RegisterBackend(scheme string, open func(rawurl string) (Depot, error)) {
+	backends[scheme] = open
+}
+
+// Open returns Depot of the backend registered for scheme of rawurl
+func Open(rawurl string) (Depot, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	open, ok := backends[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported depot url scheme %s", u.Scheme)
+	}
+	return open(rawurl)
+}
+
+// FileInfo describes data in Depot
+type FileInfo struct {
+	os.FileInfo
+	Metadata map[string]string
+}
+
+// Updater is implemented by Depot that could replace data in one step,
+// instead of Delete and then Put
+type Updater interface {
+	Update(tag *Tag, data []byte) error
+}
+
+// update replaces data of tag in d
+func update(d Depot, tag *Tag, data []byte) error {
+	if u, ok := d.(Updater); ok {
+		return u.Update(tag, data)
+	}
+	d.Delete(tag)
+	return d.Put(tag, data)
+}
+
+// ErrConflict is returned when data has been changed by others since it was read
+var ErrConflict = errors.New("data has been changed by others")
+
+// Swapper is implemented by Depot that compares and replaces data in one
+// step, such as EtcdDepot
+type Swapper interface {
+	// Swap replaces data of tag if it is still old, or creates it if old is
+	// nil and it does not exist. Otherwise it returns ErrConflict.
+	Swap(tag *Tag, old, data []byte) error
+}
+
+// swap replaces data of tag in d if it is still old, which is the data the
+// caller has read, or creates it if old is nil
+func swap(d Depot, tag *Tag, old, data []byte) error {
+	if s, ok := d.(Swapper); ok {
+		return s.Swap(tag, old, data)
+	}
+	return compareAndUpdate(d, tag, old, data)
+}
+
+// compareAndUpdate is swap in two steps, for depots guarded by Locker or
+// only used by one process
+func compareAndUpdate(d Depot, tag *Tag, old, data []byte) error {
+	cur, err := d.Get(tag)
+	if old == nil {
+		if err == nil {
+			return &os.PathError{Op: "update", Path: tag.name, Err: ErrConflict}
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		return d.Put(tag, data)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &os.PathError{Op: "update", Path: tag.name, Err: ErrConflict}
+		}
+		return err
+	}
+	if !bytes.Equal(cur, old) {
+		return &os.PathError{Op: "update", Path: tag.name, Err: ErrConflict}
+	}
+	return update(d, tag, data)
 }
 
 // FileDepot is a implementation of Depot using file system
@@ -64,6 +234,22 @@ func NewFileDepot(dir string) (*FileDepot, error) {
 	return &FileDepot{dirpath}, nil
 }
 
+// openFileDepot opens FileDepot at file:///absolute/path or file:relative/path
+func openFileDepot(rawurl string) (Depot, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	dir := u.Opaque
+	if dir == "" {
+		dir = u.Host + u.Path
+	}
+	if dir == "" {
+		return nil, errors.New("depot url has no path")
+	}
+	return NewFileDepot(dir)
+}
+
 func (d *FileDepot) path(name string) string {
 	return filepath.Join(d.dirPath, name)
 }
@@ -72,27 +258,68 @@ func (d *FileDepot) Put(tag *Tag, data []byte) error {
 	if data == nil {
 		return errors.New("data is nil")
 	}
+	return d.writeFile(d.path(tag.name), data, tag.perm, false)
+}
 
-	if err := os.MkdirAll(d.dirPath, 0755); err != nil {
-		return err
+// Update replaces data of tag in one rename
+func (d *FileDepot) Update(tag *Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
 	}
+	return d.writeFile(d.path(tag.name), data, tag.perm, true)
+}
 
-	name := d.path(tag.name)
-	perm := tag.perm
+// writeFile writes data into a synced temp file and then moves it to name,
+// so that name never holds partial data after a crash. It fails if name
+// exists unless replace is set.
+func (d *FileDepot) writeFile(name string, data []byte, perm os.FileMode, replace bool) error {
+	dir := filepath.Join(d.dirPath, tmpDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	tmpName := file.Name()
+	defer os.Remove(tmpName)
 
-	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Chmod(perm)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
 		return err
 	}
 
-	if _, err := file.Write(data); err != nil {
-		file.Close()
-		os.Remove(name)
+	if replace {
+		err = os.Rename(tmpName, name)
+	} else if err = os.Link(tmpName, name); err != nil {
+		// Link fails if name exists, which is the same as O_EXCL
+		if lerr, ok := err.(*os.LinkError); ok {
+			err = &os.PathError{Op: "open", Path: name, Err: lerr.Err}
+		}
+	}
+	if err != nil {
 		return err
 	}
+	return syncDir(filepath.Dir(name))
+}
 
-	file.Close()
-	return nil
+// syncDir flushes the entries of directory, such as renamed files
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
 }
 
 func (d *FileDepot) Check(tag *Tag) bool {
@@ -123,10 +350,18 @@ func (d *FileDepot) Get(tag *Tag) ([]byte, error) {
 }
 
 func (d *FileDepot) Delete(tag *Tag) error {
-	return os.Remove(d.path(tag.name))
+	if err := os.Remove(d.path(tag.name)); err != nil {
+		return err
+	}
+	os.Remove(d.metadataPath(tag.name))
+	return nil
+}
+
+func (d *FileDepot) metadataPath(name string) string {
+	return filepath.Join(d.dirPath, metadataDir, name+".json")
 }
 
-func (d *FileDepot) List() []*Tag {
+func (d *FileDepot) List(prefix string) []*Tag {
 	tags := make([]*Tag, 0)
 
 	filepath.Walk(d.dirPath, func(path string, info os.FileInfo, err error) error {
@@ -140,7 +375,9 @@ func (d *FileDepot) List() []*Tag {
 		if err != nil {
 			return nil
 		}
-		if rel != info.Name() {
+		// Lock and journal are files of depot itself, while host names
+		// may start with dot as well
+		if rel != info.Name() || rel == lockName || rel == journalName || !strings.HasPrefix(rel, prefix) {
 			return nil
 		}
 		tags = append(tags, &Tag{info.Name(), info.Mode()})
@@ -150,19 +387,67 @@ func (d *FileDepot) List() []*Tag {
 	return tags
 }
 
+func (d *FileDepot) Stat(tag *Tag) (*FileInfo, error) {
+	if err := d.check(tag); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(d.path(tag.name))
+	if err != nil {
+		return nil, err
+	}
+	info := &FileInfo{fi, make(map[string]string)}
+	b, err := ioutil.ReadFile(d.metadataPath(tag.name))
+	if os.IsNotExist(err) {
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &info.Metadata); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (d *FileDepot) SetMetadata(tag *Tag, metadata map[string]string) error {
+	if err := d.check(tag); err != nil {
+		return err
+	}
+	name := d.metadataPath(tag.name)
+	if len(metadata) == 0 {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return d.writeFile(name, b, 0600, true)
+}
+
+func (d *FileDepot) GetFile(tag *Tag) (*File, error) {
+	return GetFile(d, tag)
+}
+
 type File struct {
 	Info os.FileInfo
 	Data []byte
 }
 
-func (d *FileDepot) GetFile(tag *Tag) (*File, error) {
-	if err := d.check(tag); err != nil {
+// GetFile returns data of tag with its FileInfo
+func GetFile(d Depot, tag *Tag) (*File, error) {
+	fi, err := d.Stat(tag)
+	if err != nil {
 		return nil, err
 	}
-	fi, err := os.Stat(d.path(tag.name))
+	b, err := d.Get(tag)
 	if err != nil {
 		return nil, err
 	}
-	b, err := ioutil.ReadFile(d.path(tag.name))
-	return &File{fi, b}, err
+	return &File{fi, b}, nil
 }
@@ -16,8 +16,18 @@ package depot
 
 import (
 	"bytes"
+	"crypto/elliptic"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/coreos/etcd-ca/pkix"
 )
 
 const (
@@ -134,13 +144,34 @@ func TestDepotList(t *testing.T) {
 		t.Fatal("Failed putting file into Depot:", err)
 	}
 
-	tags := d.List()
+	tags := d.List("")
 	if len(tags) != 2 {
 		t.Fatal("Expect to list 2 instead of", len(tags))
 	}
 	if tags[0].name != tag.name || tags[1].name != tag2.name {
 		t.Fatal("Failed getting file tags back")
 	}
+
+	tags = d.List("host2")
+	if len(tags) != 1 || tags[0].name != tag2.name {
+		t.Fatal("Failed listing file tags with prefix")
+	}
+
+	// Names starting with dot are listed, except files of depot itself
+	unlock, err := d.Lock()
+	if err != nil {
+		t.Fatal("Failed locking depot:", err)
+	}
+	defer unlock()
+	txn := d.Begin()
+	txn.Put(HostCrtTag(".host3"), []byte(data))
+	if err = txn.Commit(); err != nil {
+		t.Fatal("Failed committing transaction:", err)
+	}
+	tags = d.List("")
+	if len(tags) != 3 || tags[0].name != HostCrtTag(".host3").name {
+		t.Fatal("Expect host name starting with dot to be listed:", tags)
+	}
 }
 
 func TestDepotGetFile(t *testing.T) {
@@ -163,3 +194,260 @@ func TestDepotGetFile(t *testing.T) {
 		t.Fatal("Failed setting permission")
 	}
 }
+
+func TestDepotMetadata(t *testing.T) {
+	d := getDepot(t)
+	defer os.RemoveAll(dir)
+
+	if err := d.SetMetadata(tag, map[string]string{"issuer": "ca"}); err == nil {
+		t.Fatal("Expect not to set metadata of nonexist file")
+	}
+	if err := d.Put(tag, []byte(data)); err != nil {
+		t.Fatal("Failed putting file into Depot:", err)
+	}
+
+	fi, err := d.Stat(tag)
+	if err != nil {
+		t.Fatal("Failed getting file info from Depot:", err)
+	}
+	if fi.Size() != int64(len(data)) || fi.Mode().Perm() != tag.perm || len(fi.Metadata) != 0 {
+		t.Fatal("Unexpected file info:", fi)
+	}
+
+	if err = d.SetMetadata(tag, map[string]string{"issuer": "ca"}); err != nil {
+		t.Fatal("Failed setting metadata:", err)
+	}
+	if fi, err = d.Stat(tag); err != nil || fi.Metadata["issuer"] != "ca" {
+		t.Fatal("Failed getting metadata:", fi, err)
+	}
+	if tags := d.List(""); len(tags) != 1 {
+		t.Fatal("Expect metadata not to be listed:", tags)
+	}
+
+	d.Delete(tag)
+	d.Put(tag, []byte(data))
+	if fi, err = d.Stat(tag); err != nil || len(fi.Metadata) != 0 {
+		t.Fatal("Expect metadata to be deleted with file:", fi, err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	defer os.RemoveAll(dir)
+
+	d, err := Open("file:" + dir)
+	if err != nil {
+		t.Fatal("Failed opening FileDepot:", err)
+	}
+	if fd, ok := d.(*FileDepot); !ok || !strings.HasSuffix(fd.dirPath, dir) {
+		t.Fatal("Unexpected depot opened:", d)
+	}
+	if d, err = Open("etcd://127.0.0.1:2379/test"); err != nil {
+		t.Fatal("Failed opening EtcdDepot:", err)
+	}
+	if _, ok := d.(*EtcdDepot); !ok {
+		t.Fatal("Unexpected depot opened:", d)
+	}
+
+	RegisterBackend("mem", func(string) (Depot, error) { return NewMemoryDepot(), nil })
+	if d, err = Open("mem:"); err != nil {
+		t.Fatal("Failed opening registered backend:", err)
+	}
+	if _, ok := d.(*MemoryDepot); !ok {
+		t.Fatal("Unexpected depot opened:", d)
+	}
+	if _, err = Open("unknown://x"); err == nil {
+		t.Fatal("Expect error opening depot of unknown scheme")
+	}
+}
+
+func TestDepotUpdate(t *testing.T) {
+	d := getDepot(t)
+	defer os.RemoveAll(dir)
+
+	if err := d.Update(tag, []byte(data)); err != nil {
+		t.Fatal("Failed updating file into Depot:", err)
+	}
+	if err := d.Update(tag, []byte("updated")); err != nil {
+		t.Fatal("Failed updating file into Depot:", err)
+	}
+	if dataRead, _ := d.Get(tag); string(dataRead) != "updated" {
+		t.Fatal("Failed getting the updated data:", string(dataRead))
+	}
+	if tmpFiles, _ := ioutil.ReadDir(filepath.Join(dir, tmpDir)); len(tmpFiles) != 0 {
+		t.Fatal("Expect temp files to be removed:", tmpFiles)
+	}
+}
+
+func TestDepotTransaction(t *testing.T) {
+	d := getDepot(t)
+	defer os.RemoveAll(dir)
+
+	if err := d.Put(tag, []byte(data)); err != nil {
+		t.Fatal("Failed putting file into Depot:", err)
+	}
+	txn := d.Begin()
+	if err := txn.Put(tag, []byte(data)); err == nil || !os.IsExist(err) {
+		t.Fatal("Expect not to put existing file in transaction:", err)
+	}
+	if err := txn.Update(tag, []byte("updated")); err != nil {
+		t.Fatal("Failed updating file in transaction:", err)
+	}
+	if err := txn.Put(tag2, []byte(data)); err != nil {
+		t.Fatal("Failed putting file in transaction:", err)
+	}
+	if dataRead, _ := txn.Get(tag); string(dataRead) != "updated" {
+		t.Fatal("Expect transaction to read its changes:", string(dataRead))
+	}
+	if tags := txn.List(""); len(tags) != 2 {
+		t.Fatal("Expect transaction to list its changes:", tags)
+	}
+	if dataRead, _ := d.Get(tag); string(dataRead) != data || d.Check(tag2) {
+		t.Fatal("Expect depot not to be changed before commit")
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatal("Failed committing transaction:", err)
+	}
+	if dataRead, _ := d.Get(tag); string(dataRead) != "updated" || !d.Check(tag2) || d.Pending() {
+		t.Fatal("Expect depot to be changed after commit")
+	}
+}
+
+func TestDepotRecover(t *testing.T) {
+	for _, rollback := range []bool{false, true} {
+		d := getDepot(t)
+		d.Put(tag, []byte(data))
+
+		// Journal is left when the changes are interrupted
+		txn := d.Begin().(*fileTransaction)
+		txn.Update(tag, []byte("updated"))
+		txn.Put(tag2, []byte(data))
+		for _, e := range txn.entries {
+			e.OldData, _ = ioutil.ReadFile(d.path(e.Name))
+			e.Existed, e.OldPerm = e.OldData != nil, tag.perm
+		}
+		b, _ := json.Marshal(txn.entries)
+		d.writeFile(d.path(journalName), b, 0600, true)
+		d.writeFile(d.path(tag.name), []byte("updated"), tag.perm, true)
+
+		if !d.Pending() {
+			t.Fatal("Expect journal to be pending")
+		}
+		if tags := d.List(""); len(tags) != 1 {
+			t.Fatal("Expect journal not to be listed:", tags)
+		}
+		if err := d.Recover(rollback); err != nil {
+			t.Fatal("Failed recovering depot:", err)
+		}
+		if d.Pending() {
+			t.Fatal("Expect journal to be removed")
+		}
+		dataRead, _ := d.Get(tag)
+		if rollback && (string(dataRead) != data || d.Check(tag2)) {
+			t.Fatal("Failed rolling back depot:", string(dataRead))
+		}
+		if !rollback && (string(dataRead) != "updated" || !d.Check(tag2)) {
+			t.Fatal("Failed rolling forward depot:", string(dataRead))
+		}
+	}
+	os.RemoveAll(dir)
+}
+
+func TestDepotLock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("flock is not available on windows")
+	}
+	d := getDepot(t)
+	defer os.RemoveAll(dir)
+	d2, _ := NewFileDepot(dir)
+
+	unlock, err := d.Lock()
+	if err != nil {
+		t.Fatal("Failed locking depot:", err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		unlock2, err := d2.Lock()
+		if err != nil {
+			t.Error("Failed locking depot:", err)
+		} else {
+			unlock2()
+		}
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("Expect depot to be locked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expect depot to be unlocked")
+	}
+}
+
+// TestUpdateEncryptedPrivateKey tests that private key is replaced in place
+// only if it is still the one read by the caller
+func TestUpdateEncryptedPrivateKey(t *testing.T) {
+	fd := getDepot(t)
+	defer os.RemoveAll(dir)
+	kek, err := NewPassphraseKEK([]byte("secret"))
+	if err != nil {
+		t.Fatal("Failed creating key encryption key:", err)
+	}
+	encd, err := InitEncryptedDepot(NewMemoryDepot(), kek)
+	if err != nil {
+		t.Fatal("Failed encrypting depot:", err)
+	}
+
+	depots := []Depot{fd, NewMemoryDepot(), encd}
+	if etcdBinary() != "" {
+		ed, done := getEtcdDepot(t)
+		defer done()
+		depots = append(depots, ed)
+	}
+	for _, d := range depots {
+		key, err := pkix.CreateECDSAKey(elliptic.P256())
+		if err != nil {
+			t.Fatal("Failed creating ecdsa key:", err)
+		}
+		if err = UpdateEncryptedPrivateKeyHost(d, "host", nil, key, []byte("old"), pkix.DefaultKeyEncryption); err != nil {
+			t.Fatalf("Failed creating private key in %T: %v", d, err)
+		}
+		old, err := d.Get(HostPrivKeyTag("host"))
+		if err != nil {
+			t.Fatal("Failed getting private key:", err)
+		}
+		if err = UpdateEncryptedPrivateKeyHost(d, "host", old, key, []byte("new"), pkix.DefaultKeyEncryption); err != nil {
+			t.Fatalf("Failed updating private key in %T: %v", d, err)
+		}
+		if _, err = GetEncryptedPrivateKeyHost(d, "host", []byte("new")); err != nil {
+			t.Fatalf("Failed getting updated private key in %T: %v", d, err)
+		}
+
+		// Key read before the update above is stale
+		if err = UpdateEncryptedPrivateKeyHost(d, "host", old, key, []byte("stale"), pkix.DefaultKeyEncryption); !errors.Is(err, ErrConflict) {
+			t.Fatalf("Expect stale key not to be updated in %T: %v", d, err)
+		}
+		if err = UpdateEncryptedPrivateKeyHost(d, "host", nil, key, []byte("stale"), pkix.DefaultKeyEncryption); !errors.Is(err, ErrConflict) {
+			t.Fatalf("Expect existing key not to be created in %T: %v", d, err)
+		}
+		txn := Begin(d)
+		err = UpdateEncryptedPrivateKeyHost(txn, "host", old, key, []byte("stale"), pkix.DefaultKeyEncryption)
+		if err == nil {
+			err = txn.Commit()
+		}
+		if !errors.Is(err, ErrConflict) {
+			t.Fatalf("Expect stale key not to be updated by transaction of %T: %v", d, err)
+		}
+		if _, err = GetEncryptedPrivateKeyHost(d, "host", []byte("new")); err != nil {
+			t.Fatalf("Expect key to be kept in %T: %v", d, err)
+		}
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, tmpDir)); len(files) != 0 {
+		t.Fatal("Expect no temp file left:", files)
+	}
+}
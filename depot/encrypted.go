@@ -0,0 +1,630 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package depot
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/golang.org/x/crypto/scrypt"
+)
+
+const (
+	// masterKeyName holds the wrapped data key of EncryptedDepot in plaintext
+	masterKeyName = "master.key"
+
+	// encryptedMagic starts every blob sealed by EncryptedDepot
+	encryptedMagic = "etcd-ca-encrypted-v1\n"
+
+	dataKeySize   = 32
+	saltSize      = 16
+	sessionIDSize = 8
+
+	kdfScrypt  = "scrypt"
+	kdfKeyFile = "key-file"
+
+	// scrypt parameters recommended for interactive logins
+	scryptN = 1 << 14
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	ErrWrongMasterKey = errors.New("wrong passphrase or key file for depot")
+	ErrDepotEncrypted = errors.New("depot is already encrypted")
+	ErrSessionExpired = errors.New("depot session has expired or been locked")
+)
+
+func MasterKeyTag() *Tag {
+	return &Tag{masterKeyName, rootPerm}
+}
+
+// masterKey is the data key wrapped by key encryption key
+type masterKey struct {
+	KDF  string `json:"kdf"`
+	Salt []byte `json:"salt,omitempty"`
+	N    int    `json:"n,omitempty"`
+	R    int    `json:"r,omitempty"`
+	P    int    `json:"p,omitempty"`
+	// WrappedKey is the data key sealed by key encryption key
+	WrappedKey []byte `json:"wrapped_key"`
+	// KeyCheck is empty data sealed by the data key, which verifies
+	// the data key unwrapped by any key
+	KeyCheck []byte `json:"key_check"`
+	// Sessions wrap the data key for shells unlocked by 'depot unlock'
+	Sessions []*depotSession `json:"sessions,omitempty"`
+}
+
+// depotSession is the data key wrapped by a random session key, which
+// is handed out as session token instead of the data key itself
+type depotSession struct {
+	ID         string    `json:"id"`
+	Expiry     time.Time `json:"expiry"`
+	WrappedKey []byte    `json:"wrapped_key"`
+}
+
+// additionalData binds the wrapped key to the session and its expiry,
+// so that the expiry cannot be extended without the data key
+func (s *depotSession) additionalData() []byte {
+	return []byte(masterKeyName + "/" + s.ID + "/" + s.Expiry.UTC().Format(time.RFC3339))
+}
+
+// KeyEncryptionKey unwraps the data key of EncryptedDepot. It is derived
+// from passphrase by scrypt, or hashed from the content of key file.
+type KeyEncryptionKey struct {
+	kdf    string
+	secret []byte
+}
+
+func NewPassphraseKEK(passphrase []byte) (*KeyEncryptionKey, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return &KeyEncryptionKey{kdfScrypt, passphrase}, nil
+}
+
+// NewKeyFileKEK uses the content of key file, which should come from
+// a random source such as 'head -c 32 /dev/urandom'
+func NewKeyFileKEK(data []byte) (*KeyEncryptionKey, error) {
+	if len(data) < dataKeySize {
+		return nil, fmt.Errorf("key file is shorter than %d bytes", dataKeySize)
+	}
+	return &KeyEncryptionKey{kdfKeyFile, data}, nil
+}
+
+// newMasterKey prepares the record to wrap data key with kek
+func (kek *KeyEncryptionKey) newMasterKey() (*masterKey, error) {
+	mk := &masterKey{KDF: kek.kdf}
+	if kek.kdf == kdfScrypt {
+		mk.Salt = make([]byte, saltSize)
+		if _, err := io.ReadFull(rand.Reader, mk.Salt); err != nil {
+			return nil, err
+		}
+		mk.N, mk.R, mk.P = scryptN, scryptR, scryptP
+	}
+	return mk, nil
+}
+
+func (kek *KeyEncryptionKey) aead(mk *masterKey) (cipher.AEAD, error) {
+	if mk.KDF != kek.kdf {
+		return nil, fmt.Errorf("depot is locked by %s instead", mk.KDF)
+	}
+	var key []byte
+	switch mk.KDF {
+	case kdfScrypt:
+		var err error
+		if key, err = scrypt.Key(kek.secret, mk.Salt, mk.N, mk.R, mk.P, dataKeySize); err != nil {
+			return nil, err
+		}
+	case kdfKeyFile:
+		sum := sha256.Sum256(kek.secret)
+		key = sum[:]
+	default:
+		return nil, fmt.Errorf("unknown key derivation %s", mk.KDF)
+	}
+	return newAEAD(key)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("data key should be %d bytes", dataKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data with a random nonce, bound to additionalData
+func seal(aead cipher.AEAD, data []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, additionalData), nil
+}
+
+func open(aead cipher.AEAD, data []byte, additionalData []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	nonce := data[:aead.NonceSize()]
+	return aead.Open(nil, nonce, data[aead.NonceSize():], additionalData)
+}
+
+// EncryptedDepot wraps Depot to encrypt all data with AES-GCM under a data key,
+// which is kept in the wrapped depot under the key encryption key.
+// Names, permissions and metadata are stored in plaintext.
+type EncryptedDepot struct {
+	d       Depot
+	aead    cipher.AEAD
+	dataKey []byte
+}
+
+// IsEncryptedDepot checks whether d has been encrypted by InitEncryptedDepot
+func IsEncryptedDepot(d Depot) bool {
+	return d.Check(MasterKeyTag())
+}
+
+// InitEncryptedDepot creates the data key wrapped by kek in d,
+// and encrypts the data already in d
+func InitEncryptedDepot(d Depot, kek *KeyEncryptionKey) (*EncryptedDepot, error) {
+	if IsEncryptedDepot(d) {
+		return nil, ErrDepotEncrypted
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	mk, err := kek.newMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := kek.aead(mk)
+	if err != nil {
+		return nil, err
+	}
+	if mk.WrappedKey, err = seal(aead, dataKey, []byte(masterKeyName)); err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if mk.KeyCheck, err = seal(dataAEAD, nil, []byte(masterKeyName)); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(mk)
+	if err != nil {
+		return nil, err
+	}
+	// Put the master key first, so an interrupted encryption could be
+	// finished by EncryptAll without losing the data key
+	if err = d.Put(MasterKeyTag(), b); err != nil {
+		return nil, err
+	}
+	e, err := openEncryptedDepot(d, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return e, e.EncryptAll()
+}
+
+// OpenEncryptedDepot unwraps the data key of d with kek
+func OpenEncryptedDepot(d Depot, kek *KeyEncryptionKey) (*EncryptedDepot, error) {
+	mk, err := getMasterKey(d)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := kek.aead(mk)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := open(aead, mk.WrappedKey, []byte(masterKeyName))
+	if err != nil {
+		return nil, ErrWrongMasterKey
+	}
+	return openEncryptedDepot(d, dataKey)
+}
+
+// openEncryptedDepot opens d with the unwrapped data key
+func openEncryptedDepot(d Depot, dataKey []byte) (*EncryptedDepot, error) {
+	mk, err := getMasterKey(d)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	// A stale data key of another depot fails here instead of on the first Get
+	if _, err = open(aead, mk.KeyCheck, []byte(masterKeyName)); err != nil {
+		return nil, ErrWrongMasterKey
+	}
+	return &EncryptedDepot{d, aead, append([]byte(nil), dataKey...)}, nil
+}
+
+func getMasterKey(d Depot) (*masterKey, error) {
+	b, err := d.Get(MasterKeyTag())
+	if err != nil {
+		return nil, err
+	}
+	mk := new(masterKey)
+	if err = json.Unmarshal(b, mk); err != nil {
+		return nil, err
+	}
+	return mk, nil
+}
+
+func putMasterKey(d Depot, mk *masterKey) error {
+	b, err := json.Marshal(mk)
+	if err != nil {
+		return err
+	}
+	return update(d, MasterKeyTag(), b)
+}
+
+// NewSession wraps the data key under a random session key that expires
+// after ttl, and returns the session token holding the session key.
+// Expired sessions are removed meanwhile.
+func (e *EncryptedDepot) NewSession(ttl time.Duration) (string, error) {
+	mk, err := getMasterKey(e.d)
+	if err != nil {
+		return "", err
+	}
+	id := make([]byte, sessionIDSize)
+	sessionKey := make([]byte, dataKeySize)
+	if _, err = io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	if _, err = io.ReadFull(rand.Reader, sessionKey); err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(sessionKey)
+	if err != nil {
+		return "", err
+	}
+	s := &depotSession{
+		ID:     base64.RawURLEncoding.EncodeToString(id),
+		Expiry: time.Now().Add(ttl).UTC().Truncate(time.Second),
+	}
+	if s.WrappedKey, err = seal(aead, e.dataKey, s.additionalData()); err != nil {
+		return "", err
+	}
+	sessions := []*depotSession{s}
+	for _, other := range mk.Sessions {
+		if time.Now().Before(other.Expiry) {
+			sessions = append(sessions, other)
+		}
+	}
+	mk.Sessions = sessions
+	if err = putMasterKey(e.d, mk); err != nil {
+		return "", err
+	}
+	return s.ID + "." + base64.RawURLEncoding.EncodeToString(sessionKey), nil
+}
+
+// parseSessionToken splits token returned by NewSession into the session ID
+// and session key
+func parseSessionToken(token string) (string, []byte, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", nil, errors.New("malformed depot session")
+	}
+	sessionKey, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(sessionKey) != dataKeySize {
+		return "", nil, errors.New("malformed depot session")
+	}
+	return parts[0], sessionKey, nil
+}
+
+// OpenEncryptedDepotWithSession opens d with the token returned by NewSession,
+// which lets an unlocked shell skip the key derivation
+func OpenEncryptedDepotWithSession(d Depot, token string) (*EncryptedDepot, error) {
+	id, sessionKey, err := parseSessionToken(token)
+	if err != nil {
+		return nil, err
+	}
+	mk, err := getMasterKey(d)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range mk.Sessions {
+		if s.ID != id {
+			continue
+		}
+		if !time.Now().Before(s.Expiry) {
+			break
+		}
+		aead, err := newAEAD(sessionKey)
+		if err != nil {
+			return nil, err
+		}
+		dataKey, err := open(aead, s.WrappedKey, s.additionalData())
+		if err != nil {
+			return nil, ErrWrongMasterKey
+		}
+		return openEncryptedDepot(d, dataKey)
+	}
+	return nil, ErrSessionExpired
+}
+
+// EndSession removes the session of token from d, so that the token cannot
+// unlock d any more. It needs no key, as sessions are stored in plaintext.
+func EndSession(d Depot, token string) error {
+	id, _, err := parseSessionToken(token)
+	if err != nil {
+		return err
+	}
+	mk, err := getMasterKey(d)
+	if err != nil {
+		return err
+	}
+	sessions := make([]*depotSession, 0)
+	for _, s := range mk.Sessions {
+		if s.ID != id && time.Now().Before(s.Expiry) {
+			sessions = append(sessions, s)
+		}
+	}
+	mk.Sessions = sessions
+	return putMasterKey(d, mk)
+}
+
+// ChangeKEK wraps the data key with kek instead, such as a new passphrase.
+// All sessions are ended, as they may be unlocked by the old one.
+func (e *EncryptedDepot) ChangeKEK(kek *KeyEncryptionKey) error {
+	old, err := getMasterKey(e.d)
+	if err != nil {
+		return err
+	}
+	mk, err := kek.newMasterKey()
+	if err != nil {
+		return err
+	}
+	aead, err := kek.aead(mk)
+	if err != nil {
+		return err
+	}
+	if mk.WrappedKey, err = seal(aead, e.dataKey, []byte(masterKeyName)); err != nil {
+		return err
+	}
+	mk.KeyCheck = old.KeyCheck
+	return putMasterKey(e.d, mk)
+}
+
+// EncryptAll encrypts the data in the wrapped depot that is still plaintext
+func (e *EncryptedDepot) EncryptAll() error {
+	for _, tag := range e.List("") {
+		b, err := e.d.Get(tag)
+		if err != nil {
+			return err
+		}
+		if isSealed(b) {
+			continue
+		}
+		sealed, err := e.seal(tag, b)
+		if err != nil {
+			return err
+		}
+		if err = update(e.d, tag, sealed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedMagic))
+}
+
+// seal encrypts data bound to the name of tag, so that it cannot be
+// moved to another name
+func (e *EncryptedDepot) seal(tag *Tag, data []byte) ([]byte, error) {
+	sealed, err := seal(e.aead, data, []byte(tag.name))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(encryptedMagic), sealed...), nil
+}
+
+func (e *EncryptedDepot) open(tag *Tag, data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return nil, fmt.Errorf("%s is not encrypted, run 'etcd-ca depot encrypt' to finish encryption", tag.name)
+	}
+	b, err := open(e.aead, data[len(encryptedMagic):], []byte(tag.name))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %s: %w", tag.name, ErrWrongMasterKey)
+	}
+	return b, nil
+}
+
+func (e *EncryptedDepot) Put(tag *Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	sealed, err := e.seal(tag, data)
+	if err != nil {
+		return err
+	}
+	return e.d.Put(tag, sealed)
+}
+
+func (e *EncryptedDepot) Update(tag *Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	sealed, err := e.seal(tag, data)
+	if err != nil {
+		return err
+	}
+	return update(e.d, tag, sealed)
+}
+
+// Swap compares the plaintext with old, and swaps the sealed data in the
+// wrapped depot, so that it fails if the data is changed in between
+func (e *EncryptedDepot) Swap(tag *Tag, old, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	var sealedOld []byte
+	if old != nil {
+		var err error
+		if sealedOld, err = e.d.Get(tag); err != nil {
+			if os.IsNotExist(err) {
+				return &os.PathError{Op: "update", Path: tag.name, Err: ErrConflict}
+			}
+			return err
+		}
+		b, err := e.open(tag, sealedOld)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(b, old) {
+			return &os.PathError{Op: "update", Path: tag.name, Err: ErrConflict}
+		}
+	}
+	sealed, err := e.seal(tag, data)
+	if err != nil {
+		return err
+	}
+	return swap(e.d, tag, sealedOld, sealed)
+}
+
+func (e *EncryptedDepot) Check(tag *Tag) bool {
+	return tag.name != masterKeyName && e.d.Check(tag)
+}
+
+func (e *EncryptedDepot) Get(tag *Tag) ([]byte, error) {
+	if tag.name == masterKeyName {
+		return nil, &os.PathError{Op: "get", Path: tag.name, Err: os.ErrPermission}
+	}
+	b, err := e.d.Get(tag)
+	if err != nil {
+		return nil, err
+	}
+	return e.open(tag, b)
+}
+
+func (e *EncryptedDepot) Delete(tag *Tag) error {
+	if tag.name == masterKeyName {
+		return &os.PathError{Op: "delete", Path: tag.name, Err: os.ErrPermission}
+	}
+	return e.d.Delete(tag)
+}
+
+// List returns tags of data in the wrapped depot except the master key
+func (e *EncryptedDepot) List(prefix string) []*Tag {
+	tags, _ := e.ListTags(prefix)
+	return tags
+}
+
+// ListTags is List that reports the error of listing the wrapped depot
+func (e *EncryptedDepot) ListTags(prefix string) ([]*Tag, error) {
+	listed, err := ListTags(e.d, prefix)
+	if err != nil {
+		return make([]*Tag, 0), err
+	}
+	tags := make([]*Tag, 0)
+	for _, tag := range listed {
+		if tag.name != masterKeyName {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// Stat returns info of data with the size of plaintext
+func (e *EncryptedDepot) Stat(tag *Tag) (*FileInfo, error) {
+	fi, err := e.d.Stat(tag)
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size() - int64(len(encryptedMagic)+e.aead.NonceSize()+e.aead.Overhead())
+	if size < 0 {
+		size = 0
+	}
+	return &FileInfo{&encryptedFileInfo{fi.FileInfo, size}, fi.Metadata}, nil
+}
+
+func (e *EncryptedDepot) SetMetadata(tag *Tag, metadata map[string]string) error {
+	return e.d.SetMetadata(tag, metadata)
+}
+
+func (e *EncryptedDepot) GetFile(tag *Tag) (*File, error) {
+	return GetFile(e, tag)
+}
+
+// Lock locks the wrapped depot if it supports
+func (e *EncryptedDepot) Lock() (func(), error) {
+	if l, ok := e.d.(Locker); ok {
+		return l.Lock()
+	}
+	return func() {}, nil
+}
+
+// Begin starts Transaction of the wrapped depot, which buffers encrypted data.
+// Changes are written directly if the wrapped depot keeps no journal.
+func (e *EncryptedDepot) Begin() Transaction {
+	j, ok := e.d.(Journaler)
+	if !ok {
+		return &encryptedTransaction{e, nil}
+	}
+	txn := j.Begin()
+	return &encryptedTransaction{&EncryptedDepot{txn, e.aead, e.dataKey}, txn}
+}
+
+func (e *EncryptedDepot) Pending() bool {
+	j, ok := e.d.(Journaler)
+	return ok && j.Pending()
+}
+
+func (e *EncryptedDepot) Recover(rollback bool) error {
+	if j, ok := e.d.(Journaler); ok {
+		return j.Recover(rollback)
+	}
+	return nil
+}
+
+type encryptedTransaction struct {
+	*EncryptedDepot
+	txn Transaction
+}
+
+func (t *encryptedTransaction) Commit() error {
+	if t.txn == nil {
+		return nil
+	}
+	return t.txn.Commit()
+}
+
+// encryptedFileInfo reports the size of plaintext
+type encryptedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi *encryptedFileInfo) Size() int64 { return fi.size }
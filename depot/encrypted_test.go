@@ -0,0 +1,200 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package depot
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncryptedDepot(t *testing.T) {
+	m := NewMemoryDepot()
+	m.Put(tag, []byte(data))
+
+	kek, err := NewPassphraseKEK([]byte("secret"))
+	if err != nil {
+		t.Fatal("Failed creating key encryption key:", err)
+	}
+	e, err := InitEncryptedDepot(m, kek)
+	if err != nil {
+		t.Fatal("Failed encrypting depot:", err)
+	}
+	if !IsEncryptedDepot(m) {
+		t.Fatal("Expect depot to be encrypted")
+	}
+	if _, err = InitEncryptedDepot(m, kek); err != ErrDepotEncrypted {
+		t.Fatal("Expect not to encrypt depot twice:", err)
+	}
+	if raw, _ := m.Get(tag); bytes.Contains(raw, []byte(data)) {
+		t.Fatal("Expect existing data to be encrypted")
+	}
+	if dataRead, err := e.Get(tag); err != nil || string(dataRead) != data {
+		t.Fatal("Failed getting existing data:", string(dataRead), err)
+	}
+
+	if err = e.Put(tag2, []byte(data)); err != nil {
+		t.Fatal("Failed putting data into EncryptedDepot:", err)
+	}
+	if raw, _ := m.Get(tag2); bytes.Contains(raw, []byte(data)) {
+		t.Fatal("Expect data to be encrypted")
+	}
+	if err = e.Update(tag2, []byte("updated")); err != nil {
+		t.Fatal("Failed updating data:", err)
+	}
+	if tags := e.List(""); len(tags) != 2 || e.Check(MasterKeyTag()) {
+		t.Fatal("Expect master key to be hidden:", tags)
+	}
+	if fi, err := e.Stat(tag2); err != nil || fi.Size() != int64(len("updated")) {
+		t.Fatal("Expect size of plaintext:", fi, err)
+	}
+
+	// Data cannot be moved to another name
+	raw, _ := m.Get(tag2)
+	m.Update(tag, raw)
+	if _, err = e.Get(tag); !errors.Is(err, ErrWrongMasterKey) {
+		t.Fatal("Expect data to be bound to its name:", err)
+	}
+	if err = e.Delete(MasterKeyTag()); !os.IsPermission(err) {
+		t.Fatal("Expect not to delete master key:", err)
+	}
+
+	wrong, _ := NewPassphraseKEK([]byte("wrong"))
+	if _, err = OpenEncryptedDepot(m, wrong); err != ErrWrongMasterKey {
+		t.Fatal("Expect wrong passphrase error:", err)
+	}
+	opened, err := OpenEncryptedDepot(m, kek)
+	if err != nil {
+		t.Fatal("Failed opening EncryptedDepot:", err)
+	}
+	if dataRead, err := opened.Get(tag2); err != nil || string(dataRead) != "updated" {
+		t.Fatal("Failed getting data:", string(dataRead), err)
+	}
+	if _, err = openEncryptedDepot(m, make([]byte, dataKeySize)); err != ErrWrongMasterKey {
+		t.Fatal("Expect wrong data key error:", err)
+	}
+}
+
+func TestEncryptedDepotSession(t *testing.T) {
+	m := NewMemoryDepot()
+	kek, _ := NewPassphraseKEK([]byte("secret"))
+	e, err := InitEncryptedDepot(m, kek)
+	if err != nil {
+		t.Fatal("Failed encrypting depot:", err)
+	}
+	e.Put(tag, []byte(data))
+
+	token, err := e.NewSession(time.Hour)
+	if err != nil {
+		t.Fatal("Failed creating session:", err)
+	}
+	if raw, _ := m.Get(MasterKeyTag()); bytes.Contains(raw, []byte(token)) || strings.Contains(token, string(e.dataKey)) {
+		t.Fatal("Expect session token to hold neither the data key nor be stored")
+	}
+	session, err := OpenEncryptedDepotWithSession(m, token)
+	if err != nil {
+		t.Fatal("Failed opening EncryptedDepot with session:", err)
+	}
+	if dataRead, err := session.Get(tag); err != nil || string(dataRead) != data {
+		t.Fatal("Failed getting data with session:", string(dataRead), err)
+	}
+	id, _, _ := parseSessionToken(token)
+	if _, err = OpenEncryptedDepotWithSession(m, id+"."+base64.RawURLEncoding.EncodeToString(make([]byte, dataKeySize))); err != ErrWrongMasterKey {
+		t.Fatal("Expect wrong session key error:", err)
+	}
+
+	expired, err := e.NewSession(-time.Minute)
+	if err != nil {
+		t.Fatal("Failed creating session:", err)
+	}
+	if _, err = OpenEncryptedDepotWithSession(m, expired); err != ErrSessionExpired {
+		t.Fatal("Expect expired session error:", err)
+	}
+	// Expiry is bound to the wrapped key
+	mk, _ := getMasterKey(m)
+	for _, s := range mk.Sessions {
+		s.Expiry = s.Expiry.Add(24 * time.Hour)
+	}
+	putMasterKey(m, mk)
+	if _, err = OpenEncryptedDepotWithSession(m, expired); err != ErrWrongMasterKey {
+		t.Fatal("Expect extended session to fail:", err)
+	}
+
+	if err = EndSession(m, expired); err != nil {
+		t.Fatal("Failed ending session:", err)
+	}
+	if _, err = OpenEncryptedDepotWithSession(m, expired); err != ErrSessionExpired {
+		t.Fatal("Expect ended session error:", err)
+	}
+
+	token, _ = e.NewSession(time.Hour)
+	changed, _ := NewPassphraseKEK([]byte("changed"))
+	if err = e.ChangeKEK(changed); err != nil {
+		t.Fatal("Failed changing key encryption key:", err)
+	}
+	if _, err = OpenEncryptedDepotWithSession(m, token); err != ErrSessionExpired {
+		t.Fatal("Expect sessions to end with the old key:", err)
+	}
+	if _, err = OpenEncryptedDepot(m, kek); err != ErrWrongMasterKey {
+		t.Fatal("Expect old passphrase to fail:", err)
+	}
+	opened, err := OpenEncryptedDepot(m, changed)
+	if err != nil {
+		t.Fatal("Failed opening EncryptedDepot with new passphrase:", err)
+	}
+	if dataRead, err := opened.Get(tag); err != nil || string(dataRead) != data {
+		t.Fatal("Failed getting data with new passphrase:", string(dataRead), err)
+	}
+}
+
+func TestEncryptedDepotKeyFile(t *testing.T) {
+	if _, err := NewKeyFileKEK([]byte("short")); err == nil {
+		t.Fatal("Expect error for short key file")
+	}
+	keyFile := bytes.Repeat([]byte{'k'}, 32)
+	kek, _ := NewKeyFileKEK(keyFile)
+	d := getDepot(t)
+	defer os.RemoveAll(dir)
+
+	e, err := InitEncryptedDepot(d, kek)
+	if err != nil {
+		t.Fatal("Failed encrypting depot:", err)
+	}
+	txn := e.Begin()
+	if err = txn.Put(tag, []byte(data)); err != nil {
+		t.Fatal("Failed putting data in transaction:", err)
+	}
+	if err = txn.Commit(); err != nil {
+		t.Fatal("Failed committing transaction:", err)
+	}
+
+	passphrase, _ := NewPassphraseKEK(keyFile)
+	if _, err = OpenEncryptedDepot(d, passphrase); err == nil {
+		t.Fatal("Expect not to open depot locked by key file with passphrase")
+	}
+	if e, err = OpenEncryptedDepot(d, kek); err != nil {
+		t.Fatal("Failed opening EncryptedDepot:", err)
+	}
+	if dataRead, err := e.Get(tag); err != nil || string(dataRead) != data {
+		t.Fatal("Failed getting committed data:", string(dataRead), err)
+	}
+	if raw, _ := d.Get(tag); bytes.Contains(raw, []byte(data)) {
+		t.Fatal("Expect committed data to be encrypted")
+	}
+}
@@ -0,0 +1,624 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package depot
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultEtcdDepotPrefix = "/etcd-ca"
+)
+
+// EtcdDepot is a implementation of Depot using etcd v3 through its JSON gateway.
+// Data of tag is kept in key <prefix>/<perm>/<name>, so that etcd RBAC roles
+// could be granted on the range of each permission, and Check/Get only find
+// data put with the same permission. Its modification time and metadata are
+// kept in <prefix>/mtime/<name> and <prefix>/metadata/<name>.
+type EtcdDepot struct {
+	endpoint string
+	prefix   string
+	user     string
+	password string
+
+	client *http.Client
+
+	mu    sync.Mutex
+	token string
+	// mod_revision of keys read by Get, compared in Update
+	revisions map[string]int64
+}
+
+func init() {
+	open := func(rawurl string) (Depot, error) { return NewEtcdDepot(rawurl) }
+	RegisterBackend("etcd", open)
+	RegisterBackend("etcds", open)
+}
+
+// NewEtcdDepot creates EtcdDepot from url etcd://[user:password@]host:port/prefix,
+// or etcds:// to connect with TLS
+func NewEtcdDepot(rawurl string) (*EtcdDepot, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	var scheme string
+	switch u.Scheme {
+	case "etcd":
+		scheme = "http"
+	case "etcds":
+		scheme = "https"
+	default:
+		return nil, fmt.Errorf("unsupported depot url scheme %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("depot url has no etcd endpoint")
+	}
+	prefix := path.Clean("/" + u.Path)
+	if prefix == "/" {
+		prefix = DefaultEtcdDepotPrefix
+	}
+	d := &EtcdDepot{
+		endpoint:  scheme + "://" + u.Host,
+		prefix:    prefix,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		revisions: make(map[string]int64),
+	}
+	if u.User != nil {
+		d.user = u.User.Username()
+		d.password, _ = u.User.Password()
+	}
+	return d, nil
+}
+
+// NewEtcdTLSConfig returns TLS config to connect to etcds:// depot, which
+// trusts only CA certificates in caFile if it is given, and presents client
+// certificate certFile with key keyFile if they are given
+func NewEtcdTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("client certificate and key of etcd must be given together")
+		}
+		crt, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{crt}
+	}
+	return config, nil
+}
+
+// SetTLSConfig sets TLS config to connect to etcds:// depot
+func (d *EtcdDepot) SetTLSConfig(config *tls.Config) {
+	d.client.Transport = &http.Transport{TLSClientConfig: config}
+}
+
+func (d *EtcdDepot) permPrefix(perm os.FileMode) string {
+	return fmt.Sprintf("%s/%04o/", d.prefix, perm.Perm())
+}
+
+func (d *EtcdDepot) key(tag *Tag) string {
+	return d.permPrefix(tag.perm) + tag.name
+}
+
+func (d *EtcdDepot) mtimeKey(tag *Tag) string {
+	return d.prefix + "/mtime/" + tag.name
+}
+
+func (d *EtcdDepot) metadataKey(tag *Tag) string {
+	return d.prefix + "/metadata/" + tag.name
+}
+
+// etcdInt64 is int64 field of gateway response, which is encoded as JSON string
+type etcdInt64 int64
+
+func (i *etcdInt64) UnmarshalJSON(b []byte) error {
+	n, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	*i = etcdInt64(n)
+	return err
+}
+
+type etcdKeyValue struct {
+	Key            []byte    `json:"key"`
+	Value          []byte    `json:"value"`
+	CreateRevision etcdInt64 `json:"create_revision"`
+	ModRevision    etcdInt64 `json:"mod_revision"`
+}
+
+type etcdHeader struct {
+	Revision etcdInt64 `json:"revision"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader      `json:"header"`
+	Kvs    []*etcdKeyValue `json:"kvs"`
+}
+
+type etcdCompare struct {
+	Key            []byte `json:"key"`
+	Result         string `json:"result"`
+	Target         string `json:"target"`
+	CreateRevision *int64 `json:"create_revision,omitempty"`
+	ModRevision    *int64 `json:"mod_revision,omitempty"`
+	Value          []byte `json:"value,omitempty"`
+}
+
+// newEtcdCompare compares key with revision rev of target, which is
+// CREATE or MOD
+func newEtcdCompare(key string, target string, rev int64) *etcdCompare {
+	cmp := &etcdCompare{Key: []byte(key), Result: "EQUAL", Target: target}
+	// target_union is oneof, so only the field of target is set
+	if target == "CREATE" {
+		cmp.CreateRevision = &rev
+	} else {
+		cmp.ModRevision = &rev
+	}
+	return cmp
+}
+
+// newEtcdSwapCompare compares key with old value, or checks that it does
+// not exist if old is nil
+func newEtcdSwapCompare(key string, old []byte) *etcdCompare {
+	if old == nil {
+		return newEtcdCompare(key, "CREATE", 0)
+	}
+	return &etcdCompare{Key: []byte(key), Result: "EQUAL", Target: "VALUE", Value: old}
+}
+
+type etcdPutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdDeleteRangeRequest struct {
+	Key []byte `json:"key"`
+}
+
+// etcdRequestOp is oneof request, so only one field is set
+type etcdRequestOp struct {
+	RequestPut         *etcdPutRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdDeleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type etcdTxnRequest struct {
+	Compare []*etcdCompare   `json:"compare"`
+	Success []*etcdRequestOp `json:"success"`
+}
+
+type etcdTxnResponse struct {
+	Header    etcdHeader `json:"header"`
+	Succeeded bool       `json:"succeeded"`
+}
+
+type etcdDeleteRangeResponse struct {
+	Deleted etcdInt64 `json:"deleted"`
+}
+
+// etcdError is the error status returned by the gateway
+type etcdError struct {
+	Status  string `json:"-"`
+	Message string `json:"message"`
+	Err     string `json:"error"`
+}
+
+func (e *etcdError) Error() string {
+	return fmt.Sprintf("etcd: %s %s", e.Status, e.Message)
+}
+
+// isInvalidToken checks whether etcd refuses the token, which expires when
+// its TTL passes or etcd restarts
+func (e *etcdError) isInvalidToken() bool {
+	return strings.Contains(e.Message, "invalid auth token") || strings.Contains(e.Message, "revision of auth store is old")
+}
+
+// call posts req to the gateway method, and decodes the response into resp.
+// It authenticates again and retries once if the token is refused.
+func (d *EtcdDepot) call(method string, req, resp interface{}) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	token, err := d.post(method, b, resp)
+	var e *etcdError
+	if errors.As(err, &e) && e.isInvalidToken() && token != "" {
+		d.mu.Lock()
+		if d.token == token {
+			d.token = ""
+		}
+		d.mu.Unlock()
+		_, err = d.post(method, b, resp)
+	}
+	return err
+}
+
+// post posts body to the gateway method with the token, which is returned
+func (d *EtcdDepot) post(method string, body []byte, resp interface{}) (string, error) {
+	if err := d.authenticate(); err != nil {
+		return "", err
+	}
+	httpReq, err := http.NewRequest("POST", d.endpoint+"/v3/"+method, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	d.mu.Lock()
+	token := d.token
+	d.mu.Unlock()
+	if token != "" {
+		httpReq.Header.Set("Authorization", token)
+	}
+	return token, d.do(httpReq, resp)
+}
+
+func (d *EtcdDepot) do(req *http.Request, resp interface{}) error {
+	httpResp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		e := &etcdError{Status: httpResp.Status}
+		json.NewDecoder(httpResp.Body).Decode(e)
+		if e.Message == "" {
+			e.Message = e.Err
+		}
+		return e
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// authenticate gets the token of user for later requests, unless one is
+// kept from earlier requests
+func (d *EtcdDepot) authenticate() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.user == "" || d.token != "" {
+		return nil
+	}
+	b, _ := json.Marshal(map[string]string{"name": d.user, "password": d.password})
+	req, err := http.NewRequest("POST", d.endpoint+"/v3/auth/authenticate", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err = d.do(req, &resp); err != nil {
+		return err
+	}
+	d.token = resp.Token
+	return nil
+}
+
+func (d *EtcdDepot) get(key string) (*etcdKeyValue, error) {
+	var resp etcdRangeResponse
+	if err := d.call("kv/range", map[string][]byte{"key": []byte(key)}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, &os.PathError{Op: "get", Path: key, Err: syscall.ENOENT}
+	}
+	return resp.Kvs[0], nil
+}
+
+// txnPut puts data of tag and its modification time if cmp succeeds
+func (d *EtcdDepot) txnPut(tag *Tag, data []byte, cmp *etcdCompare) (bool, error) {
+	key := d.key(tag)
+	mtime, err := time.Now().MarshalText()
+	if err != nil {
+		return false, err
+	}
+	req := &etcdTxnRequest{
+		Compare: []*etcdCompare{cmp},
+		Success: []*etcdRequestOp{
+			{RequestPut: &etcdPutRequest{[]byte(key), data}},
+			{RequestPut: &etcdPutRequest{[]byte(d.mtimeKey(tag)), mtime}},
+		},
+	}
+	var resp etcdTxnResponse
+	if err := d.call("kv/txn", req, &resp); err != nil {
+		return false, err
+	}
+	if resp.Succeeded {
+		d.mu.Lock()
+		d.revisions[key] = int64(resp.Header.Revision)
+		d.mu.Unlock()
+	}
+	return resp.Succeeded, nil
+}
+
+// Put creates key of tag in one transaction, and fails if it exists
+func (d *EtcdDepot) Put(tag *Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	key := d.key(tag)
+	ok, err := d.txnPut(tag, data, newEtcdCompare(key, "CREATE", 0))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &os.PathError{Op: "put", Path: key, Err: syscall.EEXIST}
+	}
+	return nil
+}
+
+// Update replaces data of tag in one transaction if it is unchanged since
+// last Get, or creates it if it was not read. It returns ErrConflict
+// when another writer gets there first.
+func (d *EtcdDepot) Update(tag *Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	key := d.key(tag)
+	d.mu.Lock()
+	rev := d.revisions[key]
+	d.mu.Unlock()
+	ok, err := d.txnPut(tag, data, newEtcdCompare(key, "MOD", rev))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &os.PathError{Op: "update", Path: key, Err: ErrConflict}
+	}
+	return nil
+}
+
+// Swap replaces data of tag in one transaction if its value is still old
+func (d *EtcdDepot) Swap(tag *Tag, old, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	key := d.key(tag)
+	ok, err := d.txnPut(tag, data, newEtcdSwapCompare(key, old))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &os.PathError{Op: "update", Path: key, Err: ErrConflict}
+	}
+	return nil
+}
+
+func (d *EtcdDepot) Check(tag *Tag) bool {
+	_, err := d.get(d.key(tag))
+	return err == nil
+}
+
+func (d *EtcdDepot) Get(tag *Tag) ([]byte, error) {
+	kv, err := d.get(d.key(tag))
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.revisions[string(kv.Key)] = int64(kv.ModRevision)
+	d.mu.Unlock()
+	return kv.Value, nil
+}
+
+func (d *EtcdDepot) Delete(tag *Tag) error {
+	key := d.key(tag)
+	var resp etcdDeleteRangeResponse
+	if err := d.call("kv/deleterange", map[string][]byte{"key": []byte(key)}, &resp); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	delete(d.revisions, key)
+	d.mu.Unlock()
+	if resp.Deleted == 0 {
+		return &os.PathError{Op: "delete", Path: key, Err: syscall.ENOENT}
+	}
+	for _, k := range []string{d.mtimeKey(tag), d.metadataKey(tag)} {
+		d.call("kv/deleterange", map[string][]byte{"key": []byte(k)}, &resp)
+	}
+	return nil
+}
+
+// List returns tags of data whose name starts with prefix, or no tags if
+// etcd could not be reached. Use ListTags to get the error.
+func (d *EtcdDepot) List(prefix string) []*Tag {
+	tags, _ := d.ListTags(prefix)
+	return tags
+}
+
+// ListTags returns tags of data whose name starts with prefix
+func (d *EtcdDepot) ListTags(prefix string) ([]*Tag, error) {
+	tags := make([]*Tag, 0)
+	kvs, err := d.rangePrefix(d.prefix + "/")
+	if err != nil {
+		return tags, err
+	}
+	for _, kv := range kvs {
+		if tag := d.tag(string(kv.Key)); tag != nil && strings.HasPrefix(tag.name, prefix) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+func (d *EtcdDepot) rangePrefix(prefix string) ([]*etcdKeyValue, error) {
+	req := map[string][]byte{
+		"key":       []byte(prefix),
+		"range_end": prefixRangeEnd(prefix),
+	}
+	var resp etcdRangeResponse
+	if err := d.call("kv/range", req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Kvs, nil
+}
+
+// tag parses key <prefix>/<perm>/<name> back into tag
+func (d *EtcdDepot) tag(key string) *Tag {
+	parts := strings.SplitN(strings.TrimPrefix(key, d.prefix+"/"), "/", 2)
+	if len(parts) != 2 || parts[1] == "" || strings.Contains(parts[1], "/") {
+		return nil
+	}
+	perm, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return nil
+	}
+	return &Tag{parts[1], os.FileMode(perm)}
+}
+
+// Stat returns FileInfo of tag. Modification time and metadata are left
+// empty if the role could not read them.
+func (d *EtcdDepot) Stat(tag *Tag) (*FileInfo, error) {
+	kv, err := d.get(d.key(tag))
+	if err != nil {
+		return nil, err
+	}
+	fi := &etcdFileInfo{tag: tag, size: int64(len(kv.Value))}
+	if kv, err := d.get(d.mtimeKey(tag)); err == nil {
+		fi.modTime.UnmarshalText(kv.Value)
+	}
+	metadata := make(map[string]string)
+	if kv, err := d.get(d.metadataKey(tag)); err == nil {
+		if err = json.Unmarshal(kv.Value, &metadata); err != nil {
+			return nil, err
+		}
+	}
+	return &FileInfo{fi, metadata}, nil
+}
+
+func (d *EtcdDepot) SetMetadata(tag *Tag, metadata map[string]string) error {
+	if !d.Check(tag) {
+		return &os.PathError{Op: "set metadata", Path: d.key(tag), Err: syscall.ENOENT}
+	}
+	if len(metadata) == 0 {
+		var resp etcdDeleteRangeResponse
+		return d.call("kv/deleterange", map[string][]byte{"key": []byte(d.metadataKey(tag))}, &resp)
+	}
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return d.call("kv/put", &etcdPutRequest{[]byte(d.metadataKey(tag)), b}, &struct{}{})
+}
+
+func (d *EtcdDepot) GetFile(tag *Tag) (*File, error) {
+	return GetFile(d, tag)
+}
+
+// etcdFileInfo describes data in EtcdDepot as os.FileInfo
+type etcdFileInfo struct {
+	tag     *Tag
+	size    int64
+	modTime time.Time
+}
+
+func (fi *etcdFileInfo) Name() string       { return fi.tag.name }
+func (fi *etcdFileInfo) Size() int64        { return fi.size }
+func (fi *etcdFileInfo) Mode() os.FileMode  { return fi.tag.perm }
+func (fi *etcdFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *etcdFileInfo) IsDir() bool        { return false }
+func (fi *etcdFileInfo) Sys() interface{}   { return nil }
+
+// EtcdRoles returns the roles allowed to read data of perm in EtcdDepot.
+// Owner of the depot gets role, and readable-by-group and readable-by-other
+// data is also granted to role-group and role-other respectively.
+func EtcdRoles(role string, perm os.FileMode) []string {
+	roles := []string{role}
+	if perm&0040 != 0 {
+		roles = append(roles, role+"-group")
+	}
+	if perm&0004 != 0 {
+		roles = append(roles, role+"-other")
+	}
+	return roles
+}
+
+// GrantRoles creates etcd roles of EtcdRoles, and grants them permissions on
+// the ranges of keys. The owner role could read and write the whole prefix,
+// while the others could only read data of permissions including theirs.
+func (d *EtcdDepot) GrantRoles(role string) error {
+	type permission struct {
+		PermType string `json:"permType"`
+		Key      []byte `json:"key"`
+		RangeEnd []byte `json:"range_end"`
+	}
+	grant := func(name, permType, prefix string) error {
+		req := map[string]interface{}{
+			"name": name,
+			"perm": &permission{permType, []byte(prefix), prefixRangeEnd(prefix)},
+		}
+		return d.call("auth/role/grant", req, &struct{}{})
+	}
+
+	for _, name := range []string{role, role + "-group", role + "-other"} {
+		if err := d.call("auth/role/add", map[string]string{"name": name}, &struct{}{}); err != nil && !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+	if err := grant(role, "READWRITE", d.prefix+"/"); err != nil {
+		return err
+	}
+	for _, perm := range []os.FileMode{rootPerm, branchPerm, leafPerm} {
+		for _, name := range EtcdRoles(role, perm)[1:] {
+			if err := grant(name, "READ", d.permPrefix(perm)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GrantUser grants roles to etcd user, such as the ones created by GrantRoles
+func (d *EtcdDepot) GrantUser(user string, roles ...string) error {
+	for _, role := range roles {
+		if err := d.call("auth/user/grant", map[string]string{"user": user, "role": role}, &struct{}{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixRangeEnd returns the range end to get all keys with prefix
+func prefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
@@ -0,0 +1,240 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package depot
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// etcdTxnEntry records the change of one key, and the revision it is
+// compared with when the change is committed
+type etcdTxnEntry struct {
+	tag     *Tag
+	data    []byte
+	deleted bool
+	cmp     *etcdCompare
+}
+
+// etcdTransaction buffers changes to EtcdDepot in memory, and commits them
+// in one etcd transaction. Every changed key is compared with its revision
+// when it was first read or changed, so Commit applies nothing and returns
+// ErrConflict if any of them has been changed by others.
+type etcdTransaction struct {
+	d       *EtcdDepot
+	entries []*etcdTxnEntry
+}
+
+// Begin starts Transaction of EtcdDepot. Metadata is not buffered,
+// and SetMetadata goes to EtcdDepot directly.
+func (d *EtcdDepot) Begin() Transaction {
+	return &etcdTransaction{d: d}
+}
+
+// Pending is always false, as etcd applies a transaction at once
+func (d *EtcdDepot) Pending() bool {
+	return false
+}
+
+func (d *EtcdDepot) Recover(rollback bool) error {
+	return nil
+}
+
+func (t *etcdTransaction) entry(tag *Tag) *etcdTxnEntry {
+	key := t.d.key(tag)
+	for _, e := range t.entries {
+		if t.d.key(e.tag) == key {
+			return e
+		}
+	}
+	return nil
+}
+
+// set buffers data of tag, which is deleted if data is nil. The key is
+// compared by cmp if it is changed the first time.
+func (t *etcdTransaction) set(tag *Tag, data []byte, cmp *etcdCompare) {
+	e := t.entry(tag)
+	if e == nil {
+		e = &etcdTxnEntry{tag: tag, cmp: cmp}
+		t.entries = append(t.entries, e)
+	}
+	e.data, e.deleted = append([]byte{}, data...), data == nil
+}
+
+func (t *etcdTransaction) Put(tag *Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	if t.Check(tag) {
+		return &os.PathError{Op: "put", Path: t.d.key(tag), Err: syscall.EEXIST}
+	}
+	t.set(tag, data, newEtcdCompare(t.d.key(tag), "CREATE", 0))
+	return nil
+}
+
+// Update buffers data of tag, which is committed only if it is unchanged
+// since last Get, or does not exist if it was not read
+func (t *etcdTransaction) Update(tag *Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	t.d.mu.Lock()
+	rev := t.d.revisions[t.d.key(tag)]
+	t.d.mu.Unlock()
+	t.set(tag, data, newEtcdCompare(t.d.key(tag), "MOD", rev))
+	return nil
+}
+
+// Swap buffers data of tag if it is still old, which is compared again
+// when committed unless tag has been changed in the transaction before
+func (t *etcdTransaction) Swap(tag *Tag, old, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	if e := t.entry(tag); e != nil {
+		if (old == nil) != e.deleted || !bytes.Equal(e.data, old) {
+			return &os.PathError{Op: "update", Path: t.d.key(tag), Err: ErrConflict}
+		}
+	}
+	t.set(tag, data, newEtcdSwapCompare(t.d.key(tag), old))
+	return nil
+}
+
+func (t *etcdTransaction) Check(tag *Tag) bool {
+	if e := t.entry(tag); e != nil {
+		return !e.deleted
+	}
+	return t.d.Check(tag)
+}
+
+func (t *etcdTransaction) Get(tag *Tag) ([]byte, error) {
+	e := t.entry(tag)
+	if e == nil {
+		return t.d.Get(tag)
+	}
+	if e.deleted {
+		return nil, &os.PathError{Op: "get", Path: t.d.key(tag), Err: syscall.ENOENT}
+	}
+	return append([]byte{}, e.data...), nil
+}
+
+func (t *etcdTransaction) Delete(tag *Tag) error {
+	if e := t.entry(tag); e != nil {
+		if e.deleted {
+			return &os.PathError{Op: "delete", Path: t.d.key(tag), Err: syscall.ENOENT}
+		}
+		t.set(tag, nil, nil)
+		return nil
+	}
+	kv, err := t.d.get(t.d.key(tag))
+	if err != nil {
+		return err
+	}
+	t.set(tag, nil, newEtcdCompare(t.d.key(tag), "MOD", int64(kv.ModRevision)))
+	return nil
+}
+
+func (t *etcdTransaction) List(prefix string) []*Tag {
+	tags, _ := t.ListTags(prefix)
+	return tags
+}
+
+func (t *etcdTransaction) ListTags(prefix string) ([]*Tag, error) {
+	listed, err := t.d.ListTags(prefix)
+	if err != nil {
+		return make([]*Tag, 0), err
+	}
+	tags := make([]*Tag, 0)
+	for _, tag := range listed {
+		if t.entry(tag) == nil {
+			tags = append(tags, tag)
+		}
+	}
+	for _, e := range t.entries {
+		if !e.deleted && strings.HasPrefix(e.tag.name, prefix) {
+			tags = append(tags, e.tag)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].name < tags[j].name })
+	return tags, nil
+}
+
+func (t *etcdTransaction) Stat(tag *Tag) (*FileInfo, error) {
+	e := t.entry(tag)
+	if e == nil {
+		return t.d.Stat(tag)
+	}
+	if e.deleted {
+		return nil, &os.PathError{Op: "stat", Path: t.d.key(tag), Err: syscall.ENOENT}
+	}
+	metadata := make(map[string]string)
+	if fi, err := t.d.Stat(tag); err == nil {
+		metadata = fi.Metadata
+	}
+	return &FileInfo{&etcdFileInfo{tag, int64(len(e.data)), time.Now()}, metadata}, nil
+}
+
+func (t *etcdTransaction) SetMetadata(tag *Tag, metadata map[string]string) error {
+	return t.d.SetMetadata(tag, metadata)
+}
+
+// Commit applies the changes in one etcd transaction
+func (t *etcdTransaction) Commit() error {
+	if len(t.entries) == 0 {
+		return nil
+	}
+	mtime, err := time.Now().MarshalText()
+	if err != nil {
+		return err
+	}
+	req := &etcdTxnRequest{}
+	for _, e := range t.entries {
+		req.Compare = append(req.Compare, e.cmp)
+		if e.deleted {
+			for _, k := range []string{t.d.key(e.tag), t.d.mtimeKey(e.tag), t.d.metadataKey(e.tag)} {
+				req.Success = append(req.Success, &etcdRequestOp{RequestDeleteRange: &etcdDeleteRangeRequest{[]byte(k)}})
+			}
+			continue
+		}
+		req.Success = append(req.Success,
+			&etcdRequestOp{RequestPut: &etcdPutRequest{[]byte(t.d.key(e.tag)), e.data}},
+			&etcdRequestOp{RequestPut: &etcdPutRequest{[]byte(t.d.mtimeKey(e.tag)), mtime}},
+		)
+	}
+	var resp etcdTxnResponse
+	if err = t.d.call("kv/txn", req, &resp); err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return &os.PathError{Op: "commit", Path: t.d.prefix, Err: ErrConflict}
+	}
+
+	t.d.mu.Lock()
+	for _, e := range t.entries {
+		if e.deleted {
+			delete(t.d.revisions, t.d.key(e.tag))
+		} else {
+			t.d.revisions[t.d.key(e.tag)] = int64(resp.Header.Revision)
+		}
+	}
+	t.d.mu.Unlock()
+	t.entries = nil
+	return nil
+}
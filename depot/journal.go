@@ -0,0 +1,287 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package depot
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	journalName = ".journal"
+)
+
+// journalEntry records the change of one file, with its data before the
+// change so that it could be rolled back
+type journalEntry struct {
+	Name    string      `json:"name"`
+	Perm    os.FileMode `json:"perm"`
+	Data    []byte      `json:"data,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"`
+
+	Existed bool        `json:"existed"`
+	OldPerm os.FileMode `json:"old_perm,omitempty"`
+	OldData []byte      `json:"old_data,omitempty"`
+}
+
+// fileTransaction buffers changes to FileDepot in memory. Reads see the
+// buffered changes, and nothing is written until Commit.
+type fileTransaction struct {
+	d       *FileDepot
+	entries []*journalEntry
+}
+
+// Begin starts Transaction of FileDepot. Metadata is not buffered,
+// and SetMetadata goes to FileDepot directly.
+func (d *FileDepot) Begin() Transaction {
+	return &fileTransaction{d: d}
+}
+
+func (t *fileTransaction) entry(name string) *journalEntry {
+	for _, e := range t.entries {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+func (t *fileTransaction) set(tag *Tag, data []byte) {
+	e := t.entry(tag.name)
+	if e == nil {
+		e = &journalEntry{Name: tag.name}
+		t.entries = append(t.entries, e)
+	}
+	e.Perm, e.Data, e.Deleted = tag.perm, append([]byte{}, data...), data == nil
+}
+
+func (t *fileTransaction) exists(name string) bool {
+	if e := t.entry(name); e != nil {
+		return !e.Deleted
+	}
+	_, err := os.Stat(t.d.path(name))
+	return err == nil
+}
+
+func (t *fileTransaction) Put(tag *Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	if t.exists(tag.name) {
+		return &os.PathError{Op: "open", Path: t.d.path(tag.name), Err: syscall.EEXIST}
+	}
+	t.set(tag, data)
+	return nil
+}
+
+func (t *fileTransaction) Update(tag *Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	t.set(tag, data)
+	return nil
+}
+
+// Swap buffers data of tag if it is still old. FileDepot is guarded by
+// its lock, so nothing changes it before Commit.
+func (t *fileTransaction) Swap(tag *Tag, old, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	return compareAndUpdate(t, tag, old, data)
+}
+
+func (t *fileTransaction) check(tag *Tag) (*journalEntry, error) {
+	e := t.entry(tag.name)
+	if e == nil {
+		return nil, t.d.check(tag)
+	}
+	if e.Deleted {
+		return nil, &os.PathError{Op: "stat", Path: t.d.path(tag.name), Err: syscall.ENOENT}
+	}
+	if ^e.Perm&tag.perm != 0 {
+		return nil, errors.New("permission denied")
+	}
+	return e, nil
+}
+
+func (t *fileTransaction) Check(tag *Tag) bool {
+	_, err := t.check(tag)
+	return err == nil
+}
+
+func (t *fileTransaction) Get(tag *Tag) ([]byte, error) {
+	e, err := t.check(tag)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return t.d.Get(tag)
+	}
+	return append([]byte{}, e.Data...), nil
+}
+
+func (t *fileTransaction) Delete(tag *Tag) error {
+	if !t.exists(tag.name) {
+		return &os.PathError{Op: "remove", Path: t.d.path(tag.name), Err: syscall.ENOENT}
+	}
+	t.set(tag, nil)
+	return nil
+}
+
+func (t *fileTransaction) List(prefix string) []*Tag {
+	tags := make([]*Tag, 0)
+	for _, tag := range t.d.List(prefix) {
+		if t.entry(tag.name) == nil {
+			tags = append(tags, tag)
+		}
+	}
+	for _, e := range t.entries {
+		if !e.Deleted && strings.HasPrefix(e.Name, prefix) {
+			tags = append(tags, &Tag{e.Name, e.Perm})
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].name < tags[j].name })
+	return tags
+}
+
+func (t *fileTransaction) Stat(tag *Tag) (*FileInfo, error) {
+	e, err := t.check(tag)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return t.d.Stat(tag)
+	}
+	metadata := make(map[string]string)
+	if fi, err := t.d.Stat(tag); err == nil {
+		metadata = fi.Metadata
+	}
+	return &FileInfo{&journalFileInfo{e, time.Now()}, metadata}, nil
+}
+
+func (t *fileTransaction) SetMetadata(tag *Tag, metadata map[string]string) error {
+	return t.d.SetMetadata(tag, metadata)
+}
+
+// Commit writes the changes into journal first, and then applies them.
+// If it is interrupted, the journal is left for Recover.
+func (t *fileTransaction) Commit() error {
+	if len(t.entries) == 0 {
+		return nil
+	}
+	for _, e := range t.entries {
+		fi, err := os.Stat(t.d.path(e.Name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if e.OldData, err = ioutil.ReadFile(t.d.path(e.Name)); err != nil {
+			return err
+		}
+		e.Existed, e.OldPerm = true, fi.Mode().Perm()
+	}
+	b, err := json.Marshal(t.entries)
+	if err != nil {
+		return err
+	}
+	if err = t.d.writeFile(t.d.path(journalName), b, 0600, true); err != nil {
+		return err
+	}
+	if err = t.d.applyJournal(t.entries, false); err != nil {
+		return err
+	}
+	t.entries = nil
+	return t.d.removeJournal()
+}
+
+func (d *FileDepot) Pending() bool {
+	_, err := os.Stat(d.path(journalName))
+	return err == nil
+}
+
+// Recover rolls forward the changes in pending journal, or rolls them back.
+// It does nothing if there is no journal.
+func (d *FileDepot) Recover(rollback bool) error {
+	b, err := ioutil.ReadFile(d.path(journalName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []*journalEntry
+	if err = json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+	if err = d.applyJournal(entries, rollback); err != nil {
+		return err
+	}
+	return d.removeJournal()
+}
+
+// applyJournal writes the new data of entries, or the old data if rollback is set.
+// It could be repeated safely.
+func (d *FileDepot) applyJournal(entries []*journalEntry, rollback bool) error {
+	for _, e := range entries {
+		name := d.path(e.Name)
+		data, perm, deleted := e.Data, e.Perm, e.Deleted
+		if rollback {
+			data, perm, deleted = e.OldData, e.OldPerm, !e.Existed
+		}
+		if deleted {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			os.Remove(d.metadataPath(e.Name))
+			continue
+		}
+		if data == nil {
+			data = []byte{}
+		}
+		if err := d.writeFile(name, data, perm, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *FileDepot) removeJournal() error {
+	if err := os.Remove(d.path(journalName)); err != nil {
+		return err
+	}
+	return syncDir(d.dirPath)
+}
+
+// journalFileInfo describes data buffered in transaction as os.FileInfo
+type journalFileInfo struct {
+	e       *journalEntry
+	modTime time.Time
+}
+
+func (fi *journalFileInfo) Name() string       { return fi.e.Name }
+func (fi *journalFileInfo) Size() int64        { return int64(len(fi.e.Data)) }
+func (fi *journalFileInfo) Mode() os.FileMode  { return fi.e.Perm }
+func (fi *journalFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *journalFileInfo) IsDir() bool        { return false }
+func (fi *journalFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,204 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package depot
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemoryDepot is a implementation of Depot keeping data in memory,
+// which is handy for tests and library users that need throwaway certificates.
+// It is safe for concurrent use.
+type MemoryDepot struct {
+	mu    sync.RWMutex
+	files map[string]*memoryFile
+}
+
+type memoryFile struct {
+	Name     string            `json:"name"`
+	Perm     os.FileMode       `json:"perm"`
+	ModTime  time.Time         `json:"mod_time"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Data     []byte            `json:"data"`
+}
+
+func NewMemoryDepot() *MemoryDepot {
+	return &MemoryDepot{files: make(map[string]*memoryFile)}
+}
+
+func (d *MemoryDepot) Put(tag *Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.files[tag.name]; ok {
+		return &os.PathError{Op: "put", Path: tag.name, Err: syscall.EEXIST}
+	}
+	d.put(tag, data)
+	return nil
+}
+
+// Update replaces data of tag in one step, and keeps its metadata
+func (d *MemoryDepot) Update(tag *Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.put(tag, data)
+	return nil
+}
+
+func (d *MemoryDepot) put(tag *Tag, data []byte) {
+	var metadata map[string]string
+	if f, ok := d.files[tag.name]; ok {
+		metadata = f.Metadata
+	}
+	d.files[tag.name] = &memoryFile{tag.name, tag.perm, time.Now(), metadata, append([]byte(nil), data...)}
+}
+
+func (d *MemoryDepot) Check(tag *Tag) bool {
+	_, err := d.check(tag)
+	return err == nil
+}
+
+// check returns file of tag if its permission contains the one required by tag
+func (d *MemoryDepot) check(tag *Tag) (*memoryFile, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	f, ok := d.files[tag.name]
+	if !ok {
+		return nil, &os.PathError{Op: "get", Path: tag.name, Err: syscall.ENOENT}
+	}
+	if ^f.Perm&tag.perm != 0 {
+		return nil, errors.New("permission denied")
+	}
+	return f, nil
+}
+
+func (d *MemoryDepot) Get(tag *Tag) ([]byte, error) {
+	f, err := d.check(tag)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), f.Data...), nil
+}
+
+func (d *MemoryDepot) Delete(tag *Tag) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.files[tag.name]; !ok {
+		return &os.PathError{Op: "delete", Path: tag.name, Err: syscall.ENOENT}
+	}
+	delete(d.files, tag.name)
+	return nil
+}
+
+// List returns tags of data whose name starts with prefix sorted by name
+func (d *MemoryDepot) List(prefix string) []*Tag {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	tags := make([]*Tag, 0, len(d.files))
+	for _, f := range d.files {
+		if strings.HasPrefix(f.Name, prefix) {
+			tags = append(tags, &Tag{f.Name, f.Perm})
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].name < tags[j].name })
+	return tags
+}
+
+func (d *MemoryDepot) Stat(tag *Tag) (*FileInfo, error) {
+	f, err := d.check(tag)
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]string, len(f.Metadata))
+	for k, v := range f.Metadata {
+		metadata[k] = v
+	}
+	return &FileInfo{&memoryFileInfo{f}, metadata}, nil
+}
+
+func (d *MemoryDepot) SetMetadata(tag *Tag, metadata map[string]string) error {
+	if _, err := d.check(tag); err != nil {
+		return err
+	}
+	copied := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		copied[k] = v
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if f, ok := d.files[tag.name]; ok {
+		f.Metadata = copied
+	}
+	return nil
+}
+
+func (d *MemoryDepot) GetFile(tag *Tag) (*File, error) {
+	return GetFile(d, tag)
+}
+
+// Snapshot exports all data in JSON, which could be loaded by Restore
+func (d *MemoryDepot) Snapshot() ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	files := make([]*memoryFile, 0, len(d.files))
+	for _, f := range d.files {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return json.Marshal(files)
+}
+
+// Restore replaces all data with the JSON snapshot
+func (d *MemoryDepot) Restore(snapshot []byte) error {
+	var files []*memoryFile
+	if err := json.Unmarshal(snapshot, &files); err != nil {
+		return err
+	}
+	m := make(map[string]*memoryFile, len(files))
+	for _, f := range files {
+		if f.Name == "" || f.Data == nil {
+			return errors.New("invalid depot snapshot")
+		}
+		m[f.Name] = f
+	}
+	d.mu.Lock()
+	d.files = m
+	d.mu.Unlock()
+	return nil
+}
+
+// memoryFileInfo describes data in MemoryDepot as os.FileInfo
+type memoryFileInfo struct {
+	f *memoryFile
+}
+
+func (fi *memoryFileInfo) Name() string       { return fi.f.Name }
+func (fi *memoryFileInfo) Size() int64        { return int64(len(fi.f.Data)) }
+func (fi *memoryFileInfo) Mode() os.FileMode  { return fi.f.Perm }
+func (fi *memoryFileInfo) ModTime() time.Time { return fi.f.ModTime }
+func (fi *memoryFileInfo) IsDir() bool        { return false }
+func (fi *memoryFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,134 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package depot
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"os"
+	"testing"
+
+	"github.com/coreos/etcd-ca/pkix"
+)
+
+func TestMemoryDepotCRUD(t *testing.T) {
+	d := NewMemoryDepot()
+
+	if err := d.Put(tag, nil); err == nil {
+		t.Fatal("Expect not to put nil into MemoryDepot")
+	}
+	if err := d.Put(tag, []byte(data)); err != nil {
+		t.Fatal("Failed putting data into MemoryDepot:", err)
+	}
+	if err := d.Put(tag, []byte(data)); err == nil || !os.IsExist(err) {
+		t.Fatal("Expect not to put data into MemoryDepot:", err)
+	}
+
+	dataRead, err := d.Get(tag)
+	if err != nil {
+		t.Fatal("Failed getting data from MemoryDepot:", err)
+	}
+	if !bytes.Equal(dataRead, []byte(data)) {
+		t.Fatal("Failed getting the previous data")
+	}
+	dataRead[0] = 'X'
+	if dataRead, _ = d.Get(tag); !bytes.Equal(dataRead, []byte(data)) {
+		t.Fatal("Expect data not to be changed through returned slice")
+	}
+	if d.Check(wrongTag) {
+		t.Fatal("Expect not to get data with wrong permission")
+	}
+	if _, err = d.Get(wrongTag2); !os.IsNotExist(err) {
+		t.Fatal("Expect not exist error:", err)
+	}
+
+	d.Put(tag2, []byte(data))
+	if tags := d.List(""); len(tags) != 2 || tags[0].name != tag.name || tags[1].name != tag2.name {
+		t.Fatal("Unexpected tags listed:", tags)
+	}
+	if tags := d.List("host2"); len(tags) != 1 || tags[0].name != tag2.name {
+		t.Fatal("Unexpected tags listed with prefix:", tags)
+	}
+	file, err := d.GetFile(tag)
+	if err != nil || file.Info.Name() != tag.name || file.Info.Mode() != tag.perm || file.Info.Size() != int64(len(data)) {
+		t.Fatal("Failed getting file from MemoryDepot:", file, err)
+	}
+
+	metadata := map[string]string{"issuer": "ca"}
+	if err = d.SetMetadata(tag, metadata); err != nil {
+		t.Fatal("Failed setting metadata:", err)
+	}
+	metadata["issuer"] = "changed"
+	d.Update(tag, []byte(data))
+	if fi, err := d.Stat(tag); err != nil || fi.Metadata["issuer"] != "ca" {
+		t.Fatal("Expect metadata to be kept by Update:", fi, err)
+	}
+
+	if err = d.Delete(tag); err != nil {
+		t.Fatal("Failed deleting data from MemoryDepot:", err)
+	}
+	if d.Check(tag) {
+		t.Fatal("Failed deleting data from MemoryDepot")
+	}
+	if err = d.Delete(tag); !os.IsNotExist(err) {
+		t.Fatal("Expect not exist error:", err)
+	}
+}
+
+func TestMemoryDepotSnapshot(t *testing.T) {
+	d := NewMemoryDepot()
+	key, err := pkix.CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	crt, info, err := pkix.CreateCertificateAuthority(key, 1, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+	if err = PutCertificateAuthority(d, crt); err != nil {
+		t.Fatal("Failed putting certificate authority:", err)
+	}
+	PutCertificateAuthorityInfo(d, info)
+	info.IncSerialNumber()
+	if err = UpdateCertificateAuthorityInfo(d, info); err != nil {
+		t.Fatal("Failed updating CA info:", err)
+	}
+
+	snapshot, err := d.Snapshot()
+	if err != nil {
+		t.Fatal("Failed taking snapshot:", err)
+	}
+	restored := NewMemoryDepot()
+	if err = restored.Restore(snapshot); err != nil {
+		t.Fatal("Failed restoring snapshot:", err)
+	}
+	if _, err = GetCertificateAuthority(restored); err != nil {
+		t.Fatal("Failed getting certificate authority from restored depot:", err)
+	}
+	infoRestored, err := GetCertificateAuthorityInfo(restored)
+	if err != nil {
+		t.Fatal("Failed getting CA info from restored depot:", err)
+	}
+	if infoRestored.SerialNumber.Cmp(info.SerialNumber) != 0 {
+		t.Fatal("Unexpected serial number in restored depot:", infoRestored.SerialNumber)
+	}
+	if len(restored.List("")) != len(d.List("")) || restored.Check(AuthPrivKeyTag()) {
+		t.Fatal("Unexpected data in restored depot:", restored.List(""))
+	}
+
+	if err = restored.Restore([]byte(`[{"name":""}]`)); err == nil {
+		t.Fatal("Expect error restoring invalid snapshot")
+	}
+}
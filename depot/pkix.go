@@ -15,20 +15,28 @@
 package depot
 
 import (
+	"math/big"
 	"strings"
 
 	"github.com/coreos/etcd-ca/pkix"
 )
 
 const (
-	authPrefix  = "ca"
-	hostPadding = ".host"
+	authPrefix          = "ca"
+	hostPadding         = ".host"
+	intermediatePadding = ".intermediate"
 
 	crtSuffix     = ".crt"
 	crtInfoSuffix = ".crt.info"
+	revokedSuffix = ".crt.revoked"
 	csrSuffix     = ".csr"
 	pubKeySuffix  = ".pub.key"
 	privKeySuffix = ".key"
+
+	archivedSuffix = ".archived"
+
+	indexName   = "index"
+	indexSuffix = ".jsonl"
 )
 
 const (
@@ -49,10 +57,23 @@ func AuthCrtInfoTag() *Tag {
 	return &Tag{authPrefix + crtInfoSuffix, rootPerm}
 }
 
+func AuthRevokedTag() *Tag {
+	return &Tag{authPrefix + revokedSuffix, rootPerm}
+}
+
+func IndexTag() *Tag {
+	return &Tag{indexName + indexSuffix, rootPerm}
+}
+
 func HostCrtTag(name string) *Tag {
 	return &Tag{name + hostPadding + crtSuffix, leafPerm}
 }
 
+// HostArchivedCrtTag is the tag of certificate of host replaced by renewal
+func HostArchivedCrtTag(name string, serialNumber *big.Int) *Tag {
+	return &Tag{name + hostPadding + "." + serialNumber.Text(16) + crtSuffix + archivedSuffix, leafPerm}
+}
+
 func HostCsrTag(name string) *Tag {
 	return &Tag{name + hostPadding + csrSuffix, leafPerm}
 }
@@ -61,6 +82,22 @@ func HostPrivKeyTag(name string) *Tag {
 	return &Tag{name + hostPadding + privKeySuffix, branchPerm}
 }
 
+func IntermediateCrtTag(name string) *Tag {
+	return &Tag{name + intermediatePadding + crtSuffix, leafPerm}
+}
+
+func IntermediatePrivKeyTag(name string) *Tag {
+	return &Tag{name + intermediatePadding + privKeySuffix, rootPerm}
+}
+
+func IntermediateCrtInfoTag(name string) *Tag {
+	return &Tag{name + intermediatePadding + crtInfoSuffix, rootPerm}
+}
+
+func IntermediateRevokedTag(name string) *Tag {
+	return &Tag{name + intermediatePadding + revokedSuffix, rootPerm}
+}
+
 func GetNameFromHostCrtTag(tag *Tag) string {
 	name := strings.TrimSuffix(tag.name, hostPadding+crtSuffix)
 	if name == tag.name {
@@ -69,6 +106,14 @@ func GetNameFromHostCrtTag(tag *Tag) string {
 	return name
 }
 
+func GetNameFromIntermediateCrtTag(tag *Tag) string {
+	name := strings.TrimSuffix(tag.name, intermediatePadding+crtSuffix)
+	if name == tag.name {
+		return ""
+	}
+	return name
+}
+
 func PutCertificateAuthorityInfo(d Depot, info *pkix.CertificateAuthorityInfo) error {
 	b, err := info.Export()
 	if err != nil {
@@ -94,8 +139,11 @@ func DeleteCertificateAuthorityInfo(d Depot) error {
 }
 
 func UpdateCertificateAuthorityInfo(d Depot, info *pkix.CertificateAuthorityInfo) error {
-	DeleteCertificateAuthorityInfo(d)
-	return PutCertificateAuthorityInfo(d, info)
+	b, err := info.Export()
+	if err != nil {
+		return err
+	}
+	return update(d, AuthCrtInfoTag(), b)
 }
 
 func PutCertificateAuthority(d Depot, crt *pkix.Certificate) error {
@@ -146,6 +194,45 @@ func DeleteCertificateHost(d Depot, name string) error {
 	return d.Delete(HostCrtTag(name))
 }
 
+// UpdateCertificateHost replaces certificate of host, which should be
+// unchanged since it was read
+func UpdateCertificateHost(d Depot, name string, crt *pkix.Certificate) error {
+	b, err := crt.Export()
+	if err != nil {
+		return err
+	}
+	return update(d, HostCrtTag(name), b)
+}
+
+// PutArchivedCertificateHost archives certificate of host by its serial number
+func PutArchivedCertificateHost(d Depot, name string, crt *pkix.Certificate) error {
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return err
+	}
+	b, err := crt.Export()
+	if err != nil {
+		return err
+	}
+	return d.Put(HostArchivedCrtTag(name, rawCrt.SerialNumber), b)
+}
+
+func CheckArchivedCertificateHost(d Depot, name string, serialNumber *big.Int) bool {
+	return d.Check(HostArchivedCrtTag(name, serialNumber))
+}
+
+func GetArchivedCertificateHost(d Depot, name string, serialNumber *big.Int) (crt *pkix.Certificate, err error) {
+	b, err := d.Get(HostArchivedCrtTag(name, serialNumber))
+	if err != nil {
+		return nil, err
+	}
+	return pkix.NewCertificateFromPEM(b)
+}
+
+func DeleteArchivedCertificateHost(d Depot, name string, serialNumber *big.Int) error {
+	return d.Delete(HostArchivedCrtTag(name, serialNumber))
+}
+
 func PutCertificateSigningRequest(d Depot, name string, csr *pkix.CertificateSigningRequest) error {
 	b, err := csr.Export()
 	if err != nil {
@@ -170,6 +257,24 @@ func DeleteCertificateSigningRequest(d Depot, name string) error {
 	return d.Delete(HostCsrTag(name))
 }
 
+// UpdateCertificateSigningRequest replaces old certificate request of host,
+// which the caller has read, or creates it if old is nil. It fails with
+// ErrConflict if the request in d is not old.
+func UpdateCertificateSigningRequest(d Depot, name string, old, csr *pkix.CertificateSigningRequest) error {
+	var oldBytes []byte
+	if old != nil {
+		var err error
+		if oldBytes, err = old.Export(); err != nil {
+			return err
+		}
+	}
+	b, err := csr.Export()
+	if err != nil {
+		return err
+	}
+	return swap(d, HostCsrTag(name), oldBytes, b)
+}
+
 func PutPrivateKeyAuthority(d Depot, key *pkix.Key) error {
 	b, err := key.ExportPrivate()
 	if err != nil {
@@ -219,7 +324,11 @@ func DeletePrivateKeyHost(d Depot, name string) error {
 }
 
 func PutEncryptedPrivateKeyAuthority(d Depot, key *pkix.Key, passphrase []byte) error {
-	b, err := key.ExportEncryptedPrivate(passphrase)
+	return PutEncryptedPrivateKeyAuthorityWithEncryption(d, key, passphrase, pkix.DefaultKeyEncryption)
+}
+
+func PutEncryptedPrivateKeyAuthorityWithEncryption(d Depot, key *pkix.Key, passphrase []byte, enc pkix.KeyEncryption) error {
+	b, err := key.ExportEncryptedPrivateWithEncryption(passphrase, enc)
 	if err != nil {
 		return err
 	}
@@ -242,8 +351,23 @@ func DeleteEncryptedPrivateKeyAuthority(d Depot) error {
 	return d.Delete(AuthPrivKeyTag())
 }
 
+// UpdateEncryptedPrivateKeyAuthority replaces private key of CA, whose PEM
+// block old the caller has read, or creates it if old is nil. It fails with
+// ErrConflict if the key in d is not old.
+func UpdateEncryptedPrivateKeyAuthority(d Depot, old []byte, key *pkix.Key, passphrase []byte, enc pkix.KeyEncryption) error {
+	b, err := key.ExportEncryptedPrivateWithEncryption(passphrase, enc)
+	if err != nil {
+		return err
+	}
+	return swap(d, AuthPrivKeyTag(), old, b)
+}
+
 func PutEncryptedPrivateKeyHost(d Depot, name string, key *pkix.Key, passphrase []byte) error {
-	b, err := key.ExportEncryptedPrivate(passphrase)
+	return PutEncryptedPrivateKeyHostWithEncryption(d, name, key, passphrase, pkix.DefaultKeyEncryption)
+}
+
+func PutEncryptedPrivateKeyHostWithEncryption(d Depot, name string, key *pkix.Key, passphrase []byte, enc pkix.KeyEncryption) error {
+	b, err := key.ExportEncryptedPrivateWithEncryption(passphrase, enc)
 	if err != nil {
 		return err
 	}
@@ -265,3 +389,201 @@ func GetEncryptedPrivateKeyHost(d Depot, name string, passphrase []byte) (key *p
 func DeleteEncryptedPrivateKeyHost(d Depot, name string) error {
 	return d.Delete(HostPrivKeyTag(name))
 }
+
+// UpdateEncryptedPrivateKeyHost replaces private key of host, whose PEM
+// block old the caller has read, or creates it if old is nil. It fails with
+// ErrConflict if the key in d is not old.
+func UpdateEncryptedPrivateKeyHost(d Depot, name string, old []byte, key *pkix.Key, passphrase []byte, enc pkix.KeyEncryption) error {
+	b, err := key.ExportEncryptedPrivateWithEncryption(passphrase, enc)
+	if err != nil {
+		return err
+	}
+	return swap(d, HostPrivKeyTag(name), old, b)
+}
+
+func PutCertificateIntermediate(d Depot, name string, crt *pkix.Certificate) error {
+	b, err := crt.Export()
+	if err != nil {
+		return err
+	}
+	return d.Put(IntermediateCrtTag(name), b)
+}
+
+func CheckCertificateIntermediate(d Depot, name string) bool {
+	return d.Check(IntermediateCrtTag(name))
+}
+
+func GetCertificateIntermediate(d Depot, name string) (crt *pkix.Certificate, err error) {
+	b, err := d.Get(IntermediateCrtTag(name))
+	if err != nil {
+		return nil, err
+	}
+	return pkix.NewCertificateFromPEM(b)
+}
+
+func DeleteCertificateIntermediate(d Depot, name string) error {
+	return d.Delete(IntermediateCrtTag(name))
+}
+
+func PutCertificateIntermediateInfo(d Depot, name string, info *pkix.CertificateAuthorityInfo) error {
+	b, err := info.Export()
+	if err != nil {
+		return err
+	}
+	return d.Put(IntermediateCrtInfoTag(name), b)
+}
+
+func CheckCertificateIntermediateInfo(d Depot, name string) bool {
+	return d.Check(IntermediateCrtInfoTag(name))
+}
+
+func GetCertificateIntermediateInfo(d Depot, name string) (info *pkix.CertificateAuthorityInfo, err error) {
+	b, err := d.Get(IntermediateCrtInfoTag(name))
+	if err != nil {
+		return nil, err
+	}
+	return pkix.NewCertificateAuthorityInfoFromJSON(b)
+}
+
+func DeleteCertificateIntermediateInfo(d Depot, name string) error {
+	return d.Delete(IntermediateCrtInfoTag(name))
+}
+
+func UpdateCertificateIntermediateInfo(d Depot, name string, info *pkix.CertificateAuthorityInfo) error {
+	b, err := info.Export()
+	if err != nil {
+		return err
+	}
+	return update(d, IntermediateCrtInfoTag(name), b)
+}
+
+func PutEncryptedPrivateKeyIntermediate(d Depot, name string, key *pkix.Key, passphrase []byte, enc pkix.KeyEncryption) error {
+	b, err := key.ExportEncryptedPrivateWithEncryption(passphrase, enc)
+	if err != nil {
+		return err
+	}
+	return d.Put(IntermediatePrivKeyTag(name), b)
+}
+
+func CheckEncryptedPrivateKeyIntermediate(d Depot, name string) bool {
+	return d.Check(IntermediatePrivKeyTag(name))
+}
+
+func GetEncryptedPrivateKeyIntermediate(d Depot, name string, passphrase []byte) (key *pkix.Key, err error) {
+	b, err := d.Get(IntermediatePrivKeyTag(name))
+	if err != nil {
+		return nil, err
+	}
+	return pkix.NewKeyFromEncryptedPrivateKeyPEM(b, passphrase)
+}
+
+func DeleteEncryptedPrivateKeyIntermediate(d Depot, name string) error {
+	return d.Delete(IntermediatePrivKeyTag(name))
+}
+
+// UpdateEncryptedPrivateKeyIntermediate replaces private key of intermediate CA, whose PEM
+// block old the caller has read, or creates it if old is nil. It fails with
+// ErrConflict if the key in d is not old.
+func UpdateEncryptedPrivateKeyIntermediate(d Depot, name string, old []byte, key *pkix.Key, passphrase []byte, enc pkix.KeyEncryption) error {
+	b, err := key.ExportEncryptedPrivateWithEncryption(passphrase, enc)
+	if err != nil {
+		return err
+	}
+	return swap(d, IntermediatePrivKeyTag(name), old, b)
+}
+
+func PutRevocationRecordsAuthority(d Depot, records *pkix.RevocationRecords) error {
+	b, err := records.Export()
+	if err != nil {
+		return err
+	}
+	return d.Put(AuthRevokedTag(), b)
+}
+
+func CheckRevocationRecordsAuthority(d Depot) bool {
+	return d.Check(AuthRevokedTag())
+}
+
+func GetRevocationRecordsAuthority(d Depot) (records *pkix.RevocationRecords, err error) {
+	b, err := d.Get(AuthRevokedTag())
+	if err != nil {
+		return nil, err
+	}
+	return pkix.NewRevocationRecordsFromJSON(b)
+}
+
+func DeleteRevocationRecordsAuthority(d Depot) error {
+	return d.Delete(AuthRevokedTag())
+}
+
+func UpdateRevocationRecordsAuthority(d Depot, records *pkix.RevocationRecords) error {
+	b, err := records.Export()
+	if err != nil {
+		return err
+	}
+	return update(d, AuthRevokedTag(), b)
+}
+
+func PutRevocationRecordsIntermediate(d Depot, name string, records *pkix.RevocationRecords) error {
+	b, err := records.Export()
+	if err != nil {
+		return err
+	}
+	return d.Put(IntermediateRevokedTag(name), b)
+}
+
+func CheckRevocationRecordsIntermediate(d Depot, name string) bool {
+	return d.Check(IntermediateRevokedTag(name))
+}
+
+func GetRevocationRecordsIntermediate(d Depot, name string) (records *pkix.RevocationRecords, err error) {
+	b, err := d.Get(IntermediateRevokedTag(name))
+	if err != nil {
+		return nil, err
+	}
+	return pkix.NewRevocationRecordsFromJSON(b)
+}
+
+func DeleteRevocationRecordsIntermediate(d Depot, name string) error {
+	return d.Delete(IntermediateRevokedTag(name))
+}
+
+func UpdateRevocationRecordsIntermediate(d Depot, name string, records *pkix.RevocationRecords) error {
+	b, err := records.Export()
+	if err != nil {
+		return err
+	}
+	return update(d, IntermediateRevokedTag(name), b)
+}
+
+func PutCertificateIndex(d Depot, index *pkix.CertificateIndex) error {
+	b, err := index.Export()
+	if err != nil {
+		return err
+	}
+	return d.Put(IndexTag(), b)
+}
+
+func CheckCertificateIndex(d Depot) bool {
+	return d.Check(IndexTag())
+}
+
+func GetCertificateIndex(d Depot) (index *pkix.CertificateIndex, err error) {
+	b, err := d.Get(IndexTag())
+	if err != nil {
+		return nil, err
+	}
+	return pkix.NewCertificateIndexFromJSONLines(b)
+}
+
+func DeleteCertificateIndex(d Depot) error {
+	return d.Delete(IndexTag())
+}
+
+func UpdateCertificateIndex(d Depot, index *pkix.CertificateIndex) error {
+	b, err := index.Export()
+	if err != nil {
+		return err
+	}
+	return update(d, IndexTag(), b)
+}
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/coreos/etcd-ca/Godeps/_workspace/src/github.com/codegangsta/cli"
@@ -29,17 +30,44 @@ func main() {
 	app.Usage = "A very simple CA manager written in Go. Primarly used for coreos/etcd SSL/TLS testing."
 	app.Flags = []cli.Flag{
 		cli.StringFlag{"depot-path", depot.DefaultFileDepotDir, "Location to store certificates, keys and other files.", ""},
+		cli.StringFlag{"depot-url", "", "Open depot at url such as etcd://[user:password@]host:port/prefix or file:///path instead of depot-path.", ""},
+		cli.StringFlag{"depot-passphrase", "", "Passphrase to unlock encrypted depot", ""},
+		cli.StringFlag{"depot-key-file", "", "Key file to unlock encrypted depot instead of passphrase", ""},
+		cli.StringFlag{"etcd-cacert", "", "CA certificates to verify etcds:// depot-url instead of the system ones", ""},
+		cli.StringFlag{"etcd-cert", "", "Client certificate to connect to etcds:// depot-url", ""},
+		cli.StringFlag{"etcd-key", "", "Private key of etcd-cert", ""},
 	}
 	app.Commands = []cli.Command{
 		cmd.NewInitCommand(),
+		cmd.NewNewIntermediateCommand(),
 		cmd.NewNewCertCommand(),
 		cmd.NewSignCommand(),
+		cmd.NewRenewCommand(),
+		cmd.NewWatchCommand(),
+		cmd.NewApplyCommand(),
 		cmd.NewChainCommand(),
 		cmd.NewExportCommand(),
 		cmd.NewStatusCommand(),
+		cmd.NewListCommand(),
+		cmd.NewRevokeCommand(),
+		cmd.NewCRLCommand(),
+		cmd.NewServeCommand(),
+		cmd.NewServeOCSPCommand(),
+		cmd.NewServeACMECommand(),
+		cmd.NewServeESTCommand(),
+		cmd.NewRekeyPassphraseCommand(),
+		cmd.NewRecoverCommand(),
+		cmd.NewDepotCommand(),
 	}
 	app.Before = func(c *cli.Context) error {
-		cmd.InitDepot(c.String("depot-path"))
+		if err := cmd.InitDepot(c); err != nil {
+			fmt.Fprintln(os.Stderr, "Init depot error:", err)
+			return err
+		}
+		if err := cmd.UnlockDepot(c); err != nil {
+			fmt.Fprintln(os.Stderr, "Unlock depot error:", err)
+			return err
+		}
 		return nil
 	}
 
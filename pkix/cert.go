@@ -98,49 +98,98 @@ func (c *Certificate) CheckAuthority() error {
 	return c.crt.CheckSignatureFrom(c.crt)
 }
 
+// IsIssuerOf checks whether the certificate is the issuer of child,
+// by matching the subject and the signature.
+func (c *Certificate) IsIssuerOf(child *Certificate) bool {
+	if err := c.buildX509Certificate(); err != nil {
+		return false
+	}
+	rawChild, err := child.GetRawCertificate()
+	if err != nil {
+		return false
+	}
+	if !bytes.Equal(rawChild.RawIssuer, c.crt.RawSubject) {
+		return false
+	}
+	return rawChild.CheckSignatureFrom(c.crt) == nil
+}
+
 // VerifyHost verifies the host certificate using host name.
 // Only certificate of authority could call this function successfully.
-// Current implementation allows one CA and direct hosts only,
-// so the organization is always this:
+// The host certificate should be signed by the authority directly:
 //         CA
 //  host1 host2 host3
 func (c *Certificate) VerifyHost(hostCert *Certificate, name string) error {
+	_, err := c.VerifyHostChain(hostCert, name, nil)
+	return err
+}
+
+// VerifyHostChain verifies the host certificate using host name, and
+// returns the certificate chain from host certificate up to the authority.
+// Only certificate of authority could call this function successfully.
+// Intermediates are the candidates of intermediate CAs between them,
+// so the organization could be like this:
+//              CA
+//     intermediate1   host1
+//   host2 host3
+func (c *Certificate) VerifyHostChain(hostCert *Certificate, name string, intermediates []*Certificate) ([]*Certificate, error) {
 	if err := c.CheckAuthority(); err != nil {
-		return err
+		return nil, err
 	}
 
 	roots := x509.NewCertPool()
 	roots.AddCert(c.crt)
 
+	pool := x509.NewCertPool()
+	for _, intermediate := range intermediates {
+		rawCrt, err := intermediate.GetRawCertificate()
+		if err != nil {
+			return nil, err
+		}
+		pool.AddCert(rawCrt)
+	}
+
 	verifyOpts := x509.VerifyOptions{
-		DNSName: "",
-		// no intermediates are allowed for now
-		Intermediates: nil,
+		DNSName:       "",
+		Intermediates: pool,
 		Roots:         roots,
 		// if zero, the current time is used
 		CurrentTime: time.Now(),
-		// An empty list means ExtKeyUsageServerAuth.
-		KeyUsages: nil,
+		// Accept all usages because host certificates could be issued
+		// with client-only or other profiles
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
 	}
 
 	rawHostCrt, err := hostCert.GetRawCertificate()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	units := rawHostCrt.Subject.OrganizationalUnit
 	if len(units) != 1 || units[0] != name {
-		return fmt.Errorf("unmatched hostname between %v and %v", units, name)
+		return nil, fmt.Errorf("unmatched hostname between %v and %v", units, name)
 	}
 
 	chains, err := rawHostCrt.Verify(verifyOpts)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if len(chains) != 1 {
-		return errors.New("internal error: verify chain number != 1")
+	if len(chains) == 0 {
+		return nil, errors.New("internal error: no verified chain")
 	}
-	return nil
+
+	// all chains end with the only root, so prefer the shortest one
+	chain := chains[0]
+	for _, ch := range chains[1:] {
+		if len(ch) < len(chain) {
+			chain = ch
+		}
+	}
+	crts := make([]*Certificate, 0, len(chain))
+	for _, rawCrt := range chain {
+		crts = append(crts, &Certificate{derBytes: rawCrt.Raw, crt: rawCrt})
+	}
+	return crts, nil
 }
 
 // Export returns PEM-format bytes
@@ -18,6 +18,7 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"math/big"
 	"time"
 )
@@ -48,8 +49,8 @@ var (
 		// NotBefore is set to be 10min earlier to fix gap on time difference in cluster
 		NotBefore: time.Now().Add(-600).UTC(),
 		NotAfter: time.Time{},
-		// Used for certificate signing only
-		KeyUsage: x509.KeyUsageCertSign,
+		// Used for certificate and CRL signing only
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 
 		ExtKeyUsage:        nil,
 		UnknownExtKeyUsage: nil,
@@ -57,8 +58,9 @@ var (
 		// activate CA
 		BasicConstraintsValid: true,
 		IsCA: true,
-		// Not allow any non-self-issued intermediate CA
-		MaxPathLen: 0,
+		// Allow any length of intermediate CA chain under it,
+		// which is limited by intermediate CAs themselves
+		MaxPathLen: -1,
 
 		// 160-bit SHA-1 hash of the value of the BIT STRING subjectPublicKey
 		// (excluding the tag, length, and number of unused bits)
@@ -76,6 +78,13 @@ var (
 // CreateCertificateAuthority creates Certificate Authority using existing key.
 // CertificateAuthorityInfo returned is the extra infomation required by Certificate Authority.
 func CreateCertificateAuthority(key *Key, years int, organization string, country string) (*Certificate, *CertificateAuthorityInfo, error) {
+	return CreateCertificateAuthorityWithConstraints(key, years, organization, country, nil)
+}
+
+// CreateCertificateAuthorityWithConstraints creates Certificate Authority that
+// could only issue certificates for names permitted by nc.
+// Nil nc is the same as CreateCertificateAuthority.
+func CreateCertificateAuthorityWithConstraints(key *Key, years int, organization string, country string, nc *NameConstraints) (*Certificate, *CertificateAuthorityInfo, error) {
 	subjectKeyId, err := GenerateSubjectKeyId(key.Public)
 	if err != nil {
 		return nil, nil, err
@@ -84,6 +93,7 @@ func CreateCertificateAuthority(key *Key, years int, organization string, countr
 	authTemplate.NotAfter = time.Now().AddDate(years, 0, 0).UTC()
 	authTemplate.Subject.Country = []string{country}
 	authTemplate.Subject.Organization = []string{organization}
+	nc.apply(&authTemplate)
 
 	crtBytes, err := x509.CreateCertificate(rand.Reader, &authTemplate, &authTemplate, key.Public, key.Private)
 	if err != nil {
@@ -92,3 +102,72 @@ func CreateCertificateAuthority(key *Key, years int, organization string, countr
 
 	return NewCertificateFromDER(crtBytes), NewCertificateAuthorityInfo(authStartSerialNumber), nil
 }
+
+// CreateIntermediateCertificateAuthority creates intermediate Certificate Authority
+// using existing key, and signs it with the parent authority.
+// maxPathLen limits the number of intermediate CAs that may follow it,
+// so 0 means that it could issue host certificates only.
+func CreateIntermediateCertificateAuthority(crtAuth *Certificate, info *CertificateAuthorityInfo, keyAuth *Key, key *Key, name string, years int, maxPathLen int, organization string, country string) (*Certificate, *CertificateAuthorityInfo, error) {
+	return CreateIntermediateCertificateAuthorityWithConstraints(crtAuth, info, keyAuth, key, name, years, maxPathLen, organization, country, nil)
+}
+
+// CreateIntermediateCertificateAuthorityWithConstraints creates intermediate
+// Certificate Authority with name constraints, which may not permit names that
+// the parent authority or its issuers in info do not. Their permitted names are
+// inherited for types that nc leaves unconstrained, and their excluded names
+// are always added.
+func CreateIntermediateCertificateAuthorityWithConstraints(crtAuth *Certificate, info *CertificateAuthorityInfo, keyAuth *Key, key *Key, name string, years int, maxPathLen int, organization string, country string, nc *NameConstraints) (*Certificate, *CertificateAuthorityInfo, error) {
+	rawCrtAuth, err := crtAuth.GetRawCertificate()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !rawCrtAuth.IsCA {
+		return nil, nil, errors.New("parent certificate is not a certificate authority")
+	}
+	if rawCrtAuth.MaxPathLen == 0 && rawCrtAuth.MaxPathLenZero {
+		return nil, nil, errors.New("parent certificate authority does not allow intermediate CA")
+	}
+	if rawCrtAuth.MaxPathLen > 0 && (maxPathLen < 0 || maxPathLen >= rawCrtAuth.MaxPathLen) {
+		maxPathLen = rawCrtAuth.MaxPathLen - 1
+	}
+
+	subjectKeyId, err := GenerateSubjectKeyId(key.Public)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := authTemplate
+	serialNumber, err := info.NextSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serialNumber
+	template.Subject = pkix.Name{
+		Country:            []string{country},
+		Organization:       []string{organization},
+		OrganizationalUnit: []string{name},
+		CommonName:         name,
+	}
+	template.SubjectKeyId = subjectKeyId
+	template.NotAfter = time.Now().AddDate(years, 0, 0).UTC()
+	template.MaxPathLen = maxPathLen
+	template.MaxPathLenZero = maxPathLen == 0
+	// The nearest CA goes first, so its permitted names are inherited
+	for _, crt := range append([]*Certificate{crtAuth}, info.Issuers...) {
+		ncParent, err := NewNameConstraintsFromCertificate(crt)
+		if err != nil {
+			return nil, nil, err
+		}
+		if nc, err = nc.narrow(ncParent); err != nil {
+			return nil, nil, err
+		}
+	}
+	nc.apply(&template)
+
+	crtBytes, err := x509.CreateCertificate(rand.Reader, &template, rawCrtAuth, key.Public, keyAuth.Private)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return NewCertificateFromDER(crtBytes), NewCertificateAuthorityInfo(authStartSerialNumber), nil
+}
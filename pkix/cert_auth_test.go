@@ -15,6 +15,8 @@
 package pkix
 
 import (
+	"crypto/elliptic"
+	"crypto/x509"
 	"testing"
 	"time"
 )
@@ -54,3 +56,90 @@ func TestCreateCertificateAuthority(t *testing.T) {
 		t.Fatal("Failed to set serial number")
 	}
 }
+
+func TestCreateCertificateAuthorityECDSA(t *testing.T) {
+	key, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+
+	crt, _, err := CreateCertificateAuthority(key, 5, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		t.Fatal("Failed to get x509.Certificate:", err)
+	}
+
+	if rawCrt.PublicKeyAlgorithm != x509.ECDSA {
+		t.Fatal("Expect ECDSA public key instead of", rawCrt.PublicKeyAlgorithm)
+	}
+	if err = rawCrt.CheckSignatureFrom(rawCrt); err != nil {
+		t.Fatal("Failed to check signature:", err)
+	}
+}
+
+func TestCreateIntermediateCertificateAuthority(t *testing.T) {
+	keyAuth, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	crtAuth, infoAuth, err := CreateCertificateAuthority(keyAuth, 5, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+
+	key, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	crt, info, err := CreateIntermediateCertificateAuthority(crtAuth, infoAuth, keyAuth, key, "sub", 1, 0, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating intermediate certificate authority:", err)
+	}
+	if infoAuth.SerialNumber.Uint64() != authStartSerialNumber+1 {
+		t.Fatal("Failed incrementing serial number of parent authority")
+	}
+
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		t.Fatal("Failed to get x509.Certificate:", err)
+	}
+	rawCrtAuth, _ := crtAuth.GetRawCertificate()
+	if err = rawCrt.CheckSignatureFrom(rawCrtAuth); err != nil {
+		t.Fatal("Failed to check signature:", err)
+	}
+	if !rawCrt.IsCA || rawCrt.MaxPathLen != 0 || !rawCrt.MaxPathLenZero {
+		t.Fatal("Failed to set basic constraints")
+	}
+
+	hostKey, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	csr, err := CreateCertificateSigningRequest(hostKey, "host1", "127.0.0.1", "", "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate request:", err)
+	}
+	crtHost, err := CreateCertificateHost(crt, info, key, csr, 1)
+	if err != nil {
+		t.Fatal("Failed creating certificate for host:", err)
+	}
+
+	if err = crtAuth.VerifyHost(crtHost, "host1"); err == nil {
+		t.Fatal("Expect not to verify host without intermediate CA")
+	}
+	chain, err := crtAuth.VerifyHostChain(crtHost, "host1", []*Certificate{crt})
+	if err != nil {
+		t.Fatal("Failed verifying host with intermediate CA:", err)
+	}
+	if len(chain) != 3 {
+		t.Fatal("Expect chain of 3 certificates instead of", len(chain))
+	}
+
+	// intermediate CA with zero path length cannot issue intermediate CA
+	if _, _, err = CreateIntermediateCertificateAuthority(crt, info, key, hostKey, "subsub", 1, 0, "test", "US"); err == nil {
+		t.Fatal("Expect not to create intermediate CA under zero path length")
+	}
+}
@@ -18,11 +18,16 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"math/big"
+	"net"
+	"strings"
 	"time"
 )
 
 var (
+	oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
 	// Build CA based on RFC5280
 	hostTemplate = x509.Certificate{
 		// **SHOULD** be filled in a unique number
@@ -58,38 +63,178 @@ var (
 	}
 )
 
+// CertificateHostOptions includes optional settings of host certificate
+type CertificateHostOptions struct {
+	// OCSPServer lists URLs of OCSP responders put into
+	// Authority Information Access extension
+	OCSPServer []string
+	// OCSPSigning makes the certificate a delegated OCSP responder of CA,
+	// which could be used to sign OCSP responses only
+	OCSPSigning bool
+	// Validity overrides years if it is not zero
+	Validity time.Duration
+	// Profile sets usages and extensions instead of the default ones
+	// which allow both server and client authentication.
+	// Its days override years if Validity is zero.
+	Profile *Profile
+	// AllowedDNSDomains and AllowedIPRanges decide which SANs requested in
+	// certificate request are honored. DNS names out of the domains and their
+	// subdomains, or IP addresses out of the ranges, are dropped.
+	// All requested SANs of a type are honored if its list is empty.
+	AllowedDNSDomains []string
+	AllowedIPRanges   []*net.IPNet
+	// SANsOf replaces DNS names and IP addresses requested in certificate
+	// request by those of the certificate, so that a renewed certificate
+	// keeps the SANs of the old one
+	SANsOf *Certificate
+	// Policy refuses to issue the certificate with *PolicyError if it is violated
+	Policy *Policy
+}
+
 // CreateCertificateHost creates certificate for host.
 // The arguments include CA certificate, CA certificate info, CA key, certificate request.
 func CreateCertificateHost(crtAuth *Certificate, info *CertificateAuthorityInfo, keyAuth *Key, csr *CertificateSigningRequest, years int) (*Certificate, error) {
-	hostTemplate.SerialNumber.Set(info.SerialNumber)
-	info.IncSerialNumber()
+	return CreateCertificateHostWithOptions(crtAuth, info, keyAuth, csr, years, nil)
+}
+
+// CreateCertificateHostWithOptions creates certificate for host using options.
+// Nil options are the same as CreateCertificateHost.
+func CreateCertificateHostWithOptions(crtAuth *Certificate, info *CertificateAuthorityInfo, keyAuth *Key, csr *CertificateSigningRequest, years int, opts *CertificateHostOptions) (*Certificate, error) {
+	if opts == nil {
+		opts = &CertificateHostOptions{}
+	}
+
+	template := hostTemplate
+	serialNumber, err := info.NextSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serialNumber
 
 	rawCsr, err := csr.GetRawCertificateSigningRequest()
 	if err != nil {
 		return nil, err
 	}
 
-	hostTemplate.Subject = rawCsr.Subject
+	template.Subject = rawCsr.Subject
 
-	hostTemplate.NotAfter = time.Now().AddDate(years, 0, 0).UTC()
+	// hostTemplate is built at startup, so refresh NotBefore for long-running processes
+	template.NotBefore = time.Now().Add(-10 * time.Minute).UTC()
+	if opts.Validity != 0 {
+		template.NotAfter = time.Now().Add(opts.Validity).UTC()
+	} else if opts.Profile != nil && opts.Profile.Days != 0 {
+		template.NotAfter = time.Now().AddDate(0, 0, opts.Profile.Days).UTC()
+	} else {
+		template.NotAfter = time.Now().AddDate(years, 0, 0).UTC()
+	}
 
-	hostTemplate.SubjectKeyId, err = GenerateSubjectKeyId(rawCsr.PublicKey)
+	template.SubjectKeyId, err = GenerateSubjectKeyId(rawCsr.PublicKey)
 	if err != nil {
 		return nil, err
 	}
 
-	hostTemplate.IPAddresses = rawCsr.IPAddresses
-	hostTemplate.DNSNames = rawCsr.DNSNames
+	template.IPAddresses = rawCsr.IPAddresses
+	template.DNSNames = rawCsr.DNSNames
+	if opts.SANsOf != nil {
+		rawCrt, err := opts.SANsOf.GetRawCertificate()
+		if err != nil {
+			return nil, err
+		}
+		template.IPAddresses = rawCrt.IPAddresses
+		template.DNSNames = rawCrt.DNSNames
+	}
+	if len(opts.AllowedDNSDomains) > 0 {
+		template.DNSNames = filterDNSNames(template.DNSNames, opts.AllowedDNSDomains)
+	}
+	if len(opts.AllowedIPRanges) > 0 {
+		template.IPAddresses = filterIPAddresses(template.IPAddresses, opts.AllowedIPRanges)
+	}
+
+	if opts.Profile != nil {
+		if err = opts.Profile.apply(&template, rawCsr.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Policy != nil {
+		if err = opts.Policy.check(&template, rawCsr.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	// Refuse names that clients would reject by name constraints of any CA in chain
+	for _, crt := range append([]*Certificate{crtAuth}, info.Issuers...) {
+		nc, err := NewNameConstraintsFromCertificate(crt)
+		if err != nil {
+			return nil, err
+		}
+		if err = nc.check(&template); err != nil {
+			return nil, err
+		}
+	}
+
+	template.OCSPServer = opts.OCSPServer
+	if opts.OCSPSigning {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}
+		// id-pkix-ocsp-nocheck tells clients not to check the status of responder itself
+		if !hasExtension(template.ExtraExtensions, oidOCSPNoCheck) {
+			template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oidOCSPNoCheck, Value: asn1.NullBytes})
+		}
+	}
 
 	rawCrtAuth, err := crtAuth.GetRawCertificate()
 	if err != nil {
 		return nil, err
 	}
 
-	crtHostBytes, err := x509.CreateCertificate(rand.Reader, &hostTemplate, rawCrtAuth, rawCsr.PublicKey, keyAuth.Private)
+	crtHostBytes, err := x509.CreateCertificate(rand.Reader, &template, rawCrtAuth, rawCsr.PublicKey, keyAuth.Private)
 	if err != nil {
 		return nil, err
 	}
 
 	return NewCertificateFromDER(crtHostBytes), nil
 }
+
+func hasExtension(exts []pkix.Extension, id asn1.ObjectIdentifier) bool {
+	for _, ext := range exts {
+		if ext.Id.Equal(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterDNSNames returns names that are in domains or their subdomains
+func filterDNSNames(names []string, domains []string) []string {
+	filtered := make([]string, 0, len(names))
+	for _, name := range names {
+		for _, domain := range domains {
+			if matchDNSDomain(name, domain) {
+				filtered = append(filtered, name)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// matchDNSDomain checks whether name is domain or its subdomain
+func matchDNSDomain(name, domain string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// filterIPAddresses returns ips that are in ranges
+func filterIPAddresses(ips []net.IP, ranges []*net.IPNet) []net.IP {
+	filtered := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		for _, ipRange := range ranges {
+			if ipRange.Contains(ip) {
+				filtered = append(filtered, ip)
+				break
+			}
+		}
+	}
+	return filtered
+}
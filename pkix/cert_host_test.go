@@ -15,6 +15,7 @@
 package pkix
 
 import (
+	"net"
 	"testing"
 )
 
@@ -58,3 +59,100 @@ func TestCreateCertificateHost(t *testing.T) {
 		t.Fatal("Expect serial number %v instead of %v", authStartSerialNumber, rawCrt.SerialNumber)
 	}
 }
+
+func TestCreateCertificateHostEd25519(t *testing.T) {
+	keyAuth, err := CreateEd25519Key()
+	if err != nil {
+		t.Fatal("Failed creating ed25519 key:", err)
+	}
+	crtAuth, info, err := CreateCertificateAuthority(keyAuth, 1, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+
+	key, err := CreateEd25519Key()
+	if err != nil {
+		t.Fatal("Failed creating ed25519 key:", err)
+	}
+	csr, err := CreateCertificateSigningRequest(key, "host1", "127.0.0.1", "", "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate request:", err)
+	}
+
+	crt, err := CreateCertificateHost(crtAuth, info, keyAuth, csr, 1)
+	if err != nil {
+		t.Fatal("Failed creating certificate for host:", err)
+	}
+
+	if err = crtAuth.VerifyHost(crt, "host1"); err != nil {
+		t.Fatal("Failed verifying certificate for host:", err)
+	}
+}
+
+func TestCreateCertificateHostAllowedSANs(t *testing.T) {
+	keyAuth, err := CreateEd25519Key()
+	if err != nil {
+		t.Fatal("Failed creating ed25519 key:", err)
+	}
+	crtAuth, info, err := CreateCertificateAuthority(keyAuth, 1, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+
+	key, err := CreateEd25519Key()
+	if err != nil {
+		t.Fatal("Failed creating ed25519 key:", err)
+	}
+	csr, err := CreateCertificateSigningRequest(key, "host1", "127.0.0.1,10.0.0.1", "host1.example.com,example.com,example.org", "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate request:", err)
+	}
+
+	_, ipRange, _ := net.ParseCIDR("10.0.0.0/8")
+	opts := &CertificateHostOptions{
+		AllowedDNSDomains: []string{".example.com"},
+		AllowedIPRanges:   []*net.IPNet{ipRange},
+	}
+	crt, err := CreateCertificateHostWithOptions(crtAuth, info, keyAuth, csr, 1, opts)
+	if err != nil {
+		t.Fatal("Failed creating certificate for host:", err)
+	}
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		t.Fatal("Failed to get x509.Certificate:", err)
+	}
+	if len(rawCrt.DNSNames) != 2 || rawCrt.DNSNames[0] != "host1.example.com" || rawCrt.DNSNames[1] != "example.com" {
+		t.Fatal("Unexpected DNS names:", rawCrt.DNSNames)
+	}
+	if len(rawCrt.IPAddresses) != 1 || !rawCrt.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatal("Unexpected IP addresses:", rawCrt.IPAddresses)
+	}
+
+	// SANs of a type are filtered only if its list is given
+	opts = &CertificateHostOptions{AllowedDNSDomains: []string{".example.com"}}
+	if crt, err = CreateCertificateHostWithOptions(crtAuth, info, keyAuth, csr, 1, opts); err != nil {
+		t.Fatal("Failed creating certificate for host:", err)
+	}
+	rawCrt, _ = crt.GetRawCertificate()
+	if len(rawCrt.DNSNames) != 2 || len(rawCrt.IPAddresses) != 2 {
+		t.Fatal("Expect IP addresses to be kept:", rawCrt.DNSNames, rawCrt.IPAddresses)
+	}
+	opts = &CertificateHostOptions{AllowedIPRanges: []*net.IPNet{ipRange}}
+	if crt, err = CreateCertificateHostWithOptions(crtAuth, info, keyAuth, csr, 1, opts); err != nil {
+		t.Fatal("Failed creating certificate for host:", err)
+	}
+	rawCrt, _ = crt.GetRawCertificate()
+	if len(rawCrt.DNSNames) != 3 || len(rawCrt.IPAddresses) != 1 {
+		t.Fatal("Expect DNS names to be kept:", rawCrt.DNSNames, rawCrt.IPAddresses)
+	}
+
+	// SANs of renewed certificate are those of the old one, not of the request
+	opts = &CertificateHostOptions{SANsOf: crt}
+	if crt, err = CreateCertificateHostWithOptions(crtAuth, info, keyAuth, csr, 1, opts); err != nil {
+		t.Fatal("Failed creating certificate for host:", err)
+	}
+	rawCrt, _ = crt.GetRawCertificate()
+	if len(rawCrt.DNSNames) != 3 || len(rawCrt.IPAddresses) != 1 || !rawCrt.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatal("Expect SANs of the old certificate:", rawCrt.DNSNames, rawCrt.IPAddresses)
+	}
+}
@@ -15,34 +15,141 @@
 package pkix
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/big"
 )
 
+// SerialStrategy decides how CA picks serial numbers of certificates it issues
+type SerialStrategy string
+
+const (
+	// SerialSequential increments the counter in info for each certificate
+	SerialSequential SerialStrategy = "sequential"
+	// SerialRandom picks positive serial numbers of at most 20 bytes from CSPRNG,
+	// as required by CA/Browser Forum baseline requirements
+	SerialRandom SerialStrategy = "random"
+)
+
+// Bit size of random serial numbers, which keeps the DER encoding
+// in 20 bytes because the highest bit is zero
+const randomSerialBits = 159
+
+// Times to retry when a random serial number has been used
+const randomSerialRetries = 10
+
+// ParseSerialStrategy returns the strategy named by name
+func ParseSerialStrategy(name string) (SerialStrategy, error) {
+	switch s := SerialStrategy(name); s {
+	case SerialSequential, SerialRandom:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown serial strategy %s", name)
+}
+
 // CertificateAuthorityInfo includes extra information required for CA
 type CertificateAuthorityInfo struct {
 	// SerialNumber that has been used so far
 	// Recorded to ensure all serial numbers issued by the CA are different
 	SerialNumber *big.Int
+	// CRLNumber that has been used so far, nil if no CRL has been issued
+	// Recorded to ensure CRL numbers issued by the CA are increasing
+	CRLNumber *big.Int `json:",omitempty"`
+	// SerialStrategy is empty for sequential serial numbers used by old depots
+	SerialStrategy SerialStrategy `json:",omitempty"`
+
+	// SerialNumberUsed reports whether the CA has issued certificate with the serial number.
+	// It is consulted to keep random serial numbers unique, and is not saved.
+	SerialNumberUsed func(serialNumber *big.Int) bool `json:"-"`
+	// Issuers lists the CAs above the CA up to the root CA. Their name
+	// constraints apply to the certificates the CA issues, and are not saved.
+	Issuers []*Certificate `json:"-"`
 }
 
 func NewCertificateAuthorityInfo(serialNumber int64) *CertificateAuthorityInfo {
-	return &CertificateAuthorityInfo{big.NewInt(serialNumber)}
+	return &CertificateAuthorityInfo{SerialNumber: big.NewInt(serialNumber)}
 }
 
+// NewCertificateAuthorityInfoFromJSON inits CertificateAuthorityInfo from JSON bytes.
+// It accepts both the JSON object and the bare serial number used by old depots.
 func NewCertificateAuthorityInfoFromJSON(data []byte) (*CertificateAuthorityInfo, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		info := &CertificateAuthorityInfo{}
+		if err := json.Unmarshal(data, info); err != nil {
+			return nil, err
+		}
+		if info.SerialNumber == nil {
+			info.SerialNumber = big.NewInt(authStartSerialNumber)
+		}
+		return info, nil
+	}
+
 	i := big.NewInt(0)
 
 	if err := i.UnmarshalJSON(data); err != nil {
 		return nil, err
 	}
 
-	return &CertificateAuthorityInfo{i}, nil
+	return &CertificateAuthorityInfo{SerialNumber: i}, nil
 }
 
 func (n *CertificateAuthorityInfo) IncSerialNumber() {
 	n.SerialNumber.Add(n.SerialNumber, big.NewInt(1))
 }
 
+// NextSerialNumber returns the serial number for the next certificate
+// issued by the CA using its serial strategy
+func (n *CertificateAuthorityInfo) NextSerialNumber() (*big.Int, error) {
+	if n.SerialStrategy != SerialRandom {
+		serialNumber := new(big.Int).Set(n.SerialNumber)
+		n.IncSerialNumber()
+		return serialNumber, nil
+	}
+
+	max := new(big.Int).Lsh(big.NewInt(1), randomSerialBits)
+	for i := 0; i < randomSerialRetries; i++ {
+		serialNumber, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return nil, err
+		}
+		if serialNumber.Sign() == 0 {
+			continue
+		}
+		if n.SerialNumberUsed != nil && n.SerialNumberUsed(serialNumber) {
+			continue
+		}
+		return serialNumber, nil
+	}
+	return nil, errors.New("failed to pick unused random serial number")
+}
+
+// IsIssuedSerialNumber checks whether serialNumber has been used by the CA.
+// It only works for sequential serial numbers.
+func (n *CertificateAuthorityInfo) IsIssuedSerialNumber(serialNumber *big.Int) bool {
+	if n.SerialStrategy == SerialRandom {
+		return false
+	}
+	return serialNumber.Cmp(big.NewInt(authStartSerialNumber)) >= 0 && serialNumber.Cmp(n.SerialNumber) < 0
+}
+
+// IncCRLNumber increments CRLNumber and returns the new one
+func (n *CertificateAuthorityInfo) IncCRLNumber() *big.Int {
+	if n.CRLNumber == nil {
+		n.CRLNumber = big.NewInt(0)
+	}
+	n.CRLNumber.Add(n.CRLNumber, big.NewInt(1))
+	return new(big.Int).Set(n.CRLNumber)
+}
+
+// Export returns JSON bytes.
+// Info that only has serial number is exported in the old format,
+// so depots stay readable by old versions until new features are used.
 func (n *CertificateAuthorityInfo) Export() ([]byte, error) {
-	return n.SerialNumber.MarshalJSON()
+	if n.CRLNumber == nil && (n.SerialStrategy == "" || n.SerialStrategy == SerialSequential) {
+		return n.SerialNumber.MarshalJSON()
+	}
+	return json.Marshal(n)
 }
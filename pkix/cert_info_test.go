@@ -16,6 +16,7 @@ package pkix
 
 import (
 	"encoding/base64"
+	"math/big"
 	"testing"
 )
 
@@ -56,3 +57,67 @@ func TestCertificateAuthorityInfoFromJSON(t *testing.T) {
 		t.Fatal("Failed exporting correct info")
 	}
 }
+
+func TestCertificateAuthorityInfoWithCRLNumber(t *testing.T) {
+	i := NewCertificateAuthorityInfo(serialNumber)
+	if i.IncCRLNumber().Uint64() != 1 || i.IncCRLNumber().Uint64() != 2 {
+		t.Fatal("Failed incrementing CRL number")
+	}
+
+	b, err := i.Export()
+	if err != nil {
+		t.Fatal("Failed exporting info:", err)
+	}
+
+	i, err = NewCertificateAuthorityInfoFromJSON(b)
+	if err != nil {
+		t.Fatal("Failed init CertificateAuthorityInfo:", err)
+	}
+	if i.SerialNumber.Uint64() != serialNumber || i.CRLNumber.Uint64() != 2 {
+		t.Fatal("Failed getting correct info")
+	}
+}
+
+func TestCertificateAuthorityInfoRandomSerialNumber(t *testing.T) {
+	i := NewCertificateAuthorityInfo(serialNumber)
+	i.SerialStrategy = SerialRandom
+
+	used := make(map[string]bool)
+	i.SerialNumberUsed = func(n *big.Int) bool {
+		return used[n.String()]
+	}
+	for j := 0; j < 100; j++ {
+		n, err := i.NextSerialNumber()
+		if err != nil {
+			t.Fatal("Failed picking random serial number:", err)
+		}
+		if n.Sign() <= 0 || n.BitLen() > 159 || used[n.String()] {
+			t.Fatal("Picked invalid serial number:", n)
+		}
+		used[n.String()] = true
+	}
+	if i.SerialNumber.Uint64() != serialNumber {
+		t.Fatal("Expect not to increment counter for random serial numbers")
+	}
+
+	i.SerialNumberUsed = func(*big.Int) bool { return true }
+	if _, err := i.NextSerialNumber(); err == nil {
+		t.Fatal("Expect error when all serial numbers are used")
+	}
+
+	b, err := i.Export()
+	if err != nil {
+		t.Fatal("Failed exporting info:", err)
+	}
+	i, err = NewCertificateAuthorityInfoFromJSON(b)
+	if err != nil {
+		t.Fatal("Failed init CertificateAuthorityInfo:", err)
+	}
+	if i.SerialStrategy != SerialRandom {
+		t.Fatal("Failed saving serial strategy")
+	}
+
+	if _, err = ParseSerialStrategy("counter"); err == nil {
+		t.Fatal("Expect error for unknown serial strategy")
+	}
+}
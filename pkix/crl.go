@@ -0,0 +1,129 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"time"
+)
+
+const (
+	crlPEMBlockType = "X509 CRL"
+)
+
+type CertificateRevocationList struct {
+	// derBytes is always set for valid CertificateRevocationList
+	derBytes []byte
+
+	crl *x509.RevocationList
+}
+
+// CreateCertificateRevocationList creates CRL of all revoked certificates signed by CA.
+// The CRL number is taken from CA info, and nextUpdate is the duration
+// until next CRL is expected.
+func CreateCertificateRevocationList(crtAuth *Certificate, info *CertificateAuthorityInfo, keyAuth *Key, records *RevocationRecords, nextUpdate time.Duration) (*CertificateRevocationList, error) {
+	rawCrtAuth, err := crtAuth.GetRawCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]x509.RevocationListEntry, 0, len(records.Revoked))
+	for _, revoked := range records.Revoked {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   revoked.SerialNumber,
+			RevocationTime: revoked.RevocationTime,
+			ReasonCode:     revoked.Reason,
+		})
+	}
+
+	now := time.Now().UTC()
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    info.IncCRLNumber(),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(nextUpdate),
+	}
+
+	signer, ok := keyAuth.Private.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key could not sign")
+	}
+	crlBytes, err := x509.CreateRevocationList(rand.Reader, template, rawCrtAuth, signer)
+	if err != nil {
+		return nil, err
+	}
+	return NewCertificateRevocationListFromDER(crlBytes), nil
+}
+
+// NewCertificateRevocationListFromDER inits CertificateRevocationList from DER-format bytes
+func NewCertificateRevocationListFromDER(derBytes []byte) *CertificateRevocationList {
+	return &CertificateRevocationList{derBytes: derBytes}
+}
+
+// NewCertificateRevocationListFromPEM inits CertificateRevocationList from PEM-format bytes
+func NewCertificateRevocationListFromPEM(data []byte) (*CertificateRevocationList, error) {
+	pemBlock, _ := pem.Decode(data)
+	if pemBlock == nil {
+		return nil, errors.New("cannot find the next PEM formatted block")
+	}
+	if pemBlock.Type != crlPEMBlockType || len(pemBlock.Headers) != 0 {
+		return nil, errors.New("unmatched type or headers")
+	}
+	return &CertificateRevocationList{derBytes: pemBlock.Bytes}, nil
+}
+
+// build crl field if needed
+func (c *CertificateRevocationList) buildX509RevocationList() error {
+	if c.crl != nil {
+		return nil
+	}
+
+	var err error
+	c.crl, err = x509.ParseRevocationList(c.derBytes)
+	return err
+}
+
+// GetRawCertificateRevocationList returns a copy of this CRL as an x509.RevocationList
+func (c *CertificateRevocationList) GetRawCertificateRevocationList() (*x509.RevocationList, error) {
+	if err := c.buildX509RevocationList(); err != nil {
+		return nil, err
+	}
+	return c.crl, nil
+}
+
+// Export returns PEM-format bytes
+func (c *CertificateRevocationList) Export() ([]byte, error) {
+	pemBlock := &pem.Block{
+		Type:    crlPEMBlockType,
+		Headers: nil,
+		Bytes:   c.derBytes,
+	}
+
+	buf := new(bytes.Buffer)
+	if err := pem.Encode(buf, pemBlock); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ExportDER returns DER-format bytes
+func (c *CertificateRevocationList) ExportDER() []byte {
+	return c.derBytes
+}
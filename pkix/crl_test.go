@@ -0,0 +1,72 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"crypto/elliptic"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCreateCertificateRevocationList(t *testing.T) {
+	key, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	crt, info, err := CreateCertificateAuthority(key, 1, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+
+	records := NewRevocationRecords()
+	records.Revoke("host1", big.NewInt(5), 1, time.Now())
+
+	crl, err := CreateCertificateRevocationList(crt, info, key, records, 24*time.Hour)
+	if err != nil {
+		t.Fatal("Failed creating CRL:", err)
+	}
+	if info.CRLNumber.Uint64() != 1 {
+		t.Fatal("Failed incrementing CRL number")
+	}
+
+	pemBytes, err := crl.Export()
+	if err != nil {
+		t.Fatal("Failed exporting PEM-format bytes:", err)
+	}
+	crl, err = NewCertificateRevocationListFromPEM(pemBytes)
+	if err != nil {
+		t.Fatal("Failed parsing CRL from PEM:", err)
+	}
+	rawCrl, err := crl.GetRawCertificateRevocationList()
+	if err != nil {
+		t.Fatal("Failed getting x509.RevocationList:", err)
+	}
+
+	rawCrt, _ := crt.GetRawCertificate()
+	if err = rawCrl.CheckSignatureFrom(rawCrt); err != nil {
+		t.Fatal("Failed checking CRL signature:", err)
+	}
+	if rawCrl.Number.Uint64() != 1 {
+		t.Fatal("Expect CRL number 1 instead of", rawCrl.Number)
+	}
+	entries := rawCrl.RevokedCertificateEntries
+	if len(entries) != 1 || entries[0].SerialNumber.Uint64() != 5 || entries[0].ReasonCode != 1 {
+		t.Fatal("Failed getting revoked certificate from CRL")
+	}
+	if rawCrl.NextUpdate.Sub(rawCrl.ThisUpdate) != 24*time.Hour {
+		t.Fatal("Failed setting next update")
+	}
+}
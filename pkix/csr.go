@@ -20,6 +20,7 @@ import (
 	"strings"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -96,6 +97,26 @@ func CreateCertificateSigningRequest(key *Key, name string, ip_list string, doma
 	return NewCertificateSigningRequestFromDER(csrBytes), nil
 }
 
+// CreateCertificateSigningRequestLike creates certificate request using key
+// with the same subject and SANs as csr. It is used to rotate the key of host.
+func CreateCertificateSigningRequestLike(key *Key, csr *CertificateSigningRequest) (*CertificateSigningRequest, error) {
+	rawCsr, err := csr.GetRawCertificateSigningRequest()
+	if err != nil {
+		return nil, err
+	}
+	csrTemplate := &x509.CertificateRequest{
+		Subject:     rawCsr.Subject,
+		IPAddresses: rawCsr.IPAddresses,
+		DNSNames:    rawCsr.DNSNames,
+	}
+
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, csrTemplate, key.Private)
+	if err != nil {
+		return nil, err
+	}
+	return NewCertificateSigningRequestFromDER(csrBytes), nil
+}
+
 type CertificateSigningRequest struct {
 	// derBytes is always set for valid Certificate
 	derBytes []byte
@@ -155,6 +176,18 @@ func (c *CertificateSigningRequest) CheckSignature() error {
 // checkSignature verifies a signature made by the key on a CSR, such
 // as on the CSR itself.
 func checkSignature(csr *x509.CertificateRequest, algo x509.SignatureAlgorithm, signed, signature []byte) error {
+	// Ed25519 signs the message itself instead of its digest
+	if algo == x509.PureEd25519 {
+		pub, ok := csr.PublicKey.(ed25519.PublicKey)
+		if !ok {
+			return x509.ErrUnsupportedAlgorithm
+		}
+		if !ed25519.Verify(pub, signed, signature) {
+			return errors.New("x509: Ed25519 verification failure")
+		}
+		return nil
+	}
+
 	var hashType crypto.Hash
 	switch algo {
 	case x509.SHA1WithRSA, x509.ECDSAWithSHA1:
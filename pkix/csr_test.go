@@ -87,6 +87,67 @@ func TestCreateCertificateSigningRequest(t *testing.T) {
 	}
 }
 
+func TestCreateCertificateSigningRequestEd25519(t *testing.T) {
+	key, err := CreateEd25519Key()
+	if err != nil {
+		t.Fatal("Failed creating ed25519 key:", err)
+	}
+
+	csr, err := CreateCertificateSigningRequest(key, csrHostname, csrIP, "", "example", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate request:", err)
+	}
+
+	if err = csr.CheckSignature(); err != nil {
+		t.Fatal("Failed checking signature in certificate request:", err)
+	}
+
+	rawCsr, err := csr.GetRawCertificateSigningRequest()
+	if err != nil {
+		t.Fatal("Failed getting raw certificate request:", err)
+	}
+	// corrupt the signature to make sure it is really verified
+	rawCsr.Signature[0] ^= 0xff
+	if err = csr.CheckSignature(); err == nil {
+		t.Fatal("Expect not to pass checking corrupted signature")
+	}
+}
+
+func TestCreateCertificateSigningRequestLike(t *testing.T) {
+	key, err := CreateEd25519Key()
+	if err != nil {
+		t.Fatal("Failed creating ed25519 key:", err)
+	}
+	csr, err := CreateCertificateSigningRequest(key, csrHostname, csrIP, "host1.example.com", "example", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate request:", err)
+	}
+
+	newKey, err := CreateKeyLike(key.Public)
+	if err != nil {
+		t.Fatal("Failed creating key like the old one:", err)
+	}
+	newCsr, err := CreateCertificateSigningRequestLike(newKey, csr)
+	if err != nil {
+		t.Fatal("Failed creating certificate request like the old one:", err)
+	}
+	if err = newCsr.CheckSignature(); err != nil {
+		t.Fatal("Failed checking signature in certificate request:", err)
+	}
+
+	rawCsr, _ := csr.GetRawCertificateSigningRequest()
+	rawNewCsr, _ := newCsr.GetRawCertificateSigningRequest()
+	if rawNewCsr.Subject.String() != rawCsr.Subject.String() {
+		t.Fatal("Expect the same subject instead of", rawNewCsr.Subject)
+	}
+	if len(rawNewCsr.DNSNames) != 1 || len(rawNewCsr.IPAddresses) != 1 {
+		t.Fatal("Expect the same SANs")
+	}
+	if bytes.Equal(rawNewCsr.RawSubjectPublicKeyInfo, rawCsr.RawSubjectPublicKeyInfo) {
+		t.Fatal("Expect different key")
+	}
+}
+
 func TestCertificateSigningRequest(t *testing.T) {
 	csr, err := NewCertificateSigningRequestFromPEM([]byte(csrPEM))
 	if err != nil {
@@ -0,0 +1,180 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Status of certificate in index
+const (
+	IndexStatusValid   = "valid"
+	IndexStatusRevoked = "revoked"
+	IndexStatusExpired = "expired"
+)
+
+// IndexEntry records one certificate issued by CA
+type IndexEntry struct {
+	// Name of the host or intermediate CA that the certificate is issued to
+	Name string
+	// Issuer is the name of intermediate CA that issues the certificate,
+	// and it is empty for CA
+	Issuer       string `json:",omitempty"`
+	SerialNumber *big.Int
+	Subject      string
+	DNSNames     []string `json:",omitempty"`
+	IPAddresses  []string `json:",omitempty"`
+	NotBefore    time.Time
+	NotAfter     time.Time
+	// Fingerprint is hex-encoded SHA-256 digest of the DER-format certificate
+	Fingerprint string
+	// IsCA is true if the certificate is issued to intermediate CA
+	IsCA bool `json:",omitempty"`
+	// Profile is the name of profile used to issue the certificate
+	Profile string `json:",omitempty"`
+	// Origin is the server that issued the certificate to host, such as
+	// acme, which is kept through renewals. It is empty for commands.
+	Origin string `json:",omitempty"`
+	Status string
+	// RevocationTime and Reason are set if the certificate is revoked
+	RevocationTime *time.Time `json:",omitempty"`
+	Reason         int        `json:",omitempty"`
+}
+
+// NewIndexEntry inits IndexEntry from certificate issued by CA named by issuer
+func NewIndexEntry(name string, issuer string, crt *Certificate) (*IndexEntry, error) {
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]string, 0, len(rawCrt.IPAddresses))
+	for _, ip := range rawCrt.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	sum := sha256.Sum256(rawCrt.Raw)
+
+	return &IndexEntry{
+		Name:         name,
+		Issuer:       issuer,
+		SerialNumber: new(big.Int).Set(rawCrt.SerialNumber),
+		Subject:      rawCrt.Subject.String(),
+		DNSNames:     rawCrt.DNSNames,
+		IPAddresses:  ips,
+		NotBefore:    rawCrt.NotBefore.UTC(),
+		NotAfter:     rawCrt.NotAfter.UTC(),
+		Fingerprint:  hex.EncodeToString(sum[:]),
+		IsCA:         rawCrt.IsCA,
+		Status:       IndexStatusValid,
+	}, nil
+}
+
+// StatusAt returns the status of certificate at time t,
+// which is expired if a valid certificate has passed its NotAfter.
+func (e *IndexEntry) StatusAt(t time.Time) string {
+	if e.Status == IndexStatusValid && t.After(e.NotAfter) {
+		return IndexStatusExpired
+	}
+	return e.Status
+}
+
+// CertificateIndex is the ledger of all certificates issued in depot.
+// It is stored as JSON lines with one entry per line.
+type CertificateIndex struct {
+	Entries []*IndexEntry
+}
+
+func NewCertificateIndex() *CertificateIndex {
+	return &CertificateIndex{Entries: make([]*IndexEntry, 0)}
+}
+
+// NewCertificateIndexFromJSONLines inits CertificateIndex from JSON lines.
+// Blank lines are skipped.
+func NewCertificateIndexFromJSONLines(data []byte) (*CertificateIndex, error) {
+	index := NewCertificateIndex()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		entry := &IndexEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			return nil, fmt.Errorf("index line %d: %v", n, err)
+		}
+		index.Entries = append(index.Entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Add appends entry to index.
+// It fails if the same CA has issued another certificate with the serial number.
+func (x *CertificateIndex) Add(entry *IndexEntry) error {
+	if x.Get(entry.Issuer, entry.SerialNumber) != nil {
+		return fmt.Errorf("certificate with serial number %v has been issued", entry.SerialNumber)
+	}
+	x.Entries = append(x.Entries, entry)
+	return nil
+}
+
+// Get returns the entry of certificate with serial number issued by CA
+// named by issuer, or nil if it is not in index
+func (x *CertificateIndex) Get(issuer string, serialNumber *big.Int) *IndexEntry {
+	for _, entry := range x.Entries {
+		if entry.Issuer == issuer && entry.SerialNumber.Cmp(serialNumber) == 0 {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Revoke marks the certificate with serial number issued by CA named by issuer as revoked.
+// It returns false if the certificate is missing in index, e.g. issued before index exists.
+func (x *CertificateIndex) Revoke(issuer string, serialNumber *big.Int, reason int, revocationTime time.Time) bool {
+	entry := x.Get(issuer, serialNumber)
+	if entry == nil {
+		return false
+	}
+	t := revocationTime.UTC()
+	entry.Status = IndexStatusRevoked
+	entry.RevocationTime = &t
+	entry.Reason = reason
+	return true
+}
+
+// Export returns JSON lines
+func (x *CertificateIndex) Export() ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	for _, entry := range x.Entries {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCertificateIndex(t *testing.T) {
+	keyAuth, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	crtAuth, info, err := CreateCertificateAuthority(keyAuth, 1, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+	key, _ := CreateECDSAKey(elliptic.P256())
+	csr, _ := CreateCertificateSigningRequest(key, "host1", "127.0.0.1", "host1.example.com", "test", "US")
+	crt, err := CreateCertificateHost(crtAuth, info, keyAuth, csr, 1)
+	if err != nil {
+		t.Fatal("Failed creating certificate for host:", err)
+	}
+
+	entry, err := NewIndexEntry("host1", "", crt)
+	if err != nil {
+		t.Fatal("Failed creating index entry:", err)
+	}
+	if entry.SerialNumber.Int64() != 2 || entry.Status != IndexStatusValid {
+		t.Fatal("Failed recording serial number and status")
+	}
+	if len(entry.DNSNames) != 1 || entry.DNSNames[0] != "host1.example.com" || len(entry.IPAddresses) != 1 || entry.IPAddresses[0] != "127.0.0.1" {
+		t.Fatal("Failed recording SANs:", entry.DNSNames, entry.IPAddresses)
+	}
+	if len(entry.Fingerprint) != 64 {
+		t.Fatal("Failed recording SHA-256 fingerprint:", entry.Fingerprint)
+	}
+
+	index := NewCertificateIndex()
+	if err = index.Add(entry); err != nil {
+		t.Fatal("Failed adding entry:", err)
+	}
+	if err = index.Add(entry); err == nil {
+		t.Fatal("Expect not to add the same serial number twice")
+	}
+	other := *entry
+	other.Issuer = "intermediate"
+	if err = index.Add(&other); err != nil {
+		t.Fatal("Failed adding entry of other CA:", err)
+	}
+
+	if index.Revoke("", big.NewInt(100), 1, time.Now()) {
+		t.Fatal("Expect not to revoke certificate missing in index")
+	}
+	if !index.Revoke("", big.NewInt(2), 1, time.Now()) {
+		t.Fatal("Failed revoking certificate")
+	}
+
+	b, err := index.Export()
+	if err != nil {
+		t.Fatal("Failed exporting index:", err)
+	}
+	if bytes.Count(b, []byte("\n")) != 2 {
+		t.Fatal("Expect one line per entry:", string(b))
+	}
+	index, err = NewCertificateIndexFromJSONLines(b)
+	if err != nil {
+		t.Fatal("Failed parsing index:", err)
+	}
+	if len(index.Entries) != 2 {
+		t.Fatal("Expect 2 entries instead of", len(index.Entries))
+	}
+	if e := index.Get("", big.NewInt(2)); e == nil || e.StatusAt(time.Now()) != IndexStatusRevoked || e.Reason != 1 || e.RevocationTime == nil {
+		t.Fatal("Failed getting revoked entry")
+	}
+	if e := index.Get("intermediate", big.NewInt(2)); e == nil || e.StatusAt(time.Now().AddDate(2, 0, 0)) != IndexStatusExpired {
+		t.Fatal("Failed getting expired entry")
+	}
+
+	if _, err = NewCertificateIndexFromJSONLines([]byte("{}\nbad\n")); err == nil {
+		t.Fatal("Expect error for malformed line")
+	}
+}
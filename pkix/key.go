@@ -17,6 +17,9 @@ package pkix
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
@@ -24,11 +27,16 @@ import (
 	"encoding/asn1"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"math/big"
+	"strings"
 )
 
 const (
 	rsaPrivateKeyPEMBlockType = "RSA PRIVATE KEY"
+	ecPrivateKeyPEMBlockType  = "EC PRIVATE KEY"
+	// PKCS#8 block, used for keys without a dedicated legacy format
+	pkcs8PrivateKeyPEMBlockType = "PRIVATE KEY"
 )
 
 // CreateRSAKey creates a new Key using RSA algorithm
@@ -41,6 +49,54 @@ func CreateRSAKey(rsaBits int) (*Key, error) {
 	return NewKey(&priv.PublicKey, priv), nil
 }
 
+// CreateECDSAKey creates a new Key using ECDSA algorithm on the given curve
+func CreateECDSAKey(curve elliptic.Curve) (*Key, error) {
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKey(&priv.PublicKey, priv), nil
+}
+
+// CreateEd25519Key creates a new Key using Ed25519 algorithm
+func CreateEd25519Key() (*Key, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKey(pub, priv), nil
+}
+
+// CreateKeyLike creates a new Key of the same algorithm and size as pub
+func CreateKeyLike(pub crypto.PublicKey) (*Key, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return CreateRSAKey(pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return CreateECDSAKey(pub.Curve)
+	case ed25519.PublicKey:
+		return CreateEd25519Key()
+	}
+	return nil, errors.New("only RSA, ECDSA and Ed25519 keys are supported")
+}
+
+// GetCurve returns the elliptic curve for name, which could be
+// one of P256, P384 and P521 (with or without the dash).
+// P224 is refused as it is below the minimum strength.
+func GetCurve(name string) (elliptic.Curve, error) {
+	switch strings.ToUpper(strings.Replace(name, "-", "", -1)) {
+	case "P256":
+		return elliptic.P256(), nil
+	case "P384":
+		return elliptic.P384(), nil
+	case "P521":
+		return elliptic.P521(), nil
+	}
+	return nil, fmt.Errorf("unsupported curve %s", name)
+}
+
 type Key struct {
 	Public  crypto.PublicKey
 	Private crypto.PrivateKey
@@ -51,59 +107,116 @@ func NewKey(pub crypto.PublicKey, priv crypto.PrivateKey) *Key {
 	return &Key{Public: pub, Private: priv}
 }
 
-// NewKeyFromPrivateKeyPEM inits Key from PEM-format rsa private key bytes
+// NewKeyFromPrivateKeyPEM inits Key from PEM-format rsa, ecdsa or PKCS#8 private key bytes
 func NewKeyFromPrivateKeyPEM(data []byte) (*Key, error) {
 	pemBlock, _ := pem.Decode(data)
 	if pemBlock == nil {
 		return nil, errors.New("cannot find the next PEM formatted block")
 	}
-	if pemBlock.Type != rsaPrivateKeyPEMBlockType || len(pemBlock.Headers) != 0 {
+	if !isPrivateKeyPEMBlockType(pemBlock.Type) || len(pemBlock.Headers) != 0 {
 		return nil, errors.New("unmatched type or headers")
 	}
 
-	priv, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
-	if err != nil {
-		return nil, err
-	}
-
-	return NewKey(&priv.PublicKey, priv), nil
+	return parsePrivateKey(pemBlock.Type, pemBlock.Bytes)
 }
 
-// NewKeyFromEncryptedPrivateKeyPEM inits Key from encrypted PEM-format rsa private key bytes
+// NewKeyFromEncryptedPrivateKeyPEM inits Key from encrypted PEM-format rsa, ecdsa or PKCS#8 private key bytes
 func NewKeyFromEncryptedPrivateKeyPEM(data []byte, password []byte) (*Key, error) {
 	pemBlock, _ := pem.Decode(data)
 	if pemBlock == nil {
 		return nil, errors.New("cannot find the next PEM formatted block")
 	}
-	if pemBlock.Type != rsaPrivateKeyPEMBlockType {
+	if pemBlock.Type == encryptedPrivateKeyPEMBlockType {
+		b, err := decryptPKCS8PrivateKey(pemBlock.Bytes, password)
+		if err != nil {
+			return nil, err
+		}
+		return parsePrivateKey(pkcs8PrivateKeyPEMBlockType, b)
+	}
+	if !isPrivateKeyPEMBlockType(pemBlock.Type) {
 		return nil, errors.New("unmatched type or headers")
 	}
 
+	// legacy encrypted PEM block
 	b, err := x509.DecryptPEMBlock(pemBlock, password)
 	if err != nil {
 		return nil, err
 	}
 
-	priv, err := x509.ParsePKCS1PrivateKey(b)
-	if err != nil {
-		return nil, err
+	return parsePrivateKey(pemBlock.Type, b)
+}
+
+func isPrivateKeyPEMBlockType(blockType string) bool {
+	switch blockType {
+	case rsaPrivateKeyPEMBlockType, ecPrivateKeyPEMBlockType, pkcs8PrivateKeyPEMBlockType:
+		return true
 	}
+	return false
+}
 
-	return NewKey(&priv.PublicKey, priv), nil
+// parsePrivateKey parses DER-format private key according to its PEM block type
+func parsePrivateKey(blockType string, der []byte) (*Key, error) {
+	switch blockType {
+	case rsaPrivateKeyPEMBlockType:
+		priv, err := x509.ParsePKCS1PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		return NewKey(&priv.PublicKey, priv), nil
+	case ecPrivateKeyPEMBlockType:
+		priv, err := x509.ParseECPrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		return NewKey(&priv.PublicKey, priv), nil
+	case pkcs8PrivateKeyPEMBlockType:
+		priv, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		switch priv := priv.(type) {
+		case *rsa.PrivateKey:
+			return NewKey(&priv.PublicKey, priv), nil
+		case *ecdsa.PrivateKey:
+			return NewKey(&priv.PublicKey, priv), nil
+		case ed25519.PrivateKey:
+			return NewKey(priv.Public(), priv), nil
+		}
+		return nil, errors.New("unsupported PKCS#8 private key")
+	}
+	return nil, errors.New("unmatched type or headers")
 }
 
-// ExportPrivate exports PEM-format private key
-func (k *Key) ExportPrivate() ([]byte, error) {
-	var privPEMBlock *pem.Block
+// marshalPrivate returns the PEM block type and DER-format bytes of private key
+func (k *Key) marshalPrivate() (string, []byte, error) {
 	switch priv := k.Private.(type) {
 	case *rsa.PrivateKey:
-		privBytes := x509.MarshalPKCS1PrivateKey(priv)
-		privPEMBlock = &pem.Block{
-			Type:  rsaPrivateKeyPEMBlockType,
-			Bytes: privBytes,
+		return rsaPrivateKeyPEMBlockType, x509.MarshalPKCS1PrivateKey(priv), nil
+	case *ecdsa.PrivateKey:
+		privBytes, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return "", nil, err
 		}
-	default:
-		return nil, errors.New("only RSA private key is supported")
+		return ecPrivateKeyPEMBlockType, privBytes, nil
+	case ed25519.PrivateKey:
+		privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return "", nil, err
+		}
+		return pkcs8PrivateKeyPEMBlockType, privBytes, nil
+	}
+	return "", nil, errors.New("only RSA, ECDSA and Ed25519 private keys are supported")
+}
+
+// ExportPrivate exports PEM-format private key
+func (k *Key) ExportPrivate() ([]byte, error) {
+	blockType, privBytes, err := k.marshalPrivate()
+	if err != nil {
+		return nil, err
+	}
+	privPEMBlock := &pem.Block{
+		Type:  blockType,
+		Bytes: privBytes,
 	}
 
 	buf := new(bytes.Buffer)
@@ -114,18 +227,38 @@ func (k *Key) ExportPrivate() ([]byte, error) {
 }
 
 // ExportEncryptedPrivate exports encrypted PEM-format private key
+// using DefaultKeyEncryption
 func (k *Key) ExportEncryptedPrivate(password []byte) ([]byte, error) {
-	var privBytes []byte
-	switch priv := k.Private.(type) {
-	case *rsa.PrivateKey:
-		privBytes = x509.MarshalPKCS1PrivateKey(priv)
-	default:
-		return nil, errors.New("only RSA private key is supported")
-	}
+	return k.ExportEncryptedPrivateWithEncryption(password, DefaultKeyEncryption)
+}
 
-	privPEMBlock, err := x509.EncryptPEMBlock(rand.Reader, rsaPrivateKeyPEMBlockType, privBytes, password, x509.PEMCipher3DES)
-	if err != nil {
-		return nil, err
+// ExportEncryptedPrivateWithEncryption exports encrypted PEM-format private key.
+// KeyEncryptionLegacy3DES keeps the key format and encrypts it with PEM headers,
+// and all the other schemes produce PKCS#8 ENCRYPTED PRIVATE KEY block.
+func (k *Key) ExportEncryptedPrivateWithEncryption(password []byte, enc KeyEncryption) ([]byte, error) {
+	var privPEMBlock *pem.Block
+	if enc == KeyEncryptionLegacy3DES {
+		blockType, privBytes, err := k.marshalPrivate()
+		if err != nil {
+			return nil, err
+		}
+		privPEMBlock, err = x509.EncryptPEMBlock(rand.Reader, blockType, privBytes, password, x509.PEMCipher3DES)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		privBytes, err := x509.MarshalPKCS8PrivateKey(k.Private)
+		if err != nil {
+			return nil, err
+		}
+		encryptedBytes, err := encryptPKCS8PrivateKey(privBytes, password, enc)
+		if err != nil {
+			return nil, err
+		}
+		privPEMBlock = &pem.Block{
+			Type:  encryptedPrivateKeyPEMBlockType,
+			Bytes: encryptedBytes,
+		}
 	}
 
 	buf := new(bytes.Buffer)
@@ -155,8 +288,17 @@ func GenerateSubjectKeyId(pub crypto.PublicKey) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+	case *ecdsa.PublicKey:
+		// the uncompressed form of the curve point, as stored in subjectPublicKey
+		ecdhPub, err := pub.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		pubBytes = ecdhPub.Bytes()
+	case ed25519.PublicKey:
+		pubBytes = pub
 	default:
-		return nil, errors.New("only RSA public key is supported")
+		return nil, errors.New("only RSA, ECDSA and Ed25519 public keys are supported")
 	}
 
 	hash := sha1.Sum(pubBytes)
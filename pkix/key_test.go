@@ -16,6 +16,9 @@ package pkix
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"encoding/base64"
 	"testing"
@@ -190,3 +193,164 @@ func TestRSAKeyGenerateSubjectKeyId(t *testing.T) {
 		t.Fatal("Failed generating correct SubjectKeyId")
 	}
 }
+
+func TestCreateECDSAKey(t *testing.T) {
+	key, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+
+	priv := key.Private.(*ecdsa.PrivateKey)
+	if !priv.Curve.IsOnCurve(priv.X, priv.Y) {
+		t.Fatal("Failed to validate private key")
+	}
+}
+
+func TestGetCurve(t *testing.T) {
+	for name, curve := range map[string]elliptic.Curve{
+		"P256":  elliptic.P256(),
+		"p384":  elliptic.P384(),
+		"P-521": elliptic.P521(),
+	} {
+		c, err := GetCurve(name)
+		if err != nil {
+			t.Fatal("Failed getting curve:", err)
+		}
+		if c != curve {
+			t.Fatalf("Expect curve %v instead of %v", curve.Params().Name, c.Params().Name)
+		}
+	}
+
+	for _, name := range []string{"P512", "P224"} {
+		if _, err := GetCurve(name); err == nil {
+			t.Fatal("Expect not to get curve", name)
+		}
+	}
+}
+
+// TestECDSAKeyExport tests the ability to convert ecdsa key into PEM bytes and back
+func TestECDSAKeyExport(t *testing.T) {
+	key, err := CreateECDSAKey(elliptic.P384())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+
+	pemBytes, err := key.ExportPrivate()
+	if err != nil {
+		t.Fatal("Failed exporting PEM-format bytes:", err)
+	}
+	if !bytes.Contains(pemBytes, []byte(ecPrivateKeyPEMBlockType)) {
+		t.Fatal("Failed exporting EC PRIVATE KEY block")
+	}
+
+	keyRead, err := NewKeyFromPrivateKeyPEM(pemBytes)
+	if err != nil {
+		t.Fatal("Failed parsing ECDSA private key:", err)
+	}
+	if !keyRead.Private.(*ecdsa.PrivateKey).Equal(key.Private) {
+		t.Fatal("Failed getting the same ECDSA private key")
+	}
+}
+
+// TestECDSAKeyExportEncrypted tests the ability to convert ecdsa key into encrypted PEM bytes and back
+func TestECDSAKeyExportEncrypted(t *testing.T) {
+	key, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+
+	pemBytes, err := key.ExportEncryptedPrivate([]byte(password))
+	if err != nil {
+		t.Fatal("Failed exporting PEM-format bytes:", err)
+	}
+
+	keyRead, err := NewKeyFromEncryptedPrivateKeyPEM(pemBytes, []byte(password))
+	if err != nil {
+		t.Fatal("Failed parsing encrypted ECDSA private key:", err)
+	}
+	if !keyRead.Private.(*ecdsa.PrivateKey).Equal(key.Private) {
+		t.Fatal("Failed getting the same ECDSA private key")
+	}
+
+	if _, err := NewKeyFromEncryptedPrivateKeyPEM(pemBytes, []byte(wrongPassword)); err == nil {
+		t.Fatal("Expect not parsing private key with wrong password")
+	}
+}
+
+func TestECDSAKeyGenerateSubjectKeyId(t *testing.T) {
+	key, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+
+	id, err := GenerateSubjectKeyId(key.Public)
+	if err != nil {
+		t.Fatal("Failed generating SubjectKeyId:", err)
+	}
+	if len(id) != 20 {
+		t.Fatal("Failed generating 160-bit SubjectKeyId")
+	}
+}
+
+func TestCreateEd25519Key(t *testing.T) {
+	key, err := CreateEd25519Key()
+	if err != nil {
+		t.Fatal("Failed creating ed25519 key:", err)
+	}
+
+	priv := key.Private.(ed25519.PrivateKey)
+	if !priv.Public().(ed25519.PublicKey).Equal(key.Public) {
+		t.Fatal("Failed matching public key")
+	}
+}
+
+// TestEd25519KeyExport tests the ability to convert ed25519 key into PKCS#8 PEM bytes and back
+func TestEd25519KeyExport(t *testing.T) {
+	key, err := CreateEd25519Key()
+	if err != nil {
+		t.Fatal("Failed creating ed25519 key:", err)
+	}
+
+	pemBytes, err := key.ExportPrivate()
+	if err != nil {
+		t.Fatal("Failed exporting PEM-format bytes:", err)
+	}
+	if !bytes.Contains(pemBytes, []byte("-----BEGIN "+pkcs8PrivateKeyPEMBlockType)) {
+		t.Fatal("Failed exporting PKCS#8 PRIVATE KEY block")
+	}
+
+	keyRead, err := NewKeyFromPrivateKeyPEM(pemBytes)
+	if err != nil {
+		t.Fatal("Failed parsing Ed25519 private key:", err)
+	}
+	if !keyRead.Private.(ed25519.PrivateKey).Equal(key.Private) {
+		t.Fatal("Failed getting the same Ed25519 private key")
+	}
+
+	pemBytes, err = key.ExportEncryptedPrivate([]byte(password))
+	if err != nil {
+		t.Fatal("Failed exporting encrypted PEM-format bytes:", err)
+	}
+	keyRead, err = NewKeyFromEncryptedPrivateKeyPEM(pemBytes, []byte(password))
+	if err != nil {
+		t.Fatal("Failed parsing encrypted Ed25519 private key:", err)
+	}
+	if !keyRead.Private.(ed25519.PrivateKey).Equal(key.Private) {
+		t.Fatal("Failed getting the same Ed25519 private key")
+	}
+}
+
+func TestEd25519KeyGenerateSubjectKeyId(t *testing.T) {
+	key, err := CreateEd25519Key()
+	if err != nil {
+		t.Fatal("Failed creating ed25519 key:", err)
+	}
+
+	id, err := GenerateSubjectKeyId(key.Public)
+	if err != nil {
+		t.Fatal("Failed generating SubjectKeyId:", err)
+	}
+	if len(id) != 20 {
+		t.Fatal("Failed generating 160-bit SubjectKeyId")
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"crypto/x509"
+	"net"
+	"strings"
+)
+
+// NameConstraints limits the names that certificate authority could issue
+// certificates for, which is written as a critical name constraints extension
+// defined in RFC 5280 section 4.2.1.10.
+// A domain matches itself and its subdomains, and one with leading dot only
+// matches its subdomains. An email constraint is a mailbox, or a domain of mailboxes.
+type NameConstraints struct {
+	PermittedDNSDomains     []string
+	ExcludedDNSDomains      []string
+	PermittedIPRanges       []*net.IPNet
+	ExcludedIPRanges        []*net.IPNet
+	PermittedEmailAddresses []string
+	ExcludedEmailAddresses  []string
+}
+
+// IsEmpty checks whether no name is constrained
+func (nc *NameConstraints) IsEmpty() bool {
+	return nc == nil || len(nc.PermittedDNSDomains)+len(nc.ExcludedDNSDomains)+
+		len(nc.PermittedIPRanges)+len(nc.ExcludedIPRanges)+
+		len(nc.PermittedEmailAddresses)+len(nc.ExcludedEmailAddresses) == 0
+}
+
+// apply writes name constraints into template of CA certificate
+func (nc *NameConstraints) apply(template *x509.Certificate) {
+	template.PermittedDNSDomainsCritical = !nc.IsEmpty()
+	if nc.IsEmpty() {
+		template.PermittedDNSDomains, template.ExcludedDNSDomains = nil, nil
+		template.PermittedIPRanges, template.ExcludedIPRanges = nil, nil
+		template.PermittedEmailAddresses, template.ExcludedEmailAddresses = nil, nil
+		return
+	}
+	template.PermittedDNSDomains = nc.PermittedDNSDomains
+	template.ExcludedDNSDomains = nc.ExcludedDNSDomains
+	template.PermittedIPRanges = nc.PermittedIPRanges
+	template.ExcludedIPRanges = nc.ExcludedIPRanges
+	template.PermittedEmailAddresses = nc.PermittedEmailAddresses
+	template.ExcludedEmailAddresses = nc.ExcludedEmailAddresses
+}
+
+// NewNameConstraintsFromCertificate returns the name constraints of CA certificate
+func NewNameConstraintsFromCertificate(crt *Certificate) (*NameConstraints, error) {
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return nil, err
+	}
+	return &NameConstraints{
+		PermittedDNSDomains:     rawCrt.PermittedDNSDomains,
+		ExcludedDNSDomains:      rawCrt.ExcludedDNSDomains,
+		PermittedIPRanges:       rawCrt.PermittedIPRanges,
+		ExcludedIPRanges:        rawCrt.ExcludedIPRanges,
+		PermittedEmailAddresses: rawCrt.PermittedEmailAddresses,
+		ExcludedEmailAddresses:  rawCrt.ExcludedEmailAddresses,
+	}, nil
+}
+
+// narrow returns name constraints that permit no name which parent does not.
+// Permitted names of parent are inherited for types that nc leaves
+// unconstrained, and excluded names of parent are added. It returns
+// *PolicyError listing permitted names of nc that are wider than parent.
+func (nc *NameConstraints) narrow(parent *NameConstraints) (*NameConstraints, error) {
+	if nc == nil {
+		nc = &NameConstraints{}
+	}
+	var violations []PolicyViolation
+	narrowed := &NameConstraints{
+		PermittedDNSDomains:     narrowConstraints(nc.PermittedDNSDomains, parent.PermittedDNSDomains, withinDNSConstraint, "permitted_dns_domains", &violations),
+		ExcludedDNSDomains:      unionConstraints(nc.ExcludedDNSDomains, parent.ExcludedDNSDomains),
+		PermittedIPRanges:       nc.PermittedIPRanges,
+		ExcludedIPRanges:        nc.ExcludedIPRanges,
+		PermittedEmailAddresses: narrowConstraints(nc.PermittedEmailAddresses, parent.PermittedEmailAddresses, withinEmailConstraint, "permitted_email_addresses", &violations),
+		ExcludedEmailAddresses:  unionConstraints(nc.ExcludedEmailAddresses, parent.ExcludedEmailAddresses),
+	}
+	if len(narrowed.PermittedIPRanges) == 0 {
+		narrowed.PermittedIPRanges = parent.PermittedIPRanges
+	} else if len(parent.PermittedIPRanges) > 0 {
+		for _, ipRange := range nc.PermittedIPRanges {
+			if !withinAnyIPRange(ipRange, parent.PermittedIPRanges) {
+				violations = append(violations, PolicyViolation{"permitted_ip_ranges", ipRange.String()})
+			}
+		}
+	}
+	for _, ipRange := range parent.ExcludedIPRanges {
+		if !containsIPRange(narrowed.ExcludedIPRanges, ipRange) {
+			narrowed.ExcludedIPRanges = append(narrowed.ExcludedIPRanges, ipRange)
+		}
+	}
+	if len(violations) > 0 {
+		return nil, &PolicyError{violations}
+	}
+	return narrowed, nil
+}
+
+// narrowConstraints returns permitted constraints of child, or those of parent
+// if child has none. Constraints of child not within parent are added to violations.
+func narrowConstraints(child, parent []string, within func(string, string) bool, rule string, violations *[]PolicyViolation) []string {
+	if len(child) == 0 {
+		return parent
+	}
+	if len(parent) == 0 {
+		return child
+	}
+	for _, constraint := range child {
+		if !matchAnyConstraint(constraint, parent, within) {
+			*violations = append(*violations, PolicyViolation{rule, constraint})
+		}
+	}
+	return child
+}
+
+// unionConstraints returns excluded constraints of both child and parent
+func unionConstraints(child, parent []string) []string {
+	union := append([]string{}, child...)
+	for _, constraint := range parent {
+		if !matchAnyConstraint(constraint, union, strings.EqualFold) {
+			union = append(union, constraint)
+		}
+	}
+	return union
+}
+
+// withinDNSConstraint checks that all names matching DNS constraint also match parent
+func withinDNSConstraint(constraint, parent string) bool {
+	if strings.HasPrefix(constraint, ".") {
+		return strings.EqualFold(constraint, parent) || matchDNSConstraint(constraint[1:], parent)
+	}
+	return matchDNSConstraint(constraint, parent)
+}
+
+// withinEmailConstraint checks that all addresses matching email constraint also match parent
+func withinEmailConstraint(constraint, parent string) bool {
+	if strings.Contains(constraint, "@") {
+		return matchEmailConstraint(constraint, parent)
+	}
+	if strings.Contains(parent, "@") {
+		return false
+	}
+	if strings.HasPrefix(parent, ".") {
+		return strings.HasSuffix(strings.ToLower(constraint), strings.ToLower(parent))
+	}
+	return strings.EqualFold(constraint, parent)
+}
+
+// withinAnyIPRange checks that ipRange is inside one of ranges
+func withinAnyIPRange(ipRange *net.IPNet, ranges []*net.IPNet) bool {
+	ones, bits := ipRange.Mask.Size()
+	for _, r := range ranges {
+		rOnes, rBits := r.Mask.Size()
+		if bits == rBits && rOnes <= ones && r.Contains(ipRange.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIPRange(ranges []*net.IPNet, ipRange *net.IPNet) bool {
+	for _, r := range ranges {
+		if r.String() == ipRange.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns *PolicyError listing names in template that break name constraints
+func (nc *NameConstraints) check(template *x509.Certificate) error {
+	if nc.IsEmpty() {
+		return nil
+	}
+	var violations []PolicyViolation
+	for _, name := range template.DNSNames {
+		if len(nc.PermittedDNSDomains) > 0 && !matchAnyConstraint(name, nc.PermittedDNSDomains, matchDNSConstraint) {
+			violations = append(violations, PolicyViolation{"permitted_dns_domains", name})
+		}
+		if matchAnyConstraint(name, nc.ExcludedDNSDomains, matchDNSConstraint) {
+			violations = append(violations, PolicyViolation{"excluded_dns_domains", name})
+		}
+	}
+	for _, ip := range template.IPAddresses {
+		if len(nc.PermittedIPRanges) > 0 && len(filterIPAddresses([]net.IP{ip}, nc.PermittedIPRanges)) == 0 {
+			violations = append(violations, PolicyViolation{"permitted_ip_ranges", ip.String()})
+		}
+		if len(filterIPAddresses([]net.IP{ip}, nc.ExcludedIPRanges)) > 0 {
+			violations = append(violations, PolicyViolation{"excluded_ip_ranges", ip.String()})
+		}
+	}
+	for _, email := range template.EmailAddresses {
+		if len(nc.PermittedEmailAddresses) > 0 && !matchAnyConstraint(email, nc.PermittedEmailAddresses, matchEmailConstraint) {
+			violations = append(violations, PolicyViolation{"permitted_email_addresses", email})
+		}
+		if matchAnyConstraint(email, nc.ExcludedEmailAddresses, matchEmailConstraint) {
+			violations = append(violations, PolicyViolation{"excluded_email_addresses", email})
+		}
+	}
+	if len(violations) > 0 {
+		return &PolicyError{violations}
+	}
+	return nil
+}
+
+func matchAnyConstraint(name string, constraints []string, match func(string, string) bool) bool {
+	for _, constraint := range constraints {
+		if match(name, constraint) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDNSConstraint(name, constraint string) bool {
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(strings.ToLower(name), strings.ToLower(constraint))
+	}
+	return matchDNSDomain(name, constraint)
+}
+
+func matchEmailConstraint(email, constraint string) bool {
+	if strings.Contains(constraint, "@") {
+		return strings.EqualFold(email, constraint)
+	}
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return false
+	}
+	host := email[i+1:]
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(constraint))
+	}
+	return strings.EqualFold(host, constraint)
+}
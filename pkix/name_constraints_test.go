@@ -0,0 +1,163 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"crypto/elliptic"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestNameConstraints(t *testing.T) {
+	_, ipRange, _ := net.ParseCIDR("10.0.0.0/8")
+	nc := &NameConstraints{
+		PermittedDNSDomains: []string{"example.com"},
+		ExcludedDNSDomains:  []string{"secret.example.com"},
+		PermittedIPRanges:   []*net.IPNet{ipRange},
+	}
+	keyAuth, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	crtAuth, infoAuth, err := CreateCertificateAuthorityWithConstraints(keyAuth, 1, "test", "US", nc)
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+	rawCrtAuth, _ := crtAuth.GetRawCertificate()
+	if !rawCrtAuth.PermittedDNSDomainsCritical || len(rawCrtAuth.PermittedDNSDomains) != 1 || len(rawCrtAuth.ExcludedDNSDomains) != 1 || len(rawCrtAuth.PermittedIPRanges) != 1 {
+		t.Fatal("Unexpected name constraints of certificate authority:", rawCrtAuth)
+	}
+
+	key, _ := CreateECDSAKey(elliptic.P256())
+	csr, _ := CreateCertificateSigningRequest(key, "host1", "10.0.0.1", "host1.example.com", "test", "US")
+	crt, err := CreateCertificateHost(crtAuth, infoAuth, keyAuth, csr, 1)
+	if err != nil {
+		t.Fatal("Failed creating certificate for host:", err)
+	}
+	if err = crtAuth.VerifyHost(crt, "host1"); err != nil {
+		t.Fatal("Failed verifying certificate for host:", err)
+	}
+
+	csr, _ = CreateCertificateSigningRequest(key, "host2", "192.168.0.1", "host2.secret.example.com,host2.example.org", "test", "US")
+	_, err = CreateCertificateHost(crtAuth, infoAuth, keyAuth, csr, 1)
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) || len(policyErr.Violations) != 3 {
+		t.Fatal("Expect violations of name constraints:", err)
+	}
+
+	// Intermediate CA inherits name constraints
+	keySub, _ := CreateECDSAKey(elliptic.P256())
+	crtSub, infoSub, err := CreateIntermediateCertificateAuthority(crtAuth, infoAuth, keyAuth, keySub, "sub", 1, 0, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating intermediate certificate authority:", err)
+	}
+	if _, err = CreateCertificateHost(crtSub, infoSub, keySub, csr, 1); !errors.As(err, &policyErr) {
+		t.Fatal("Expect violations of inherited name constraints:", err)
+	}
+
+	// Constraints are not left for certificate authorities created later
+	crtAuth, _, err = CreateCertificateAuthority(keyAuth, 1, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+	if rawCrtAuth, _ = crtAuth.GetRawCertificate(); len(rawCrtAuth.PermittedDNSDomains) != 0 || rawCrtAuth.PermittedDNSDomainsCritical {
+		t.Fatal("Unexpected name constraints of certificate authority:", rawCrtAuth.PermittedDNSDomains)
+	}
+}
+
+// TestIntermediateNameConstraints tests that intermediate CA could only narrow
+// name constraints of its parents, which apply to the certificates it issues
+func TestIntermediateNameConstraints(t *testing.T) {
+	_, ipRange, _ := net.ParseCIDR("10.0.0.0/8")
+	keyAuth, _ := CreateECDSAKey(elliptic.P256())
+	crtAuth, infoAuth, err := CreateCertificateAuthorityWithConstraints(keyAuth, 1, "test", "US", &NameConstraints{
+		PermittedDNSDomains: []string{"example.com"},
+		ExcludedDNSDomains:  []string{"secret.example.com"},
+		PermittedIPRanges:   []*net.IPNet{ipRange},
+	})
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+
+	keySub, _ := CreateECDSAKey(elliptic.P256())
+	_, wideRange, _ := net.ParseCIDR("0.0.0.0/0")
+	_, _, err = CreateIntermediateCertificateAuthorityWithConstraints(crtAuth, infoAuth, keyAuth, keySub, "sub", 1, 0, "test", "US", &NameConstraints{
+		PermittedDNSDomains: []string{"ci.example.com", "example.org"},
+		PermittedIPRanges:   []*net.IPNet{wideRange},
+	})
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) || len(policyErr.Violations) != 2 {
+		t.Fatal("Expect intermediate CA not to widen name constraints:", err)
+	}
+
+	crtSub, _, err := CreateIntermediateCertificateAuthorityWithConstraints(crtAuth, infoAuth, keyAuth, keySub, "sub", 1, 0, "test", "US", &NameConstraints{
+		PermittedDNSDomains: []string{".ci.example.com"},
+		ExcludedDNSDomains:  []string{"x.ci.example.com"},
+	})
+	if err != nil {
+		t.Fatal("Failed creating intermediate certificate authority:", err)
+	}
+	rawCrtSub, _ := crtSub.GetRawCertificate()
+	if len(rawCrtSub.PermittedDNSDomains) != 1 || len(rawCrtSub.ExcludedDNSDomains) != 2 || len(rawCrtSub.PermittedIPRanges) != 1 {
+		t.Fatal("Expect name constraints to be narrowed:", rawCrtSub.PermittedDNSDomains, rawCrtSub.ExcludedDNSDomains, rawCrtSub.PermittedIPRanges)
+	}
+
+	// Name constraints of the whole chain are checked, even if the
+	// intermediate CA itself does not carry them
+	keyLegacy, _ := CreateECDSAKey(elliptic.P256())
+	crtPlain, infoPlain, _ := CreateCertificateAuthority(keyAuth, 1, "test", "US")
+	crtLegacy, infoLegacy, err := CreateIntermediateCertificateAuthority(crtPlain, infoPlain, keyAuth, keyLegacy, "legacy", 1, 0, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating intermediate certificate authority:", err)
+	}
+	infoLegacy.Issuers = []*Certificate{crtAuth}
+	key, _ := CreateECDSAKey(elliptic.P256())
+	csr, _ := CreateCertificateSigningRequest(key, "host1", "10.0.0.1", "host1.example.org", "test", "US")
+	if _, err = CreateCertificateHost(crtLegacy, infoLegacy, keyLegacy, csr, 1); !errors.As(err, &policyErr) {
+		t.Fatal("Expect violations of name constraints of issuers:", err)
+	}
+}
+
+func TestMatchNameConstraint(t *testing.T) {
+	for _, c := range []struct {
+		match      func(string, string) bool
+		name       string
+		constraint string
+		matched    bool
+	}{
+		{matchDNSConstraint, "example.com", "example.com", true},
+		{matchDNSConstraint, "a.example.com", "example.com", true},
+		{matchDNSConstraint, "badexample.com", "example.com", false},
+		{matchDNSConstraint, "example.com", ".example.com", false},
+		{matchDNSConstraint, "a.Example.com", ".example.com", true},
+		{matchEmailConstraint, "bob@example.com", "bob@example.com", true},
+		{matchEmailConstraint, "alice@example.com", "bob@example.com", false},
+		{matchEmailConstraint, "bob@example.com", "example.com", true},
+		{matchEmailConstraint, "bob@mail.example.com", "example.com", false},
+		{matchEmailConstraint, "bob@mail.example.com", ".example.com", true},
+		{withinDNSConstraint, ".a.example.com", "example.com", true},
+		{withinDNSConstraint, ".example.com", ".example.com", true},
+		{withinDNSConstraint, "example.com", ".example.com", false},
+		{withinDNSConstraint, "example.com", "a.example.com", false},
+		{withinEmailConstraint, "bob@example.com", "example.com", true},
+		{withinEmailConstraint, "example.com", ".com", true},
+		{withinEmailConstraint, "example.com", "bob@example.com", false},
+	} {
+		if c.match(c.name, c.constraint) != c.matched {
+			t.Errorf("Expect match of %s against %s to be %v", c.name, c.constraint, c.matched)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/golang.org/x/crypto/ocsp"
+)
+
+// Certificate status in OCSP response defined in RFC 6960
+const (
+	OCSPGood    = ocsp.Good
+	OCSPRevoked = ocsp.Revoked
+	OCSPUnknown = ocsp.Unknown
+)
+
+// OCSPStatusFunc returns OCSP status of the certificate with serial number
+// issued by CA, and the revocation record if it is revoked.
+type OCSPStatusFunc func(serialNumber *big.Int) (int, *RevokedCertificate)
+
+// OCSPResponder answers OCSP requests for certificates issued by one CA.
+// Responses are signed by CA itself, or by a delegated responder
+// certificate issued by CA for OCSP signing.
+type OCSPResponder struct {
+	crtAuth      *x509.Certificate
+	crtResponder *x509.Certificate
+	signer       crypto.Signer
+	// delegated is true if responder certificate is not CA itself
+	delegated bool
+}
+
+// NewOCSPResponder inits OCSPResponder of CA.
+// crtResponder and keyResponder could be CA certificate and key,
+// or those of the delegated responder.
+func NewOCSPResponder(crtAuth *Certificate, crtResponder *Certificate, keyResponder *Key) (*OCSPResponder, error) {
+	rawCrtAuth, err := crtAuth.GetRawCertificate()
+	if err != nil {
+		return nil, err
+	}
+	rawCrtResponder, err := crtResponder.GetRawCertificate()
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := keyResponder.Private.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key could not sign")
+	}
+
+	delegated := !bytes.Equal(rawCrtAuth.Raw, rawCrtResponder.Raw)
+	if delegated {
+		if err = rawCrtResponder.CheckSignatureFrom(rawCrtAuth); err != nil {
+			return nil, err
+		}
+		isOCSPSigner := false
+		for _, usage := range rawCrtResponder.ExtKeyUsage {
+			if usage == x509.ExtKeyUsageOCSPSigning {
+				isOCSPSigner = true
+			}
+		}
+		if !isOCSPSigner {
+			return nil, errors.New("responder certificate is not for OCSP signing")
+		}
+	}
+
+	return &OCSPResponder{
+		crtAuth:      rawCrtAuth,
+		crtResponder: rawCrtResponder,
+		signer:       signer,
+		delegated:    delegated,
+	}, nil
+}
+
+// Respond answers DER-format OCSP request using status of certificates,
+// and returns DER-format OCSP response which is valid for nextUpdate.
+// Requests about certificates of other CAs are answered with unauthorized error.
+func (r *OCSPResponder) Respond(reqBytes []byte, status OCSPStatusFunc, nextUpdate time.Duration) []byte {
+	req, err := ocsp.ParseRequest(reqBytes)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse
+	}
+
+	if !r.isIssuer(req) {
+		return ocsp.UnauthorizedErrorResponse
+	}
+
+	now := time.Now().UTC()
+	template := ocsp.Response{
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(nextUpdate),
+		IssuerHash:   req.HashAlgorithm,
+	}
+	var revoked *RevokedCertificate
+	template.Status, revoked = status(req.SerialNumber)
+	if template.Status == OCSPRevoked && revoked != nil {
+		template.RevokedAt = revoked.RevocationTime
+		template.RevocationReason = revoked.Reason
+	}
+	if r.delegated {
+		template.Certificate = r.crtResponder
+	}
+
+	resp, err := ocsp.CreateResponse(r.crtAuth, r.crtResponder, template, r.signer)
+	if err != nil {
+		return ocsp.InternalErrorErrorResponse
+	}
+	return resp
+}
+
+// isIssuer checks whether the request is about certificate issued by CA
+func (r *OCSPResponder) isIssuer(req *ocsp.Request) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+	// Reuse CreateRequest to calculate issuer hashes for CA
+	b, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: req.SerialNumber}, r.crtAuth, &ocsp.RequestOptions{Hash: req.HashAlgorithm})
+	if err != nil {
+		return false
+	}
+	expected, err := ocsp.ParseRequest(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(expected.IssuerNameHash, req.IssuerNameHash) && bytes.Equal(expected.IssuerKeyHash, req.IssuerKeyHash)
+}
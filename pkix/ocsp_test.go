@@ -0,0 +1,148 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/golang.org/x/crypto/ocsp"
+)
+
+func createOCSPTestHost(t *testing.T, crtAuth *Certificate, info *CertificateAuthorityInfo, keyAuth *Key, opts *CertificateHostOptions) (*Certificate, *Key) {
+	key, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	csr, err := CreateCertificateSigningRequest(key, "host", "127.0.0.1", "host", "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate request:", err)
+	}
+	crt, err := CreateCertificateHostWithOptions(crtAuth, info, keyAuth, csr, 1, opts)
+	if err != nil {
+		t.Fatal("Failed creating certificate for host:", err)
+	}
+	return crt, key
+}
+
+func TestOCSPResponder(t *testing.T) {
+	keyAuth, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	crtAuth, info, err := CreateCertificateAuthority(keyAuth, 1, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+	crtHost, _ := createOCSPTestHost(t, crtAuth, info, keyAuth, &CertificateHostOptions{OCSPServer: []string{"http://localhost:8889"}})
+	crtResponder, keyResponder := createOCSPTestHost(t, crtAuth, info, keyAuth, &CertificateHostOptions{OCSPSigning: true})
+
+	rawCrtAuth, _ := crtAuth.GetRawCertificate()
+	rawCrtHost, _ := crtHost.GetRawCertificate()
+	if len(rawCrtHost.OCSPServer) != 1 || rawCrtHost.OCSPServer[0] != "http://localhost:8889" {
+		t.Fatal("Failed setting OCSP server:", rawCrtHost.OCSPServer)
+	}
+
+	records := NewRevocationRecords()
+	status := func(serialNumber *big.Int) (int, *RevokedCertificate) {
+		if revoked := records.Get(serialNumber); revoked != nil {
+			return OCSPRevoked, revoked
+		}
+		if info.IsIssuedSerialNumber(serialNumber) {
+			return OCSPGood, nil
+		}
+		return OCSPUnknown, nil
+	}
+
+	req, err := ocsp.CreateRequest(rawCrtHost, rawCrtAuth, nil)
+	if err != nil {
+		t.Fatal("Failed creating OCSP request:", err)
+	}
+
+	responder, err := NewOCSPResponder(crtAuth, crtAuth, keyAuth)
+	if err != nil {
+		t.Fatal("Failed creating OCSP responder:", err)
+	}
+	resp, err := ocsp.ParseResponse(responder.Respond(req, status, time.Hour), rawCrtAuth)
+	if err != nil {
+		t.Fatal("Failed parsing OCSP response:", err)
+	}
+	if resp.Status != ocsp.Good || resp.SerialNumber.Cmp(rawCrtHost.SerialNumber) != 0 {
+		t.Fatal("Expect good status instead of", resp.Status)
+	}
+
+	records.Revoke("host", rawCrtHost.SerialNumber, ocsp.KeyCompromise, time.Now())
+	delegated, err := NewOCSPResponder(crtAuth, crtResponder, keyResponder)
+	if err != nil {
+		t.Fatal("Failed creating delegated OCSP responder:", err)
+	}
+	resp, err = ocsp.ParseResponse(delegated.Respond(req, status, time.Hour), rawCrtAuth)
+	if err != nil {
+		t.Fatal("Failed parsing OCSP response:", err)
+	}
+	if resp.Status != ocsp.Revoked || resp.RevocationReason != ocsp.KeyCompromise {
+		t.Fatal("Expect revoked status instead of", resp.Status)
+	}
+	rawCrtResponder, _ := crtResponder.GetRawCertificate()
+	if resp.Certificate == nil || !bytes.Equal(resp.Certificate.Raw, rawCrtResponder.Raw) {
+		t.Fatal("Failed including responder certificate")
+	}
+
+	unknown := &x509.Certificate{SerialNumber: big.NewInt(100)}
+	req, _ = ocsp.CreateRequest(unknown, rawCrtAuth, nil)
+	resp, err = ocsp.ParseResponse(responder.Respond(req, status, time.Hour), rawCrtAuth)
+	if err != nil {
+		t.Fatal("Failed parsing OCSP response:", err)
+	}
+	if resp.Status != ocsp.Unknown {
+		t.Fatal("Expect unknown status instead of", resp.Status)
+	}
+
+	if _, err = ocsp.ParseResponse(responder.Respond([]byte("bad"), status, time.Hour), rawCrtAuth); err == nil {
+		t.Fatal("Expect error response for malformed request")
+	}
+}
+
+func TestOCSPResponderUnauthorized(t *testing.T) {
+	keyAuth, _ := CreateECDSAKey(elliptic.P256())
+	crtAuth, info, _ := CreateCertificateAuthority(keyAuth, 1, "test", "US")
+	keyOther, _ := CreateECDSAKey(elliptic.P256())
+	crtOther, infoOther, _ := CreateCertificateAuthority(keyOther, 1, "other", "US")
+	crtHost, _ := createOCSPTestHost(t, crtOther, infoOther, keyOther, nil)
+
+	if _, err := NewOCSPResponder(crtAuth, crtHost, keyAuth); err == nil {
+		t.Fatal("Expect error for responder certificate not issued by CA")
+	}
+	crtPlain, keyPlain := createOCSPTestHost(t, crtAuth, info, keyAuth, nil)
+	if _, err := NewOCSPResponder(crtAuth, crtPlain, keyPlain); err == nil {
+		t.Fatal("Expect error for responder certificate without OCSP signing usage")
+	}
+
+	responder, err := NewOCSPResponder(crtAuth, crtAuth, keyAuth)
+	if err != nil {
+		t.Fatal("Failed creating OCSP responder:", err)
+	}
+	rawCrtOther, _ := crtOther.GetRawCertificate()
+	rawCrtHost, _ := crtHost.GetRawCertificate()
+	req, _ := ocsp.CreateRequest(rawCrtHost, rawCrtOther, nil)
+	resp := responder.Respond(req, func(*big.Int) (int, *RevokedCertificate) { return OCSPGood, nil }, time.Hour)
+	if !bytes.Equal(resp, ocsp.UnauthorizedErrorResponse) {
+		t.Fatal("Expect unauthorized response for certificate of other CA")
+	}
+}
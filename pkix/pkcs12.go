@@ -0,0 +1,94 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/software.sslmate.com/src/go-pkcs12"
+)
+
+// PKCS12Encryption is the scheme used to encrypt PKCS#12 bundles.
+type PKCS12Encryption string
+
+const (
+	// PKCS12EncryptionModern uses PBKDF2 with AES-256-CBC and HMAC-SHA-256,
+	// which is supported by OpenSSL 1.1.1, Java 12 and later
+	PKCS12EncryptionModern PKCS12Encryption = "modern"
+	// PKCS12EncryptionLegacyDES uses 3DES for both keys and certificates,
+	// which could be read by Windows and older Java
+	PKCS12EncryptionLegacyDES PKCS12Encryption = "legacy-des"
+	// PKCS12EncryptionLegacyRC2 uses 40-bit RC2 for certificates and 3DES for keys,
+	// which is the default of old OpenSSL and could be read almost everywhere
+	PKCS12EncryptionLegacyRC2 PKCS12Encryption = "legacy-rc2"
+
+	DefaultPKCS12Encryption = PKCS12EncryptionModern
+)
+
+// ParsePKCS12Encryption returns the PKCS12Encryption named by name
+func ParsePKCS12Encryption(name string) (PKCS12Encryption, error) {
+	enc := PKCS12Encryption(strings.ToLower(name))
+	switch enc {
+	case PKCS12EncryptionModern, PKCS12EncryptionLegacyDES, PKCS12EncryptionLegacyRC2:
+		return enc, nil
+	}
+	return "", fmt.Errorf("unsupported PKCS#12 encryption %s", name)
+}
+
+// ExportPKCS12 exports key, certificate and certificates of its CA chain
+// in a PKCS#12 bundle protected by password.
+func ExportPKCS12(key *Key, crt *Certificate, chain []*Certificate, password []byte, enc PKCS12Encryption) ([]byte, error) {
+	var encoder *pkcs12.Encoder
+	switch enc {
+	case PKCS12EncryptionModern:
+		encoder = pkcs12.Modern
+	case PKCS12EncryptionLegacyDES:
+		encoder = pkcs12.LegacyDES
+	case PKCS12EncryptionLegacyRC2:
+		encoder = pkcs12.LegacyRC2
+	default:
+		return nil, fmt.Errorf("unsupported PKCS#12 encryption %s", enc)
+	}
+
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return nil, err
+	}
+	rawChain := make([]*x509.Certificate, 0, len(chain))
+	for _, c := range chain {
+		rawC, err := c.GetRawCertificate()
+		if err != nil {
+			return nil, err
+		}
+		rawChain = append(rawChain, rawC)
+	}
+	return encoder.Encode(key.Private, rawCrt, rawChain, string(password))
+}
+
+// ParsePKCS12 parses PKCS#12 bundle protected by password,
+// and returns key, certificate and certificates of its CA chain.
+func ParsePKCS12(pfxData []byte, password []byte) (*Key, *Certificate, []*Certificate, error) {
+	priv, rawCrt, rawChain, err := pkcs12.DecodeChain(pfxData, string(password))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	chain := make([]*Certificate, 0, len(rawChain))
+	for _, c := range rawChain {
+		chain = append(chain, NewCertificateFromDER(c.Raw))
+	}
+	return NewKey(rawCrt.PublicKey, priv), NewCertificateFromDER(rawCrt.Raw), chain, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"testing"
+)
+
+func TestPKCS12(t *testing.T) {
+	keyAuth, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	crtAuth, info, err := CreateCertificateAuthority(keyAuth, 1, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+	password := []byte("123456")
+
+	for _, create := range []func() (*Key, error){
+		func() (*Key, error) { return CreateRSAKey(1024) },
+		func() (*Key, error) { return CreateECDSAKey(elliptic.P256()) },
+		CreateEd25519Key,
+	} {
+		key, err := create()
+		if err != nil {
+			t.Fatal("Failed creating key:", err)
+		}
+		csr, _ := CreateCertificateSigningRequest(key, "host1", "127.0.0.1", "", "test", "US")
+		crt, err := CreateCertificateHost(crtAuth, info, keyAuth, csr, 1)
+		if err != nil {
+			t.Fatal("Failed creating certificate for host:", err)
+		}
+		keyPEM, _ := key.ExportPrivate()
+
+		for _, enc := range []PKCS12Encryption{PKCS12EncryptionModern, PKCS12EncryptionLegacyDES, PKCS12EncryptionLegacyRC2} {
+			pfxData, err := ExportPKCS12(key, crt, []*Certificate{crtAuth}, password, enc)
+			if err != nil {
+				t.Fatalf("Failed exporting PKCS#12 with %s: %v", enc, err)
+			}
+			key2, crt2, chain, err := ParsePKCS12(pfxData, password)
+			if err != nil {
+				t.Fatalf("Failed parsing PKCS#12 with %s: %v", enc, err)
+			}
+			if keyPEM2, _ := key2.ExportPrivate(); !bytes.Equal(keyPEM, keyPEM2) {
+				t.Fatalf("Failed getting the same key from PKCS#12 with %s", enc)
+			}
+			if !bytes.Equal(crt2.derBytes, crt.derBytes) || len(chain) != 1 || !bytes.Equal(chain[0].derBytes, crtAuth.derBytes) {
+				t.Fatalf("Failed getting the same certificates from PKCS#12 with %s", enc)
+			}
+			if _, _, _, err = ParsePKCS12(pfxData, []byte("wrong")); err == nil {
+				t.Fatalf("Expect error for wrong password with %s", enc)
+			}
+		}
+	}
+
+	if _, err = ParsePKCS12Encryption("rc4"); err == nil {
+		t.Fatal("Expect error for unsupported PKCS#12 encryption")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+)
+
+var (
+	oidPKCS7Data       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+// pkcs7ContentInfo and pkcs7SignedData are defined in RFC 5652.
+// Only the degenerate form without signers is used to carry certificates.
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     pkcs7SignedData `asn1:"explicit,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      struct {
+		ContentType asn1.ObjectIdentifier
+	}
+	// Certificates is [0] IMPLICIT SET OF Certificate
+	Certificates asn1.RawValue
+	SignerInfos  []asn1.RawValue `asn1:"set"`
+}
+
+// ExportPKCS7Certificates exports crts in DER-format PKCS#7 certs-only message,
+// which is used by EST and Windows to transfer certificates
+func ExportPKCS7Certificates(crts []*Certificate) ([]byte, error) {
+	var crtBytes []byte
+	for _, crt := range crts {
+		if len(crt.derBytes) == 0 {
+			return nil, errors.New("empty certificate")
+		}
+		crtBytes = append(crtBytes, crt.derBytes...)
+	}
+
+	info := pkcs7ContentInfo{ContentType: oidPKCS7SignedData}
+	info.Content.Version = 1
+	info.Content.DigestAlgorithms = []pkix.AlgorithmIdentifier{}
+	info.Content.ContentInfo.ContentType = oidPKCS7Data
+	info.Content.Certificates = asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      crtBytes,
+	}
+	info.Content.SignerInfos = []asn1.RawValue{}
+	return asn1.Marshal(info)
+}
+
+// ParsePKCS7Certificates parses certificates in DER-format PKCS#7 certs-only message
+func ParsePKCS7Certificates(derBytes []byte) ([]*Certificate, error) {
+	var info pkcs7ContentInfo
+	rest, err := asn1.Unmarshal(derBytes, &info)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 || !info.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, errors.New("not PKCS#7 signed data")
+	}
+	certs := info.Content.Certificates
+	if certs.Class != asn1.ClassContextSpecific || certs.Tag != 0 {
+		return nil, errors.New("no certificates in PKCS#7 signed data")
+	}
+	rawCrts, err := x509.ParseCertificates(certs.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	crts := make([]*Certificate, 0, len(rawCrts))
+	for _, rawCrt := range rawCrts {
+		crts = append(crts, &Certificate{derBytes: rawCrt.Raw, crt: rawCrt})
+	}
+	return crts, nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"testing"
+)
+
+func TestPKCS7Certificates(t *testing.T) {
+	key, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	crt, info, err := CreateCertificateAuthority(key, 1, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+	crtIntermediate, _, err := CreateIntermediateCertificateAuthority(crt, info, key, key, "build", 1, 0, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating intermediate certificate authority:", err)
+	}
+
+	derBytes, err := ExportPKCS7Certificates([]*Certificate{crtIntermediate, crt})
+	if err != nil {
+		t.Fatal("Failed exporting PKCS#7:", err)
+	}
+	crts, err := ParsePKCS7Certificates(derBytes)
+	if err != nil {
+		t.Fatal("Failed parsing PKCS#7:", err)
+	}
+	if len(crts) != 2 || !bytes.Equal(crts[0].derBytes, crtIntermediate.derBytes) || !bytes.Equal(crts[1].derBytes, crt.derBytes) {
+		t.Fatal("Failed getting the same certificates from PKCS#7")
+	}
+
+	if _, err = ParsePKCS7Certificates(crt.derBytes); err == nil {
+		t.Fatal("Expect error for certificate instead of PKCS#7")
+	}
+}
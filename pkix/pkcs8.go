@@ -0,0 +1,343 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/golang.org/x/crypto/pbkdf2"
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/golang.org/x/crypto/scrypt"
+)
+
+const (
+	encryptedPrivateKeyPEMBlockType = "ENCRYPTED PRIVATE KEY"
+)
+
+// KeyEncryption is the scheme used to encrypt private-key PEM blocks.
+type KeyEncryption string
+
+const (
+	// KeyEncryptionLegacy3DES is the OpenSSL-style encrypted PEM block with
+	// Proc-Type and DEK-Info headers. It is kept to read and write old depots.
+	KeyEncryptionLegacy3DES KeyEncryption = "3des"
+	// PKCS#8 PBES2 schemes, named after key derivation and cipher
+	KeyEncryptionPBKDF2AES256CBC KeyEncryption = "pbkdf2-aes256-cbc"
+	KeyEncryptionPBKDF2AES256GCM KeyEncryption = "pbkdf2-aes256-gcm"
+	KeyEncryptionScryptAES256CBC KeyEncryption = "scrypt-aes256-cbc"
+	KeyEncryptionScryptAES256GCM KeyEncryption = "scrypt-aes256-gcm"
+
+	// DefaultKeyEncryption could be read by OpenSSL and most other tools
+	DefaultKeyEncryption = KeyEncryptionPBKDF2AES256CBC
+)
+
+const (
+	pbkdf2Iterations = 600000
+	// same as OpenSSL, which refuses larger cost under its default memory limit
+	scryptCost      = 1 << 14
+	scryptBlockSize = 8
+	scryptParallel  = 1
+	pbes2SaltSize   = 16
+	aes256KeySize   = 32
+	gcmTagSize      = 16
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidAES128GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 6}
+	oidAES192GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 26}
+	oidAES256GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+)
+
+// ParseKeyEncryption returns the KeyEncryption named by name
+func ParseKeyEncryption(name string) (KeyEncryption, error) {
+	enc := KeyEncryption(strings.ToLower(name))
+	switch enc {
+	case KeyEncryptionLegacy3DES, KeyEncryptionPBKDF2AES256CBC, KeyEncryptionPBKDF2AES256GCM,
+		KeyEncryptionScryptAES256CBC, KeyEncryptionScryptAES256GCM:
+		return enc, nil
+	}
+	return "", fmt.Errorf("unsupported key encryption %s", name)
+}
+
+// encryptedPrivateKeyInfo reflects the ASN.1 structure of PKCS#8 EncryptedPrivateKeyInfo
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Params reflects the ASN.1 structure of PBES2-params defined in RFC 8018
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params reflects the ASN.1 structure of PBKDF2-params defined in RFC 8018
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// scryptParams reflects the ASN.1 structure of scrypt-params defined in RFC 7914
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// gcmParams reflects the ASN.1 structure of GCMParameters defined in RFC 5084
+type gcmParams struct {
+	Nonce  []byte
+	ICVLen int `asn1:"default:12"`
+}
+
+// encryptPKCS8PrivateKey encrypts DER-format PKCS#8 private key into
+// DER-format EncryptedPrivateKeyInfo using PBES2
+func encryptPKCS8PrivateKey(der, password []byte, enc KeyEncryption) ([]byte, error) {
+	salt := make([]byte, pbes2SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	var kdf pkix.AlgorithmIdentifier
+	var key []byte
+	var err error
+	switch enc {
+	case KeyEncryptionPBKDF2AES256CBC, KeyEncryptionPBKDF2AES256GCM:
+		key = pbkdf2.Key(password, salt, pbkdf2Iterations, aes256KeySize, sha256.New)
+		kdf.Algorithm = oidPBKDF2
+		kdf.Parameters.FullBytes, err = asn1.Marshal(pbkdf2Params{
+			Salt:           salt,
+			IterationCount: pbkdf2Iterations,
+			PRF: pkix.AlgorithmIdentifier{
+				Algorithm:  oidHMACWithSHA256,
+				Parameters: asn1.NullRawValue,
+			},
+		})
+	case KeyEncryptionScryptAES256CBC, KeyEncryptionScryptAES256GCM:
+		key, err = scrypt.Key(password, salt, scryptCost, scryptBlockSize, scryptParallel, aes256KeySize)
+		if err != nil {
+			return nil, err
+		}
+		kdf.Algorithm = oidScrypt
+		kdf.Parameters.FullBytes, err = asn1.Marshal(scryptParams{
+			Salt:                     salt,
+			CostParameter:            scryptCost,
+			BlockSize:                scryptBlockSize,
+			ParallelizationParameter: scryptParallel,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported key encryption %s", enc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var scheme pkix.AlgorithmIdentifier
+	var encrypted []byte
+	switch enc {
+	case KeyEncryptionPBKDF2AES256CBC, KeyEncryptionScryptAES256CBC:
+		iv := make([]byte, aes.BlockSize)
+		if _, err := rand.Read(iv); err != nil {
+			return nil, err
+		}
+		padding := aes.BlockSize - len(der)%aes.BlockSize
+		encrypted = append(append([]byte{}, der...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+		scheme.Algorithm = oidAES256CBC
+		scheme.Parameters.FullBytes, err = asn1.Marshal(iv)
+	default:
+		var aead cipher.AEAD
+		if aead, err = cipher.NewGCMWithTagSize(block, gcmTagSize); err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		encrypted = aead.Seal(nil, nonce, der, nil)
+		scheme.Algorithm = oidAES256GCM
+		scheme.Parameters.FullBytes, err = asn1.Marshal(gcmParams{nonce, gcmTagSize})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := asn1.Marshal(pbes2Params{kdf, scheme})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBES2,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: encrypted,
+	})
+}
+
+// decryptPKCS8PrivateKey decrypts DER-format EncryptedPrivateKeyInfo into
+// DER-format PKCS#8 private key
+func decryptPKCS8PrivateKey(der, password []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New("only PBES2 encrypted private key is supported")
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+
+	keyLen, gcm, err := pbes2CipherInfo(params.EncryptionScheme.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	key, err := pbes2DeriveKey(params.KeyDerivationFunc, password, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if gcm {
+		var p gcmParams
+		if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &p); err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCMWithTagSize(block, p.ICVLen)
+		if err != nil {
+			return nil, err
+		}
+		if len(p.Nonce) != aead.NonceSize() {
+			return nil, errors.New("invalid AES-GCM nonce size")
+		}
+		b, err := aead.Open(nil, p.Nonce, info.EncryptedData, nil)
+		if err != nil {
+			return nil, errors.New("decryption password incorrect")
+		}
+		return b, nil
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid AES-CBC IV size")
+	}
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid AES-CBC encrypted data size")
+	}
+	b := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(b, data)
+
+	// same as x509.DecryptPEMBlock, a wrong password is detected by
+	// the padding check in most cases
+	padding := int(b[len(b)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("decryption password incorrect")
+	}
+	for _, c := range b[len(b)-padding:] {
+		if int(c) != padding {
+			return nil, errors.New("decryption password incorrect")
+		}
+	}
+	return b[:len(b)-padding], nil
+}
+
+// pbes2CipherInfo returns key length and whether GCM mode is used for encryption scheme
+func pbes2CipherInfo(oid asn1.ObjectIdentifier) (int, bool, error) {
+	switch {
+	case oid.Equal(oidAES128CBC):
+		return 16, false, nil
+	case oid.Equal(oidAES192CBC):
+		return 24, false, nil
+	case oid.Equal(oidAES256CBC):
+		return 32, false, nil
+	case oid.Equal(oidAES128GCM):
+		return 16, true, nil
+	case oid.Equal(oidAES192GCM):
+		return 24, true, nil
+	case oid.Equal(oidAES256GCM):
+		return 32, true, nil
+	}
+	return 0, false, fmt.Errorf("unsupported PBES2 encryption scheme %v", oid)
+}
+
+// pbes2DeriveKey derives the encryption key from password using key derivation function
+func pbes2DeriveKey(kdf pkix.AlgorithmIdentifier, password []byte, keyLen int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var p pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &p); err != nil {
+			return nil, err
+		}
+		var h func() hash.Hash
+		switch {
+		case len(p.PRF.Algorithm) == 0 || p.PRF.Algorithm.Equal(oidHMACWithSHA1):
+			h = sha1.New
+		case p.PRF.Algorithm.Equal(oidHMACWithSHA256):
+			h = sha256.New
+		default:
+			return nil, fmt.Errorf("unsupported PBKDF2 PRF %v", p.PRF.Algorithm)
+		}
+		if p.KeyLength != 0 && p.KeyLength != keyLen {
+			return nil, errors.New("unmatched PBKDF2 key length")
+		}
+		return pbkdf2.Key(password, p.Salt, p.IterationCount, keyLen, h), nil
+	case kdf.Algorithm.Equal(oidScrypt):
+		var p scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &p); err != nil {
+			return nil, err
+		}
+		if p.KeyLength != 0 && p.KeyLength != keyLen {
+			return nil, errors.New("unmatched scrypt key length")
+		}
+		return scrypt.Key(password, p.Salt, p.CostParameter, p.BlockSize, p.ParallelizationParameter, keyLen)
+	}
+	return nil, fmt.Errorf("unsupported PBES2 key derivation function %v", kdf.Algorithm)
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"testing"
+)
+
+func TestParseKeyEncryption(t *testing.T) {
+	enc, err := ParseKeyEncryption("Scrypt-AES256-GCM")
+	if err != nil {
+		t.Fatal("Failed parsing key encryption:", err)
+	}
+	if enc != KeyEncryptionScryptAES256GCM {
+		t.Fatal("Expect scrypt-aes256-gcm instead of", enc)
+	}
+
+	if _, err = ParseKeyEncryption("aes128"); err == nil {
+		t.Fatal("Expect not to parse unknown key encryption")
+	}
+}
+
+// TestKeyExportPKCS8Encrypted tests all PBES2 schemes could encrypt key and read it back
+func TestKeyExportPKCS8Encrypted(t *testing.T) {
+	key, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	keyPEM, _ := key.ExportPrivate()
+
+	for _, enc := range []KeyEncryption{
+		KeyEncryptionPBKDF2AES256CBC,
+		KeyEncryptionPBKDF2AES256GCM,
+		KeyEncryptionScryptAES256CBC,
+		KeyEncryptionScryptAES256GCM,
+	} {
+		pemBytes, err := key.ExportEncryptedPrivateWithEncryption([]byte(password), enc)
+		if err != nil {
+			t.Fatalf("Failed exporting %v encrypted key: %v", enc, err)
+		}
+		if !bytes.Contains(pemBytes, []byte("-----BEGIN "+encryptedPrivateKeyPEMBlockType)) {
+			t.Fatalf("Failed exporting %v key as PKCS#8 block", enc)
+		}
+
+		keyRead, err := NewKeyFromEncryptedPrivateKeyPEM(pemBytes, []byte(password))
+		if err != nil {
+			t.Fatalf("Failed parsing %v encrypted key: %v", enc, err)
+		}
+		keyReadPEM, _ := keyRead.ExportPrivate()
+		if bytes.Compare(keyPEM, keyReadPEM) != 0 {
+			t.Fatalf("Failed getting the same key from %v encrypted key", enc)
+		}
+
+		if _, err = NewKeyFromEncryptedPrivateKeyPEM(pemBytes, []byte(wrongPassword)); err == nil {
+			t.Fatalf("Expect not to parse %v encrypted key with wrong password", enc)
+		}
+	}
+}
+
+// TestKeyExportLegacyEncrypted tests the legacy scheme keeps the old PEM format
+func TestKeyExportLegacyEncrypted(t *testing.T) {
+	key, err := NewKeyFromPrivateKeyPEM([]byte(rsaPrivKeyAuthPEM))
+	if err != nil {
+		t.Fatal("Failed parsing RSA private key:", err)
+	}
+
+	pemBytes, err := key.ExportEncryptedPrivateWithEncryption([]byte(password), KeyEncryptionLegacy3DES)
+	if err != nil {
+		t.Fatal("Failed exporting PEM-format bytes:", err)
+	}
+	if !bytes.Contains(pemBytes, []byte("DEK-Info: DES-EDE3-CBC")) {
+		t.Fatal("Failed exporting legacy encrypted PEM block")
+	}
+
+	keyRead, err := NewKeyFromEncryptedPrivateKeyPEM(pemBytes, []byte(password))
+	if err != nil {
+		t.Fatal("Failed parsing legacy encrypted key:", err)
+	}
+	keyReadPEM, _ := keyRead.ExportPrivate()
+	if bytes.Compare(keyReadPEM, []byte(rsaPrivKeyAuthPEM)) != 0 {
+		t.Fatal("Failed getting the same key from legacy encrypted key")
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/gopkg.in/yaml.v2"
+)
+
+// Names of subject fields that policy could require
+var subjectFieldNames = []struct {
+	name  string
+	value func(*pkix.Name) []string
+}{
+	{"common_name", func(n *pkix.Name) []string { return []string{n.CommonName} }},
+	{"organization", func(n *pkix.Name) []string { return n.Organization }},
+	{"organizational_unit", func(n *pkix.Name) []string { return n.OrganizationalUnit }},
+	{"country", func(n *pkix.Name) []string { return n.Country }},
+	{"province", func(n *pkix.Name) []string { return n.Province }},
+	{"locality", func(n *pkix.Name) []string { return n.Locality }},
+}
+
+// Policy restricts certificates that CA issues. Empty fields apply no restriction.
+type Policy struct {
+	// DNSSuffixes lists domains whose names and subdomains are permitted in SANs
+	DNSSuffixes []string `yaml:"dns_suffixes,omitempty" json:"dns_suffixes,omitempty"`
+	// IPRanges lists CIDRs whose addresses are permitted in SANs
+	IPRanges []string `yaml:"ip_ranges,omitempty" json:"ip_ranges,omitempty"`
+	// MinRSABits is the minimum size of RSA keys
+	MinRSABits int `yaml:"min_rsa_bits,omitempty" json:"min_rsa_bits,omitempty"`
+	// Curves lists permitted curves of ECDSA keys, e.g. P-256, and Ed25519 for ed25519 keys
+	Curves []string `yaml:"curves,omitempty" json:"curves,omitempty"`
+	// MaxDays is the maximum validity of certificates
+	MaxDays int `yaml:"max_days,omitempty" json:"max_days,omitempty"`
+	// RequiredSubject lists subject fields that must be set, e.g. common_name
+	RequiredSubject []string `yaml:"required_subject,omitempty" json:"required_subject,omitempty"`
+}
+
+// PolicyViolation describes one rule of policy that certificate breaks
+type PolicyViolation struct {
+	// Rule is the name of policy field, e.g. dns_suffixes
+	Rule string
+	// Value is the offending value in certificate request
+	Value string
+}
+
+func (v PolicyViolation) String() string {
+	return fmt.Sprintf("%s does not permit %s", v.Rule, v.Value)
+}
+
+// PolicyError is returned when certificate violates policy
+type PolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	msgs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.String())
+	}
+	return "policy violation: " + strings.Join(msgs, "; ")
+}
+
+// NewPolicyFromYAML parses policy from YAML or JSON bytes
+func NewPolicyFromYAML(data []byte) (*Policy, error) {
+	var file struct {
+		Policy *Policy `yaml:"policy"`
+	}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	if file.Policy == nil {
+		return nil, fmt.Errorf("policy is empty")
+	}
+	if err := file.Policy.Validate(); err != nil {
+		return nil, err
+	}
+	return file.Policy, nil
+}
+
+// Validate checks that all fields of policy are well-formed
+func (p *Policy) Validate() error {
+	if _, err := p.parseIPRanges(); err != nil {
+		return err
+	}
+	for _, curve := range p.Curves {
+		switch curve {
+		case "P-224", "P-256", "P-384", "P-521", "Ed25519":
+		default:
+			return fmt.Errorf("unknown curve %s", curve)
+		}
+	}
+	for _, field := range p.RequiredSubject {
+		if subjectField(field) == nil {
+			return fmt.Errorf("unknown subject field %s", field)
+		}
+	}
+	if p.MinRSABits < 0 || p.MaxDays < 0 {
+		return fmt.Errorf("min_rsa_bits and max_days must not be negative")
+	}
+	return nil
+}
+
+func (p *Policy) parseIPRanges() ([]*net.IPNet, error) {
+	ipNets := make([]*net.IPNet, 0, len(p.IPRanges))
+	for _, cidr := range p.IPRanges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %s", cidr)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+func subjectField(name string) func(*pkix.Name) []string {
+	for _, f := range subjectFieldNames {
+		if f.name == name {
+			return f.value
+		}
+	}
+	return nil
+}
+
+// check returns *PolicyError listing all rules that template breaks
+func (p *Policy) check(template *x509.Certificate, pub crypto.PublicKey) error {
+	var violations []PolicyViolation
+	if len(p.DNSSuffixes) > 0 {
+		for _, name := range template.DNSNames {
+			if len(filterDNSNames([]string{name}, p.DNSSuffixes)) == 0 {
+				violations = append(violations, PolicyViolation{"dns_suffixes", name})
+			}
+		}
+	}
+	if len(p.IPRanges) > 0 {
+		ipNets, err := p.parseIPRanges()
+		if err != nil {
+			return err
+		}
+		for _, ip := range template.IPAddresses {
+			if len(filterIPAddresses([]net.IP{ip}, ipNets)) == 0 {
+				violations = append(violations, PolicyViolation{"ip_ranges", ip.String()})
+			}
+		}
+	}
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if bits := pub.N.BitLen(); bits < p.MinRSABits {
+			violations = append(violations, PolicyViolation{"min_rsa_bits", fmt.Sprintf("%d-bit RSA key", bits)})
+		}
+	case *ecdsa.PublicKey:
+		if len(p.Curves) > 0 && !containsString(p.Curves, pub.Curve.Params().Name) {
+			violations = append(violations, PolicyViolation{"curves", pub.Curve.Params().Name})
+		}
+	case ed25519.PublicKey:
+		if len(p.Curves) > 0 && !containsString(p.Curves, "Ed25519") {
+			violations = append(violations, PolicyViolation{"curves", "Ed25519"})
+		}
+	}
+
+	if p.MaxDays > 0 && template.NotAfter.Sub(time.Now()) > time.Duration(p.MaxDays)*24*time.Hour {
+		violations = append(violations, PolicyViolation{"max_days", fmt.Sprintf("expiration at %s", template.NotAfter.Format(time.RFC3339))})
+	}
+	for _, field := range p.RequiredSubject {
+		if !hasNonEmpty(subjectField(field)(&template.Subject)) {
+			violations = append(violations, PolicyViolation{"required_subject", "empty " + field})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{violations}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func hasNonEmpty(values []string) bool {
+	for _, v := range values {
+		if v != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"crypto/elliptic"
+	"errors"
+	"testing"
+)
+
+const policyYAML = `
+policy:
+  dns_suffixes: [example.com]
+  ip_ranges: [10.0.0.0/8]
+  min_rsa_bits: 2048
+  curves: [P-256]
+  max_days: 365
+  required_subject: [common_name, organizational_unit]
+`
+
+func TestPolicy(t *testing.T) {
+	policy, err := NewPolicyFromYAML([]byte(policyYAML))
+	if err != nil {
+		t.Fatal("Failed parsing policy:", err)
+	}
+	keyAuth, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	crtAuth, info, err := CreateCertificateAuthority(keyAuth, 1, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+
+	key, _ := CreateECDSAKey(elliptic.P256())
+	csr, _ := CreateCertificateSigningRequest(key, "host1", "10.0.0.1", "host1.example.com", "test", "US")
+	opts := &CertificateHostOptions{Policy: policy, Profile: &Profile{Days: 90}}
+	if _, err = CreateCertificateHostWithOptions(crtAuth, info, keyAuth, csr, 0, opts); err != nil {
+		t.Fatal("Failed creating certificate complying with policy:", err)
+	}
+
+	key, _ = CreateECDSAKey(elliptic.P384())
+	csr, _ = CreateCertificateSigningRequest(key, "", "192.168.0.1", "host1.example.org", "test", "US")
+	_, err = CreateCertificateHostWithOptions(crtAuth, info, keyAuth, csr, 2, &CertificateHostOptions{Policy: policy})
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatal("Expect policy error instead of:", err)
+	}
+	rules := make(map[string]string)
+	for _, v := range policyErr.Violations {
+		rules[v.Rule] = v.Value
+	}
+	expected := map[string]string{
+		"dns_suffixes":     "host1.example.org",
+		"ip_ranges":        "192.168.0.1",
+		"curves":           "P-384",
+		"required_subject": "empty organizational_unit",
+	}
+	for rule, value := range expected {
+		if rules[rule] != value {
+			t.Fatalf("Expect violation of %s by %s: %v", rule, value, policyErr)
+		}
+	}
+	if _, ok := rules["max_days"]; !ok {
+		t.Fatal("Expect violation of max_days:", policyErr)
+	}
+
+	key, _ = CreateRSAKey(1024)
+	csr, _ = CreateCertificateSigningRequest(key, "host1", "10.0.0.1", "", "test", "US")
+	_, err = CreateCertificateHostWithOptions(crtAuth, info, keyAuth, csr, 0, &CertificateHostOptions{Policy: policy, Profile: &Profile{Days: 1}})
+	if !errors.As(err, &policyErr) || len(policyErr.Violations) != 1 || policyErr.Violations[0].Rule != "min_rsa_bits" {
+		t.Fatal("Expect violation of min_rsa_bits:", err)
+	}
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"policy:\n  ip_ranges: [10.0.0.0]\n",
+		"policy:\n  curves: [P-192]\n",
+		"policy:\n  required_subject: [email]\n",
+		"policy:\n  max_days: -1\n",
+		"policy:\n  unknown: 1\n",
+	} {
+		if _, err := NewPolicyFromYAML([]byte(data)); err == nil {
+			t.Fatalf("Expect error for policy %q", data)
+		}
+	}
+}
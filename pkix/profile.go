@@ -0,0 +1,331 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/gopkg.in/yaml.v2"
+)
+
+// Names of key usages defined in RFC 5280 section 4.2.1.3
+var keyUsageNames = []struct {
+	name  string
+	usage x509.KeyUsage
+}{
+	{"digitalSignature", x509.KeyUsageDigitalSignature},
+	{"contentCommitment", x509.KeyUsageContentCommitment},
+	{"keyEncipherment", x509.KeyUsageKeyEncipherment},
+	{"dataEncipherment", x509.KeyUsageDataEncipherment},
+	{"keyAgreement", x509.KeyUsageKeyAgreement},
+	{"keyCertSign", x509.KeyUsageCertSign},
+	{"cRLSign", x509.KeyUsageCRLSign},
+	{"encipherOnly", x509.KeyUsageEncipherOnly},
+	{"decipherOnly", x509.KeyUsageDecipherOnly},
+}
+
+// Names of extended key usages defined in RFC 5280 section 4.2.1.12
+var extKeyUsageNames = []struct {
+	name  string
+	usage x509.ExtKeyUsage
+}{
+	{"any", x509.ExtKeyUsageAny},
+	{"serverAuth", x509.ExtKeyUsageServerAuth},
+	{"clientAuth", x509.ExtKeyUsageClientAuth},
+	{"codeSigning", x509.ExtKeyUsageCodeSigning},
+	{"emailProtection", x509.ExtKeyUsageEmailProtection},
+	{"timeStamping", x509.ExtKeyUsageTimeStamping},
+	{"OCSPSigning", x509.ExtKeyUsageOCSPSigning},
+}
+
+// Extensions that are generated from certificate template,
+// so they are not copied as extra extensions of profile
+var templateExtensionOIDs = []asn1.ObjectIdentifier{
+	{2, 5, 29, 14},              // subject key identifier
+	{2, 5, 29, 35},              // authority key identifier
+	{2, 5, 29, 15},              // key usage
+	{2, 5, 29, 37},              // extended key usage
+	{2, 5, 29, 19},              // basic constraints
+	{2, 5, 29, 17},              // subject alternative name
+	{2, 5, 29, 30},              // name constraints
+	{2, 5, 29, 31},              // CRL distribution points
+	{2, 5, 29, 32},              // certificate policies
+	{1, 3, 6, 1, 5, 5, 7, 1, 1}, // authority information access
+}
+
+// ProfileExtension is an extra extension put into certificate
+type ProfileExtension struct {
+	// OID in dotted form, e.g. 1.3.6.1.5.5.7.48.1.5
+	OID      string `yaml:"oid" json:"oid"`
+	Critical bool   `yaml:"critical,omitempty" json:"critical,omitempty"`
+	// Value is base64-encoded DER bytes
+	Value string `yaml:"value" json:"value"`
+}
+
+// Profile is the template of usages and extensions of host certificate
+type Profile struct {
+	Name string `yaml:"-" json:"-"`
+	// KeyUsage lists names defined in RFC 5280, e.g. digitalSignature.
+	// keyEncipherment is only applied to RSA keys.
+	KeyUsage []string `yaml:"key_usage,omitempty" json:"key_usage,omitempty"`
+	// ExtKeyUsage lists names defined in RFC 5280, e.g. serverAuth and clientAuth
+	ExtKeyUsage []string `yaml:"ext_key_usage,omitempty" json:"ext_key_usage,omitempty"`
+	// Days is how long until the certificate expires, and zero leaves it to the caller
+	Days int `yaml:"days,omitempty" json:"days,omitempty"`
+	// CA makes the certificate a certificate authority
+	CA bool `yaml:"ca,omitempty" json:"ca,omitempty"`
+	// MaxPathLen limits intermediate CAs under CA, and -1 means unlimited
+	MaxPathLen int                `yaml:"max_path_len,omitempty" json:"max_path_len,omitempty"`
+	Extensions []ProfileExtension `yaml:"extensions,omitempty" json:"extensions,omitempty"`
+}
+
+// Built-in profiles
+var builtinProfiles = map[string]*Profile{
+	"server": {
+		KeyUsage:    []string{"digitalSignature", "keyEncipherment"},
+		ExtKeyUsage: []string{"serverAuth"},
+	},
+	"client": {
+		KeyUsage:    []string{"digitalSignature", "keyEncipherment"},
+		ExtKeyUsage: []string{"clientAuth"},
+	},
+	"peer": {
+		KeyUsage:    []string{"digitalSignature", "keyEncipherment"},
+		ExtKeyUsage: []string{"serverAuth", "clientAuth"},
+	},
+	"ca": {
+		KeyUsage: []string{"keyCertSign", "cRLSign"},
+		CA:       true,
+	},
+}
+
+// ProfileNames returns names of built-in profiles
+func ProfileNames() []string {
+	names := make([]string, 0, len(builtinProfiles))
+	for name := range builtinProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetProfile returns profile named by name from user-defined profiles,
+// or built-in ones if it is not defined by user. profiles could be nil.
+func GetProfile(name string, profiles map[string]*Profile) (*Profile, error) {
+	if p, ok := profiles[name]; ok {
+		return p, nil
+	}
+	if p, ok := builtinProfiles[name]; ok {
+		copied := *p
+		copied.Name = name
+		return &copied, nil
+	}
+	return nil, fmt.Errorf("unknown profile %s", name)
+}
+
+// NewProfilesFromYAML parses user-defined profiles from YAML or JSON bytes
+// in the form of a map from profile name to profile.
+func NewProfilesFromYAML(data []byte) (map[string]*Profile, error) {
+	var file struct {
+		Profiles map[string]*Profile `yaml:"profiles"`
+	}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	for name, p := range file.Profiles {
+		if p == nil {
+			return nil, fmt.Errorf("profile %s is empty", name)
+		}
+		p.Name = name
+		if err := p.Validate(); err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+	}
+	return file.Profiles, nil
+}
+
+// NewProfileFromCertificate creates profile with the same usages and
+// extra extensions as crt, which is used to re-issue it.
+func NewProfileFromCertificate(crt *Certificate) (*Profile, error) {
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Profile{}
+	for _, ku := range keyUsageNames {
+		if rawCrt.KeyUsage&ku.usage != 0 {
+			p.KeyUsage = append(p.KeyUsage, ku.name)
+		}
+	}
+	for _, usage := range rawCrt.ExtKeyUsage {
+		for _, eku := range extKeyUsageNames {
+			if usage == eku.usage {
+				p.ExtKeyUsage = append(p.ExtKeyUsage, eku.name)
+			}
+		}
+	}
+	if rawCrt.BasicConstraintsValid && rawCrt.IsCA {
+		p.CA = true
+		p.MaxPathLen = rawCrt.MaxPathLen
+	}
+	for _, ext := range rawCrt.Extensions {
+		if isTemplateExtension(ext.Id) {
+			continue
+		}
+		p.Extensions = append(p.Extensions, ProfileExtension{
+			OID:      ext.Id.String(),
+			Critical: ext.Critical,
+			Value:    base64.StdEncoding.EncodeToString(ext.Value),
+		})
+	}
+	return p, nil
+}
+
+func isTemplateExtension(id asn1.ObjectIdentifier) bool {
+	for _, oid := range templateExtensionOIDs {
+		if id.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks names, OIDs and values in profile
+func (p *Profile) Validate() error {
+	if _, err := p.keyUsage(nil); err != nil {
+		return err
+	}
+	if _, err := p.extKeyUsage(); err != nil {
+		return err
+	}
+	if _, err := p.extraExtensions(); err != nil {
+		return err
+	}
+	if p.Days < 0 {
+		return fmt.Errorf("negative days %d", p.Days)
+	}
+	return nil
+}
+
+// apply sets usages and extensions of template for certificate of pub
+func (p *Profile) apply(template *x509.Certificate, pub crypto.PublicKey) error {
+	var err error
+	if template.KeyUsage, err = p.keyUsage(pub); err != nil {
+		return err
+	}
+	if template.ExtKeyUsage, err = p.extKeyUsage(); err != nil {
+		return err
+	}
+	if template.ExtraExtensions, err = p.extraExtensions(); err != nil {
+		return err
+	}
+	if p.CA {
+		template.BasicConstraintsValid = true
+		template.IsCA = true
+		template.MaxPathLen = p.MaxPathLen
+		template.MaxPathLenZero = p.MaxPathLen == 0
+	}
+	return nil
+}
+
+func (p *Profile) keyUsage(pub crypto.PublicKey) (x509.KeyUsage, error) {
+	// RSA is the only key type used for key transport
+	_, isRSA := pub.(*rsa.PublicKey)
+	skipKeyEncipherment := pub != nil && !isRSA
+
+	var usage x509.KeyUsage
+	for _, name := range p.KeyUsage {
+		found := false
+		for _, ku := range keyUsageNames {
+			if strings.EqualFold(ku.name, name) {
+				found = true
+				if ku.usage != x509.KeyUsageKeyEncipherment || !skipKeyEncipherment {
+					usage |= ku.usage
+				}
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown key usage %s", name)
+		}
+	}
+	return usage, nil
+}
+
+func (p *Profile) extKeyUsage() ([]x509.ExtKeyUsage, error) {
+	usages := make([]x509.ExtKeyUsage, 0, len(p.ExtKeyUsage))
+	for _, name := range p.ExtKeyUsage {
+		found := false
+		for _, eku := range extKeyUsageNames {
+			if strings.EqualFold(eku.name, name) {
+				found = true
+				usages = append(usages, eku.usage)
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown extended key usage %s", name)
+		}
+	}
+	return usages, nil
+}
+
+func (p *Profile) extraExtensions() ([]pkix.Extension, error) {
+	exts := make([]pkix.Extension, 0, len(p.Extensions))
+	for _, ext := range p.Extensions {
+		oid, err := parseOID(ext.OID)
+		if err != nil {
+			return nil, err
+		}
+		// Such as SAN and basic constraints, which would be duplicated in
+		// certificate or bypass the checks of them
+		if isTemplateExtension(oid) {
+			return nil, fmt.Errorf("extension %s is generated from certificate template and cannot be set by profile", ext.OID)
+		}
+		value, err := base64.StdEncoding.DecodeString(ext.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of extension %s: %v", ext.OID, err)
+		}
+		exts = append(exts, pkix.Extension{Id: oid, Critical: ext.Critical, Value: value})
+	}
+	return exts, nil
+}
+
+// parseOID parses OID in dotted form
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %s", s)
+	}
+	oid := make(asn1.ObjectIdentifier, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %s", s)
+		}
+		oid = append(oid, n)
+	}
+	return oid, nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"crypto/elliptic"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+const profilesYAML = `
+profiles:
+  metrics:
+    key_usage: [digitalSignature, keyEncipherment]
+    ext_key_usage: [clientAuth]
+    days: 90
+    extensions:
+      - oid: 1.2.3.4
+        value: BQA=
+`
+
+func createProfileTestCertificate(t *testing.T, profile *Profile) *x509.Certificate {
+	keyAuth, err := CreateECDSAKey(elliptic.P256())
+	if err != nil {
+		t.Fatal("Failed creating ecdsa key:", err)
+	}
+	crtAuth, info, err := CreateCertificateAuthority(keyAuth, 1, "test", "US")
+	if err != nil {
+		t.Fatal("Failed creating certificate authority:", err)
+	}
+	key, _ := CreateECDSAKey(elliptic.P256())
+	csr, _ := CreateCertificateSigningRequest(key, "host1", "127.0.0.1", "", "test", "US")
+	crt, err := CreateCertificateHostWithOptions(crtAuth, info, keyAuth, csr, 1, &CertificateHostOptions{Profile: profile})
+	if err != nil {
+		t.Fatal("Failed creating certificate with profile:", err)
+	}
+	if _, err = crtAuth.VerifyHostChain(crt, "host1", nil); err != nil {
+		t.Fatal("Failed verifying certificate with profile:", err)
+	}
+	rawCrt, _ := crt.GetRawCertificate()
+	return rawCrt
+}
+
+func TestBuiltinProfiles(t *testing.T) {
+	client, err := GetProfile("client", nil)
+	if err != nil {
+		t.Fatal("Failed getting client profile:", err)
+	}
+	rawCrt := createProfileTestCertificate(t, client)
+	if len(rawCrt.ExtKeyUsage) != 1 || rawCrt.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Fatal("Expect client authentication only instead of", rawCrt.ExtKeyUsage)
+	}
+	// keyEncipherment does not apply to ECDSA keys
+	if rawCrt.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Fatal("Expect digital signature only instead of", rawCrt.KeyUsage)
+	}
+
+	ca, _ := GetProfile("ca", nil)
+	rawCrt = createProfileTestCertificate(t, ca)
+	if !rawCrt.IsCA || rawCrt.MaxPathLen != 0 || !rawCrt.MaxPathLenZero {
+		t.Fatal("Expect CA certificate with zero path length")
+	}
+
+	if _, err = GetProfile("unknown", nil); err == nil {
+		t.Fatal("Expect error for unknown profile")
+	}
+}
+
+func TestUserDefinedProfiles(t *testing.T) {
+	profiles, err := NewProfilesFromYAML([]byte(profilesYAML))
+	if err != nil {
+		t.Fatal("Failed parsing profiles:", err)
+	}
+	metrics, err := GetProfile("metrics", profiles)
+	if err != nil {
+		t.Fatal("Failed getting user-defined profile:", err)
+	}
+	if metrics.Name != "metrics" || metrics.Days != 90 {
+		t.Fatal("Failed parsing profile:", metrics)
+	}
+
+	rawCrt := createProfileTestCertificate(t, metrics)
+	if days := rawCrt.NotAfter.Sub(time.Now()).Hours() / 24; days < 89 || days > 91 {
+		t.Fatal("Expect 90-day validity instead of", days)
+	}
+	found := false
+	for _, ext := range rawCrt.Extensions {
+		if ext.Id.String() == "1.2.3.4" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("Failed putting extra extension")
+	}
+
+	profile, err := NewProfileFromCertificate(NewCertificateFromDER(rawCrt.Raw))
+	if err != nil {
+		t.Fatal("Failed creating profile from certificate:", err)
+	}
+	if len(profile.ExtKeyUsage) != 1 || profile.ExtKeyUsage[0] != "clientAuth" || len(profile.Extensions) != 1 || profile.Extensions[0].Value != "BQA=" {
+		t.Fatal("Failed copying usages and extensions from certificate:", profile)
+	}
+
+	// JSON is accepted as well
+	if _, err = NewProfilesFromYAML([]byte(`{"profiles": {"web": {"ext_key_usage": ["serverAuth"]}}}`)); err != nil {
+		t.Fatal("Failed parsing profiles in JSON:", err)
+	}
+	for _, bad := range []string{
+		"profiles:\n  bad:\n    key_usage: [signEverything]\n",
+		"profiles:\n  bad:\n    ext_key_usage: [serverAuth]\n    unknown_field: 1\n",
+		"profiles:\n  bad:\n    extensions:\n      - oid: foo\n        value: BQA=\n",
+		"profiles:\n  bad:\n    extensions:\n      - oid: 2.5.29.17\n        value: MA0wC4IJZXZpbC5jb20=\n",
+		"profiles:\n  bad:\n    extensions:\n      - oid: 2.5.29.19\n        value: MAMBAf8=\n",
+		"profiles:\n  bad:\n    extensions:\n      - oid: 2.5.29.30\n        value: MAA=\n",
+	} {
+		if _, err = NewProfilesFromYAML([]byte(bad)); err == nil {
+			t.Fatal("Expect error for invalid profile:", bad)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Revocation reason codes defined in RFC 5280 section 5.3.1
+var revocationReasons = []string{
+	0:  "unspecified",
+	1:  "keyCompromise",
+	2:  "cACompromise",
+	3:  "affiliationChanged",
+	4:  "superseded",
+	5:  "cessationOfOperation",
+	6:  "certificateHold",
+	8:  "removeFromCRL",
+	9:  "privilegeWithdrawn",
+	10: "aACompromise",
+}
+
+// reasonRemoveFromCRL is allowed only in delta CRLs, which are never generated
+const reasonRemoveFromCRL = 8
+
+// ParseRevocationReason returns the reason code named by name.
+// removeFromCRL is refused, as it could not be used to revoke certificates.
+func ParseRevocationReason(name string) (int, error) {
+	for code, reason := range revocationReasons {
+		if reason != "" && strings.EqualFold(reason, name) {
+			if code == reasonRemoveFromCRL {
+				return 0, fmt.Errorf("revocation reason %s is only used in delta CRLs", reason)
+			}
+			return code, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown revocation reason %s", name)
+}
+
+// RevocationReasonName returns the name of reason code
+func RevocationReasonName(code int) string {
+	if code < 0 || code >= len(revocationReasons) || revocationReasons[code] == "" {
+		return fmt.Sprintf("reason(%d)", code)
+	}
+	return revocationReasons[code]
+}
+
+// RevokedCertificate records one certificate revoked by CA
+type RevokedCertificate struct {
+	// Name of the host that the certificate is issued to
+	Name           string
+	SerialNumber   *big.Int
+	RevocationTime time.Time
+	// Reason code defined in RFC 5280
+	Reason int
+}
+
+// RevocationRecords includes all certificates revoked by CA
+type RevocationRecords struct {
+	Revoked []*RevokedCertificate
+}
+
+func NewRevocationRecords() *RevocationRecords {
+	return &RevocationRecords{Revoked: make([]*RevokedCertificate, 0)}
+}
+
+func NewRevocationRecordsFromJSON(data []byte) (*RevocationRecords, error) {
+	r := NewRevocationRecords()
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Revoke records the certificate with serial number as revoked
+func (r *RevocationRecords) Revoke(name string, serialNumber *big.Int, reason int, revocationTime time.Time) error {
+	if r.Get(serialNumber) != nil {
+		return fmt.Errorf("certificate with serial number %v has been revoked", serialNumber)
+	}
+	r.Revoked = append(r.Revoked, &RevokedCertificate{
+		Name:           name,
+		SerialNumber:   new(big.Int).Set(serialNumber),
+		RevocationTime: revocationTime.UTC(),
+		Reason:         reason,
+	})
+	return nil
+}
+
+// Get returns the record of certificate with serial number, or nil if it is not revoked
+func (r *RevocationRecords) Get(serialNumber *big.Int) *RevokedCertificate {
+	for _, revoked := range r.Revoked {
+		if revoked.SerialNumber.Cmp(serialNumber) == 0 {
+			return revoked
+		}
+	}
+	return nil
+}
+
+func (r *RevocationRecords) Export() ([]byte, error) {
+	return json.Marshal(r)
+}
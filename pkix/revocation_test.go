@@ -0,0 +1,68 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkix
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestParseRevocationReason(t *testing.T) {
+	reason, err := ParseRevocationReason("keycompromise")
+	if err != nil {
+		t.Fatal("Failed parsing revocation reason:", err)
+	}
+	if reason != 1 {
+		t.Fatal("Expect reason code 1 instead of", reason)
+	}
+	if RevocationReasonName(reason) != "keyCompromise" {
+		t.Fatal("Failed getting revocation reason name")
+	}
+
+	if _, err = ParseRevocationReason("lost"); err == nil {
+		t.Fatal("Expect not to parse unknown revocation reason")
+	}
+	if _, err = ParseRevocationReason("removeFromCRL"); err == nil {
+		t.Fatal("Expect not to parse revocation reason of delta CRLs")
+	}
+}
+
+func TestRevocationRecords(t *testing.T) {
+	r := NewRevocationRecords()
+	if err := r.Revoke("host1", big.NewInt(2), 1, time.Now()); err != nil {
+		t.Fatal("Failed revoking certificate:", err)
+	}
+	if err := r.Revoke("host1", big.NewInt(2), 4, time.Now()); err == nil {
+		t.Fatal("Expect not to revoke certificate twice")
+	}
+
+	b, err := r.Export()
+	if err != nil {
+		t.Fatal("Failed exporting revocation records:", err)
+	}
+	r, err = NewRevocationRecordsFromJSON(b)
+	if err != nil {
+		t.Fatal("Failed parsing revocation records:", err)
+	}
+
+	revoked := r.Get(big.NewInt(2))
+	if revoked == nil || revoked.Name != "host1" || revoked.Reason != 1 {
+		t.Fatal("Failed getting revoked certificate back")
+	}
+	if r.Get(big.NewInt(3)) != nil {
+		t.Fatal("Expect not to get unrevoked certificate")
+	}
+}
@@ -50,6 +50,16 @@ func runWithStdin(stdin io.Reader, command string, args ...string) (string, stri
 	return stdoutBytes.String(), stderrBytes.String(), err
 }
 
+// start runs command in background, and the caller should kill it when done
+func start(command string, args ...string) (*exec.Cmd, error) {
+	args = append([]string{"--depot-path", depotDir}, args...)
+	cmd := exec.Command(command, args...)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
 func TestVersion(t *testing.T) {
 	stdout, stderr, err := run(binPath, "--version")
 	if stderr != "" || err != nil {
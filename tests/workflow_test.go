@@ -15,14 +15,68 @@
 package tests
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/golang.org/x/crypto/acme"
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/golang.org/x/crypto/ocsp"
+	"github.com/coreos/etcd-ca/Godeps/_workspace/src/gopkg.in/yaml.v2"
+	etcdpkix "github.com/coreos/etcd-ca/pkix"
 )
 
+// resetDepot starts the test with an empty depot, which is removed at the end
+func resetDepot(t *testing.T) {
+	os.RemoveAll(depotDir)
+	t.Cleanup(func() { os.RemoveAll(depotDir) })
+}
+
+// runAll runs commands in order, and fails at the first one with error or stderr
+func runAll(t *testing.T, commands ...[]string) {
+	t.Helper()
+	for _, args := range commands {
+		if _, stderr, err := run(binPath, args...); stderr != "" || err != nil {
+			t.Fatalf("Received unexpected error of %v: %v, %v", args, stderr, err)
+		}
+	}
+}
+
+// initArgs creates CA with ECDSA key, followed by extra flags
+func initArgs(flags ...string) []string {
+	return append([]string{"init", "--passphrase", passphrase, "--key-type", "ecdsa"}, flags...)
+}
+
+// newCertArgs creates ECDSA key and certificate request of host name
+func newCertArgs(name string, flags ...string) []string {
+	args := append([]string{"new-cert", "--passphrase", passphrase, "--key-type", "ecdsa"}, flags...)
+	return append(args, name)
+}
+
+// signArgs signs certificate of host name by CA
+func signArgs(name string, flags ...string) []string {
+	args := append([]string{"sign", "--passphrase", passphrase}, flags...)
+	return append(args, name)
+}
+
 // TestWorkflow runs etcd-ca in the normal workflow
 // and traverses all commands
 func TestWorkflow(t *testing.T) {
@@ -99,3 +153,1579 @@ func TestWorkflow(t *testing.T) {
 		t.Fatalf("Received insufficient expiration: %v", stdout)
 	}
 }
+
+// TestWorkflowECDSA runs etcd-ca in the normal workflow using ECDSA keys
+func TestWorkflowECDSA(t *testing.T) {
+	os.RemoveAll(depotDir)
+	defer os.RemoveAll(depotDir)
+
+	stdout, stderr, err := run(binPath, "init", "--passphrase", passphrase, "--key-type", "ecdsa", "--curve", "P384")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if strings.Count(stdout, "Created") != 2 {
+		t.Fatalf("Received insufficient create: %v", stdout)
+	}
+
+	stdout, stderr, err = run(binPath, "new-cert", "--passphrase", passphrase, "--key-type", "ecdsa", hostname)
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if strings.Count(stdout, "Created") != 2 {
+		t.Fatalf("Received insufficient create: %v", stdout)
+	}
+
+	stdout, stderr, err = run(binPath, "sign", "--passphrase", passphrase, hostname)
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if strings.Count(stdout, "Created") != 1 {
+		t.Fatalf("Received insufficient create: %v", stdout)
+	}
+
+	stdout, stderr, err = run(binPath, "chain", hostname)
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v", err)
+	}
+	if strings.Count(stdout, "CERTIFICATE") != 4 {
+		t.Fatalf("Received insufficient CERTIFICATE: %v", stdout)
+	}
+
+	stdout, stderr, err = run(binPath, "export", "--insecure", "--passphrase", passphrase, hostname)
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if !strings.Contains(stdout, "EC PRIVATE KEY") {
+		t.Fatalf("Received no EC private key: %v", stdout)
+	}
+}
+
+// TestRekeyPassphrase re-encrypts CA key and checks it with the new passphrase
+func TestRekeyPassphrase(t *testing.T) {
+	os.RemoveAll(depotDir)
+	defer os.RemoveAll(depotDir)
+
+	_, stderr, err := run(binPath, "init", "--passphrase", passphrase, "--key-type", "ecdsa", "--key-encryption", "3des")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+
+	stdout, stderr, err := run(binPath, "rekey-passphrase", "--passphrase", passphrase, "--new-passphrase", "abcdef", "--key-encryption", "scrypt-aes256-gcm")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if !strings.Contains(stdout, "Re-encrypted ca/key") {
+		t.Fatalf("Received unexpected stdout: %v", stdout)
+	}
+
+	if _, _, err = run(binPath, "export", "--insecure", "--passphrase", passphrase); err == nil {
+		t.Fatal("Expect not to decrypt CA key with old passphrase")
+	}
+	stdout, stderr, err = run(binPath, "export", "--insecure", "--passphrase", "abcdef")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if !strings.Contains(stdout, "EC PRIVATE KEY") {
+		t.Fatalf("Received no EC private key: %v", stdout)
+	}
+}
+
+// TestWorkflowIntermediate signs host certificate by intermediate CA
+func TestWorkflowIntermediate(t *testing.T) {
+	os.RemoveAll(depotDir)
+	defer os.RemoveAll(depotDir)
+
+	_, stderr, err := run(binPath, "init", "--passphrase", passphrase, "--key-type", "ecdsa")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+
+	stdout, stderr, err := run(binPath, "new-intermediate", "--passphrase", passphrase, "--ca-passphrase", passphrase, "--key-type", "ecdsa", "sub")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if strings.Count(stdout, "Created") != 2 {
+		t.Fatalf("Received insufficient create: %v", stdout)
+	}
+
+	_, stderr, err = run(binPath, "new-cert", "--passphrase", passphrase, "--key-type", "ecdsa", hostname)
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+
+	stdout, stderr, err = run(binPath, "sign", "--passphrase", passphrase, "--ca", "sub", hostname)
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if !strings.Contains(stdout, "signed by sub/key") {
+		t.Fatalf("Received unexpected stdout: %v", stdout)
+	}
+
+	stdout, stderr, err = run(binPath, "chain", hostname)
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if strings.Count(stdout, "CERTIFICATE") != 6 {
+		t.Fatalf("Received insufficient CERTIFICATE: %v", stdout)
+	}
+
+	stdout, stderr, err = run(binPath, "status")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if strings.Count(stdout, "expiration") != 3 {
+		t.Fatalf("Received insufficient expiration: %v", stdout)
+	}
+}
+
+// TestRevokeAndCRL revokes host certificate and publishes it in CRL
+func TestRevokeAndCRL(t *testing.T) {
+	resetDepot(t)
+
+	runAll(t,
+		initArgs(),
+		newCertArgs(hostname),
+		signArgs(hostname),
+		newCertArgs("host2"),
+		signArgs("host2"),
+	)
+
+	// Certificate archived by renewal is revoked by its serial number
+	archived := readCertificate(t, depotDir+"/"+hostname+".host.crt")
+	if _, stderr, err := run(binPath, "renew", "--passphrase", passphrase, hostname); stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	stdout, stderr, err := run(binPath, "revoke", "--reason", "superseded", "--serial", archived.SerialNumber.String(), hostname)
+	if stderr != "" || err != nil || !strings.Contains(stdout, "serial "+archived.SerialNumber.String()) {
+		t.Fatalf("Received unexpected revocation: %v, %v, %v", stdout, stderr, err)
+	}
+	if _, _, err = run(binPath, "revoke", "--serial", "12345", hostname); err == nil {
+		t.Fatal("Expect error for unknown serial number")
+	}
+	if stdout, _, err = run(binPath, "status"); err != nil || strings.Contains(stdout, "REVOKED") {
+		t.Fatalf("Expect current certificate not to be revoked: %v, %v", stdout, err)
+	}
+
+	stdout, stderr, err = run(binPath, "revoke", "--reason", "keyCompromise", hostname)
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if !strings.Contains(stdout, "Revoked") {
+		t.Fatalf("Received unexpected stdout: %v", stdout)
+	}
+	if _, _, err = run(binPath, "revoke", hostname); err == nil {
+		t.Fatal("Expect not to revoke certificate twice")
+	}
+
+	stdout, _, err = run(binPath, "status")
+	if err != nil || !strings.Contains(stdout, "REVOKED (keyCompromise)") {
+		t.Fatalf("Received unexpected status: %v, %v", stdout, err)
+	}
+
+	stdout, stderr, err = run(binPath, "crl", "--passphrase", passphrase)
+	if err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	block, _ := pem.Decode([]byte(stdout))
+	if block == nil || block.Type != "X509 CRL" {
+		t.Fatalf("Received no CRL: %v", stdout)
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal("Failed parsing CRL:", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 2 || crl.Number.Int64() != 1 {
+		t.Fatalf("Received unexpected CRL: %v entries, number %v", len(crl.RevokedCertificateEntries), crl.Number)
+	}
+	crtAuth := readCertificate(t, depotDir+"/ca.crt")
+	if err = crl.CheckSignatureFrom(crtAuth); err != nil {
+		t.Fatal("Failed verifying CRL signature:", err)
+	}
+
+	// Clients checking the CRL reject the revoked certificate only
+	if err = handshakeWithCRL(readTLSCertificate(t, "host2"), crtAuth, crl); err != nil {
+		t.Fatal("Failed handshaking with valid certificate:", err)
+	}
+	if err = handshakeWithCRL(readTLSCertificate(t, hostname), crtAuth, crl); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Fatal("Expect revoked certificate to be rejected:", err)
+	}
+
+	stdout, _, err = run(binPath, "crl", "--passphrase", passphrase, "--format", "der")
+	if err != nil {
+		t.Fatal("Received unexpected error:", err)
+	}
+	if crl, err = x509.ParseRevocationList([]byte(stdout)); err != nil || crl.Number.Int64() != 2 {
+		t.Fatalf("Received unexpected DER CRL: %v", err)
+	}
+}
+
+// handshakeWithCRL connects to TLS server of crt by client that trusts crtAuth
+// and rejects certificates listed in crl
+func handshakeWithCRL(crt tls.Certificate, crtAuth *x509.Certificate, crl *x509.RevocationList) error {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{crt}})
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(crtAuth)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		RootCAs: roots,
+		VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if err := crl.CheckSignatureFrom(crtAuth); err != nil {
+				return err
+			}
+			for _, entry := range crl.RevokedCertificateEntries {
+				if entry.SerialNumber.Cmp(chains[0][0].SerialNumber) == 0 {
+					return fmt.Errorf("certificate %v is revoked", entry.SerialNumber)
+				}
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// TestServeOCSP queries OCSP responder served by etcd-ca over HTTP
+func TestServeOCSP(t *testing.T) {
+	resetDepot(t)
+
+	ocspURL := "http://127.0.0.1:18889"
+	runAll(t,
+		initArgs(),
+		newCertArgs(hostname),
+		signArgs(hostname, "--ocsp-url", ocspURL),
+		newCertArgs("responder"),
+		signArgs("responder", "--ocsp-signing"),
+	)
+
+	server, err := start(binPath, "serve-ocsp", "--listen", "127.0.0.1:18889", "--responder", "responder", "--passphrase", passphrase)
+	if err != nil {
+		t.Fatal("Failed starting OCSP responder:", err)
+	}
+	defer server.Process.Kill()
+
+	crtAuth := readCertificate(t, depotDir+"/ca.crt")
+	crtHost := readCertificate(t, depotDir+"/"+hostname+".host.crt")
+	if len(crtHost.OCSPServer) != 1 || crtHost.OCSPServer[0] != ocspURL {
+		t.Fatalf("Received unexpected OCSP server: %v", crtHost.OCSPServer)
+	}
+	req, err := ocsp.CreateRequest(crtHost, crtAuth, nil)
+	if err != nil {
+		t.Fatal("Failed creating OCSP request:", err)
+	}
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = http.Post(ocspURL, "application/ocsp-request", bytes.NewReader(req))
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal("Failed querying OCSP responder:", err)
+	}
+	ocspResp := readOCSPResponse(t, resp, crtAuth)
+	if ocspResp.Status != ocsp.Good {
+		t.Fatalf("Received unexpected OCSP status: %v", ocspResp.Status)
+	}
+
+	if _, stderr, err := run(binPath, "revoke", "--reason", "superseded", hostname); stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	resp, err = http.Get(ocspURL + "/" + url.PathEscape(base64.StdEncoding.EncodeToString(req)))
+	if err != nil {
+		t.Fatal("Failed querying OCSP responder:", err)
+	}
+	ocspResp = readOCSPResponse(t, resp, crtAuth)
+	if ocspResp.Status != ocsp.Revoked || ocspResp.RevocationReason != ocsp.Superseded {
+		t.Fatalf("Received unexpected OCSP status: %v", ocspResp.Status)
+	}
+}
+
+func readCertificate(t *testing.T, path string) *x509.Certificate {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("Failed reading certificate:", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("Failed decoding certificate PEM")
+	}
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal("Failed parsing certificate:", err)
+	}
+	return crt
+}
+
+func readOCSPResponse(t *testing.T, resp *http.Response, issuer *x509.Certificate) *ocsp.Response {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("Failed reading OCSP response:", err)
+	}
+	ocspResp, err := ocsp.ParseResponse(body, issuer)
+	if err != nil {
+		t.Fatal("Failed parsing OCSP response:", err)
+	}
+	return ocspResp
+}
+
+// TestListIndex checks that issued certificates are recorded in index
+func TestListIndex(t *testing.T) {
+	resetDepot(t)
+
+	runAll(t,
+		initArgs(),
+		newCertArgs(hostname, "--domain", "host1.example.com"),
+		signArgs(hostname),
+		newCertArgs("host2"),
+		signArgs("host2"),
+		[]string{"revoke", "host2"},
+	)
+
+	stdout, stderr, err := run(binPath, "list")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if !strings.Contains(stdout, hostname) || !strings.Contains(stdout, "host1.example.com") || strings.Contains(stdout, "host2") {
+		t.Fatalf("Received unexpected list: %v", stdout)
+	}
+
+	stdout, _, err = run(binPath, "list", "--all")
+	if err != nil || !strings.Contains(stdout, "revoked (unspecified)") {
+		t.Fatalf("Received unexpected list: %v, %v", stdout, err)
+	}
+
+	stdout, _, err = run(binPath, "list", "--all", "--format", "json")
+	if err != nil || strings.Count(stdout, "\n") != 2 || !strings.Contains(stdout, `"Fingerprint"`) {
+		t.Fatalf("Received unexpected list: %v, %v", stdout, err)
+	}
+}
+
+// TestRandomSerialNumber checks that CA initialized with random serial
+// strategy issues large serial numbers
+func TestRandomSerialNumber(t *testing.T) {
+	resetDepot(t)
+
+	runAll(t,
+		initArgs("--serial-strategy", "random"),
+		[]string{"new-intermediate", "--passphrase", passphrase, "--ca-passphrase", passphrase, "--key-type", "ecdsa", "sub"},
+		newCertArgs(hostname),
+		signArgs(hostname, "--ca", "sub"),
+	)
+
+	for _, path := range []string{depotDir + "/sub.intermediate.crt", depotDir + "/" + hostname + ".host.crt"} {
+		crt := readCertificate(t, path)
+		if crt.SerialNumber.BitLen() < 64 {
+			t.Fatalf("Received sequential serial number %v in %v", crt.SerialNumber, path)
+		}
+	}
+}
+
+// TestRenew renews host certificate with and without rotating the key
+func TestRenew(t *testing.T) {
+	resetDepot(t)
+
+	runAll(t,
+		initArgs(),
+		newCertArgs(hostname, "--domain", "host1.example.com"),
+		signArgs(hostname, "--ocsp-url", "http://127.0.0.1:8889"),
+	)
+	crtPath := depotDir + "/" + hostname + ".host.crt"
+	crtOld := readCertificate(t, crtPath)
+
+	stdout, stderr, err := run(binPath, "renew", "--passphrase", passphrase, "--days", "30", hostname)
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if !strings.Contains(stdout, "Renewed") || !strings.Contains(stdout, "Archived") {
+		t.Fatalf("Received unexpected stdout: %v", stdout)
+	}
+	crt := readCertificate(t, crtPath)
+	if crt.SerialNumber.Cmp(crtOld.SerialNumber) == 0 || !bytes.Equal(crt.RawSubjectPublicKeyInfo, crtOld.RawSubjectPublicKeyInfo) {
+		t.Fatal("Expect new serial number with the same key")
+	}
+	if len(crt.DNSNames) != 1 || crt.DNSNames[0] != "host1.example.com" || len(crt.OCSPServer) != 1 {
+		t.Fatalf("Received unexpected SANs or extensions: %v, %v", crt.DNSNames, crt.OCSPServer)
+	}
+	if days := crt.NotAfter.Sub(crt.NotBefore).Hours() / 24; days < 29 || days > 31 {
+		t.Fatalf("Received unexpected validity: %v days", days)
+	}
+	archived := readCertificate(t, depotDir+"/"+hostname+".host."+crtOld.SerialNumber.Text(16)+".crt.archived")
+	if !bytes.Equal(archived.Raw, crtOld.Raw) {
+		t.Fatal("Failed archiving the old certificate")
+	}
+
+	if _, stderr, err = run(binPath, "renew", "--passphrase", passphrase, "--rekey", "--key-passphrase", passphrase, hostname); stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	crtRekeyed := readCertificate(t, crtPath)
+	if bytes.Equal(crtRekeyed.RawSubjectPublicKeyInfo, crt.RawSubjectPublicKeyInfo) {
+		t.Fatal("Expect the key to be rotated")
+	}
+	if crtRekeyed.Subject.String() != crt.Subject.String() || len(crtRekeyed.DNSNames) != 1 {
+		t.Fatal("Expect the same subject and SANs after rotating the key")
+	}
+	if _, stderr, err = run(binPath, "export", "--passphrase", passphrase, hostname); stderr != "" || err != nil {
+		t.Fatalf("Failed exporting the new key: %v, %v", stderr, err)
+	}
+
+	stdout, _, err = run(binPath, "list")
+	if err != nil || strings.Count(stdout, "\n"+hostname+" ") != 3 {
+		t.Fatalf("Received unexpected list: %v, %v", stdout, err)
+	}
+}
+
+// TestRenewAllowedSANs checks that SANs dropped by allow-lists at signing
+// are not brought back by renewal from the stored certificate request
+func TestRenewAllowedSANs(t *testing.T) {
+	resetDepot(t)
+
+	runAll(t,
+		initArgs(),
+		newCertArgs(hostname, "--domain", "host1.example.com,host1.example.org", "--ip", "127.0.0.1,10.0.0.1"),
+		signArgs(hostname, "--allow-domain", "example.com", "--allow-ip", "10.0.0.0/8"),
+	)
+	crtPath := depotDir + "/" + hostname + ".host.crt"
+	crtOld := readCertificate(t, crtPath)
+	if len(crtOld.DNSNames) != 1 || len(crtOld.IPAddresses) != 1 {
+		t.Fatalf("Received unexpected SANs: %v, %v", crtOld.DNSNames, crtOld.IPAddresses)
+	}
+
+	for _, args := range [][]string{
+		{"renew", "--passphrase", passphrase, hostname},
+		{"renew", "--passphrase", passphrase, "--rekey", "--key-passphrase", passphrase, hostname},
+	} {
+		if _, stderr, err := run(binPath, args...); stderr != "" || err != nil {
+			t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+		}
+		crt := readCertificate(t, crtPath)
+		if len(crt.DNSNames) != 1 || crt.DNSNames[0] != "host1.example.com" ||
+			len(crt.IPAddresses) != 1 || !crt.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")) {
+			t.Fatalf("Expect SANs of renewed certificate not to grow: %v, %v", crt.DNSNames, crt.IPAddresses)
+		}
+	}
+}
+
+// TestWatch renews certificates expiring soon and runs hooks once
+func TestWatch(t *testing.T) {
+	resetDepot(t)
+	outputDir := depotDir + "/output"
+
+	runAll(t,
+		initArgs(),
+		newCertArgs(hostname),
+		signArgs(hostname, "--years", "0"),
+		newCertArgs("host2"),
+		signArgs("host2"),
+	)
+
+	stdout, stderr, err := run(binPath, "watch", "--passphrase", passphrase, "--once", "--renew-before", "30d", "--days", "90",
+		"--output-dir", outputDir, "--hook", hostname+"=echo hooked $ETCD_CA_NAME $ETCD_CA_CRT_FILE", "--hook", "host2=echo unexpected")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if strings.Count(stdout, "Renewed") != 1 || !strings.Contains(stdout, "hooked "+hostname+" "+outputDir+"/"+hostname+".crt") || strings.Contains(stdout, "unexpected") {
+		t.Fatalf("Received unexpected stdout: %v", stdout)
+	}
+
+	crt := readCertificate(t, outputDir+"/"+hostname+".crt")
+	if days := crt.NotAfter.Sub(time.Now()).Hours() / 24; days < 89 || days > 91 {
+		t.Fatalf("Received unexpected validity: %v days", days)
+	}
+	if _, err = os.Stat(outputDir + "/ca.crt"); err != nil {
+		t.Fatal("Failed writing CA certificate:", err)
+	}
+
+	stdout, _, err = run(binPath, "watch", "--passphrase", passphrase, "--once", "--renew-before", "30d")
+	if err != nil || strings.Contains(stdout, "Renewed") {
+		t.Fatalf("Expect nothing to renew: %v, %v", stdout, err)
+	}
+
+	// Outputs that fail after renewal are written by the next run
+	if _, stderr, err = run(binPath, "renew", "--passphrase", passphrase, "--days", "1", hostname); stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	os.Remove(outputDir + "/ca.crt")
+	os.Mkdir(outputDir+"/ca.crt", 0755)
+	stdout, stderr, err = run(binPath, "watch", "--passphrase", passphrase, "--once", "--renew-before", "30d", "--days", "90",
+		"--output-dir", outputDir, "--hook", hostname+"=echo hooked")
+	if !strings.Contains(stdout, "Renewed") || strings.Contains(stdout, "hooked") || !strings.Contains(stderr, "Write outputs error") {
+		t.Fatalf("Expect writing outputs to fail: %v, %v, %v", stdout, stderr, err)
+	}
+	os.Remove(outputDir + "/ca.crt")
+	stdout, stderr, err = run(binPath, "watch", "--passphrase", passphrase, "--once", "--renew-before", "30d",
+		"--output-dir", outputDir, "--hook", hostname+"=echo hooked")
+	if stderr != "" || err != nil || strings.Contains(stdout, "Renewed") || !strings.Contains(stdout, "hooked") {
+		t.Fatalf("Expect pending outputs to be written: %v, %v, %v", stdout, stderr, err)
+	}
+	if !bytes.Equal(readCertificate(t, outputDir+"/"+hostname+".crt").Raw, readCertificate(t, depotDir+"/"+hostname+".host.crt").Raw) {
+		t.Fatal("Expect output to be the certificate in depot")
+	}
+	if _, err = os.Stat(outputDir + "/ca.crt"); err != nil {
+		t.Fatal("Failed writing CA certificate:", err)
+	}
+}
+
+// TestSignWithProfile signs certificates with built-in and user-defined profiles
+func TestSignWithProfile(t *testing.T) {
+	resetDepot(t)
+	profileFile := depotDir + "/profiles.yaml"
+
+	runAll(t,
+		initArgs(),
+		newCertArgs(hostname),
+		signArgs(hostname, "--profile", "client"),
+		newCertArgs("host2"),
+	)
+	crt := readCertificate(t, depotDir+"/"+hostname+".host.crt")
+	if len(crt.ExtKeyUsage) != 1 || crt.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Fatalf("Received unexpected extended key usages: %v", crt.ExtKeyUsage)
+	}
+	if stdout, _, err := run(binPath, "chain", hostname); err != nil || strings.Count(stdout, "CERTIFICATE") != 4 {
+		t.Fatalf("Failed exporting chain of client certificate: %v", err)
+	}
+
+	// renewed certificate keeps the profile
+	if _, stderr, err := run(binPath, "renew", "--passphrase", passphrase, hostname); stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	crt = readCertificate(t, depotDir+"/"+hostname+".host.crt")
+	if len(crt.ExtKeyUsage) != 1 || crt.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Fatalf("Received unexpected extended key usages after renewal: %v", crt.ExtKeyUsage)
+	}
+	if stdout, _, err := run(binPath, "list", "--format", "json"); err != nil || strings.Count(stdout, `"Profile":"client"`) != 2 {
+		t.Fatalf("Received unexpected index: %v, %v", stdout, err)
+	}
+
+	ioutil.WriteFile(profileFile, []byte("profiles:\n  short:\n    ext_key_usage: [serverAuth]\n    days: 7\n"), 0644)
+	if _, _, err := run(binPath, "sign", "--passphrase", passphrase, "--profile", "short", "host2"); err == nil {
+		t.Fatal("Expect error for profile missing in built-in ones")
+	}
+	if _, stderr, err := run(binPath, "sign", "--passphrase", passphrase, "--profile", "short", "--profile-file", profileFile, "host2"); stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	crt = readCertificate(t, depotDir+"/host2.host.crt")
+	if days := crt.NotAfter.Sub(time.Now()).Hours() / 24; days < 6 || days > 8 {
+		t.Fatalf("Received unexpected validity: %v days", days)
+	}
+}
+
+const clusterManifest = `
+ca:
+  key_type: ecdsa
+  organization: etcd
+renew_before: %s
+members:
+  - name: etcd1
+    ips: [%s]
+    domains: [etcd1.example.com]
+    profile: peer
+    key_type: ecdsa
+  - name: etcd2
+    profile: client
+    validity: 10d
+    key_type: ecdsa
+`
+
+// TestApply creates, renews and checks certificates of cluster described in manifest
+func TestSignCSRFile(t *testing.T) {
+	resetDepot(t)
+	runAll(t, initArgs())
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csrBytes, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{OrganizationalUnit: []string{"bob"}, CommonName: "bob.example.com"},
+		DNSNames:    []string{"bob.example.com", "evil.example.org"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("192.168.0.5")},
+	}, key)
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})
+	csrFile := depotDir + "/bob.pem"
+	ioutil.WriteFile(csrFile, csrPEM, 0644)
+
+	stdout, stderr, err := run(binPath, "sign", "--passphrase", passphrase, "--csr-file", csrFile, "--name", "bob", "--allow-domain", "example.com", "--allow-ip", "10.0.0.0/8")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if !strings.Contains(stdout, "Dropped SAN evil.example.org") || !strings.Contains(stdout, "Dropped SAN 192.168.0.5") {
+		t.Fatalf("Received unexpected stdout: %v", stdout)
+	}
+	crt := readCertificate(t, depotDir+"/bob.host.crt")
+	if len(crt.DNSNames) != 1 || crt.DNSNames[0] != "bob.example.com" || len(crt.IPAddresses) != 1 || !crt.IPAddresses[0].Equal(net.ParseIP("10.0.0.5")) {
+		t.Fatalf("Received unexpected SANs: %v, %v", crt.DNSNames, crt.IPAddresses)
+	}
+	if _, err = os.Stat(depotDir + "/bob.host.csr"); err != nil {
+		t.Fatal("Expect certificate request to be imported:", err)
+	}
+	if _, _, err = run(binPath, "sign", "--passphrase", passphrase, "--csr-file", csrFile, "--name", "bob"); err == nil {
+		t.Fatal("Expect error for existing host")
+	}
+
+	// All requested SANs are honored without restriction
+	if _, stderr, err = runWithStdin(bytes.NewReader(csrPEM), binPath, "sign", "--passphrase", passphrase, "--csr-file", "-", "--name", "alice"); stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if crt = readCertificate(t, depotDir+"/alice.host.crt"); len(crt.DNSNames) != 2 || len(crt.IPAddresses) != 2 {
+		t.Fatalf("Received unexpected SANs: %v, %v", crt.DNSNames, crt.IPAddresses)
+	}
+
+	// Tampered certificate request is rejected
+	csrBytes[len(csrBytes)-1] ^= 0xff
+	csrPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})
+	if _, _, err = runWithStdin(bytes.NewReader(csrPEM), binPath, "sign", "--passphrase", passphrase, "--csr-file", "-", "--name", "carol"); err == nil {
+		t.Fatal("Expect error for certificate request with invalid signature")
+	}
+}
+
+func TestSignWithPolicy(t *testing.T) {
+	resetDepot(t)
+	policyFile := depotDir + "/policy.yaml"
+
+	runAll(t,
+		initArgs(),
+		newCertArgs(hostname, "--domain", "host1.example.com"),
+		newCertArgs("host2", "--domain", "host2.example.org"),
+	)
+	ioutil.WriteFile(policyFile, []byte("policy:\n  dns_suffixes: [example.com]\n  ip_ranges: [127.0.0.0/8]\n  curves: [P-256]\n  max_days: 365\n"), 0644)
+
+	if _, stderr, err := run(binPath, "sign", "--passphrase", passphrase, "--policy-file", policyFile, hostname); err == nil || !strings.Contains(stderr, "max_days") {
+		t.Fatalf("Expect error for validity beyond policy: %v, %v", stderr, err)
+	}
+	ioutil.WriteFile(depotDir+"/profiles.yaml", []byte("profiles:\n  short:\n    ext_key_usage: [serverAuth]\n    days: 90\n"), 0644)
+	if _, stderr, err := run(binPath, "sign", "--passphrase", passphrase, "--policy-file", policyFile, "--profile", "short", "--profile-file", depotDir+"/profiles.yaml", hostname); stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	_, stderr, err := run(binPath, "sign", "--passphrase", passphrase, "--policy-file", policyFile, "--profile", "short", "--profile-file", depotDir+"/profiles.yaml", "host2")
+	if err == nil || !strings.Contains(stderr, "dns_suffixes does not permit host2.example.org") {
+		t.Fatalf("Expect error for domain out of policy: %v, %v", stderr, err)
+	}
+	if _, err = os.Stat(depotDir + "/host2.host.crt"); err == nil {
+		t.Fatal("Expect no certificate issued against policy")
+	}
+}
+
+func TestNameConstraints(t *testing.T) {
+	resetDepot(t)
+
+	runAll(t,
+		initArgs("--permitted-dns", "example.com", "--permitted-ip", "127.0.0.0/8"),
+		newCertArgs(hostname, "--domain", "host1.example.com"),
+		signArgs(hostname),
+		newCertArgs("host2", "--domain", "host2.example.org"),
+	)
+	caCrt := readCertificate(t, depotDir+"/ca.crt")
+	if !caCrt.PermittedDNSDomainsCritical || len(caCrt.PermittedDNSDomains) != 1 || caCrt.PermittedIPRanges[0].String() != "127.0.0.0/8" {
+		t.Fatalf("Received unexpected name constraints: %v, %v", caCrt.PermittedDNSDomains, caCrt.PermittedIPRanges)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCrt)
+	if _, err := readCertificate(t, depotDir+"/"+hostname+".host.crt").Verify(x509.VerifyOptions{Roots: roots, DNSName: "host1.example.com"}); err != nil {
+		t.Fatal("Failed verifying certificate under name constraints:", err)
+	}
+
+	_, stderr, err := run(binPath, "sign", "--passphrase", passphrase, "host2")
+	if err == nil || !strings.Contains(stderr, "permitted_dns_domains does not permit host2.example.org") {
+		t.Fatalf("Expect error for domain out of name constraints: %v, %v", stderr, err)
+	}
+}
+
+func TestExportPKCS12(t *testing.T) {
+	resetDepot(t)
+
+	runAll(t,
+		initArgs(),
+		[]string{"new-intermediate", "--passphrase", passphrase, "--ca-passphrase", passphrase, "--key-type", "ecdsa", "build"},
+		newCertArgs(hostname),
+		signArgs(hostname, "--ca", "build"),
+	)
+
+	for _, enc := range []string{"modern", "legacy-des", "legacy-rc2"} {
+		stdout, stderr, err := run(binPath, "export", "--format", "pkcs12", "--pkcs12-encryption", enc, "--pkcs12-password", "secret", "--passphrase", passphrase, hostname)
+		if stderr != "" || err != nil {
+			t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+		}
+		key, crt, chain, err := etcdpkix.ParsePKCS12([]byte(stdout), []byte("secret"))
+		if err != nil {
+			t.Fatalf("Failed parsing PKCS#12 with %s: %v", enc, err)
+		}
+		rawCrt, _ := crt.GetRawCertificate()
+		if !rawCrt.Equal(readCertificate(t, depotDir+"/"+hostname+".host.crt")) || len(chain) != 2 || key == nil {
+			t.Fatalf("Received unexpected PKCS#12 with %s: %v, %v", enc, rawCrt.Subject, chain)
+		}
+		if rawChain, _ := chain[1].GetRawCertificate(); !rawChain.Equal(readCertificate(t, depotDir+"/ca.crt")) {
+			t.Fatalf("Expect root CA at the end of chain with %s", enc)
+		}
+	}
+
+	stdout, stderr, err := run(binPath, "export", "--format", "pkcs12", "--pkcs12-password", "secret", "--passphrase", passphrase)
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if _, _, chain, err := etcdpkix.ParsePKCS12([]byte(stdout), []byte("secret")); err != nil || len(chain) != 0 {
+		t.Fatalf("Received unexpected PKCS#12 of CA: %v, %v", chain, err)
+	}
+	if _, _, err = run(binPath, "export", "--format", "zip", hostname); err == nil {
+		t.Fatal("Expect error for unsupported format")
+	}
+}
+
+func TestExportK8sSecret(t *testing.T) {
+	resetDepot(t)
+
+	runAll(t,
+		initArgs(),
+		[]string{"new-intermediate", "--passphrase", passphrase, "--ca-passphrase", passphrase, "--key-type", "ecdsa", "build"},
+		newCertArgs(hostname),
+		signArgs(hostname, "--ca", "build"),
+	)
+
+	stdout, stderr, err := run(binPath, "export", "--format", "k8s-secret", "--namespace", "etcd", "--configmap", "etcd-ca", "--passphrase", passphrase, hostname)
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	docs := strings.Split(stdout, "\n---\n")
+	if len(docs) != 2 {
+		t.Fatalf("Expect Secret and ConfigMap: %s", stdout)
+	}
+	var secret, configMap struct {
+		Kind     string
+		Type     string
+		Metadata struct{ Name, Namespace string }
+		Data     map[string]string
+	}
+	if err = yaml.Unmarshal([]byte(docs[0]), &secret); err != nil || secret.Kind != "Secret" || secret.Type != "kubernetes.io/tls" || secret.Metadata.Name != hostname || secret.Metadata.Namespace != "etcd" {
+		t.Fatalf("Received unexpected Secret: %v, %v", secret, err)
+	}
+	crtPEM, _ := base64.StdEncoding.DecodeString(secret.Data["tls.crt"])
+	keyPEM, _ := base64.StdEncoding.DecodeString(secret.Data["tls.key"])
+	if _, err = tls.X509KeyPair(crtPEM, keyPEM); err != nil {
+		t.Fatal("Failed loading key pair in Secret:", err)
+	}
+	caPEM, _ := base64.StdEncoding.DecodeString(secret.Data["ca.crt"])
+	if strings.Count(string(caPEM), "BEGIN CERTIFICATE") != 2 {
+		t.Fatalf("Expect CA chain in Secret: %s", caPEM)
+	}
+	if err = yaml.Unmarshal([]byte(docs[1]), &configMap); err != nil || configMap.Kind != "ConfigMap" || configMap.Metadata.Name != "etcd-ca" || configMap.Data["ca.crt"] != string(caPEM) {
+		t.Fatalf("Received unexpected ConfigMap: %v, %v", configMap, err)
+	}
+
+	if _, _, err = run(binPath, "export", "--format", "k8s-secret", "--secret-name", "Host_1", "--passphrase", passphrase, hostname); err == nil {
+		t.Fatal("Expect error for invalid Kubernetes name")
+	}
+}
+
+func TestApply(t *testing.T) {
+	resetDepot(t)
+	os.MkdirAll(depotDir, 0700)
+	manifest := depotDir + "/cluster.yaml"
+	apply := func(renewBefore, ip string) string {
+		ioutil.WriteFile(manifest, []byte(fmt.Sprintf(clusterManifest, renewBefore, ip)), 0644)
+		stdout, stderr, err := run(binPath, "apply", "-f", manifest, "--passphrase", passphrase, "--key-passphrase", passphrase)
+		if stderr != "" || err != nil {
+			t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+		}
+		return stdout
+	}
+
+	stdout := apply("5d", "10.0.0.1")
+	for _, created := range []string{"ca/crt", "etcd1/key", "etcd1/csr", "etcd1/crt", "etcd2/crt"} {
+		if !strings.Contains(stdout, "Created "+created) {
+			t.Fatalf("Expect %s to be created: %v", created, stdout)
+		}
+	}
+	crt := readCertificate(t, depotDir+"/etcd2.host.crt")
+	if len(crt.ExtKeyUsage) != 1 || crt.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Fatalf("Received unexpected extended key usages: %v", crt.ExtKeyUsage)
+	}
+	if days := crt.NotAfter.Sub(time.Now()).Hours() / 24; days < 9 || days > 11 {
+		t.Fatalf("Received unexpected validity: %v days", days)
+	}
+	crt = readCertificate(t, depotDir+"/etcd1.host.crt")
+	if len(crt.IPAddresses) != 1 || crt.IPAddresses[0].String() != "10.0.0.1" || len(crt.DNSNames) != 1 || crt.Subject.Organization[0] != "etcd" {
+		t.Fatalf("Received unexpected certificate: %v %v %v", crt.IPAddresses, crt.DNSNames, crt.Subject)
+	}
+
+	// Nothing changes when it is applied again
+	if stdout = apply("5d", "10.0.0.1"); stdout != "" {
+		t.Fatalf("Expect no change instead of: %v", stdout)
+	}
+
+	// etcd2 is renewed, while changed IP and unlisted host are reported
+	runAll(t,
+		newCertArgs("host3"),
+		signArgs("host3"),
+	)
+	stdout = apply("20d", "10.0.0.2")
+	if strings.Contains(stdout, "Created") || strings.Contains(stdout, "Renewed etcd1") || !strings.Contains(stdout, "Renewed etcd2/crt") {
+		t.Fatalf("Expect etcd2 to be renewed only: %v", stdout)
+	}
+	if !strings.Contains(stdout, "Drift: etcd1/csr has IPs [10.0.0.1], manifest has [10.0.0.2]") || !strings.Contains(stdout, "Drift: host3/crt is not in manifest") {
+		t.Fatalf("Expect drift to be reported: %v", stdout)
+	}
+	crt = readCertificate(t, depotDir+"/etcd2.host.crt")
+	if len(crt.ExtKeyUsage) != 1 || crt.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Fatalf("Received unexpected extended key usages after renewal: %v", crt.ExtKeyUsage)
+	}
+
+	// Revoked etcd2 is reported instead of re-issued with the same key
+	runAll(t, []string{"revoke", "--reason", "keyCompromise", "etcd2"})
+	stdout = apply("20d", "10.0.0.1")
+	if strings.Contains(stdout, "Renewed") || !strings.Contains(stdout, "Drift: etcd2/crt is revoked") {
+		t.Fatalf("Expect revoked etcd2 to be reported only: %v", stdout)
+	}
+	if !bytes.Equal(readCertificate(t, depotDir+"/etcd2.host.crt").Raw, crt.Raw) {
+		t.Fatal("Expect revoked certificate to be left alone")
+	}
+}
+
+// readTLSCertificate exports certificate and decrypted key of host for TLS clients
+func readTLSCertificate(t *testing.T, name string) tls.Certificate {
+	stdout, stderr, err := run(binPath, "export", "--insecure", "--passphrase", passphrase, name)
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	files := make(map[string][]byte)
+	r := tar.NewReader(strings.NewReader(stdout))
+	for {
+		header, err := r.Next()
+		if err != nil {
+			break
+		}
+		files[header.Name], _ = ioutil.ReadAll(r)
+	}
+	crt, err := tls.X509KeyPair(files[name+".crt"], files[name+".key.insecure"])
+	if err != nil {
+		t.Fatal("Failed loading exported key pair:", err)
+	}
+	return crt
+}
+
+// TestServe signs certificate requests and fetches certificates over signing API
+func TestServe(t *testing.T) {
+	resetDepot(t)
+
+	serverURL := "https://127.0.0.1:18443/v1"
+	runAll(t,
+		initArgs(),
+		newCertArgs("server"),
+		signArgs("server", "--profile", "server"),
+		newCertArgs("ci"),
+		signArgs("ci", "--profile", "client"),
+		newCertArgs("guest"),
+		signArgs("guest", "--profile", "client"),
+	)
+
+	server, err := start(binPath, "serve", "--listen", "127.0.0.1:18443", "--cert", "server", "--role", "ci=peer", "--passphrase", passphrase, "--cert-passphrase", passphrase)
+	if err != nil {
+		t.Fatal("Failed starting signing server:", err)
+	}
+	defer server.Process.Kill()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(readCertificate(t, depotDir+"/ca.crt"))
+	newClient := func(name string) *http.Client {
+		config := &tls.Config{RootCAs: roots}
+		if name != "" {
+			config.Certificates = []tls.Certificate{readTLSCertificate(t, name)}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+	client := newClient("ci")
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = client.Get(serverURL + "/ca")
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed fetching CA chain: %v, %v", resp, err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if caBytes, _ := ioutil.ReadFile(depotDir + "/ca.crt"); !bytes.Equal(body, caBytes) {
+		t.Fatalf("Received unexpected CA chain: %s", body)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csrBytes, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{OrganizationalUnit: []string{"worker"}, CommonName: "worker.example.com"},
+		DNSNames: []string{"worker.example.com"},
+	}, key)
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})
+
+	resp, err = client.Post(serverURL+"/csr/worker", "application/pkcs10", bytes.NewReader(csrPEM))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed signing certificate request: %v, %v", resp, err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	block, _ := pem.Decode(body)
+	if block == nil {
+		t.Fatalf("Received unexpected certificate: %s", body)
+	}
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || len(crt.ExtKeyUsage) != 2 || crt.DNSNames[0] != "worker.example.com" {
+		t.Fatalf("Received unexpected certificate: %v, %v", crt, err)
+	}
+	if crtBytes, _ := ioutil.ReadFile(depotDir + "/worker.host.crt"); !bytes.Equal(body, crtBytes) {
+		t.Fatal("Expect certificate to be saved in depot")
+	}
+
+	for _, c := range []struct {
+		client *http.Client
+		method string
+		path   string
+		status int
+	}{
+		{client, "POST", "/csr/worker", http.StatusConflict},
+		{client, "POST", "/csr/..", http.StatusBadRequest},
+		// Organizational unit of the request must name the host
+		{client, "POST", "/csr/worker3", http.StatusBadRequest},
+		{newClient("guest"), "POST", "/csr/worker2", http.StatusForbidden},
+		{newClient("guest"), "GET", "/certs/worker", http.StatusOK},
+		{client, "GET", "/certs/nobody", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest(c.method, serverURL+c.path, bytes.NewReader(csrPEM))
+		resp, err = c.client.Do(req)
+		if err != nil || resp.StatusCode != c.status {
+			t.Fatalf("Expect status %d for %s %s: %v, %v", c.status, c.method, c.path, resp, err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err = client.Get(serverURL + "/status?name=worker")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed fetching status: %v, %v", resp, err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Count(string(body), "\n") != 1 || !strings.Contains(string(body), `"Profile":"peer"`) || !strings.Contains(string(body), `"Status":"valid"`) {
+		t.Fatalf("Received unexpected status: %s", body)
+	}
+
+	// Client is named by index instead of the organizational unit it requested
+	fakeKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	fakeCsrBytes, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{OrganizationalUnit: []string{"ci"}},
+	}, fakeKey)
+	csrPath := depotDir + "-fake.csr"
+	ioutil.WriteFile(csrPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: fakeCsrBytes}), 0644)
+	defer os.Remove(csrPath)
+	if _, stderr, err := run(binPath, "sign", "--passphrase", passphrase, "--profile", "client", "--csr-file", csrPath, "--name", "fake"); stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	fakeCrt := tls.Certificate{Certificate: [][]byte{readCertificate(t, depotDir+"/fake.host.crt").Raw}, PrivateKey: fakeKey}
+	fakeClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{fakeCrt}}}}
+	if resp, err = fakeClient.Post(serverURL+"/csr/worker", "application/pkcs10", bytes.NewReader(csrPEM)); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expect client claiming another name to be rejected: %v, %v", resp, err)
+	}
+
+	// Clients without certificate or with revoked certificate are rejected
+	if _, err = newClient("").Get(serverURL + "/ca"); err == nil {
+		t.Fatal("Expect error for client without certificate")
+	}
+	if _, stderr, err := run(binPath, "revoke", "ci"); stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if resp, err = newClient("ci").Get(serverURL + "/ca"); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expect revoked client to be rejected: %v, %v", resp, err)
+	}
+}
+
+// obtainACMECertificate orders certificate of identifiers from ACME server by standard client,
+// and responds to challenges of type chalType by respond
+func obtainACMECertificate(t *testing.T, directoryURL string, ids []acme.AuthzID, chalType string, respond func(*acme.Client, *acme.Challenge)) (*acme.Client, [][]byte) {
+	client, der, err := orderACMECertificate(t, directoryURL, ids, chalType, respond)
+	if err != nil {
+		t.Fatal("Failed finalizing ACME order:", err)
+	}
+	return client, der
+}
+
+// orderACMECertificate is obtainACMECertificate that returns the error of finalizing the order
+func orderACMECertificate(t *testing.T, directoryURL string, ids []acme.AuthzID, chalType string, respond func(*acme.Client, *acme.Challenge)) (*acme.Client, [][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	accountKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	client := &acme.Client{Key: accountKey, DirectoryURL: directoryURL}
+	var err error
+	for i := 0; i < 50; i++ {
+		if _, err = client.Discover(ctx); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal("Failed discovering ACME directory:", err)
+	}
+	if _, err = client.Register(ctx, &acme.Account{}, acme.AcceptTOS); err != nil {
+		t.Fatal("Failed registering ACME account:", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, ids)
+	if err != nil {
+		t.Fatal("Failed creating ACME order:", err)
+	}
+	for _, url := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, url)
+		if err != nil {
+			t.Fatal("Failed getting ACME authorization:", err)
+		}
+		var chal *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == chalType {
+				chal = c
+			}
+		}
+		if chal == nil {
+			t.Fatalf("No %s challenge for %v", chalType, authz.Identifier)
+		}
+		respond(client, chal)
+		if _, err = client.Accept(ctx, chal); err != nil {
+			t.Fatal("Failed accepting ACME challenge:", err)
+		}
+		if _, err = client.WaitAuthorization(ctx, url); err != nil {
+			t.Fatal("Failed validating ACME challenge:", err)
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		t.Fatal("Failed waiting ACME order:", err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.CertificateRequest{}
+	for _, id := range ids {
+		if id.Type == "ip" {
+			template.IPAddresses = append(template.IPAddresses, net.ParseIP(id.Value))
+		} else {
+			template.DNSNames = append(template.DNSNames, id.Value)
+		}
+	}
+	csr, _ := x509.CreateCertificateRequest(rand.Reader, template, key)
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	return client, der, err
+}
+
+// TestServeACME obtains certificates from ACME server by standard client
+func TestServeACME(t *testing.T) {
+	resetDepot(t)
+
+	runAll(t, initArgs())
+	server, err := start(binPath, "serve-acme", "--listen", "127.0.0.1:14000", "--http-port", "18080", "--passphrase", passphrase)
+	if err != nil {
+		t.Fatal("Failed starting ACME server:", err)
+	}
+	defer server.Process.Kill()
+
+	// Serve http-01 challenge responses
+	responses := make(map[string]string)
+	var mu sync.Mutex
+	listener, err := net.Listen("tcp", "127.0.0.1:18080")
+	if err != nil {
+		t.Fatal("Failed listening for http-01 challenges:", err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write([]byte(responses[r.URL.Path]))
+	}))
+
+	ids := []acme.AuthzID{{Type: "dns", Value: "localhost"}, {Type: "ip", Value: "127.0.0.1"}}
+	client, der := obtainACMECertificate(t, "http://127.0.0.1:14000/directory", ids, "http-01", func(client *acme.Client, chal *acme.Challenge) {
+		resp, _ := client.HTTP01ChallengeResponse(chal.Token)
+		mu.Lock()
+		defer mu.Unlock()
+		responses[client.HTTP01ChallengePath(chal.Token)] = resp
+	})
+	crt, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		t.Fatal("Failed parsing ACME certificate:", err)
+	}
+	if crt.DNSNames[0] != "localhost" || !crt.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) || len(crt.ExtKeyUsage) != 1 || crt.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Fatalf("Received unexpected certificate: %v %v %v", crt.DNSNames, crt.IPAddresses, crt.ExtKeyUsage)
+	}
+	if days := crt.NotAfter.Sub(time.Now()).Hours() / 24; days < 89 || days > 91 {
+		t.Fatalf("Received unexpected validity: %v days", days)
+	}
+	if crtDepot := readCertificate(t, depotDir+"/localhost.host.crt"); !bytes.Equal(crtDepot.Raw, der[0]) {
+		t.Fatal("Expect certificate to be saved in depot")
+	}
+
+	if err = client.RevokeCert(context.Background(), nil, der[0], acme.CRLReasonSuperseded); err != nil {
+		t.Fatal("Failed revoking ACME certificate:", err)
+	}
+	if stdout, _, err := run(binPath, "list", "--all"); err != nil || !strings.Contains(stdout, "revoked (superseded)") {
+		t.Fatalf("Expect certificate to be revoked: %v, %v", stdout, err)
+	}
+
+	// Challenges are accepted as they are in trust-all mode
+	server, err = start(binPath, "serve-acme", "--listen", "127.0.0.1:14001", "--passphrase", passphrase, "--trust-all", "--profile", "peer")
+	if err != nil {
+		t.Fatal("Failed starting ACME server:", err)
+	}
+	defer server.Process.Kill()
+	_, der = obtainACMECertificate(t, "http://127.0.0.1:14001/directory", []acme.AuthzID{{Type: "dns", Value: "*.example.com"}}, "dns-01", func(*acme.Client, *acme.Challenge) {})
+	if crt, err = x509.ParseCertificate(der[0]); err != nil || crt.DNSNames[0] != "*.example.com" || len(crt.ExtKeyUsage) != 2 {
+		t.Fatalf("Received unexpected certificate: %v, %v", crt, err)
+	}
+
+	// Hosts issued by ACME before are renewed, but others are not replaced
+	_, der = obtainACMECertificate(t, "http://127.0.0.1:14001/directory", ids[:1], "dns-01", func(*acme.Client, *acme.Challenge) {})
+	if crtDepot := readCertificate(t, depotDir+"/localhost.host.crt"); !bytes.Equal(crtDepot.Raw, der[0]) {
+		t.Fatal("Expect certificate issued by ACME to be replaced")
+	}
+	signedKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signedCsrBytes, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"signed.example.com"}}, signedKey)
+	csrPath := depotDir + "-signed.csr"
+	ioutil.WriteFile(csrPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: signedCsrBytes}), 0644)
+	defer os.Remove(csrPath)
+	if _, stderr, err := run(binPath, "sign", "--passphrase", passphrase, "--csr-file", csrPath, "--name", "signed.example.com"); stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	signedCrt := readCertificate(t, depotDir+"/signed.example.com.host.crt")
+	if _, _, err = orderACMECertificate(t, "http://127.0.0.1:14001/directory", []acme.AuthzID{{Type: "dns", Value: "signed.example.com"}}, "dns-01", func(*acme.Client, *acme.Challenge) {}); err == nil || !strings.Contains(err.Error(), "managed in depot") {
+		t.Fatal("Expect host signed outside ACME to be refused:", err)
+	}
+	if crtDepot := readCertificate(t, depotDir+"/signed.example.com.host.crt"); !bytes.Equal(crtDepot.Raw, signedCrt.Raw) {
+		t.Fatal("Expect certificate signed outside ACME to be kept")
+	}
+}
+
+func TestServeEST(t *testing.T) {
+	resetDepot(t)
+
+	serverURL := "https://127.0.0.1:18444/.well-known/est"
+	runAll(t,
+		initArgs(),
+		newCertArgs("server"),
+		signArgs("server", "--profile", "server"),
+		newCertArgs("managed"),
+		signArgs("managed", "--profile", "client"),
+	)
+
+	server, err := start(binPath, "serve-est", "--listen", "127.0.0.1:18444", "--cert", "server", "--user", "dev:secret", "--profile", "client", "--passphrase", passphrase, "--cert-passphrase", passphrase)
+	if err != nil {
+		t.Fatal("Failed starting EST server:", err)
+	}
+	defer server.Process.Kill()
+
+	roots := x509.NewCertPool()
+	caCrt := readCertificate(t, depotDir+"/ca.crt")
+	roots.AddCert(caCrt)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	readCertificates := func(resp *http.Response) []*x509.Certificate {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		der, err := base64.StdEncoding.DecodeString(string(body))
+		if err != nil {
+			t.Fatalf("Received unexpected body: %s", body)
+		}
+		crts, err := etcdpkix.ParsePKCS7Certificates(der)
+		if err != nil {
+			t.Fatal("Failed parsing PKCS#7:", err)
+		}
+		rawCrts := make([]*x509.Certificate, 0, len(crts))
+		for _, crt := range crts {
+			rawCrt, _ := crt.GetRawCertificate()
+			rawCrts = append(rawCrts, rawCrt)
+		}
+		return rawCrts
+	}
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = client.Get(serverURL + "/cacerts")
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed fetching CA certificates: %v, %v", resp, err)
+	}
+	if crts := readCertificates(resp); len(crts) != 1 || !crts[0].Equal(caCrt) {
+		t.Fatalf("Received unexpected CA certificates: %v", crts)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csrBytes, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{OrganizationalUnit: []string{"device"}, CommonName: "device.example.com"},
+		DNSNames: []string{"device.example.com"},
+	}, key)
+	enroll := func(client *http.Client, path string, user string) *http.Response {
+		req, _ := http.NewRequest("POST", serverURL+path, strings.NewReader(base64.StdEncoding.EncodeToString(csrBytes)))
+		req.Header.Set("Content-Type", "application/pkcs10")
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed requesting %s: %v", path, err)
+		}
+		return resp
+	}
+
+	if resp = enroll(client, "/simpleenroll", "nobody"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expect unknown user to be rejected: %v", resp)
+	}
+	// Request could not claim other names in organizational units
+	unitsCsrBytes, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{OrganizationalUnit: []string{"device2", "admin"}},
+	}, key)
+	req, _ := http.NewRequest("POST", serverURL+"/simpleenroll", strings.NewReader(base64.StdEncoding.EncodeToString(unitsCsrBytes)))
+	req.Header.Set("Content-Type", "application/pkcs10")
+	req.SetBasicAuth("dev", "secret")
+	if resp, err = client.Do(req); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expect request with several organizational units to be rejected: %v, %v", resp, err)
+	}
+	resp = enroll(client, "/simpleenroll", "dev")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed enrolling: %v", resp)
+	}
+	crts := readCertificates(resp)
+	if len(crts) != 1 || crts[0].DNSNames[0] != "device.example.com" || crts[0].ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Fatalf("Received unexpected certificate: %v", crts)
+	}
+	if _, err = os.Stat(depotDir + "/device.host.csr"); err != nil {
+		t.Fatal("Expect certificate request to be saved in depot:", err)
+	}
+	if saved := readCertificate(t, depotDir+"/device.host.crt"); !saved.Equal(crts[0]) {
+		t.Fatal("Expect certificate to be saved in depot")
+	}
+	if resp = enroll(client, "/simpleenroll", "dev"); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expect enrolled host to be rejected: %v", resp)
+	}
+	if resp = enroll(client, "/simplereenroll", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expect re-enrollment without certificate to be rejected: %v", resp)
+	}
+
+	tlsCrt := tls.Certificate{Certificate: [][]byte{crts[0].Raw}, PrivateKey: key}
+	deviceClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{tlsCrt}}}}
+	resp = enroll(deviceClient, "/simplereenroll", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed re-enrolling: %v", resp)
+	}
+	renewed := readCertificates(resp)
+	if len(renewed) != 1 || renewed[0].SerialNumber.Cmp(crts[0].SerialNumber) == 0 || renewed[0].DNSNames[0] != "device.example.com" {
+		t.Fatalf("Received unexpected certificate: %v", renewed)
+	}
+	if archived := readCertificate(t, depotDir+"/device.host."+crts[0].SerialNumber.Text(16)+".crt.archived"); !archived.Equal(crts[0]) {
+		t.Fatal("Expect old certificate to be archived")
+	}
+	// Archived certificate cannot re-enroll again
+	if resp = enroll(deviceClient, "/simplereenroll", ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expect archived certificate to be rejected: %v", resp)
+	}
+
+	// Host whose key is kept in depot cannot re-enroll with a new key
+	managedCrt := readCertificate(t, depotDir+"/managed.host.crt")
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csrBytes, _ = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		RawSubject:  managedCrt.RawSubject,
+		DNSNames:    managedCrt.DNSNames,
+		IPAddresses: managedCrt.IPAddresses,
+	}, newKey)
+	managedClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{readTLSCertificate(t, "managed")}}}}
+	if resp = enroll(managedClient, "/simplereenroll", ""); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expect new key of host managed in depot to be rejected: %v", resp)
+	}
+}
+
+// TestDepotURL runs etcd-ca with depot opened by url instead of depot-path
+func TestDepotURL(t *testing.T) {
+	urlDir := depotDir + "-url"
+	os.RemoveAll(depotDir)
+	os.RemoveAll(urlDir)
+	defer os.RemoveAll(urlDir)
+
+	runAll(t,
+		[]string{"--depot-url", "file:" + urlDir, "init", "--passphrase", passphrase, "--key-type", "ecdsa"},
+		[]string{"--depot-url", "file:" + urlDir, "new-cert", "--passphrase", passphrase, "--key-type", "ecdsa", hostname},
+		[]string{"--depot-url", "file:" + urlDir, "sign", "--passphrase", passphrase, hostname},
+	)
+	if _, err := os.Stat(depotDir); !os.IsNotExist(err) {
+		t.Fatal("Expect depot-path not to be used:", err)
+	}
+
+	stdout, stderr, err := run(binPath, "--depot-url", "file:"+urlDir, "status")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if strings.Count(stdout, "expiration") != 2 {
+		t.Fatalf("Received insufficient expiration: %v", stdout)
+	}
+
+	if _, stderr, err = run(binPath, "--depot-url", "unknown://x", "status"); err == nil || !strings.Contains(stderr, "unsupported depot url scheme") {
+		t.Fatalf("Expect error for unknown depot url: %v, %v", stderr, err)
+	}
+}
+
+// startEtcd starts etcd given in ETCD_CA_TEST_ETCD_BIN or found in PATH,
+// which serves clients at https://127.0.0.1:12379 with certificate crtFile
+// and requires client certificates signed by caFile. The test is skipped
+// if no etcd is found.
+func startEtcd(t *testing.T, caFile, crtFile, keyFile string) {
+	bin := os.Getenv("ETCD_CA_TEST_ETCD_BIN")
+	if bin == "" {
+		if bin, _ = exec.LookPath("etcd"); bin == "" {
+			t.Skip("etcd is not found in ETCD_CA_TEST_ETCD_BIN or PATH")
+		}
+	}
+	etcd := exec.Command(bin,
+		"--name", "test",
+		"--data-dir", t.TempDir(),
+		"--listen-client-urls", "https://127.0.0.1:12379",
+		"--advertise-client-urls", "https://127.0.0.1:12379",
+		"--listen-peer-urls", "http://127.0.0.1:12380",
+		"--initial-advertise-peer-urls", "http://127.0.0.1:12380",
+		"--initial-cluster", "test=http://127.0.0.1:12380",
+		"--cert-file", crtFile,
+		"--key-file", keyFile,
+		"--client-cert-auth",
+		"--trusted-ca-file", caFile,
+	)
+	if err := etcd.Start(); err != nil {
+		t.Fatal("Failed starting etcd:", err)
+	}
+	t.Cleanup(func() {
+		etcd.Process.Kill()
+		etcd.Wait()
+	})
+}
+
+// TestEtcdDepot keeps depot in etcd requiring client certificates, and
+// grants etcd roles that read the depot to a user
+func TestEtcdDepot(t *testing.T) {
+	resetDepot(t)
+
+	// CA and certificate of etcd, which also serves as its client
+	runAll(t,
+		initArgs(),
+		newCertArgs("etcd"),
+		signArgs("etcd"),
+	)
+	stdout, stderr, err := run(binPath, "export", "--insecure", "--passphrase", passphrase, "etcd")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	tlsDir := t.TempDir()
+	r := tar.NewReader(strings.NewReader(stdout))
+	for {
+		header, err := r.Next()
+		if err != nil {
+			break
+		}
+		data, _ := ioutil.ReadAll(r)
+		ioutil.WriteFile(tlsDir+"/"+header.Name, data, 0600)
+	}
+	caFile, crtFile, keyFile := depotDir+"/ca.crt", tlsDir+"/etcd.crt", tlsDir+"/etcd.key.insecure"
+	startEtcd(t, caFile, crtFile, keyFile)
+
+	crt := readTLSCertificate(t, "etcd")
+	roots := x509.NewCertPool()
+	roots.AddCert(readCertificate(t, caFile))
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{crt}}}}
+	post := func(method, body string) (string, error) {
+		resp, err := client.Post("https://127.0.0.1:12379/v3/"+method, "application/json", strings.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("%s: %s %s", method, resp.Status, b)
+		}
+		return string(b), nil
+	}
+	for i := 0; i < 100; i++ {
+		if _, err = post("maintenance/status", "{}"); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal("Failed connecting to etcd:", err)
+	}
+
+	depotURL := "etcds://127.0.0.1:12379/etcd-ca"
+	tlsFlags := []string{"--depot-url", depotURL, "--etcd-cacert", caFile, "--etcd-cert", crtFile, "--etcd-key", keyFile}
+	if _, stderr, err = run(binPath, "--depot-url", depotURL, "status"); err == nil {
+		t.Fatalf("Expect etcd not to be trusted without --etcd-cacert: %v", stderr)
+	}
+	runAll(t,
+		append(tlsFlags, initArgs()...),
+		append(tlsFlags, newCertArgs(hostname)...),
+		append(tlsFlags, signArgs(hostname)...),
+	)
+	stdout, stderr, err = run(binPath, append(tlsFlags, "status")...)
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if strings.Count(stdout, "expiration") != 2 {
+		t.Fatalf("Received insufficient expiration: %v", stdout)
+	}
+
+	if _, err = post("auth/user/add", `{"name":"reader","password":"secret"}`); err != nil {
+		t.Fatal("Failed adding etcd user:", err)
+	}
+	stdout, stderr, err = run(binPath, append(tlsFlags, "depot", "grant-roles", "--other", "reader", "ca")...)
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if !strings.Contains(stdout, "Granted ca-other to user reader") {
+		t.Fatalf("Received unexpected grant: %v", stdout)
+	}
+	user, err := post("auth/user/get", `{"name":"reader"}`)
+	if err != nil || !strings.Contains(user, `"ca-other"`) {
+		t.Fatalf("Expect reader to be granted ca-other: %v, %v", user, err)
+	}
+	role, err := post("auth/role/get", `{"role":"ca-other"}`)
+	if err != nil || !strings.Contains(role, base64.StdEncoding.EncodeToString([]byte("/etcd-ca/0444/"))) {
+		t.Fatalf("Expect ca-other to read files readable by everyone: %v, %v", role, err)
+	}
+
+	if _, stderr, err = run(binPath, "--etcd-cacert", caFile, "status"); err == nil || !strings.Contains(stderr, "only apply to depot in etcd") {
+		t.Fatalf("Expect error for TLS files of file depot: %v, %v", stderr, err)
+	}
+	if _, stderr, err = run(binPath, "depot", "grant-roles", "ca"); err == nil || !strings.Contains(stderr, "Depot is not in etcd") {
+		t.Fatalf("Expect error granting roles of file depot: %v, %v", stderr, err)
+	}
+}
+
+// TestRecover checks that commands refuse to run on depot with interrupted
+// operation until it is recovered
+func TestRecover(t *testing.T) {
+	resetDepot(t)
+
+	runAll(t,
+		initArgs(),
+		newCertArgs(hostname),
+	)
+
+	stdout, _, err := run(binPath, "recover")
+	if err != nil || !strings.Contains(stdout, "No interrupted operation") {
+		t.Fatalf("Received unexpected recover: %v, %v", stdout, err)
+	}
+
+	// Journal of sign interrupted before the certificate is saved
+	journal := fmt.Sprintf(`[{"name":"%s.host.crt","perm":292,"data":"Y3J0","existed":false}]`, hostname)
+	if err = ioutil.WriteFile(depotDir+"/.journal", []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, err := run(binPath, "sign", "--passphrase", passphrase, hostname)
+	if err == nil || !strings.Contains(stderr, "etcd-ca recover") {
+		t.Fatalf("Expect sign to fail with interrupted operation: %v, %v", stderr, err)
+	}
+
+	stdout, stderr, err = run(binPath, "recover", "--rollback")
+	if stderr != "" || err != nil || !strings.Contains(stdout, "Rolled back") {
+		t.Fatalf("Received unexpected error: %v, %v, %v", stdout, stderr, err)
+	}
+	if _, err = os.Stat(depotDir + "/" + hostname + ".host.crt"); !os.IsNotExist(err) {
+		t.Fatal("Expect certificate not to be saved:", err)
+	}
+
+	stdout, stderr, err = run(binPath, "sign", "--passphrase", passphrase, hostname)
+	if stderr != "" || err != nil || !strings.Contains(stdout, "Created") {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+}
+
+func TestEncryptedDepot(t *testing.T) {
+	resetDepot(t)
+	defer os.Unsetenv("ETCD_CA_DEPOT_SESSION")
+	depotPassphrase := "depot-secret"
+
+	runAll(t,
+		initArgs(),
+		newCertArgs(hostname),
+		[]string{"--depot-passphrase", depotPassphrase, "depot", "encrypt"},
+		[]string{"--depot-passphrase", depotPassphrase, "sign", "--passphrase", passphrase, hostname},
+	)
+	for _, name := range []string{"ca.crt", hostname + ".host.csr", hostname + ".host.crt"} {
+		data, err := ioutil.ReadFile(depotDir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "-----BEGIN") {
+			t.Fatalf("Expect %s to be encrypted", name)
+		}
+	}
+
+	if _, stderr, err := run(binPath, "--depot-passphrase", "wrong", "status"); err == nil || !strings.Contains(stderr, "Unlock depot error") {
+		t.Fatalf("Expect error for wrong depot passphrase: %v, %v", stderr, err)
+	}
+
+	stdout, stderr, err := run(binPath, "--depot-passphrase", depotPassphrase, "depot", "unlock", "--ttl", "1h")
+	if stderr != "" || err != nil || !strings.HasPrefix(stdout, "export ETCD_CA_DEPOT_SESSION=") {
+		t.Fatalf("Received unexpected unlock: %v, %v, %v", stdout, stderr, err)
+	}
+	session := strings.TrimSpace(strings.TrimPrefix(stdout, "export ETCD_CA_DEPOT_SESSION="))
+	os.Setenv("ETCD_CA_DEPOT_SESSION", session)
+	stdout, stderr, err = run(binPath, "status")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	if strings.Count(stdout, "expiration") != 2 {
+		t.Fatalf("Received insufficient expiration: %v", stdout)
+	}
+
+	// Hooks cannot read the depot with the session
+	stdout, stderr, err = run(binPath, "watch", "--passphrase", passphrase, "--once", "--renew-before", "10000d",
+		"--hook", hostname+"=echo session=$ETCD_CA_DEPOT_SESSION")
+	if stderr != "" || err != nil || !strings.Contains(stdout, "session=\n") {
+		t.Fatalf("Expect hook not to see depot session: %v, %v, %v", stdout, stderr, err)
+	}
+
+	// The session is useless once locked, even if the token is kept
+	stdout, stderr, err = run(binPath, "depot", "lock")
+	if stderr != "" || err != nil || stdout != "unset ETCD_CA_DEPOT_SESSION\n" {
+		t.Fatalf("Received unexpected lock: %v, %v, %v", stdout, stderr, err)
+	}
+	if _, stderr, err = run(binPath, "status"); err == nil || !strings.Contains(stderr, "expired or been locked") {
+		t.Fatalf("Expect locked session to fail: %v, %v", stderr, err)
+	}
+	os.Unsetenv("ETCD_CA_DEPOT_SESSION")
+
+	stdout, stderr, err = run(binPath, "--depot-passphrase", depotPassphrase, "depot", "unlock")
+	if stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+	os.Setenv("ETCD_CA_DEPOT_SESSION", strings.TrimSpace(strings.TrimPrefix(stdout, "export ETCD_CA_DEPOT_SESSION=")))
+	if _, stderr, err = run(binPath, "depot", "change-passphrase", "--new-depot-passphrase", "changed"); err == nil {
+		t.Fatalf("Expect changing passphrase to ask the current one instead of session: %v", stderr)
+	}
+	stdout, stderr, err = run(binPath, "--depot-passphrase", depotPassphrase, "depot", "change-passphrase", "--new-depot-passphrase", "changed")
+	if stderr != "" || err != nil || !strings.Contains(stdout, "Changed depot passphrase") {
+		t.Fatalf("Received unexpected error: %v, %v, %v", stdout, stderr, err)
+	}
+	if _, stderr, err = run(binPath, "status"); err == nil {
+		t.Fatalf("Expect sessions to end with the old passphrase: %v", stderr)
+	}
+	os.Unsetenv("ETCD_CA_DEPOT_SESSION")
+	if _, stderr, err = run(binPath, "--depot-passphrase", depotPassphrase, "status"); err == nil {
+		t.Fatalf("Expect old passphrase to fail: %v", stderr)
+	}
+	if _, stderr, err = run(binPath, "--depot-passphrase", "changed", "status"); stderr != "" || err != nil {
+		t.Fatalf("Received unexpected error: %v, %v", stderr, err)
+	}
+}